@@ -0,0 +1,84 @@
+package perforator
+
+import (
+	"runtime"
+	"testing"
+
+	"acln.ro/perf"
+)
+
+// The events counted by BenchmarkRegion if none are given.
+var benchmarkEvents = []perf.Configurator{
+	perf.Instructions,
+	perf.CPUCycles,
+	perf.CacheMisses,
+	perf.BranchMisses,
+}
+
+// BenchmarkRegion runs f b.N times with counters for the given events (or
+// instructions, cpu-cycles, cache-misses, and branch-misses if there are
+// none) enabled around the loop, and reports the count of each event per
+// operation with b.ReportMetric, such as instructions/op, so that they are
+// shown by go test -bench along with the time per operation.
+//
+// Only user code of the calling thread is counted: the benchmark is locked to
+// its thread while it runs, and work that f hands to other goroutines is not
+// included. The counters are enabled once for all b.N calls rather than
+// around each one, so that the cost of enabling them is not counted in every
+// operation. Events that the CPU does not support are left out, and if no
+// counters can be opened (without permission to use perf, for example) the
+// error is logged and only the time is reported.
+func BenchmarkRegion(b *testing.B, f func(), events ...perf.Configurator) {
+	if len(events) == 0 {
+		events = benchmarkEvents
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	attrs := make([]*perf.Attr, len(events))
+	for i, c := range events {
+		attr := &perf.Attr{
+			CountFormat: perf.CountFormat{
+				Enabled: true,
+				Running: true,
+			},
+			Options: perf.Options{
+				Disabled:          true,
+				ExcludeKernel:     true,
+				ExcludeHypervisor: true,
+			},
+		}
+		c.Configure(attr)
+		attrs[i] = attr
+	}
+	prof, err := NewMultiProfiler(attrs, perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		b.Logf("perforator: %v (reporting time only)", err)
+		if prof != nil {
+			prof.Close()
+		}
+		prof = nil
+	} else {
+		defer prof.Close()
+		prof.Reset()
+	}
+
+	b.ResetTimer()
+	if prof != nil {
+		prof.Enable()
+	}
+	for i := 0; i < b.N; i++ {
+		f()
+	}
+	if prof != nil {
+		prof.Disable()
+	}
+	b.StopTimer()
+
+	if prof == nil {
+		return
+	}
+	for _, r := range prof.Metrics().Results {
+		b.ReportMetric(float64(r.ScaledValue())/float64(b.N), r.Label+"/op")
+	}
+}
@@ -12,12 +12,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/ianlancetaylor/demangle"
 )
 
 var (
 	ErrInvalidElfType = errors.New("invalid elf type")
+	ErrNoLineInfo     = errors.New("no DWARF line information (was the binary stripped or built without debug info?)")
+	ErrNoSymbols      = errors.New("no elf symbol table (the binary may be stripped and have no debug file)")
+
+	errNoPC = errors.New("no associated PC")
 )
 
 // ErrMultipleMatches is an error that describes a filename or function name
@@ -50,12 +57,40 @@ type address struct {
 // executable is position-independent and if so provides a function to compute
 // the PIE offset for a running instance.
 type BinFile struct {
-	pie     bool
-	funcs   map[string]uint64
-	inlined map[string][]InlinedFunc
+	pie   bool
+	funcs map[string]uint64
+	// demangled forms of mangled C++/Rust function names (with and without
+	// parameters)
+	demangled map[string][]string
+	// function symbols sorted by address, for symbolizing PCs
+	syms []symbol
+	// true if the function symbols came from .symtab rather than only the
+	// dynamic symbols exported by a shared library
+	symtab bool
+	// resolvers of indirect functions, by name
+	ifuncs map[string]uint64
+	// GOT entries set to the result of each resolver, by resolver address
+	irelative map[uint64][]uint64
+	inlined   map[string][]InlinedFunc
 	// we use this map structure so that we can fuzzy match on the filename
 	lines map[int][]address
 	name  string
+	// addresses that begin a row of the line table (and therefore begin an
+	// instruction)
+	rows map[uint64]bool
+	// vaddr of the first loadable segment, subtracted from all addresses
+	vaddr uint64
+	// identification of the separate debug file
+	buildID   string
+	debuglink string
+	debugcrc  uint32
+	// address ranges of the executable sections (such as .text and .plt)
+	sections map[string][2]uint64
+	// executable segments, if loaded with LoadCode
+	machine elf.Machine
+	code    []segment
+	// true if the executable was built by the Go toolchain
+	golang bool
 }
 
 // FromPid creates a new BinFile from a running process.
@@ -106,6 +141,19 @@ func Read(r io.ReaderAt, name string) (*BinFile, error) {
 		}
 	}
 
+	b.vaddr = vaddr
+	b.buildID = readBuildID(f)
+	b.debuglink, b.debugcrc, _ = readDebugLink(f)
+
+	b.irelative = readIrelative(f, vaddr)
+	b.golang = f.Section(".gopclntab") != nil || f.Section(".go.buildinfo") != nil
+	b.sections = make(map[string][2]uint64)
+	for _, sec := range f.Sections {
+		if sec.Flags&elf.SHF_EXECINSTR != 0 && sec.Flags&elf.SHF_ALLOC != 0 {
+			b.sections[sec.Name] = [2]uint64{sec.Addr - vaddr, sec.Addr + sec.Size - vaddr}
+		}
+	}
+
 	b.buildFuncCache(f, vaddr)
 	b.buildInlinedFuncCache(f, vaddr)
 	b.buildLineCache(f, vaddr)
@@ -115,21 +163,70 @@ func Read(r io.ReaderAt, name string) (*BinFile, error) {
 
 func (b *BinFile) buildFuncCache(f *elf.File, offset uint64) error {
 	symbols, err := f.Symbols()
+	symtab := err == nil
+	if err == elf.ErrNoSymbols {
+		// stripped shared libraries still export their dynamic symbols
+		symbols, err = f.DynamicSymbols()
+	}
 	if err != nil {
 		return err
 	}
 
 	b.funcs = make(map[string]uint64)
+	b.demangled = make(map[string][]string)
+	b.ifuncs = make(map[string]uint64)
+	b.syms = nil
+	b.symtab = symtab
 
 	for _, s := range symbols {
-		if elf.ST_TYPE(s.Info) == elf.STT_FUNC {
+		// undefined symbols are functions imported from shared libraries
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Section != elf.SHN_UNDEF {
 			b.funcs[s.Name] = s.Value - offset
+			if full := Demangle(s.Name); full != s.Name {
+				b.demangled[s.Name] = []string{full, demangle.Filter(s.Name, demangle.NoParams)}
+			}
+			b.syms = append(b.syms, symbol{
+				name: s.Name,
+				addr: s.Value - offset,
+				size: s.Size,
+			})
+		} else if elf.ST_TYPE(s.Info) == elf.STT_GNU_IFUNC && s.Section != elf.SHN_UNDEF {
+			b.ifuncs[s.Name] = s.Value - offset
 		}
 	}
+	sort.Slice(b.syms, func(i, j int) bool {
+		return b.syms[i].addr < b.syms[j].addr
+	})
 
 	return nil
 }
 
+// Demangle returns the demangled form of a C++ (Itanium ABI) or Rust symbol
+// name, or the name unchanged if it is not mangled.
+func Demangle(name string) string {
+	return demangle.Filter(name)
+}
+
+// matches returns true if match accepts the function's name or one of its
+// demangled forms.
+func (b *BinFile) matches(fn string, match func(string) bool) bool {
+	if match(fn) {
+		return true
+	}
+	for _, d := range b.demangled[fn] {
+		if match(d) {
+			return true
+		}
+	}
+	return false
+}
+
+type symbol struct {
+	name string
+	addr uint64
+	size uint64
+}
+
 // An InlinedFunc is a range of addresses representing the beginning and end of
 // the inlined function.
 type InlinedFunc struct {
@@ -211,6 +308,7 @@ func (b *BinFile) buildLineCache(f *elf.File, offset uint64) error {
 	}
 
 	b.lines = make(map[int][]address)
+	b.rows = make(map[uint64]bool)
 
 	var filetable []string
 	r := dw.Reader()
@@ -247,7 +345,11 @@ func (b *BinFile) buildLineCache(f *elf.File, offset uint64) error {
 				err = lr.Next(&entry)
 				if err == io.EOF {
 					break
-				} else if err != nil || !entry.IsStmt {
+				} else if err != nil {
+					continue
+				}
+				b.rows[entry.Address-offset] = true
+				if !entry.IsStmt {
 					continue
 				}
 
@@ -296,27 +398,62 @@ func (b *BinFile) addLineCacheEntry(file string, line int, addr uint64) {
 	}
 }
 
+// Name returns the file name of the executable, without its directory.
+func (b *BinFile) Name() string {
+	return filepath.Base(b.name)
+}
+
 // Pie returns true if this executable is position-independent.
 func (b *BinFile) Pie() bool {
 	return b.pie
 }
 
+// LinkToPC converts a link-time address of the executable, as shown by objdump
+// or nm, to a PC. PCs are relative to the first loadable segment of a
+// position-independent executable, so that adding the PIE offset of a running
+// instance gives its address in that instance whether or not address space
+// randomization is enabled; the two only differ if the first segment is not
+// linked at address 0.
+func (b *BinFile) LinkToPC(addr uint64) uint64 {
+	return addr - b.vaddr
+}
+
+// Go returns true if the executable was built by the Go toolchain, which
+// runs goroutines on threads of its own choosing.
+func (b *BinFile) Go() bool {
+	return b.golang
+}
+
 // FuncToPC converts a function name to a PC. It does a "fuzzy" search so if
 // the given name is a substring of a real function name, and the substring
 // uniquely identifies it, that function is used. If there are multiple matches
 // it returns a multiple match error describing all the matches.
 func (b *BinFile) FuncToPC(name string) (uint64, error) {
 	if b.funcs == nil {
-		return 0, errors.New("no elf symbol table")
+		return 0, ErrNoSymbols
 	}
 
 	if addr, ok := b.funcs[name]; ok {
 		return addr, nil
 	}
 
+	// an exact demangled name, with or without parameters
 	matches := make([]string, 0)
+	for fn := range b.demangled {
+		if b.matches(fn, func(d string) bool { return d == name }) {
+			matches = append(matches, fn)
+		}
+	}
+	if len(matches) == 1 {
+		return b.funcs[matches[0]], nil
+	} else if len(matches) > 1 {
+		return 0, &ErrMultipleMatches{
+			Matches: matches,
+		}
+	}
+
 	for fn := range b.funcs {
-		if strings.Contains(fn, name) {
+		if b.matches(fn, func(d string) bool { return strings.Contains(d, name) }) {
 			matches = append(matches, fn)
 		}
 	}
@@ -330,6 +467,75 @@ func (b *BinFile) FuncToPC(name string) (uint64, error) {
 	}
 }
 
+// MatchFuncs returns the sorted names of all functions in the symbol table for
+// which match returns true. Mangled names match if either the mangled or the
+// demangled form matches, and the mangled name is returned.
+func (b *BinFile) MatchFuncs(match func(name string) bool) []string {
+	var names []string
+	for fn := range b.funcs {
+		if b.matches(fn, match) {
+			names = append(names, fn)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FuncsInRange returns the sorted names of the functions that start at an
+// address in [start, end).
+func (b *BinFile) FuncsInRange(start, end uint64) []string {
+	var names []string
+	for fn, addr := range b.funcs {
+		if addr >= start && addr < end {
+			names = append(names, fn)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FuncsInSource returns the sorted names of the functions whose first
+// instruction belongs to a source file for which match returns true.
+func (b *BinFile) FuncsInSource(match func(file string) bool) ([]string, error) {
+	if len(b.lines) == 0 {
+		return nil, ErrNoLineInfo
+	}
+	starts := make(map[uint64][]string)
+	for fn, addr := range b.funcs {
+		starts[addr] = append(starts[addr], fn)
+	}
+	var names []string
+	for _, addrs := range b.lines {
+		for _, fa := range addrs {
+			if fns, ok := starts[fa.addr]; ok && match(fa.file) {
+				names = append(names, fns...)
+				// each function is only added once
+				delete(starts, fa.addr)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SectionRange returns the start and end addresses of the executable section
+// with the given name, such as .text.
+func (b *BinFile) SectionRange(name string) (uint64, uint64, bool) {
+	r, ok := b.sections[name]
+	return r[0], r[1], ok
+}
+
+// InExecSection returns true if the PC is inside one of the executable
+// sections of the binary, such as .text or .plt.
+func (b *BinFile) InExecSection(pc uint64) bool {
+	for _, r := range b.sections {
+		if pc >= r[0] && pc < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
 // InlinedFuncToPCs is the same as FuncToPCs but works for inlined functions
 // and returns all start addresses and end addresses of the various inlinings
 // of the specified function.
@@ -359,15 +565,38 @@ func (b *BinFile) InlinedFuncToPCs(name string) ([]InlinedFunc, error) {
 }
 
 // LineToPC converts a file/line location to a PC. It performs a "fuzzy" search
-// on the filename similar to FuncToPC.
+// on the filename similar to FuncToPC. If no code is associated with the line
+// (for example a comment or blank line), the closest following line in the
+// same file that has code is used.
 func (b *BinFile) LineToPC(file string, line int) (uint64, error) {
-	if b.lines == nil {
-		return 0, errors.New("no DWARF debugging data")
+	if len(b.lines) == 0 {
+		return 0, ErrNoLineInfo
+	}
+
+	addr, err := b.lineToPC(file, line)
+	if err != errNoPC {
+		return addr, err
+	}
+
+	next := -1
+	for l := range b.lines {
+		if l <= line || (next != -1 && l >= next) {
+			continue
+		}
+		if _, err := b.lineToPC(file, l); err == nil {
+			next = l
+		}
+	}
+	if next == -1 {
+		return 0, fmt.Errorf("%s:%d has no associated PC", file, line)
 	}
+	return b.lineToPC(file, next)
+}
 
+func (b *BinFile) lineToPC(file string, line int) (uint64, error) {
 	addrs, ok := b.lines[line]
 	if !ok {
-		return 0, fmt.Errorf("%s:%d has no associated PC", file, line)
+		return 0, errNoPC
 	}
 
 	var addr uint64
@@ -384,7 +613,7 @@ func (b *BinFile) LineToPC(file string, line int) (uint64, error) {
 	if len(matches) == 1 {
 		return addr, nil
 	} else if len(matches) == 0 {
-		return 0, fmt.Errorf("%s:%d has no associated PC", file, line)
+		return 0, errNoPC
 	}
 
 	return 0, &ErrMultipleMatches{
@@ -392,44 +621,125 @@ func (b *BinFile) LineToPC(file string, line int) (uint64, error) {
 	}
 }
 
+// PCToFunc returns the name of the function containing the given PC.
+func (b *BinFile) PCToFunc(pc uint64) (string, error) {
+	if len(b.syms) == 0 {
+		return "", ErrNoSymbols
+	}
+	i := sort.Search(len(b.syms), func(i int) bool {
+		return b.syms[i].addr > pc
+	})
+	if i == 0 {
+		return "", fmt.Errorf("0x%x has no associated function", pc)
+	}
+	sym := b.syms[i-1]
+	if sym.size != 0 && pc >= sym.addr+sym.size {
+		return "", fmt.Errorf("0x%x has no associated function", pc)
+	}
+	return sym.name, nil
+}
+
+// PCToFuncOffset returns the function that contains the PC and the offset of
+// the PC from the start of the function.
+func (b *BinFile) PCToFuncOffset(pc uint64) (string, uint64, error) {
+	fn, err := b.PCToFunc(pc)
+	if err != nil {
+		return "", 0, err
+	}
+	i := sort.Search(len(b.syms), func(i int) bool {
+		return b.syms[i].addr > pc
+	})
+	return fn, pc - b.syms[i-1].addr, nil
+}
+
+// IsLineBoundary returns true if the PC begins a row of the DWARF line table,
+// meaning that it is known to be the start of an instruction. A PC that does
+// not begin a row may still be the start of an instruction.
+func (b *BinFile) IsLineBoundary(pc uint64) (bool, error) {
+	if len(b.rows) == 0 {
+		return false, ErrNoLineInfo
+	}
+	return b.rows[pc], nil
+}
+
+// PCToLine converts a PC to the closest preceding file/line location.
+func (b *BinFile) PCToLine(pc uint64) (string, int, error) {
+	if len(b.lines) == 0 {
+		return "", 0, ErrNoLineInfo
+	}
+
+	var (
+		file  string
+		line  int
+		best  uint64
+		found bool
+	)
+	for l, addrs := range b.lines {
+		for _, fa := range addrs {
+			if fa.addr <= pc && (!found || fa.addr > best) {
+				file, line, best, found = fa.file, l, fa.addr, true
+			}
+		}
+	}
+
+	if !found {
+		return "", 0, fmt.Errorf("0x%x has no associated line", pc)
+	}
+	return file, line, nil
+}
+
 // PieOffset returns the PIE/ASLR offset for a running instance of this binary
 // file. It reads /proc/pid/maps to determine the right location, so the caller
 // must have ptrace permissions. If possible, you should cache the result of
-// this function instead of calling it multiple times.
+// this function instead of calling it multiple times. Executables that are not
+// position-independent (ELF type ET_EXEC) are always loaded at their link-time
+// addresses, so the offset is 0 and /proc/pid/maps is not read.
 func (b *BinFile) PieOffset(pid int) (uint64, error) {
 	if !b.pie {
 		return 0, nil
 	}
 
+	// The kernel appends " (deleted)" to the path of an executable that has
+	// been replaced or removed since it was started.
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return 0, err
+	}
+	exe = strings.TrimSuffix(exe, " (deleted)")
+
 	maps, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
 	if err != nil {
 		return 0, err
 	}
 	defer maps.Close()
 
-	// only read the first line of the file (this will show the bottom mapping
-	// for the text segment)
+	// The load base is the start of the executable's mapping at file offset
+	// 0 (the first loadable segment). It is not necessarily the first line of
+	// the file, since other mappings may come first.
 	scanner := bufio.NewScanner(maps)
-	for {
-		if !scanner.Scan() {
-			if err := scanner.Err(); err != nil {
-				return 0, err
-			}
-			break
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
 		}
-		line := scanner.Text()
-		if !strings.Contains(line, filepath.Base(b.name)) {
+		path := strings.TrimSuffix(strings.Join(fields[5:], " "), " (deleted)")
+		if path != exe {
 			continue
 		}
-		parts := strings.Split(line, "-")
-		if len(parts) < 1 {
+		offset, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil || offset != 0 {
 			continue
 		}
-		off, err := strconv.ParseUint("0x"+parts[0], 0, 64)
+		addrs := strings.SplitN(fields[0], "-", 2)
+		off, err := strconv.ParseUint(addrs[0], 16, 64)
 		if err != nil {
 			return 0, err
 		}
 		return off, nil
 	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
 	return 0, errors.New("could not find pie offset")
 }
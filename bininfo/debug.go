@@ -0,0 +1,216 @@
+package bininfo
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The directory that separate debug files are installed in by most
+// distributions.
+const debugDir = "/usr/lib/debug"
+
+// readBuildID returns the hex build ID from the .note.gnu.build-id section, or
+// the empty string if there is none.
+func readBuildID(f *elf.File) string {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil || len(data) < 12 {
+		return ""
+	}
+	// namesz, descsz, type, then the name padded to 4 bytes ("GNU\0")
+	namesz := f.ByteOrder.Uint32(data[0:4])
+	descsz := f.ByteOrder.Uint32(data[4:8])
+	start := 12 + (namesz+3)&^3
+	if uint32(len(data)) < start+descsz {
+		return ""
+	}
+	return hex.EncodeToString(data[start : start+descsz])
+}
+
+// readDebugLink returns the file name and CRC from the .gnu_debuglink section.
+func readDebugLink(f *elf.File) (string, uint32, bool) {
+	s := f.Section(".gnu_debuglink")
+	if s == nil {
+		return "", 0, false
+	}
+	data, err := s.Data()
+	if err != nil {
+		return "", 0, false
+	}
+	// the file name is NUL-terminated and padded to 4 bytes, followed by
+	// the CRC32 of the debug file
+	end := bytes.IndexByte(data, 0)
+	if end <= 0 {
+		return "", 0, false
+	}
+	off := (end + 4) &^ 3
+	if len(data) < off+4 {
+		return "", 0, false
+	}
+	return string(data[:end]), f.ByteOrder.Uint32(data[off : off+4]), true
+}
+
+// HasSymbols returns true if a symbol table was found in the binary or its
+// debug file. Dynamic symbols alone do not count, since they only include
+// exported functions.
+func (b *BinFile) HasSymbols() bool {
+	return b.symtab
+}
+
+// HasDebugInfo returns true if DWARF line information was found in the binary
+// or its debug file.
+func (b *BinFile) HasDebugInfo() bool {
+	return b.lines != nil
+}
+
+// BuildID returns the hex GNU build ID of the binary, or the empty string.
+func (b *BinFile) BuildID() string {
+	return b.buildID
+}
+
+// LoadDebug reads the symbols and DWARF information that are missing from the
+// binary from a separate debug file, such as one created with 'objcopy
+// --only-keep-debug'. The debug file has the same section addresses as the
+// binary, so the binary's load layout is used for both.
+func (b *BinFile) LoadDebug(r io.ReaderAt) error {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !b.HasSymbols() {
+		b.buildFuncCache(f, b.vaddr)
+	}
+	if !b.HasDebugInfo() {
+		b.buildInlinedFuncCache(f, b.vaddr)
+		b.buildLineCache(f, b.vaddr)
+	}
+	if !b.HasSymbols() && !b.HasDebugInfo() {
+		return errors.New("no symbols or DWARF information in the binary or the debug file")
+	}
+	return nil
+}
+
+// FindDebugFile looks for the separate debug file of the binary at binpath in
+// the standard locations: by build ID under /usr/lib/debug/.build-id, and by
+// the name in the .gnu_debuglink section next to the binary, in its .debug
+// directory, or under /usr/lib/debug. It returns the empty string if no debug
+// file is found.
+func (b *BinFile) FindDebugFile(binpath string) string {
+	if b.buildID != "" && len(b.buildID) > 2 {
+		path := filepath.Join(debugDir, ".build-id", b.buildID[:2], b.buildID[2:]+".debug")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	if b.debuglink == "" {
+		return ""
+	}
+	dir, err := filepath.Abs(filepath.Dir(binpath))
+	if err != nil {
+		return ""
+	}
+	for _, path := range []string{
+		filepath.Join(dir, b.debuglink),
+		filepath.Join(dir, ".debug", b.debuglink),
+		filepath.Join(debugDir, dir, b.debuglink),
+	} {
+		if path == binpath {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if crc32.ChecksumIEEE(data) != b.debugcrc {
+			continue
+		}
+		return path
+	}
+	return ""
+}
+
+// FetchDebugFile downloads the debug file of the binary from the debuginfod
+// servers listed in the DEBUGINFOD_URLS environment variable and returns its
+// path. Downloaded files are cached.
+func (b *BinFile) FetchDebugFile() (string, error) {
+	urls := strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	if len(urls) == 0 {
+		return "", errors.New("DEBUGINFOD_URLS is not set")
+	}
+	if b.buildID == "" {
+		return "", errors.New("binary has no build ID")
+	}
+
+	cache := os.Getenv("DEBUGINFOD_CACHE_PATH")
+	if cache == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cache = filepath.Join(dir, "debuginfod_client")
+	}
+	path := filepath.Join(cache, b.buildID, "debuginfo")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	var errs []string
+	for _, url := range urls {
+		err := download(client, strings.TrimSuffix(url, "/")+"/buildid/"+b.buildID+"/debuginfo", path)
+		if err == nil {
+			return path, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return "", fmt.Errorf("debuginfod: %s", strings.Join(errs, "; "))
+}
+
+// download writes the contents of url to path.
+func download(client *http.Client, url, path string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".debuginfo")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,61 @@
+package bininfo
+
+import (
+	"debug/elf"
+)
+
+// IfuncToPC returns the address of the resolver of the indirect function
+// (symbol type STT_GNU_IFUNC) with the given name, such as memcpy in glibc.
+// The dynamic linker calls the resolver when the program is loaded, and it
+// returns the address of the implementation to use on the CPU. The name must
+// match exactly. It returns false if there is no indirect function with the
+// name.
+func (b *BinFile) IfuncToPC(name string) (uint64, bool) {
+	addr, ok := b.ifuncs[name]
+	return addr, ok
+}
+
+// IfuncSlots returns the addresses of the GOT entries that the dynamic linker
+// sets to the result of the resolver at the given address (the targets of its
+// IRELATIVE relocations). A shared library that calls its own indirect
+// functions has one for each of them.
+func (b *BinFile) IfuncSlots(resolver uint64) []uint64 {
+	return b.irelative[resolver]
+}
+
+// readIrelative reads the IRELATIVE relocations of a 64-bit ELF file, and
+// returns the GOT entries they apply to by the address of their resolver,
+// both relative to the first loadable segment.
+func readIrelative(f *elf.File, offset uint64) map[uint64][]uint64 {
+	var irelative uint32
+	switch f.Machine {
+	case elf.EM_X86_64:
+		irelative = uint32(elf.R_X86_64_IRELATIVE)
+	case elf.EM_AARCH64:
+		irelative = uint32(elf.R_AARCH64_IRELATIVE)
+	default:
+		return nil
+	}
+
+	slots := make(map[uint64][]uint64)
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_RELA {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		// Elf64_Rela: r_offset, r_info, r_addend
+		for i := 0; i+24 <= len(data); i += 24 {
+			info := f.ByteOrder.Uint64(data[i+8:])
+			if elf.R_TYPE64(info) != irelative {
+				continue
+			}
+			slot := f.ByteOrder.Uint64(data[i:])
+			resolver := f.ByteOrder.Uint64(data[i+16:])
+			slots[resolver-offset] = append(slots[resolver-offset], slot-offset)
+		}
+	}
+	return slots
+}
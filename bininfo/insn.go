@@ -0,0 +1,474 @@
+package bininfo
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ErrNoCode is returned when checking instruction boundaries without the
+// binary's code having been loaded with LoadCode.
+var ErrNoCode = errors.New("the binary's code was not loaded")
+
+// maximum length of an x86 instruction
+const maxInsnLen = 15
+
+// An executable segment of the binary, at its address relative to the first
+// loadable segment.
+type segment struct {
+	addr uint64
+	data []byte
+}
+
+// LoadCode reads the executable segments of the binary so that instruction
+// boundaries can be checked with IsInstructionStart. The reader must be the
+// binary itself, not a separate debug file, since the code is not kept in
+// debug files.
+func (b *BinFile) LoadCode(r io.ReaderAt) error {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b.machine = f.Machine
+	b.code = nil
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Flags&elf.PF_X == 0 {
+			continue
+		}
+		data := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(data, 0); err != nil {
+			return fmt.Errorf("segment at 0x%x: %w", p.Vaddr, err)
+		}
+		b.code = append(b.code, segment{
+			addr: p.Vaddr - b.vaddr,
+			data: data,
+		})
+	}
+	sort.Slice(b.code, func(i, j int) bool {
+		return b.code[i].addr < b.code[j].addr
+	})
+	return nil
+}
+
+// IsInstructionStart returns true if the PC is the start of an instruction.
+// On x86-64 the instructions of the function containing the PC are decoded
+// from its start up to the PC, so the function must have a symbol. On arm64
+// all instructions are 4 bytes and aligned. The code must have been loaded
+// with LoadCode.
+func (b *BinFile) IsInstructionStart(pc uint64) (bool, error) {
+	if b.code == nil {
+		return false, ErrNoCode
+	}
+	if b.machine == elf.EM_AARCH64 {
+		return pc%4 == 0, nil
+	} else if b.machine != elf.EM_X86_64 {
+		return false, fmt.Errorf("cannot decode instructions for %v", b.machine)
+	}
+
+	fn, off, err := b.PCToFuncOffset(pc)
+	if err != nil {
+		return false, err
+	}
+	code, err := b.codeAt(pc-off, off)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", fn, err)
+	}
+	var n uint64
+	for n < off {
+		l, err := x86InsnLen(code[n:])
+		if err != nil {
+			return false, fmt.Errorf("%s+0x%x: %w", fn, n, err)
+		}
+		n += uint64(l)
+	}
+	return n == off, nil
+}
+
+// codeAt returns the code starting at addr, including at least n bytes and
+// the longest instruction that may follow them.
+func (b *BinFile) codeAt(addr, n uint64) ([]byte, error) {
+	for _, s := range b.code {
+		if addr >= s.addr && addr+n < s.addr+uint64(len(s.data)) {
+			end := addr - s.addr + n + maxInsnLen
+			if end > uint64(len(s.data)) {
+				end = uint64(len(s.data))
+			}
+			return s.data[addr-s.addr : end], nil
+		}
+	}
+	return nil, fmt.Errorf("0x%x is not in an executable segment", addr)
+}
+
+// Operand sizes of x86 opcodes.
+const (
+	opModRM  = 1 << iota // followed by a ModRM byte
+	opImm8               // 8-bit immediate
+	opImm16              // 16-bit immediate
+	opImmZ               // 16 or 32-bit immediate, depending on operand size
+	opImmV               // 16, 32 or 64-bit immediate, depending on operand size
+	opMoffs              // 32 or 64-bit address, depending on address size
+	opGroup3             // ModRM, and an immediate only for TEST (/0 and /1)
+	opBad                // invalid in 64-bit mode, or not decoded
+)
+
+// operands of the one-byte opcodes, not including prefixes and escapes
+var oneByte = func() (t [256]uint8) {
+	for op := 0; op < 0x40; op++ {
+		switch op & 7 {
+		case 0, 1, 2, 3:
+			t[op] = opModRM
+		case 4:
+			t[op] = opImm8
+		case 5:
+			t[op] = opImmZ
+		default:
+			t[op] = opBad
+		}
+	}
+	for op := 0x60; op <= 0x62; op++ {
+		t[op] = opBad
+	}
+	t[0x63] = opModRM
+	t[0x68] = opImmZ
+	t[0x69] = opModRM | opImmZ
+	t[0x6a] = opImm8
+	t[0x6b] = opModRM | opImm8
+	for op := 0x70; op <= 0x7f; op++ {
+		t[op] = opImm8
+	}
+	t[0x80] = opModRM | opImm8
+	t[0x81] = opModRM | opImmZ
+	t[0x82] = opBad
+	t[0x83] = opModRM | opImm8
+	for op := 0x84; op <= 0x8f; op++ {
+		t[op] = opModRM
+	}
+	t[0x9a] = opBad
+	for op := 0xa0; op <= 0xa3; op++ {
+		t[op] = opMoffs
+	}
+	t[0xa8] = opImm8
+	t[0xa9] = opImmZ
+	for op := 0xb0; op <= 0xb7; op++ {
+		t[op] = opImm8
+	}
+	for op := 0xb8; op <= 0xbf; op++ {
+		t[op] = opImmV
+	}
+	t[0xc0] = opModRM | opImm8
+	t[0xc1] = opModRM | opImm8
+	t[0xc2] = opImm16
+	t[0xc6] = opModRM | opImm8
+	t[0xc7] = opModRM | opImmZ
+	t[0xc8] = opImm16 | opImm8
+	t[0xca] = opImm16
+	t[0xcd] = opImm8
+	t[0xce] = opBad
+	for op := 0xd0; op <= 0xd3; op++ {
+		t[op] = opModRM
+	}
+	t[0xd4] = opBad
+	t[0xd5] = opBad
+	t[0xd6] = opBad
+	for op := 0xd8; op <= 0xdf; op++ {
+		t[op] = opModRM
+	}
+	for op := 0xe0; op <= 0xe7; op++ {
+		t[op] = opImm8
+	}
+	t[0xe8] = opImmZ
+	t[0xe9] = opImmZ
+	t[0xea] = opBad
+	t[0xeb] = opImm8
+	t[0xf6] = opGroup3
+	t[0xf7] = opGroup3
+	t[0xfe] = opModRM
+	t[0xff] = opModRM
+	return t
+}()
+
+// operands of the two-byte opcodes (0f xx)
+var twoByte = func() (t [256]uint8) {
+	for op := range t {
+		t[op] = opModRM
+	}
+	for _, op := range []int{0x05, 0x06, 0x07, 0x08, 0x09, 0x0b, 0x0e, 0x77, 0xa0, 0xa1, 0xa2, 0xa8, 0xa9, 0xaa} {
+		t[op] = 0
+	}
+	for op := 0x30; op <= 0x37; op++ {
+		t[op] = 0
+	}
+	for op := 0x80; op <= 0x8f; op++ {
+		t[op] = opImmZ
+	}
+	for op := 0xc8; op <= 0xcf; op++ {
+		t[op] = 0
+	}
+	for _, op := range []int{0x0f, 0x70, 0x71, 0x72, 0x73, 0xa4, 0xac, 0xba, 0xc2, 0xc4, 0xc5, 0xc6} {
+		t[op] = opModRM | opImm8
+	}
+	for _, op := range []int{0x04, 0x0a, 0x0c, 0x24, 0x25, 0x26, 0x27, 0x36, 0x39, 0x3b, 0x3c, 0x3d, 0x3e, 0x3f} {
+		t[op] = opBad
+	}
+	return t
+}()
+
+var errBadInsn = errors.New("invalid or unsupported instruction")
+
+// x86InsnLen returns the length of the x86-64 instruction at the start of
+// code. Only the length is decoded, so some invalid instructions are accepted.
+func x86InsnLen(code []byte) (int, error) {
+	var (
+		n      int
+		opsize bool // 0x66 prefix
+		adsize bool // 0x67 prefix
+		rexw   bool
+	)
+	next := func() (byte, bool) {
+		if n >= len(code) || n >= maxInsnLen {
+			return 0, false
+		}
+		n++
+		return code[n-1], true
+	}
+
+	op, ok := next()
+prefixes:
+	for ok {
+		switch op {
+		case 0x66:
+			opsize = true
+		case 0x67:
+			adsize = true
+		case 0xf0, 0xf2, 0xf3, 0x26, 0x2e, 0x36, 0x3e, 0x64, 0x65:
+		default:
+			break prefixes
+		}
+		op, ok = next()
+	}
+	if ok && op&0xf0 == 0x40 {
+		rexw = op&0x08 != 0
+		op, ok = next()
+	}
+	if !ok {
+		return 0, errBadInsn
+	}
+
+	// opcode map: 0 for one-byte opcodes, 1 for 0f xx, 2 for 0f 38 xx, 3
+	// for 0f 3a xx, and 5 and 6 for the EVEX encoded FP16 maps
+	opmap := 0
+	vex := op == 0xc4 || op == 0xc5 || op == 0x62
+	switch op {
+	case 0xc5:
+		// two-byte VEX prefix
+		if _, ok = next(); !ok {
+			return 0, errBadInsn
+		}
+		opmap = 1
+	case 0xc4, 0x62:
+		// three-byte VEX and four-byte EVEX prefixes
+		p0, ok := next()
+		for i := 0; ok && (i < 1 || op == 0x62 && i < 2); i++ {
+			_, ok = next()
+		}
+		if !ok {
+			return 0, errBadInsn
+		}
+		opmap = int(p0 & 0x1f)
+		if op == 0x62 {
+			opmap = int(p0 & 0x07)
+		}
+	case 0x0f:
+		if op, ok = next(); !ok {
+			return 0, errBadInsn
+		}
+		opmap = 1
+		if op == 0x38 || op == 0x3a {
+			opmap = 2 + int(op>>1&1)
+			if op, ok = next(); !ok {
+				return 0, errBadInsn
+			}
+		}
+	}
+	if vex {
+		if op, ok = next(); !ok {
+			return 0, errBadInsn
+		}
+	}
+
+	var flags uint8
+	switch opmap {
+	case 0:
+		flags = oneByte[op]
+	case 1:
+		flags = twoByte[op]
+		if vex {
+			// vzeroupper and vzeroall are the only VEX encoded
+			// instructions of the map without a ModRM byte
+			flags = opModRM | flags&opImm8
+			if op == 0x77 {
+				flags = 0
+			}
+		}
+	case 2, 5, 6:
+		flags = opModRM
+	case 3:
+		flags = opModRM | opImm8
+	default:
+		return 0, errBadInsn
+	}
+
+	if flags&opBad != 0 {
+		return 0, errBadInsn
+	}
+	if flags&(opModRM|opGroup3) != 0 {
+		modrm, ok := next()
+		if !ok {
+			return 0, errBadInsn
+		}
+		mod, reg, rm := modrm>>6, (modrm>>3)&7, modrm&7
+		if flags&opGroup3 != 0 && reg <= 1 {
+			if op == 0xf6 {
+				flags |= opImm8
+			} else {
+				flags |= opImmZ
+			}
+		}
+		disp := 0
+		if mod != 3 && rm == 4 {
+			sib, ok := next()
+			if !ok {
+				return 0, errBadInsn
+			}
+			if mod == 0 && sib&7 == 5 {
+				disp = 4
+			}
+		}
+		switch {
+		case mod == 0 && rm == 5:
+			disp = 4
+		case mod == 1:
+			disp = 1
+		case mod == 2:
+			disp = 4
+		}
+		n += disp
+	}
+
+	if flags&opImm8 != 0 {
+		n++
+	}
+	if flags&opImm16 != 0 {
+		n += 2
+	}
+	if flags&opImmZ != 0 {
+		if opsize && !rexw {
+			n += 2
+		} else {
+			n += 4
+		}
+	}
+	if flags&opImmV != 0 {
+		if rexw {
+			n += 8
+		} else if opsize {
+			n += 2
+		} else {
+			n += 4
+		}
+	}
+	if flags&opMoffs != 0 {
+		if adsize {
+			n += 4
+		} else {
+			n += 8
+		}
+	}
+
+	if n > maxInsnLen || n > len(code) {
+		return 0, errBadInsn
+	}
+	return n, nil
+}
+
+// FuncReturns returns the addresses of the return instructions in the function
+// that starts at pc, found by decoding its instructions from its start to the
+// end of its symbol. The function must have a symbol with a size, and the code
+// must have been loaded with LoadCode. Code that the compiler placed in a
+// separate symbol (such as a cold path split into a .cold function) is not
+// included.
+func (b *BinFile) FuncReturns(pc uint64) ([]uint64, error) {
+	if b.code == nil {
+		return nil, ErrNoCode
+	}
+	fn, off, err := b.PCToFuncOffset(pc)
+	if err != nil {
+		return nil, err
+	} else if off != 0 {
+		return nil, fmt.Errorf("0x%x is not the start of a function (%s+0x%x)", pc, fn, off)
+	}
+	i := sort.Search(len(b.syms), func(i int) bool {
+		return b.syms[i].addr > pc
+	})
+	size := b.syms[i-1].size
+	if size == 0 {
+		return nil, fmt.Errorf("%s: the size of the function is unknown", fn)
+	}
+
+	var rets []uint64
+	switch b.machine {
+	case elf.EM_AARCH64:
+		code, err := b.codeAt(pc, size-1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+		for n := uint64(0); n+4 <= size; n += 4 {
+			if arm64IsRet(binary.LittleEndian.Uint32(code[n:])) {
+				rets = append(rets, pc+n)
+			}
+		}
+	case elf.EM_X86_64:
+		code, err := b.codeAt(pc, size-1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+		for n := uint64(0); n < size; {
+			l, err := x86InsnLen(code[n:])
+			if err != nil {
+				return nil, fmt.Errorf("%s+0x%x: %w", fn, n, err)
+			}
+			if x86IsRet(code[n : n+uint64(l)]) {
+				rets = append(rets, pc+n)
+			}
+			n += uint64(l)
+		}
+	default:
+		return nil, fmt.Errorf("cannot decode instructions for %v", b.machine)
+	}
+	return rets, nil
+}
+
+// x86IsRet returns true if the instruction is a near return (ret or ret imm16,
+// including with the rep and bnd prefixes that some compilers emit).
+func x86IsRet(insn []byte) bool {
+	for _, c := range insn {
+		switch c {
+		case 0xf2, 0xf3:
+			continue
+		case 0xc2, 0xc3:
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// arm64IsRet returns true if the instruction is RET, RETAA, or RETAB.
+func arm64IsRet(insn uint32) bool {
+	return insn&0xfffffc1f == 0xd65f0000 || insn == 0xd65f0bff || insn == 0xd65f0fff
+}
@@ -0,0 +1,110 @@
+package perforator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"acln.ro/perf"
+	"github.com/zyedidia/perforator/bininfo"
+	"github.com/zyedidia/perforator/utrace"
+)
+
+// environment variable that makes a binary importing this package run the
+// calibration region instead of its main function
+const calibrateEnv = "PERFORATOR_CALIBRATE"
+
+// number of invocations of the calibration region
+const calibrationRuns = 100
+
+func init() {
+	if os.Getenv(calibrateEnv) != "1" {
+		return
+	}
+	for i := 0; i < calibrationRuns; i++ {
+		calibrationStart()
+		calibrationEnd()
+	}
+	os.Exit(0)
+}
+
+// The region from the start of calibrationStart to the start of
+// calibrationEnd is profiled to calibrate the overhead of a region
+// invocation. It is found by address since the executable may be stripped.
+//
+//go:noinline
+func calibrationStart() {}
+
+//go:noinline
+func calibrationEnd() {}
+
+// Calibrate measures the overhead that is counted in every region invocation:
+// the events of the target's own work when counters are enabled and disabled
+// around a breakpoint, and the time taken to stop and resume it. The current
+// executable is traced with a region that is almost empty (a call and a return
+// of empty functions), which runs before its main function because the
+// executable imports this package. The result is the smallest value of each event
+// (and of the times) over many invocations, using the same events and options
+// as Run. It can be subtracted from the metrics of an invocation with
+// SubtractOverhead.
+func Calibrate(ctx context.Context, events Events, attropts perf.Options, traceopts utrace.Options) (Metrics, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return Metrics{}, fmt.Errorf("calibrate: %w", err)
+	}
+	bin, err := bininfo.FromPid(os.Getpid())
+	if err != nil {
+		return Metrics{}, fmt.Errorf("calibrate: %w", err)
+	}
+	off, err := bin.PieOffset(os.Getpid())
+	if err != nil {
+		return Metrics{}, fmt.Errorf("calibrate: %w", err)
+	}
+	region := fmt.Sprintf("0x%x-0x%x",
+		uint64(reflect.ValueOf(calibrationStart).Pointer())-off,
+		uint64(reflect.ValueOf(calibrationEnd).Pointer())-off)
+	opts := utrace.Options{
+		Breakpoints: traceopts.Breakpoints,
+		Callers:     traceopts.Callers,
+		Affinity:    traceopts.Affinity,
+		Env:         append(os.Environ(), calibrateEnv+"=1"),
+	}
+	events.Branches = 0
+	total, err := Run(ctx, self, nil, []string{region}, 0, events, attropts, opts, BinOptions{}, nil)
+	if err != nil {
+		return Metrics{}, fmt.Errorf("calibrate: %w", err)
+	}
+	stats := total.Stats()
+	if len(stats) == 0 || stats[0].Count == 0 {
+		return Metrics{}, errors.New("calibrate: the empty region was never executed")
+	}
+
+	r := stats[0]
+	overhead := Metrics{
+		Elapsed: total[0].Elapsed,
+		Wall:    time.Duration(r.WallMin.Value),
+	}
+	for _, nm := range total {
+		if nm.Elapsed < overhead.Elapsed {
+			overhead.Elapsed = nm.Elapsed
+		}
+	}
+	for i, l := range r.Labels {
+		overhead.Results = append(overhead.Results, Result{
+			Label:   l,
+			Value:   r.Min[i].Value,
+			Enabled: 1,
+			Running: 1,
+		})
+	}
+	return overhead, nil
+}
+
+// SubtractOverhead returns the metrics of an invocation with the overhead
+// measured by Calibrate removed. Values that would drop below zero are zero.
+func (m Metrics) SubtractOverhead(overhead Metrics) Metrics {
+	return m.subtract(overhead)
+}
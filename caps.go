@@ -0,0 +1,232 @@
+package perforator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"acln.ro/perf"
+	"golang.org/x/sys/unix"
+)
+
+// Capabilities are the features of perf_event_open that this system
+// supports, which differ between kernels, their configuration, and the PMU
+// that the CPU (or hypervisor) exposes.
+type Capabilities struct {
+	// Kernel is the release of the running kernel, and Paranoid the setting
+	// of /proc/sys/kernel/perf_event_paranoid.
+	Kernel   string
+	Paranoid string
+	// Software and Hardware are set if software counters (such as
+	// task-clock) and hardware counters (such as instructions) can be
+	// opened for a thread. Most virtual machines have no hardware counters.
+	Software bool
+	Hardware bool
+	// KernelEvents is set if events can be counted in kernel code as well
+	// as in user code.
+	KernelEvents bool
+	// CPUWide is set if every process on a CPU can be counted, and Cgroup if
+	// the processes of a cgroup can.
+	CPUWide bool
+	Cgroup  bool
+	// InheritGroup is set if an event group can be inherited by new threads
+	// and read in the group format, which older kernels reject.
+	InheritGroup bool
+	// Precise is the highest precise_ip level of hardware samples.
+	Precise perf.Skid
+	// LBR is set if the Last Branch Record can be used in call-stack mode.
+	LBR bool
+}
+
+var (
+	capsOnce sync.Once
+	caps     Capabilities
+)
+
+// ProbeCapabilities detects the capabilities of this system by opening
+// throwaway counters for the calling thread. The probe runs once, and later
+// calls return the cached result.
+func ProbeCapabilities() Capabilities {
+	capsOnce.Do(func() {
+		caps = probe()
+	})
+	return caps
+}
+
+func probe() Capabilities {
+	var c Capabilities
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		c.Kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+	c.Paranoid = paranoidSetting()
+
+	user := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	c.Software = canOpen(perf.TaskClock, user, perf.CallingThread, perf.AnyCPU)
+	c.Hardware = canOpen(perf.Instructions, user, perf.CallingThread, perf.AnyCPU)
+	// the remaining probes use a hardware counter if there is one, as the
+	// events that are usually counted
+	var event perf.Configurator = perf.TaskClock
+	if c.Hardware {
+		event = perf.Instructions
+	}
+	c.KernelEvents = canOpen(event, perf.Options{ExcludeHypervisor: true}, perf.CallingThread, perf.AnyCPU)
+	c.CPUWide = canOpen(event, user, perf.AllThreads, 0)
+	c.Cgroup = canOpenCgroup(event, user)
+
+	g := perf.Group{Options: user}
+	g.Options.Inherit = true
+	g.Add(event, perf.TaskClock)
+	if ev, err := g.Open(perf.CallingThread, perf.AnyCPU); err == nil {
+		ev.Close()
+		c.InheritGroup = true
+	}
+
+	if c.Hardware {
+		attr := &perf.Attr{
+			SampleFormat: perf.SampleFormat{IP: true},
+			Options:      user,
+		}
+		perf.CPUCycles.Configure(attr)
+		attr.SetSamplePeriod(lbrIdlePeriod)
+		if ev, err := openPrecise(attr, perf.MustHaveZeroSkid, perf.CallingThread, perf.AnyCPU); err == nil {
+			ev.Close()
+			c.Precise = attr.Options.PreciseIP
+		}
+		c.LBR = checkLBR() == nil
+	}
+	return c
+}
+
+// canOpen returns true if the event can be opened with the given options, for
+// the pid and cpu.
+func canOpen(event perf.Configurator, opts perf.Options, pid, cpu int) bool {
+	attr := &perf.Attr{Options: opts}
+	event.Configure(attr)
+	ev, err := perf.Open(attr, pid, cpu, nil)
+	if err != nil {
+		infof("probe %s (pid %d, cpu %d): %v\n", attr.Label, pid, cpu, err)
+		return false
+	}
+	ev.Close()
+	return true
+}
+
+// canOpenCgroup returns true if the event can be counted for the root cgroup,
+// in either the unified hierarchy or the perf_event controller's.
+func canOpenCgroup(event perf.Configurator, opts perf.Options) bool {
+	for _, path := range []string{"/sys/fs/cgroup/perf_event", "/sys/fs/cgroup"} {
+		dir, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		attr := &perf.Attr{Options: opts}
+		event.Configure(attr)
+		ev, err := perf.OpenCGroup(attr, int(dir.Fd()), 0, nil)
+		dir.Close()
+		if err == nil {
+			ev.Close()
+			return true
+		}
+		infof("probe %s (cgroup %s): %v\n", attr.Label, path, err)
+	}
+	return false
+}
+
+// Degrade adapts the events and counter options to the capabilities, leaving
+// out what cannot be counted, and returns a warning for each change. Requests
+// that cannot be degraded, such as counting a cgroup, return an error before
+// the target is started rather than once it is running.
+func (c Capabilities) Degrade(events *Events, opts *perf.Options) ([]string, error) {
+	var warnings []string
+	if events.Cgroup != "" && !c.Cgroup {
+		return nil, fmt.Errorf("cgroup counters are not supported (perf_event_paranoid is %s, or the kernel was built without CONFIG_CGROUP_PERF)", c.Paranoid)
+	}
+	if opts.Inherit && len(events.Groups) > 0 && !c.InheritGroup {
+		return nil, ErrInheritGroup
+	}
+	if events.SplitModes && !c.KernelEvents && c.Software {
+		return nil, fmt.Errorf("kernel events are not allowed (perf_event_paranoid is %s), so they cannot be counted separately", c.Paranoid)
+	}
+	if !opts.ExcludeKernel && !c.KernelEvents && c.Software {
+		opts.ExcludeKernel = true
+		warnings = append(warnings, fmt.Sprintf("kernel events are not allowed (perf_event_paranoid is %s), counting user code only", c.Paranoid))
+	}
+	if !c.Hardware && c.Software {
+		var dropped []string
+		events.Base, dropped = withoutHardware(events.Base, dropped)
+		var groups [][]perf.Configurator
+		for _, g := range events.Groups {
+			g, dropped = withoutHardware(g, dropped)
+			if len(g) > 0 {
+				groups = append(groups, g)
+			}
+		}
+		events.Groups = groups
+		if len(dropped) > 0 {
+			warnings = append(warnings, fmt.Sprintf("hardware counters are not available, leaving out %s", strings.Join(dropped, ", ")))
+		}
+		var ratios []Ratio
+		for _, r := range events.Ratios {
+			if checkRatios([]Ratio{r}, events.Groups) == nil {
+				ratios = append(ratios, r)
+			} else {
+				warnings = append(warnings, fmt.Sprintf("leaving out derived ratio %s", r.Label))
+			}
+		}
+		events.Ratios = ratios
+	}
+	if events.Branches > 0 && !c.LBR {
+		warnings = append(warnings, "the Last Branch Record is not available, capturing callers instead")
+	}
+	return warnings, nil
+}
+
+// withoutHardware returns the events that are not counted by the PMU, adding
+// the labels of the others to dropped.
+func withoutHardware(events []perf.Configurator, dropped []string) ([]perf.Configurator, []string) {
+	var kept []perf.Configurator
+	for _, ev := range events {
+		var attr perf.Attr
+		ev.Configure(&attr)
+		switch attr.Type {
+		case perf.HardwareEvent, perf.HardwareCacheEvent, perf.RawEvent:
+			dropped = append(dropped, attr.Label)
+		default:
+			kept = append(kept, ev)
+		}
+	}
+	return kept, dropped
+}
+
+// WriteTo writes a table of the capabilities.
+func (c Capabilities) WriteTo(table MetricsWriter) {
+	yes := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	precise := map[perf.Skid]string{
+		perf.CanHaveArbitrarySkid: "0 (arbitrary skid)",
+		perf.MustHaveConstantSkid: "1 (constant skid)",
+		perf.RequestedZeroSkid:    "2 (zero skid requested)",
+		perf.MustHaveZeroSkid:     "3 (zero skid)",
+	}
+	table.SetHeader([]string{"capability", "supported"})
+	table.Append([]string{"kernel", c.Kernel})
+	table.Append([]string{"perf_event_paranoid", c.Paranoid})
+	table.Append([]string{"software counters", yes(c.Software)})
+	table.Append([]string{"hardware counters", yes(c.Hardware)})
+	table.Append([]string{"kernel events", yes(c.KernelEvents)})
+	table.Append([]string{"cpu-wide counters", yes(c.CPUWide)})
+	table.Append([]string{"cgroup counters", yes(c.Cgroup)})
+	table.Append([]string{"inherited groups", yes(c.InheritGroup)})
+	table.Append([]string{"precise_ip", precise[c.Precise]})
+	table.Append([]string{"last branch record", yes(c.LBR)})
+	table.Render()
+}
@@ -0,0 +1,161 @@
+package perforator
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"acln.ro/perf"
+	"golang.org/x/sys/unix"
+)
+
+// ErrCgroupGroup is returned when cgroup counters are requested for a group
+// of events, which are only supported for single threads.
+var ErrCgroupGroup = errors.New("cgroup counters cannot be used with event groups")
+
+// NewCgroupProfiler opens the events for every process in a cgroup, while it
+// runs on the given CPU. The cgroup is given by a file descriptor of its
+// directory in the cgroup filesystem (such as /sys/fs/cgroup/system.slice/
+// foo.service). The kernel only counts a cgroup on a single CPU, so cpu must
+// not be -1; open a profiler on each CPU to count the cgroup everywhere. Like
+// NewMultiProfiler, events that the CPU does not support are skipped.
+func NewCgroupProfiler(attrs []*perf.Attr, cgroupFd, cpu int) (*MultiProfiler, error) {
+	if err := checkCgroupScope(cgroupFd, cpu); err != nil {
+		return nil, err
+	}
+	return newMultiProfiler(attrs, func(attr *perf.Attr) (*SingleProfiler, error) {
+		return openAttr(sysAttr(attr), attr.Label, cgroupFd, cpu, unix.PERF_FLAG_PID_CGROUP)
+	})
+}
+
+// checkCgroupScope returns an error if a cgroup cannot be counted with the
+// given file descriptor and CPU.
+func checkCgroupScope(cgroupFd, cpu int) error {
+	if cgroupFd < 0 {
+		return fmt.Errorf("invalid cgroup file descriptor %d", cgroupFd)
+	}
+	if cpu < 0 {
+		return errors.New("a profiler for a cgroup must be opened on a single CPU")
+	}
+	return nil
+}
+
+// A cgroupScope is a cgroup to count events for, and the CPUs to count them
+// on.
+type cgroupScope struct {
+	dir  *os.File
+	cpus []int
+}
+
+// openCgroup opens the cgroup directory at path, to count its events on the
+// given CPU, or on every online CPU if cpu is perf.AnyCPU.
+func openCgroup(path string, cpu int) (*cgroupScope, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	cpus := []int{cpu}
+	if cpu == perf.AnyCPU {
+		cpus, err = onlineCPUs()
+		if err != nil {
+			dir.Close()
+			return nil, fmt.Errorf("cgroup: %w", err)
+		}
+	}
+	return &cgroupScope{dir, cpus}, nil
+}
+
+func (c *cgroupScope) Close() error {
+	return c.dir.Close()
+}
+
+// onlineCPUs returns the CPUs that are online, as listed in sysfs.
+func onlineCPUs() ([]int, error) {
+	b, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// parseCPUList parses a list of CPUs in the kernel's format, such as 0-3,8.
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, r := range strings.Split(list, ",") {
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("cpu list %q: %w", list, err)
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("cpu list %q: %w", list, err)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// A cpuSumProfiler counts the same events on several CPUs, and adds up the
+// counts of each event.
+type cpuSumProfiler struct {
+	MultiProfiler
+}
+
+// newCgroupSumProfiler opens the events for every process in a cgroup on each
+// of the CPUs.
+func newCgroupSumProfiler(attrs []*perf.Attr, cgroupFd int, cpus []int) (*cpuSumProfiler, error) {
+	p := &cpuSumProfiler{}
+	for _, cpu := range cpus {
+		prof, err := NewCgroupProfiler(attrs, cgroupFd, cpu)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+		p.profilers = append(p.profilers, prof)
+	}
+	return p, nil
+}
+
+// Metrics returns the counts of each event, added up over the CPUs. The counts
+// are scaled for multiplexing on each CPU before they are added.
+func (p *cpuSumProfiler) Metrics() Metrics {
+	var m Metrics
+	index := make(map[string]int)
+	for _, prof := range p.profilers {
+		pm := prof.Metrics()
+		for _, r := range pm.Results {
+			i, ok := index[r.Label]
+			if !ok {
+				i = len(m.Results)
+				index[r.Label] = i
+				m.Results = append(m.Results, Result{
+					Label:  r.Label,
+					Cgroup: r.Cgroup,
+				})
+			}
+			m.Results[i].Value += r.ScaledValue()
+			// a failed read on any CPU makes the sum unreliable
+			m.Results[i].Anomaly = m.Results[i].Anomaly || r.Anomaly
+			if r.Enabled > m.Results[i].Enabled {
+				m.Results[i].Enabled = r.Enabled
+			}
+		}
+		if pm.Elapsed > m.Elapsed {
+			m.Elapsed = pm.Elapsed
+		}
+	}
+	// the counts are already scaled
+	for i := range m.Results {
+		m.Results[i].Running = m.Results[i].Enabled
+	}
+	return m
+}
@@ -0,0 +1,72 @@
+package perforator
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// traceEvent is an event in the Trace Event Format read by chrome://tracing
+// and Perfetto.
+type traceEvent struct {
+	Name string `json:"name"`
+	Cat  string `json:"cat"`
+	Ph   string `json:"ph"`
+	// timestamp in microseconds
+	Ts   float64                `json:"ts"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes the invocations as a timeline in the Trace Event
+// Format, which can be opened with chrome://tracing or Perfetto. Each
+// invocation becomes a begin/end pair of events on its thread's lane, at its
+// CLOCK_MONOTONIC entry and exit times. The end event carries the values of
+// the events, the derived ratios, and whether the invocation was incomplete.
+func (t TotalMetrics) WriteChromeTrace(w io.Writer) error {
+	events := make([]traceEvent, 0, 2*len(t))
+	for _, nm := range t {
+		pid := nm.Pid
+		if pid == 0 {
+			pid = nm.Tid
+		}
+		begin := traceEvent{
+			Name: nm.Name,
+			Cat:  "region",
+			Ph:   "B",
+			Ts:   float64(nm.Start) / 1000,
+			Pid:  pid,
+			Tid:  nm.Tid,
+		}
+		end := begin
+		end.Ph = "E"
+		end.Ts = float64(nm.End) / 1000
+		end.Args = make(map[string]interface{})
+		rec := nm.record()
+		for label, v := range rec.Counters {
+			end.Args[label] = v
+		}
+		for label, v := range rec.Derived {
+			end.Args[label] = v
+		}
+		if nm.Incomplete {
+			end.Args["incomplete"] = true
+		}
+		events = append(events, begin, end)
+	}
+	// invocations are recorded when they end, so the events are put back in
+	// time order, ending an invocation before beginning the next one at the
+	// same time
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Ts != events[j].Ts {
+			return events[i].Ts < events[j].Ts
+		}
+		return events[i].Ph == "E" && events[j].Ph == "B"
+	})
+
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ns"})
+}
@@ -1,34 +1,166 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"acln.ro/perf"
 	"github.com/zyedidia/perforator"
 )
 
 var opts struct {
-	List        string   `short:"l" long:"list" description:"List available events for {hardware, software, cache, trace} event types"`
-	Events      string   `short:"e" long:"events" default-mask:"-" default:"instructions,branch-instructions,branch-misses,cache-references,cache-misses" description:"Comma-separated list of events to profile"`
-	GroupEvents []string `short:"g" long:"group" description:"Comma-separated list of events to profile together as a group"`
-	Regions     []string `short:"r" long:"region" description:"Region(s) to profile: 'function' or 'start-end'; start/end locations may be file:line or hex addresses"`
-	Kernel      bool     `long:"kernel" description:"Include kernel code in measurements"`
-	Hypervisor  bool     `long:"hypervisor" description:"Include hypervisor code in measurements"`
-	ExcludeUser bool     `long:"exclude-user" description:"Exclude user code from measurements"`
-	Summary     bool     `short:"s" long:"summary" description:"Instead of printing results immediately, show an aggregated summary afterwards"`
-	SortKey     string   `long:"sort-key" description:"Key to sort summary tables with"`
-	ReverseSort bool     `long:"reverse-sort" description:"Reverse summary table sorting"`
-	Csv         bool     `long:"csv" description:"Write summary output in CSV format"`
-	Output      string   `short:"o" long:"output" description:"Write summary output to file"`
-	Verbose     bool     `short:"V" long:"verbose" description:"Show verbose debug information"`
-	Version     bool     `short:"v" long:"version" description:"Show version information"`
-	Help        bool     `short:"h" long:"help" description:"Show this help message"`
+	List        string        `short:"l" long:"list" description:"List available events for {hardware, software, cache, trace} event types, or the derived ratios with 'derived'"`
+	ListEvents  bool          `long:"list-events" description:"List the known hardware, software, and cache events and whether each is supported on this system"`
+	PrintCaps   bool          `long:"print-caps" description:"Print the perf_event_open features that this kernel and CPU support, as probed at startup, and exit"`
+	Events      string        `short:"e" long:"events" default-mask:"-" default:"instructions,branch-instructions,branch-misses,cache-references,cache-misses" description:"Comma-separated list of events to profile"`
+	GroupEvents []string      `short:"g" long:"group" description:"Comma-separated list of events to profile together as a group"`
+	Regions     []string      `short:"r" long:"region" description:"Region(s) to profile: 'function', 'regexp:pattern', 'glob:pattern', 'source:path' (every function defined in matching source files), 'range:start-end' or 'range:.section' (every function starting in the range), 'start-end', or 'span:start-end' (start and end may be in different functions), or 'rets:function' (ends at the function's return instructions); start/end locations may be file:line or hex addresses"`
+	RegionsFile string        `long:"regions-file" description:"Read more regions from a file, one selector per line in the form of --region (blank lines and lines starting with # are ignored)"`
+	MaxRegions  int           `long:"max-regions" default:"64" description:"Maximum number of regions that selectors (regexp, glob, source, range) may expand to (0 for no limit)"`
+	DryRun      bool          `long:"dry-run" description:"Print the addresses that the breakpoints of each region would be placed at, and exit without profiling (a position-independent target is started briefly to find its load address)"`
+	Mode        string        `long:"mode" choice:"region" choice:"sample" default:"region" description:"Profile regions precisely with breakpoints, or sample the whole program statistically"`
+	SamplePer   uint64        `long:"sample-period" default:"1000000" description:"In sample mode, take a sample every N occurrences of the event"`
+	SampleFreq  uint64        `long:"sample-freq" description:"In sample mode, take N samples per second instead of using a fixed period"`
+	Precise     bool          `long:"precise" description:"In sample mode, ask the CPU to attribute samples to the exact instruction (precise_ip, with PEBS or IBS), using the highest level the event supports"`
+	Derived     string        `long:"derived" description:"Comma-separated list of derived ratios to show: cache-miss-rate, branch-miss-rate, ipc (their events must be in the same --group)"`
+	NoReset     bool          `long:"no-reset" description:"Read counters at region entry and subtract at exit instead of resetting them"`
+	Interval    time.Duration `long:"interval" description:"Also read the counters every interval (e.g. 10ms) while a region is active, and show each invocation's counts and derived ratios over time (cannot be used with --gated)"`
+	NoCounters  bool          `long:"no-counters" description:"Do not open any perf events and only measure wall-clock time (works without perf permissions)"`
+	Kernel      bool          `long:"kernel" description:"Include kernel code in measurements"`
+	Hypervisor  bool          `long:"hypervisor" description:"Include hypervisor code in measurements"`
+	ExcludeUser bool          `long:"exclude-user" description:"Exclude user code from measurements"`
+	UserKernel  bool          `long:"user-kernel" description:"Count every event separately in user code (event:u) and kernel code (event:k), with both counters in the same group (cannot be used with --kernel, --exclude-user, --cgroup, or --gated)"`
+	ExcludeSys  bool          `long:"exclude-syscalls" description:"Pause the counters while a region is inside a system call, so that only on-CPU work is counted (adds two stops per system call)"`
+	Inherit     bool          `long:"inherit" description:"Also count events in threads and child processes created while a region is active (cannot be used with --group on kernels that cannot read inherited groups; see --print-caps)"`
+	Gated       bool          `long:"gated" description:"Count each region's events with a single set of counters, inherited by every thread and enabled while any thread is inside the region, and show their totals instead of each invocation (implies --summary; --group requires a kernel that can inherit event groups)"`
+	Threshold   string        `long:"threshold" description:"Stop the target once the gated count of an event in --threshold-region reaches a total, given as event=count (such as instructions=1e6), and report how many invocations and how much time it took (implies --gated)"`
+	ThresholdIn string        `long:"threshold-region" description:"Region whose count is compared with --threshold (default: the first region)"`
+	Cgroup      string        `long:"cgroup" description:"Count the events of every process in the cgroup at the given path (such as /sys/fs/cgroup/system.slice/foo.service) on every CPU while a region is active, instead of the target's own (cannot be used with --group)"`
+	CPU         int           `long:"cpu" default:"-1" description:"Pin the target to the given CPU and count events only on that CPU"`
+	Callers     bool          `long:"callers" description:"Capture the call stack each time a region is entered (requires frame pointers)"`
+	Branches    int           `long:"branches" description:"Capture the given number of calls from the Last Branch Record each time a region is entered (falls back to --callers if unsupported)"`
+	FollowExec  bool          `long:"follow-exec" description:"Keep tracing processes that call exec, finding the regions in the new executable (the target may then be a script)"`
+	Go          bool          `long:"go" description:"Trace the target as a Go program, matching region entries with their ends by goroutine and only measuring invocations that end on the thread that entered them (automatic for executables built by Go)"`
+	HwBreak     bool          `long:"hw-breakpoints" description:"Use hardware debug registers for breakpoints when available"`
+	Trap        string        `long:"trap" description:"Hex bytes of the instruction to write at software breakpoints, such as cd03 for 'int 3' (default: the architecture's breakpoint instruction)"`
+	Runs        int           `long:"runs" default:"1" description:"Run the target N times and aggregate the results of all runs"`
+	Warmup      int           `long:"warmup" description:"Discard the first K invocations of each region in each run"`
+	WarmupRuns  int           `long:"warmup-runs" description:"Run the target K times before measuring and discard the results"`
+	Limit       int           `long:"limit" description:"Stop measuring a region after N completed invocations in each run, removing its breakpoint so the rest of the run is not slowed down"`
+	SampleRate  int           `long:"sample-rate" description:"Measure only every Kth invocation of each region in each thread, to lower the overhead for hot regions"`
+	Timeout     time.Duration `long:"timeout" description:"Stop profiling after the given duration (e.g. 30s) and report the results collected so far"`
+	Summary     bool          `short:"s" long:"summary" description:"Instead of printing results immediately, show an aggregated summary afterwards"`
+	Stats       bool          `long:"stats" description:"Summarize each region with its invocation count and the total, mean, and standard deviation of each event (implies --summary)"`
+	PerThread   bool          `long:"per-thread" description:"With --stats, also show each region's statistics for every thread that executed it (implies --stats)"`
+	PerCPU      bool          `long:"per-cpu" description:"With --stats, also show each region's statistics for every CPU it was entered on (implies --stats)"`
+	SubOverhead bool          `long:"subtract-overhead" description:"Measure the events counted by perforator's own work in an empty region, and subtract them from every invocation"`
+	Exclusive   bool          `long:"exclusive" description:"Subtract the counts of nested regions from the regions that enclose them (implies --summary)"`
+	Extremes    bool          `long:"extremes" description:"With --stats, also show the invocations with the smallest and largest value of each event, with their callers if captured (implies --stats)"`
+	Percentiles string        `long:"percentiles" default:"50,90,99" description:"Comma-separated percentiles of each event to show with --stats"`
+	SortKey     string        `long:"sort-key" description:"Key to sort summary tables with"`
+	ReverseSort bool          `long:"reverse-sort" description:"Reverse summary table sorting"`
+	Csv         bool          `long:"csv" description:"Write summary output in CSV format"`
+	Format      string        `long:"format" choice:"table" choice:"csv" choice:"pprof" choice:"folded" choice:"jsonl" choice:"json" choice:"chrome-trace" choice:"text" choice:"prometheus" description:"Output format (default: text, or table with --gated, --stats, --sort-key, --reverse-sort, or --interval); text writes a compact summary of each region with abbreviated counts after the target exits (implies --summary), table writes a table of each invocation as it completes, or of the totals with --summary, prometheus writes the totals of each region for node_exporter's textfile collector, replacing the --output file atomically (implies --summary), pprof writes a gzipped profile.proto and folded writes collapsed stacks for flamegraph.pl (both imply --summary), jsonl streams one JSON object per region invocation, json writes a versioned report with host information afterwards, and chrome-trace writes a timeline for chrome://tracing or Perfetto"`
+	JSONPretty  bool          `long:"json-pretty" description:"With --format json, indent the report by two spaces for each level of nesting instead of writing it on a single line"`
+	FoldedEvent string        `long:"folded-event" default:"instructions" description:"Event used to weight folded stacks"`
+	Output      string        `short:"o" long:"output" description:"Write summary output to file"`
+	Record      string        `long:"record" description:"Record every raw event of the trace (with counter snapshots) to a binary file, whose results can be shown again later with 'perforator [OPTIONS] replay FILE' without running the target (cannot be used with --gated or --threshold)"`
+	Stream      string        `long:"stream-socket" description:"Listen on a Unix socket at the given path and send each completed region invocation to the connected clients as a line of JSON (as with --format jsonl), for live monitoring"`
+	ChildStdout string        `long:"child-stdout" description:"Write the target's standard output to a file"`
+	ChildStderr string        `long:"child-stderr" description:"Write the target's standard error to a file"`
+	QuietChild  bool          `long:"quiet-child" description:"Discard the target's standard output and error"`
+	Env         []string      `long:"env" description:"Set an environment variable of the target as KEY=VAL (may be repeated); an empty value clears the environment inherited so far"`
+	Chdir       string        `long:"chdir" description:"Run the target in the given directory"`
+	DebugFile   string        `long:"debug-file" description:"Read symbols and debugging information from a separate debug file"`
+	VerifyAddrs bool          `long:"verify-addrs" description:"Check that address regions begin and end on instruction boundaries"`
+	NoDemangle  bool          `long:"no-demangle" description:"Show C++ and Rust symbol names in their mangled form"`
+	Verbose     []bool        `short:"V" long:"verbose" description:"Show what happens to the target and its regions; repeat (-VV) to also show the addresses and stops of tracing"`
+	Quiet       bool          `short:"q" long:"quiet" description:"Do not show notes and warnings, only the results and errors"`
+	Version     bool          `short:"v" long:"version" description:"Show version information"`
+	Help        bool          `short:"h" long:"help" description:"Show this help message"`
+}
+
+// splitEvents splits a comma-separated list of events, ignoring commas inside
+// raw event descriptors such as cpu/event=0xc4,umask=0x01/.
+func splitEvents(s string) []string {
+	var parts []string
+	inside := false
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '/':
+			inside = !inside
+		case ',':
+			if !inside {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// TargetEnv applies --env settings to the environment env. Each KEY=VAL
+// setting is added, replacing an inherited value, and an empty setting
+// clears the environment built so far.
+func TargetEnv(env, settings []string) ([]string, error) {
+	for _, s := range settings {
+		if s == "" {
+			env = []string{}
+			continue
+		}
+		if !strings.Contains(s, "=") {
+			return nil, fmt.Errorf("invalid environment setting %s: expected KEY=VAL", s)
+		}
+		env = append(env, s)
+	}
+	return env, nil
+}
+
+// ParsePercentiles parses a comma-separated list of percentiles between 0 and
+// 100.
+func ParsePercentiles(s string) ([]float64, error) {
+	var percentiles []float64
+	if s == "" {
+		return percentiles, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentile %s: %w", part, err)
+		}
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %s: must be between 0 and 100", part)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+// ParseThreshold parses a threshold of the form event=count, where the count
+// may be written in exponent notation, such as instructions=1e6.
+func ParseThreshold(s string) (perforator.Threshold, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return perforator.Threshold{}, fmt.Errorf("invalid threshold %s: expected event=count", s)
+	}
+	n, err := strconv.ParseFloat(s[i+1:], 64)
+	if err != nil || n < 1 || n >= math.MaxUint64 {
+		return perforator.Threshold{}, fmt.Errorf("invalid threshold count %s: must be a positive number", s[i+1:])
+	}
+	return perforator.Threshold{
+		Event: s[:i],
+		Count: uint64(n),
+	}, nil
 }
 
 // ParseEventList looks at a comma-separated list of events and returns the
 // perf Configurators corresponding to those events.
 func ParseEventList(s string) ([]perf.Configurator, error) {
-	parts := strings.Split(s, ",")
+	parts := splitEvents(s)
 	var configs []perf.Configurator
 	var errs []error
 	for _, ev := range parts {
@@ -1,24 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 
 	"acln.ro/perf"
 	"github.com/jessevdk/go-flags"
 	"github.com/zyedidia/perforator"
 	"github.com/zyedidia/perforator/utrace"
+	"golang.org/x/sys/unix"
 )
 
 func fatal(a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
+	// the target may still be traced if the error happened while it ran
+	utrace.KillAll()
 	os.Exit(1)
 }
 
+// warnf writes a warning or a note to standard error, unless --quiet is set.
+func warnf(format string, a ...interface{}) {
+	if !opts.Quiet {
+		fmt.Fprintf(os.Stderr, format, a...)
+	}
+}
+
 func must(desc string, err error) {
 	if err != nil {
 		fatal(desc, ":", err)
@@ -26,14 +42,95 @@ func must(desc string, err error) {
 }
 
 func metricsWriter(w io.Writer) perforator.MetricsWriter {
-	if opts.Csv {
+	if opts.Format == "csv" {
 		return perforator.NewCSVWriter(w)
 	}
 	return perforator.NewTableWriter(w)
 }
 
+// stopped returns true if err indicates that profiling was stopped early, and
+// warns that the results are partial.
+func stopped(err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		warnf("warning: timed out, target was stopped\n")
+	case errors.Is(err, context.Canceled):
+		warnf("warning: interrupted, target was stopped\n")
+	default:
+		return false
+	}
+	return true
+}
+
+// exit exits with the target's exit code if it exited unsuccessfully, or 0
+// otherwise.
+func exit(err error) {
+	var exitErr *perforator.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	os.Exit(0)
+}
+
+// createOutput returns the file given with --output, or stdout.
+func createOutput() io.WriteCloser {
+	if opts.Output == "" {
+		return os.Stdout
+	}
+	f, err := os.OpenFile(opts.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	must("open-output", err)
+	return f
+}
+
+// An atomicFile is written to a temporary file that replaces the output file
+// once it is closed, so that readers never see it partially written.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+// createAtomicOutput returns the file given with --output, written
+// atomically, or stdout.
+func createAtomicOutput() io.WriteCloser {
+	if opts.Output == "" {
+		return os.Stdout
+	}
+	dir, base := filepath.Split(opts.Output)
+	if dir == "" {
+		dir = "."
+	}
+	// the temporary file is in the same directory, so that renaming it
+	// does not cross file systems
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	must("open-output", err)
+	must("open-output", f.Chmod(0644))
+	return &atomicFile{f, opts.Output}
+}
+
+// Close closes the temporary file and renames it to the output file.
+func (f *atomicFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+// createChildOutput opens a file for one of the target's output streams.
+func createChildOutput(path string) *os.File {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	must("open-child-output", err)
+	return f
+}
+
 func main() {
 	runtime.LockOSThread()
+	defer func() {
+		if r := recover(); r != nil {
+			utrace.KillAll()
+			panic(r)
+		}
+	}()
 
 	flagparser := flags.NewParser(&opts, flags.PassDoubleDash|flags.PrintErrors)
 	flagparser.Usage = "[OPTIONS] COMMAND [ARGS]"
@@ -47,10 +144,38 @@ func main() {
 		os.Exit(0)
 	}
 
-	if opts.Verbose {
-		logger := log.New(os.Stdout, "INFO: ", 0)
+	if opts.Quiet && len(opts.Verbose) > 0 {
+		fatal("error: --quiet cannot be used with --verbose")
+	}
+	if len(opts.Verbose) > 0 {
+		// -V shows what happens to the target, and -VV the details of
+		// tracing as well
+		level, prefix := utrace.LevelInfo, "INFO: "
+		if len(opts.Verbose) > 1 {
+			level, prefix = utrace.LevelDebug, "DEBUG: "
+		}
+		logger := log.New(os.Stdout, prefix, 0)
 		perforator.SetLogger(logger)
+		perforator.SetLogLevel(level)
 		utrace.SetLogger(logger)
+		utrace.SetLogLevel(level)
+	}
+	perforator.SetDemangle(!opts.NoDemangle)
+
+	if opts.ListEvents {
+		for _, ev := range perforator.KnownEvents() {
+			support := "supported"
+			if !ev.Supported {
+				support = "not supported"
+			}
+			fmt.Printf("[%s event]: %s (%s)\n", ev.Type, ev.Name, support)
+		}
+		os.Exit(0)
+	}
+
+	if opts.PrintCaps {
+		perforator.ProbeCapabilities().WriteTo(metricsWriter(os.Stdout))
+		os.Exit(0)
 	}
 
 	if opts.List != "" {
@@ -64,6 +189,8 @@ func main() {
 			events = perforator.AvailableCacheEvents()
 		case "trace":
 			events = perforator.AvailableTraceEvents()
+		case "derived":
+			events = perforator.AvailableRatios()
 		default:
 			fatal("error: invalid event type", opts.List)
 		}
@@ -83,16 +210,91 @@ func main() {
 		os.Exit(0)
 	}
 
+	// 'perforator replay FILE' shows the results of a trace recorded with
+	// --record instead of running a target
+	var replay string
+	if args[0] == "replay" {
+		if len(args) != 2 {
+			fatal("error: replay expects a single trace log")
+		}
+		if opts.Record != "" || opts.DryRun || opts.Mode == "sample" || opts.Gated || opts.Threshold != "" || opts.SubOverhead {
+			fatal("error: replay cannot be used with --record, --dry-run, --mode sample, --gated, --threshold, or --subtract-overhead")
+		}
+		replay = args[1]
+	}
+
 	target := args[0]
 	args = args[1:]
 
+	if opts.Csv {
+		opts.Format = "csv"
+	}
+	if opts.RegionsFile != "" {
+		regions, err := perforator.ReadRegionsFile(opts.RegionsFile)
+		must("regions-file", err)
+		opts.Regions = append(opts.Regions, regions...)
+	}
+
 	perfOpts := perf.Options{
 		ExcludeKernel:     !opts.Kernel,
 		ExcludeHypervisor: !opts.Hypervisor,
 		ExcludeUser:       opts.ExcludeUser,
+		Inherit:           opts.Inherit,
+	}
+
+	binOpts := perforator.BinOptions{
+		DebugFile:   opts.DebugFile,
+		VerifyAddrs: opts.VerifyAddrs,
+	}
+
+	traceOpts := utrace.Options{
+		Callers:    opts.Callers,
+		FollowExec: opts.FollowExec,
+		Go:         opts.Go,
+		Limit:      opts.Limit,
+		SampleRate: opts.SampleRate,
+		Syscalls:   opts.ExcludeSys,
+	}
+	if opts.CPU >= 0 {
+		traceOpts.Affinity = &unix.CPUSet{}
+		traceOpts.Affinity.Set(opts.CPU)
+	}
+	if opts.HwBreak {
+		traceOpts.Breakpoints = utrace.HardwareBreakpoints
+	}
+	if opts.Trap != "" {
+		traceOpts.Trap, err = hex.DecodeString(strings.TrimPrefix(opts.Trap, "0x"))
+		must("trap-parse", err)
+	}
+	if opts.QuietChild {
+		opts.ChildStdout, opts.ChildStderr = os.DevNull, os.DevNull
+	}
+	if opts.ChildStdout != "" {
+		traceOpts.Stdout = createChildOutput(opts.ChildStdout)
+	}
+	if opts.ChildStderr != "" {
+		traceOpts.Stderr = createChildOutput(opts.ChildStderr)
+	}
+	if opts.Env != nil {
+		traceOpts.Env, err = TargetEnv(os.Environ(), opts.Env)
+		must("env-parse", err)
+	}
+	traceOpts.Dir = opts.Chdir
+
+	if opts.DryRun {
+		regions, err := perforator.Resolve(target, args, opts.Regions, opts.MaxRegions, traceOpts, binOpts)
+		if err != nil {
+			fatal(err)
+		}
+		perforator.WriteResolved(metricsWriter(os.Stdout), regions)
+		os.Exit(0)
 	}
 
 	var configs []perf.Configurator
+	if opts.NoCounters || replay != "" {
+		opts.Events = ""
+		opts.GroupEvents = nil
+	}
 	if len(opts.Events) >= 1 {
 		configs, err = ParseEventList(opts.Events)
 		if len(configs) == 0 {
@@ -108,37 +310,373 @@ func main() {
 		groups = append(groups, gconfigs)
 	}
 
+	ratios, err := perforator.ParseRatios(opts.Derived)
+	must("derived-parse", err)
+
+	if opts.UserKernel && (opts.Kernel || opts.ExcludeUser || opts.Cgroup != "" || opts.Gated || opts.Threshold != "" || opts.Mode == "sample") {
+		fatal("error: --user-kernel cannot be used with --kernel, --exclude-user, --cgroup, --gated, --threshold, or --mode sample")
+	}
+
+	if opts.Interval > 0 && (opts.Gated || opts.Threshold != "" || opts.NoCounters || opts.Mode == "sample") {
+		fatal("error: --interval cannot be used with --gated, --threshold, --no-counters, or --mode sample")
+	}
+
 	evs := perforator.Events{
-		Base:   configs,
-		Groups: groups,
+		Base:       configs,
+		Groups:     groups,
+		NoReset:    opts.NoReset,
+		Ratios:     ratios,
+		Branches:   opts.Branches,
+		Cgroup:     opts.Cgroup,
+		SplitModes: opts.UserKernel,
+		Interval:   opts.Interval,
 	}
 
-	var out io.Writer = os.Stdout
-	if opts.Summary {
-		out = ioutil.Discard
+	// Features that this system does not support are left out with a
+	// warning before the target is started, rather than failing once it is
+	// running.
+	if !opts.NoCounters && replay == "" {
+		caps := perforator.ProbeCapabilities()
+		warnings, err := caps.Degrade(&evs, &perfOpts)
+		must("capabilities", err)
+		if opts.Precise && caps.Precise == perf.CanHaveArbitrarySkid {
+			warnings = append(warnings, "precise sampling is not supported, samples may be skewed")
+			opts.Precise = false
+		}
+		for _, w := range warnings {
+			warnf("warning: %s\n", w)
+		}
+		configs = evs.Base
 	}
-	immediate := func() perforator.MetricsWriter {
-		return metricsWriter(out)
+
+	percentiles, err := ParsePercentiles(opts.Percentiles)
+	must("percentile-parse", err)
+
+	var threshold perforator.Threshold
+	if opts.Threshold != "" {
+		threshold, err = ParseThreshold(opts.Threshold)
+		must("threshold-parse", err)
+		threshold.Region = opts.ThresholdIn
+		opts.Gated = true
+	} else if opts.ThresholdIn != "" {
+		fatal("error: --threshold-region requires --threshold")
 	}
 
-	total, err := perforator.Run(target, args, opts.Regions, evs, perfOpts, immediate)
-	if err != nil {
+	if opts.Runs < 1 {
+		fatal("error: --runs must be at least 1")
+	}
+	if opts.Warmup < 0 || opts.WarmupRuns < 0 {
+		fatal("error: warm-up counts cannot be negative")
+	}
+
+	if opts.PerThread || opts.PerCPU || opts.Extremes {
+		opts.Stats = true
+	}
+	// the compact summary is shown by default, unless an option that only
+	// applies to the tables was given
+	if opts.Format == "" {
+		if opts.Gated || opts.Stats || opts.SortKey != "" || opts.ReverseSort || opts.Interval > 0 {
+			opts.Format = "table"
+		} else {
+			opts.Format = "text"
+		}
+	}
+	if opts.Exclusive && opts.Format == "jsonl" {
+		fatal("error: --exclusive cannot be used with --format jsonl")
+	}
+	if opts.JSONPretty && opts.Format != "json" {
+		fatal("error: --json-pretty can only be used with --format json")
+	}
+	if opts.Gated && (opts.Format != "table" && opts.Format != "csv" || opts.Stats || opts.Exclusive) {
+		fatal("error: --gated can only be used with --format table or csv, without --stats or --exclusive")
+	}
+	if opts.Gated || opts.Exclusive || opts.Stats || opts.Format == "pprof" || opts.Format == "folded" || opts.Format == "json" || opts.Format == "chrome-trace" || opts.Format == "text" || opts.Format == "prometheus" {
+		opts.Summary = true
+	}
+
+	// The first SIGINT/SIGTERM is forwarded to the target so that it can
+	// clean up and exit. A second one stops profiling and detaches from the
+	// target cleanly, and a third terminates perforator immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	forward := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, unix.SIGTERM)
+	go func() {
+		forward <- <-sigs
+		<-sigs
+		signal.Stop(sigs)
+		cancel()
+	}()
+	traceOpts.Signals = forward
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	if opts.Mode == "sample" {
+		if len(configs) == 0 {
+			fatal("error: sample mode requires an event")
+		}
+		precise := perf.CanHaveArbitrarySkid
+		if opts.Precise {
+			precise = perf.MustHaveZeroSkid
+		}
+		prof, err := perforator.Sample(ctx, target, args, configs[0], perforator.SampleOptions{
+			Period:    opts.SamplePer,
+			Freq:      opts.SampleFreq,
+			Precise:   precise,
+			Affinity:  traceOpts.Affinity,
+			Signals:   traceOpts.Signals,
+			Stdout:    traceOpts.Stdout,
+			Stderr:    traceOpts.Stderr,
+			Env:       traceOpts.Env,
+			Dir:       traceOpts.Dir,
+			DebugFile: binOpts.DebugFile,
+		}, perfOpts)
+		if !stopped(err) && !errors.As(err, new(*perforator.ExitError)) && err != nil {
+			fatal(err)
+		}
+		if opts.Precise && prof.Precise == perf.CanHaveArbitrarySkid {
+			warnf("warning: %s does not support precise sampling, samples may be skewed\n", prof.Event)
+		}
+		if prof.Lost > 0 {
+			warnf("warning: %d samples were lost\n", prof.Lost)
+		}
+		prof.WriteTo(metricsWriter(os.Stdout))
+		exit(err)
+	}
+
+	var overhead perforator.Metrics
+	if opts.SubOverhead {
+		overhead, err = perforator.Calibrate(ctx, evs, perfOpts, traceOpts)
+		if err != nil {
+			fatal(err)
+		}
+		warnf("note: subtracting an overhead of %s per invocation\n", overheadString(overhead))
+	}
+
+	// the invocations of every run of a recorded trace
+	var replayed []perforator.TotalMetrics
+	if replay != "" {
+		f, err := os.Open(replay)
+		must("replay", err)
+		replayed, err = perforator.ReadTraceLog(f)
+		f.Close()
+		must("replay", err)
+		// the warm-up runs were recorded along with the others
+		opts.Runs = len(replayed) - opts.WarmupRuns
+		if opts.Runs < 1 {
+			fatal(fmt.Sprintf("error: %s has %d runs, which are all warm-up runs", replay, len(replayed)))
+		}
+	}
+
+	var traceLog *os.File
+	if opts.Record != "" {
+		if opts.Gated || opts.Threshold != "" {
+			fatal("error: --record cannot be used with --gated or --threshold")
+		}
+		traceLog, err = os.Create(opts.Record)
+		must("record", err)
+		l, err := perforator.NewTraceLog(traceLog)
+		must("record", err)
+		perforator.SetTraceLog(l)
+	}
+
+	// index of the current run of the target
+	run := 0
+
+	var immediate func(perforator.NamedMetrics)
+	if opts.Format == "jsonl" {
+		// each invocation is written (and flushed) as soon as it completes
+		out := createOutput()
+		defer out.Close()
+		immediate = func(nm perforator.NamedMetrics) {
+			must("write-jsonl", nm.WriteJSON(out))
+		}
+		opts.Summary = false
+	} else if !opts.Summary {
+		immediate = func(nm perforator.NamedMetrics) {
+			nm.WriteTo(metricsWriter(os.Stdout))
+			nm.WriteSeries(metricsWriter(os.Stdout))
+		}
+	}
+
+	var stream *perforator.Stream
+	if opts.Stream != "" {
+		stream, err = perforator.NewStream(opts.Stream)
+		must("stream-socket", err)
+		write := immediate
+		immediate = func(nm perforator.NamedMetrics) {
+			must("write-stream", stream.Write(nm))
+			if write != nil {
+				write(nm)
+			}
+		}
+	}
+
+	// each run executes the target from scratch, and the invocations of all
+	// runs are aggregated, except those of warm-up runs and the warm-up
+	// invocations of each run
+	var total, gated perforator.TotalMetrics
+	for run = -opts.WarmupRuns; run < opts.Runs; run++ {
+		warmup := perforator.NewWarmup(opts.Warmup)
+		record := func(nm perforator.NamedMetrics) {
+			if run < 0 || !warmup.Keep(nm) {
+				return
+			}
+			nm.Run = run
+			if opts.SubOverhead {
+				nm.Metrics = nm.SubtractOverhead(overhead)
+			}
+			total = append(total, nm)
+			if immediate != nil {
+				immediate(nm)
+			}
+		}
+		if replayed != nil {
+			for _, nm := range replayed[run+opts.WarmupRuns] {
+				nm.Ratios = evs.Ratios
+				record(nm)
+			}
+		} else if opts.Threshold != "" {
+			var g perforator.TotalMetrics
+			g, _, err = perforator.RunUntil(ctx, target, args, opts.Regions, opts.MaxRegions, evs, perfOpts, traceOpts, binOpts, threshold, record)
+			var reached *perforator.ThresholdError
+			if errors.As(err, &reached) {
+				// the next run starts from scratch
+				err = nil
+				if run >= 0 {
+					warnf("note: run %d reached %d %s in %s after %d invocations (%s inside the region, %s in total)\n",
+						run+1, reached.Value, reached.Event, reached.Region, reached.Invocations, reached.Wall, reached.Elapsed)
+				}
+			} else if err == nil && run >= 0 {
+				warnf("warning: run %d exited before reaching the threshold\n", run+1)
+			}
+			if run >= 0 {
+				gated = addGated(gated, g)
+			}
+		} else if opts.Gated {
+			var g perforator.TotalMetrics
+			g, _, err = perforator.RunGated(ctx, target, args, opts.Regions, opts.MaxRegions, evs, perfOpts, traceOpts, binOpts, record)
+			if run >= 0 {
+				gated = addGated(gated, g)
+			}
+		} else {
+			_, err = perforator.Run(ctx, target, args, opts.Regions, opts.MaxRegions, evs, perfOpts, traceOpts, binOpts, record)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if stream != nil {
+		// the remaining records are sent before exiting
+		stream.Close()
+	}
+	if traceLog != nil {
+		// each run flushes its events as it ends
+		must("record", traceLog.Close())
+	}
+	if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+		fatal(err.Error() + "\n(use --no-counters to only measure wall-clock time)")
+	} else if !stopped(err) && !errors.As(err, new(*perforator.ExitError)) && err != nil {
 		fatal(err)
 	}
 
+	mismatched := make(map[string]int)
+	for _, nm := range total {
+		if nm.StackMismatch {
+			mismatched[nm.Name]++
+		}
+	}
+	for _, r := range total.Stats() {
+		if r.Incomplete > 0 {
+			warnf("warning: %d incomplete invocations of %s\n", r.Incomplete, r.Name)
+		}
+		if r.Anomalies > 0 {
+			warnf("warning: a counter went backwards during %d invocations of %s, which are left out of the statistics\n", r.Anomalies, r.Name)
+		}
+		if n := mismatched[r.Name]; n > 0 {
+			warnf("warning: the return address of %s was reached from another stack frame during %d invocations, which may include unrelated code\n", r.Name, n)
+		}
+		// warm-up invocations count towards the limit but are not recorded
+		if opts.Limit > 0 && r.Count >= opts.Limit-opts.Warmup {
+			warnf("note: measurement of %s stopped after %d invocations per run (--limit)\n", r.Name, opts.Limit)
+		}
+		if opts.SampleRate > 1 {
+			warnf("note: %d invocations of %s sampled (1 in %d measured)\n", r.Count, r.Name, opts.SampleRate)
+		}
+	}
+
+	if opts.Exclusive {
+		total = total.Exclusive()
+	}
 	if opts.Summary {
-		var out io.WriteCloser = os.Stdout
+		var out io.WriteCloser
+		if opts.Format == "prometheus" {
+			out = createAtomicOutput()
+		} else {
+			out = createOutput()
+		}
 
-		if opts.Output != "" {
-			f, err := os.OpenFile(opts.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "open-output :", err)
+		switch {
+		case opts.Gated:
+			gated.WriteTo(metricsWriter(out), opts.SortKey, opts.ReverseSort)
+		case opts.Format == "pprof":
+			must("write-pprof", total.WritePprof(out))
+		case opts.Format == "folded":
+			must("write-folded", total.WriteFolded(out, opts.FoldedEvent))
+		case opts.Format == "json":
+			if opts.JSONPretty {
+				must("write-json", total.WriteJSONIndent(out, evs.Labels(), "  "))
+			} else {
+				must("write-json", total.WriteJSON(out, evs.Labels()))
 			}
-			out = f
+		case opts.Format == "chrome-trace":
+			must("write-chrome-trace", total.WriteChromeTrace(out))
+		case opts.Format == "text":
+			must("write-text", total.WriteText(out))
+		case opts.Format == "prometheus":
+			must("write-prometheus", total.WritePrometheus(out))
+		case opts.Stats:
+			total.WriteStatsTo(metricsWriter(out), percentiles, opts.PerThread, opts.PerCPU)
+			if opts.Extremes {
+				total.WriteExtremesTo(metricsWriter(out))
+			}
+		default:
+			total.WriteTo(metricsWriter(out), opts.SortKey, opts.ReverseSort)
 		}
+		must("close-output", out.Close())
+	}
+
+	exit(err)
+}
+
+// addGated adds the gated totals of a run to those of the previous runs.
+func addGated(sum, run perforator.TotalMetrics) perforator.TotalMetrics {
+	if sum == nil {
+		return run
+	}
+	for i := 0; i < len(sum) && i < len(run); i++ {
+		sum[i].Wall += run[i].Wall
+		sum[i].Elapsed += run[i].Elapsed
+		for j := 0; j < len(sum[i].Results) && j < len(run[i].Results); j++ {
+			sum[i].Results[j].Value += run[i].Results[j].Value
+			sum[i].Results[j].Enabled += run[i].Results[j].Enabled
+			sum[i].Results[j].Running += run[i].Results[j].Running
+		}
+	}
+	return sum
+}
 
-		mv := metricsWriter(out)
-		total.WriteTo(mv, opts.SortKey, opts.ReverseSort)
-		out.Close()
+// overheadString describes the overhead of an invocation, such as
+// "instructions 12, wall-time 25µs".
+func overheadString(m perforator.Metrics) string {
+	var parts []string
+	for _, r := range m.Results {
+		parts = append(parts, fmt.Sprintf("%s %d", r.Label, r.ScaledValue()))
 	}
+	parts = append(parts, fmt.Sprintf("wall-time %s", m.Wall))
+	return strings.Join(parts, ", ")
 }
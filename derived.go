@@ -0,0 +1,110 @@
+package perforator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"acln.ro/perf"
+)
+
+// A Ratio is a metric derived from two events by dividing the count of one by
+// the other. Both events must be counted in the same group so that the ratio
+// is taken over a consistent window.
+type Ratio struct {
+	Label       string
+	Numerator   string
+	Denominator string
+	// Percent is set if the ratio is shown as a percentage.
+	Percent bool
+}
+
+var ratios = map[string]Ratio{
+	"cache-miss-rate":  {"cache-miss-rate", "cache-misses", "cache-references", true},
+	"branch-miss-rate": {"branch-miss-rate", "branch-misses", "branch-instructions", true},
+	"ipc":              {"ipc", "instructions", "cpu-cycles", false},
+}
+
+// AvailableRatios returns the names of the derived ratios.
+func AvailableRatios() []string {
+	var names []string
+	for name, r := range ratios {
+		names = append(names, fmt.Sprintf("%s (%s/%s)", name, r.Numerator, r.Denominator))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseRatios parses a comma-separated list of derived ratio names.
+func ParseRatios(s string) ([]Ratio, error) {
+	var rs []Ratio
+	if s == "" {
+		return rs, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		r, ok := ratios[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown derived ratio %s", name)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Value computes the ratio from the results of one invocation. It returns
+// false if either event was not counted or the denominator is zero.
+func (r Ratio) Value(results []Result) (float64, bool) {
+	return r.compute(func(label string) (float64, bool) {
+		for _, result := range results {
+			if result.Label == label {
+				return float64(result.ScaledValue()), true
+			}
+		}
+		return 0, false
+	})
+}
+
+func (r Ratio) compute(count func(label string) (float64, bool)) (float64, bool) {
+	num, ok := count(r.Numerator)
+	if !ok {
+		return 0, false
+	}
+	den, ok := count(r.Denominator)
+	if !ok || den == 0 {
+		return 0, false
+	}
+	return num / den, true
+}
+
+// Format returns the ratio's value as text, or "-" if it is not available.
+func (r Ratio) Format(v float64, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	if r.Percent {
+		return fmt.Sprintf("%.2f%%", 100*v)
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// checkRatios returns an error if the events of a ratio are not counted
+// together in one of the event groups.
+func checkRatios(rs []Ratio, groups [][]perf.Configurator) error {
+	for _, r := range rs {
+		grouped := false
+		for _, group := range groups {
+			var num, den bool
+			for _, c := range group {
+				var attr perf.Attr
+				c.Configure(&attr)
+				num = num || attr.Label == r.Numerator
+				den = den || attr.Label == r.Denominator
+			}
+			grouped = grouped || num && den
+		}
+		if !grouped {
+			return fmt.Errorf("derived ratio %s requires %s and %s in the same event group", r.Label, r.Numerator, r.Denominator)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package perforator
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/zyedidia/perforator/utrace"
+	"golang.org/x/sys/unix"
+)
+
+// A ResolvedRegion describes where the breakpoints of a region are placed in
+// the target. A region name may resolve to several regions, such as a
+// function along with its inlined copies.
+type ResolvedRegion struct {
+	Name string
+	// Id is the index of the region name in the list of regions given to
+	// Resolve.
+	Id int
+	// Location is the start of the region in the executable, with its
+	// address relative to the executable file.
+	Location
+	// Start is the address of the region's start in the target's address
+	// space.
+	Start uint64
+	// End is the address of the region's end in the target's address
+	// space, or 0 if the region ends when its function returns, since the
+	// return address is only known once the function is entered.
+	End uint64
+	// Rets are the addresses of the return instructions that end a
+	// rets: region.
+	Rets []uint64
+	// Lib is the shared library of a region in one. The addresses of such
+	// a region are only known once the target has loaded the library, so
+	// Start and End are 0.
+	Lib string
+	// Indirect is set if the region is an indirect function (such as
+	// memcpy in a static executable). It starts at the implementation that
+	// its resolver chooses when the target is loaded, so Start is 0, and
+	// Location is that of the resolver.
+	Indirect bool
+}
+
+// Resolve finds the regions with the given names in the target as Run would,
+// and returns the addresses of their breakpoints, without profiling the
+// target. If the target is a position-independent executable, it is started
+// (with the given arguments and traceopts) to find the address it is loaded
+// at, and killed before it executes any of its own code. Addresses differ
+// between runs of such a target, unless address space randomization is
+// disabled. The executables of the target are read with binopts.
+func Resolve(target string, args []string, regionNames []string, maxRegions int, traceopts utrace.Options, binopts BinOptions) ([]ResolvedRegion, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	bin, _, set, names, err := loadRegions(target, regionNames, maxRegions, traceopts.FollowExec, binopts)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset uint64
+	if bin != nil && bin.Pie() {
+		traceopts.Signals = nil
+		traceopts.FollowExec = false
+		traceopts.Exec = nil
+		prog, pid, err := utrace.NewProgram(bin, target, args, nil, traceopts)
+		if err != nil {
+			return nil, err
+		}
+		offset, err = bin.PieOffset(pid)
+		cleanup(prog, pid)
+		// reap the target, which was killed
+		unix.Wait4(pid, nil, unix.WALL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("pie-offset: %w", err)
+		}
+		debugf("%s: loaded at 0x%x\n", target, offset)
+	}
+
+	resolved := make([]ResolvedRegion, len(set.regions))
+	for i, reg := range set.regions {
+		r := ResolvedRegion{
+			Name: names[set.ids[i]],
+			Id:   set.ids[i],
+		}
+		switch reg := reg.(type) {
+		case *utrace.LibFuncRegion:
+			r.Lib = reg.Lib
+		case *utrace.FuncRegion:
+			r.Addr = reg.Addr
+		case *utrace.IfuncRegion:
+			r.Addr = reg.Resolver
+			r.Indirect = true
+		case *utrace.RetsRegion:
+			r.Addr = reg.Addr
+			for _, ret := range reg.Rets {
+				r.Rets = append(r.Rets, ret+offset)
+			}
+		case *utrace.AddressRegion:
+			r.Addr = reg.StartAddr
+			r.End = reg.EndAddr + offset
+		case *utrace.SpanRegion:
+			r.Addr = reg.StartAddr
+			r.End = reg.EndAddr + offset
+		}
+		if r.Lib == "" {
+			if !r.Indirect {
+				r.Start = r.Addr + offset
+			}
+			r.File, r.Line, _ = bin.PCToLine(r.Addr)
+		}
+		resolved[i] = r
+	}
+	return resolved, nil
+}
+
+// WriteResolved writes a table of the addresses of each region's start and
+// end, along with the source location of the start.
+func WriteResolved(table MetricsWriter, regions []ResolvedRegion) {
+	table.SetHeader([]string{"region", "start", "end", "location"})
+	for _, r := range regions {
+		if r.Lib != "" {
+			table.Append([]string{r.Name, "-", "-", fmt.Sprintf("resolved when %s is loaded", r.Lib)})
+			continue
+		}
+		end := "return"
+		if r.End != 0 {
+			end = fmt.Sprintf("0x%x", r.End)
+		} else if len(r.Rets) > 0 {
+			rets := make([]string, len(r.Rets))
+			for i, ret := range r.Rets {
+				rets[i] = fmt.Sprintf("0x%x", ret)
+			}
+			end = strings.Join(rets, " ")
+		}
+		loc := "?"
+		if r.File != "" {
+			loc = fmt.Sprintf("%s:%d", r.File, r.Line)
+		}
+		if r.Indirect {
+			table.Append([]string{r.Name, "-", end, "indirect function, chosen when loaded"})
+			continue
+		}
+		table.Append([]string{r.Name, fmt.Sprintf("0x%x", r.Start), end, loc})
+	}
+	table.Render()
+}
@@ -1,9 +1,11 @@
 package perforator
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"sort"
+	"strconv"
 	"strings"
 
 	"acln.ro/perf"
@@ -92,6 +94,166 @@ func cacheEvents() map[string]cacheEvent {
 	return events
 }
 
+// A rawEvent is a CPU-specific event given directly by its config value, and
+// the value of config1 for the events that take an extra register, such as
+// Intel's offcore response events (OFFCORE_RESPONSE_0 and _1), which select
+// what they count in an MSR that perf sets from config1.
+type rawEvent struct {
+	config  uint64
+	config1 uint64
+	label   string
+}
+
+func (e rawEvent) Configure(attr *perf.Attr) error {
+	attr.Type = perf.RawEvent
+	attr.Config = e.config
+	attr.Config1 = e.config1
+	attr.Label = e.label
+	return nil
+}
+
+// ErrSplitModesScope is returned when user and kernel counts are split for
+// cgroup or gated counters, which cannot count events in groups.
+var ErrSplitModesScope = errors.New("user and kernel counts cannot be split for cgroup or gated counters")
+
+// A modeEvent counts an event only in user code or only in kernel code, with
+// perf's :u or :k suffix added to its label.
+type modeEvent struct {
+	perf.Configurator
+	kernel bool
+}
+
+func (e modeEvent) Configure(attr *perf.Attr) error {
+	if err := e.Configurator.Configure(attr); err != nil {
+		return err
+	}
+	attr.Options.ExcludeUser = !e.kernel
+	attr.Options.ExcludeKernel = e.kernel
+	if e.kernel {
+		attr.Label += ":k"
+	} else {
+		attr.Label += ":u"
+	}
+	return nil
+}
+
+// splitModes replaces every event with a user and a kernel copy in the same
+// group. Each base event becomes a group of its two copies.
+func splitModes(events Events) Events {
+	split := func(group []perf.Configurator) []perf.Configurator {
+		var pairs []perf.Configurator
+		for _, c := range group {
+			pairs = append(pairs, modeEvent{c, false}, modeEvent{c, true})
+		}
+		return pairs
+	}
+	groups := make([][]perf.Configurator, 0, len(events.Base)+len(events.Groups))
+	for _, c := range events.Base {
+		groups = append(groups, split([]perf.Configurator{c}))
+	}
+	for _, g := range events.Groups {
+		groups = append(groups, split(g))
+	}
+	events.Base, events.Groups = nil, groups
+	events.SplitModes = false
+	return events
+}
+
+// Labels returns the labels of the events, the Base events followed by each
+// group, with the user and kernel copies of every event if SplitModes is set.
+// Events that the CPU turns out not to support are included.
+func (e Events) Labels() []string {
+	if e.SplitModes {
+		e = splitModes(e)
+	}
+	labels := []string{}
+	add := func(c perf.Configurator) {
+		attr := new(perf.Attr)
+		if err := c.Configure(attr); err == nil {
+			labels = append(labels, attr.Label)
+		}
+	}
+	for _, c := range e.Base {
+		add(c)
+	}
+	for _, g := range e.Groups {
+		for _, c := range g {
+			add(c)
+		}
+	}
+	return labels
+}
+
+// raw event descriptor fields and their position in the config (x86 layout)
+var rawEventFields = map[string]uint{
+	"event": 0,
+	"umask": 8,
+	"edge":  18,
+	"inv":   23,
+	"cmask": 24,
+}
+
+// raw event descriptor fields that are written to config1 (x86 layout): the
+// offcore response MSR value of OFFCORE_RESPONSE events, and the latency
+// threshold of load latency events
+var rawEventFields1 = map[string]uint{
+	"config1":     0,
+	"offcore_rsp": 0,
+	"ldlat":       0,
+}
+
+// parseRawEvent parses a raw event written either as rUUEE (hexadecimal
+// umask and event number, as in perf) or as a descriptor such as
+// 'cpu/event=0xc4,umask=0x01/' or 'event=0xc4,umask=0x01', which may also
+// set config1 (as 'cpu/event=0xb7,umask=0x01,offcore_rsp=0x10001/'). The
+// boolean result is false if the name is not a raw event.
+func parseRawEvent(name string) (rawEvent, bool, error) {
+	if len(name) > 1 && name[0] == 'r' {
+		config, err := strconv.ParseUint(name[1:], 16, 64)
+		if err == nil {
+			return rawEvent{
+				config: config,
+				label:  name,
+			}, true, nil
+		}
+	}
+
+	desc := name
+	if strings.HasPrefix(desc, "cpu/") && strings.HasSuffix(desc, "/") {
+		desc = desc[len("cpu/") : len(desc)-1]
+	} else if !strings.HasPrefix(desc, "event=") {
+		return rawEvent{}, false, nil
+	}
+
+	var config, config1 uint64
+	for _, term := range strings.Split(desc, ",") {
+		parts := strings.SplitN(term, "=", 2)
+		dst := &config
+		shift, ok := rawEventFields[parts[0]]
+		if !ok {
+			dst = &config1
+			shift, ok = rawEventFields1[parts[0]]
+		}
+		if !ok {
+			return rawEvent{}, true, fmt.Errorf("raw event %s: unknown field %s", name, parts[0])
+		}
+		val := uint64(1)
+		if len(parts) == 2 {
+			var err error
+			val, err = strconv.ParseUint(parts[1], 0, 64)
+			if err != nil {
+				return rawEvent{}, true, fmt.Errorf("raw event %s: %w", name, err)
+			}
+		}
+		*dst |= val << shift
+	}
+	return rawEvent{
+		config:  config,
+		config1: config1,
+		label:   name,
+	}, true, nil
+}
+
 // IsAvailable returns true if the given event is available on the current
 // system.
 func IsAvailable(ev perf.Configurator) bool {
@@ -145,6 +307,51 @@ func AvailableCacheEvents() []string {
 	return events
 }
 
+// An EventSupport records whether a named event is supported on the current
+// system.
+type EventSupport struct {
+	Name      string
+	Type      string
+	Supported bool
+}
+
+// KnownEvents returns every named hardware, software, and cache event, along
+// with whether it can be opened on the current system. Unlike the Available
+// functions, unsupported events are included.
+func KnownEvents() []EventSupport {
+	var events []EventSupport
+	add := func(typ string, names []string, config func(string) perf.Configurator) {
+		sort.Strings(names)
+		for _, name := range names {
+			events = append(events, EventSupport{
+				Name:      name,
+				Type:      typ,
+				Supported: IsAvailable(config(name)),
+			})
+		}
+	}
+
+	var names []string
+	for name := range hardwareEvents {
+		names = append(names, name)
+	}
+	add("hardware", names, func(name string) perf.Configurator { return hardwareEvents[name] })
+
+	names = nil
+	for name := range softwareEvents {
+		names = append(names, name)
+	}
+	add("software", names, func(name string) perf.Configurator { return softwareEvents[name] })
+
+	cevs := cacheEvents()
+	names = nil
+	for name := range cevs {
+		names = append(names, name)
+	}
+	add("cache", names, func(name string) perf.Configurator { return cevs[name] })
+	return events
+}
+
 // AvailableTraceEvents returns the list of available trace events.
 func AvailableTraceEvents() []string {
 	events, err := ioutil.ReadFile(traceDir + "/available_events")
@@ -157,7 +364,9 @@ func AvailableTraceEvents() []string {
 }
 
 // NameToConfig converts a string representation of an event to a perf
-// configurator.
+// configurator. Besides the named events, raw CPU-specific events may be given
+// as rUUEE (hexadecimal umask and event number) or as a descriptor like
+// cpu/event=0xc4,umask=0x01/.
 func NameToConfig(name string) (perf.Configurator, error) {
 	if ev, ok := hardwareEvents[name]; ok {
 		return ev, nil
@@ -165,6 +374,8 @@ func NameToConfig(name string) (perf.Configurator, error) {
 		return ev, nil
 	} else if ev, ok := cacheEvents()[name]; ok {
 		return ev, nil
+	} else if ev, ok, err := parseRawEvent(name); ok {
+		return ev, err
 	} else if strings.Contains(name, ":") {
 		parts := strings.Split(name, ":")
 		subsystem, event := parts[0], parts[1]
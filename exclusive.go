@@ -0,0 +1,82 @@
+package perforator
+
+import (
+	"sort"
+	"time"
+)
+
+// Exclusive returns the metrics with the counts of nested regions subtracted
+// from the regions that enclose them, so that each invocation only holds what
+// it executed itself. An invocation's nested invocations are the ones that
+// ran on the same thread while it was active and were not nested in another
+// invocation themselves. The events, elapsed time, and wall-clock time are
+// subtracted (events after scaling for multiplexing), and never drop below
+// zero. The metrics are returned in the same order.
+func (t TotalMetrics) Exclusive() TotalMetrics {
+	excl := make(TotalMetrics, len(t))
+	copy(excl, t)
+
+	type thread struct {
+		run, tid int
+	}
+	threads := make(map[thread][]int)
+	for i, nm := range t {
+		th := thread{nm.Run, nm.Tid}
+		threads[th] = append(threads[th], i)
+	}
+
+	for _, idx := range threads {
+		// enclosing invocations start first, or at the same time and end
+		// later
+		sort.SliceStable(idx, func(i, j int) bool {
+			a, b := t[idx[i]], t[idx[j]]
+			if a.Start != b.Start {
+				return a.Start < b.Start
+			}
+			return a.End > b.End
+		})
+		var open []int
+		for _, i := range idx {
+			for len(open) > 0 && t[open[len(open)-1]].End <= t[i].Start {
+				open = open[:len(open)-1]
+			}
+			if len(open) > 0 {
+				parent := open[len(open)-1]
+				excl[parent].Metrics = excl[parent].subtract(t[i].Metrics)
+			}
+			open = append(open, i)
+		}
+	}
+	return excl
+}
+
+// subtract returns the metrics with the events and times of n removed.
+func (m Metrics) subtract(n Metrics) Metrics {
+	sub := func(a, b time.Duration) time.Duration {
+		if b > a {
+			return 0
+		}
+		return a - b
+	}
+
+	results := make([]Result, len(m.Results))
+	for i, r := range m.Results {
+		results[i] = r
+		for _, c := range n.Results {
+			if c.Label != r.Label || r.Running == 0 {
+				continue
+			}
+			v, cv := r.ScaledValue(), c.ScaledValue()
+			if cv > v {
+				cv = v
+			}
+			// the scaled count is kept as the raw value
+			results[i].Value = v - cv
+			results[i].Running = r.Enabled
+		}
+	}
+	m.Results = results
+	m.Elapsed = sub(m.Elapsed, n.Elapsed)
+	m.Wall = sub(m.Wall, n.Wall)
+	return m
+}
@@ -0,0 +1,65 @@
+package perforator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// weight returns the value of the given event, or the elapsed time in
+// nanoseconds for "time-elapsed" and "wall-time".
+func (m Metrics) weight(event string) (int64, bool) {
+	if event == "time-elapsed" {
+		return int64(m.Elapsed), true
+	} else if event == "wall-time" {
+		return int64(m.Wall), true
+	}
+	for _, r := range m.Results {
+		if r.Label == event {
+			return int64(r.ScaledValue()), true
+		}
+	}
+	return 0, false
+}
+
+// WriteFolded writes the metrics in the collapsed stack format used by
+// flamegraph.pl: one 'outer;inner count' line per distinct region nesting,
+// weighted by the given event. Nested regions are subtracted from their
+// parents so that each line holds the region's exclusive count. Incomplete
+// invocations are left out.
+func (t TotalMetrics) WriteFolded(w io.Writer, event string) error {
+	weights := make(map[string]int64)
+	for _, nm := range t {
+		if nm.Incomplete {
+			continue
+		}
+		v, ok := nm.weight(event)
+		if !ok {
+			return fmt.Errorf("folded: event %s not recorded", event)
+		}
+
+		path := append(append([]string{}, nm.Parents...), nm.Name)
+		weights[strings.Join(path, ";")] += v
+		if len(nm.Parents) > 0 {
+			weights[strings.Join(nm.Parents, ";")] -= v
+		}
+	}
+
+	paths := make([]string, 0, len(weights))
+	for p := range weights {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	bw := bufio.NewWriter(w)
+	for _, p := range paths {
+		v := weights[p]
+		if v < 0 {
+			v = 0
+		}
+		fmt.Fprintf(bw, "%s %d\n", p, v)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,190 @@
+package perforator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"acln.ro/perf"
+)
+
+// ErrGatedScope is returned when gated counters are requested along with
+// cgroup counters, or with event groups on a kernel that cannot read inherited
+// groups (see Capabilities.InheritGroup), since gated counters are inherited
+// by every thread of the target.
+var ErrGatedScope = errors.New("gated counters cannot be used with cgroup counters, or with event groups on this kernel")
+
+// A Threshold stops profiling once the gated count of an event in a region
+// (see RunUntil) reaches a total.
+type Threshold struct {
+	// Region is the name of the region, after selectors are expanded. If
+	// it is empty, the first region is used.
+	Region string
+	// Event is the label of one of the Base events.
+	Event string
+	Count uint64
+}
+
+// A ThresholdError reports that the target was stopped because a threshold
+// was reached. The metrics returned with it are those collected until then.
+type ThresholdError struct {
+	Threshold
+	// Value is the count of the event when the threshold was checked,
+	// which may exceed Count by the events of the last invocation.
+	Value uint64
+	// Invocations is the number of invocations of the region that were
+	// measured, Wall is the time that any thread was inside it, and Elapsed
+	// is the time since the target was started.
+	Invocations int
+	Wall        time.Duration
+	Elapsed     time.Duration
+}
+
+func (e *ThresholdError) Error() string {
+	return fmt.Sprintf("threshold reached: %d %s in %s after %d invocations (%s inside the region, %s in total)",
+		e.Value, e.Event, e.Region, e.Invocations, e.Wall, e.Elapsed)
+}
+
+// A gate counts the events of each region with a single set of counters that
+// every thread and child process of the target inherits. The counters of a
+// region are enabled while any thread is inside it, and are never reset, so
+// they accumulate the events of all of its invocations.
+type gate struct {
+	profilers []*MultiProfiler
+	// number of threads inside each region
+	inside []int
+	// when the first thread entered each region, and the total time that
+	// any thread was inside it
+	opened []time.Duration
+	wall   []time.Duration
+}
+
+// openGate opens the counters of n regions for the process pid, which must
+// not have started any threads yet, since only threads created after the
+// counters are opened inherit them. Each group of events is opened as an
+// inherited group.
+func openGate(pid, cpu, n int, attrs []*perf.Attr, groups [][]*perf.Attr) (*gate, error) {
+	g := &gate{
+		inside: make([]int, n),
+		opened: make([]time.Duration, n),
+		wall:   make([]time.Duration, n),
+	}
+	for i := 0; i < n; i++ {
+		prof, err := NewMultiProfiler(inheritAttrs(attrs), pid, cpu)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("gate: %w", err)
+		}
+		g.profilers = append(g.profilers, prof)
+		for _, gattrs := range groups {
+			gprof, err := NewGroupProfiler(inheritAttrs(gattrs), pid, cpu)
+			if err != nil {
+				g.Close()
+				return nil, fmt.Errorf("gate: %w", err)
+			}
+			prof.profilers = append(prof.profilers, gprof)
+		}
+	}
+	return g, nil
+}
+
+// inheritAttrs returns copies of attrs that are inherited by new threads.
+func inheritAttrs(attrs []*perf.Attr) []*perf.Attr {
+	inherited := make([]*perf.Attr, len(attrs))
+	for i, attr := range attrs {
+		a := *attr
+		a.Options.Inherit = true
+		inherited[i] = &a
+	}
+	return inherited
+}
+
+// enter records that a thread entered region id, enabling its counters if no
+// other thread is inside.
+func (g *gate) enter(id int, now time.Duration) {
+	g.inside[id]++
+	if g.inside[id] == 1 {
+		g.opened[id] = now
+		g.profilers[id].Enable()
+	}
+}
+
+// leave records that a thread left region id, disabling its counters if it
+// was the last thread inside.
+func (g *gate) leave(id int, now time.Duration) {
+	if g.inside[id] == 0 {
+		return
+	}
+	g.inside[id]--
+	if g.inside[id] == 0 {
+		g.profilers[id].Disable()
+		g.wall[id] += now - g.opened[id]
+	}
+}
+
+// find returns the index of the threshold's region in names, filling in the
+// region if it is empty, and checks that its event is one of the events.
+func (t *Threshold) find(names []string, events []perf.Configurator) (int, error) {
+	if t.Region == "" && len(names) > 0 {
+		t.Region = names[0]
+	}
+	id := -1
+	for i, name := range names {
+		if name == t.Region {
+			id = i
+			break
+		}
+	}
+	if id < 0 {
+		return -1, fmt.Errorf("threshold: no region %s", t.Region)
+	}
+	for _, c := range events {
+		var attr perf.Attr
+		c.Configure(&attr)
+		if attr.Label == t.Event {
+			return id, nil
+		}
+	}
+	return -1, fmt.Errorf("threshold: %s is not one of the counted events", t.Event)
+}
+
+// count returns the current value of the event with the given label in region
+// id, including the events of any thread that is still inside it.
+func (g *gate) count(id int, label string) uint64 {
+	for _, r := range g.profilers[id].Metrics().Results {
+		if r.Label == label {
+			return r.ScaledValue()
+		}
+	}
+	return 0
+}
+
+// totals returns the counts of each region. Inherited counters include the
+// counts of exited threads, so this should be called once the target has
+// exited.
+func (g *gate) totals(names []string, locs []Location) TotalMetrics {
+	total := make(TotalMetrics, 0, len(g.profilers))
+	for i, prof := range g.profilers {
+		m := prof.Metrics()
+		m.Wall = g.wall[i]
+		total = append(total, NamedMetrics{
+			Metrics: m,
+			Name:    names[i],
+			Id:      i,
+			Loc:     locs[i],
+			CPU:     -1,
+		})
+	}
+	return total
+}
+
+// Close closes the counters of every region.
+func (g *gate) Close() error {
+	var errs []error
+	for _, prof := range g.profilers {
+		if err := prof.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
@@ -5,6 +5,7 @@ go 1.15
 require (
 	acln.ro/perf v0.0.0-20200512125540-4d8e4e566115
 	github.com/blang/semver v3.5.1+incompatible
+	github.com/ianlancetaylor/demangle v0.0.0-20220319035150-800ac71e25c2
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/olekukonko/tablewriter v0.0.4
 	golang.org/x/sys v0.0.0-20201231184435-2d18734c6014
@@ -0,0 +1,90 @@
+package perforator
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// number of sub-buckets per power of two, as a power of two
+const histSubBits = 5
+
+// A Histogram counts values in logarithmic buckets so that quantiles can be
+// estimated with bounded memory, no matter how many values are added. Each
+// power of two is split into 32 buckets, so a quantile is within about 3% of
+// the true value. Values below 64 are counted exactly.
+type Histogram struct {
+	counts map[int]uint64
+	n      uint64
+	max    uint64
+}
+
+func histBucket(v uint64) int {
+	if v < 2<<histSubBits {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histSubBits - 1
+	return (shift+1)<<histSubBits + int(v>>uint(shift)) - 1<<histSubBits
+}
+
+// histRange returns the smallest value in a bucket and the bucket's width.
+func histRange(b int) (uint64, uint64) {
+	if b < 2<<histSubBits {
+		return uint64(b), 1
+	}
+	shift := uint(b>>histSubBits - 1)
+	top := uint64(b&(1<<histSubBits-1)) + 1<<histSubBits
+	return top << shift, 1 << shift
+}
+
+// Add a value to the histogram.
+func (h *Histogram) Add(v uint64) {
+	if h.counts == nil {
+		h.counts = make(map[int]uint64)
+	}
+	h.counts[histBucket(v)]++
+	h.n++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// Max returns the largest value added.
+func (h *Histogram) Max() uint64 {
+	return h.max
+}
+
+// Quantile estimates the value below which the fraction q (between 0 and 1)
+// of the values fall. It returns 0 if the histogram is empty.
+func (h *Histogram) Quantile(q float64) uint64 {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.n)))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank >= h.n {
+		return h.max
+	}
+
+	buckets := make([]int, 0, len(h.counts))
+	for b := range h.counts {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+
+	var seen uint64
+	for _, b := range buckets {
+		seen += h.counts[b]
+		if seen >= rank {
+			low, width := histRange(b)
+			v := low + width/2
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,32 @@
+/*
+ * Marker functions that delimit a region for perforator.
+ *
+ * Call perforator_begin() where a measurement should start and
+ * perforator_end() where it should stop, and select the region with
+ *
+ *     perforator -r markers ./program
+ *
+ * The markers do nothing. They are weak, so the header may be included in
+ * several files of a program, and never inlined, so that every call remains
+ * in the program for perforator to place its breakpoints on.
+ */
+#ifndef PERFORATOR_H
+#define PERFORATOR_H
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+__attribute__((weak, noinline)) void perforator_begin(void) {
+    __asm__ volatile("" ::: "memory");
+}
+
+__attribute__((weak, noinline)) void perforator_end(void) {
+    __asm__ volatile("" ::: "memory");
+}
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
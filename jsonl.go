@@ -0,0 +1,197 @@
+package perforator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// JSONSchema is the version of the layout of the JSON report written by
+// TotalMetrics.WriteJSON. It is incremented whenever fields are renamed,
+// removed, or change meaning, so that consumers can adapt.
+const JSONSchema = 1
+
+// invocationRecord is the JSON form of a single region invocation.
+type invocationRecord struct {
+	Region   string             `json:"region"`
+	Id       int                `json:"id"`
+	Tid      int                `json:"tid"`
+	CPU      int                `json:"cpu"`
+	Start    int64              `json:"start_ns"`
+	End      int64              `json:"end_ns"`
+	Elapsed  int64              `json:"elapsed_ns"`
+	Counters map[string]uint64  `json:"counters"`
+	Derived  map[string]float64 `json:"derived,omitempty"`
+	// Incomplete is set if the invocation never reached the region's end.
+	Incomplete bool `json:"incomplete,omitempty"`
+	// StackMismatch is set if the region's end was reached from another
+	// stack frame while the invocation was active.
+	StackMismatch bool `json:"stack_mismatch,omitempty"`
+	// Anomaly is set if a counter went backwards, so its count is 0.
+	Anomaly bool `json:"anomaly,omitempty"`
+	// Series are the counts of each interval, if the counters were sampled
+	// at intervals.
+	Series []bucketRecord `json:"series,omitempty"`
+}
+
+// bucketRecord is the JSON form of an interval of an invocation. Start is the
+// time since the region was entered.
+type bucketRecord struct {
+	Start    int64              `json:"start_ns"`
+	Wall     int64              `json:"wall_ns"`
+	Elapsed  int64              `json:"elapsed_ns"`
+	Counters map[string]uint64  `json:"counters"`
+	Derived  map[string]float64 `json:"derived,omitempty"`
+}
+
+// WriteJSON writes the metrics of the invocation as a single line of JSON,
+// with the region name and id, the thread that executed it and the CPU it
+// entered the region on, its CLOCK_MONOTONIC entry and exit times, the value
+// of each event, the derived ratios that could be computed, and the counts of
+// each interval under "series" if the counters were sampled at intervals.
+func (m NamedMetrics) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m.record())
+}
+
+func (m NamedMetrics) record() invocationRecord {
+	rec := invocationRecord{
+		Region:        m.Name,
+		Id:            m.Id,
+		Tid:           m.Tid,
+		CPU:           m.CPU,
+		Start:         int64(m.Start),
+		End:           int64(m.End),
+		Elapsed:       int64(m.Elapsed),
+		Incomplete:    m.Incomplete,
+		StackMismatch: m.StackMismatch,
+		Anomaly:       m.Anomalous(),
+	}
+	rec.Counters, rec.Derived = counters(m.Metrics)
+	for _, b := range m.Series {
+		br := bucketRecord{
+			Start:   int64(b.Start),
+			Wall:    int64(b.Wall),
+			Elapsed: int64(b.Elapsed),
+		}
+		br.Counters, br.Derived = counters(b.Metrics)
+		rec.Series = append(rec.Series, br)
+	}
+	return rec
+}
+
+// counters returns the value of each event of m, and of the derived ratios
+// that could be computed.
+func counters(m Metrics) (map[string]uint64, map[string]float64) {
+	values := make(map[string]uint64)
+	var derived map[string]float64
+	for _, r := range m.Results {
+		values[r.Label] = r.ScaledValue()
+	}
+	for _, r := range m.Ratios {
+		if v, ok := r.Value(m.Results); ok {
+			if derived == nil {
+				derived = make(map[string]float64)
+			}
+			derived[r.Label] = v
+		}
+	}
+	return values, derived
+}
+
+// A Host describes the system that the metrics were collected on.
+type Host struct {
+	CPU    string   `json:"cpu"`
+	Kernel string   `json:"kernel"`
+	Events []string `json:"events"`
+}
+
+// jsonReport is the top-level object of the JSON report.
+type jsonReport struct {
+	Schema  int                `json:"schema"`
+	Host    Host               `json:"host"`
+	Regions []invocationRecord `json:"regions"`
+}
+
+// ReadHost returns the CPU model and kernel release of this system. Events is
+// left empty.
+func ReadHost() Host {
+	var h Host
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		h.Kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+	h.CPU = cpuModel(f)
+	return h
+}
+
+// cpuModel returns the model of the first CPU listed in r, in the format of
+// /proc/cpuinfo. On arm64, which does not list the model's name, the CPU is
+// described by the implementer and part numbers instead, as
+// "implementer 0x41 part 0xd0c".
+func cpuModel(r io.Reader) string {
+	var implementer, part string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			if implementer != "" && part != "" {
+				// the end of the first CPU's entry
+				break
+			}
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "model name":
+			return value
+		case "CPU implementer":
+			implementer = value
+		case "CPU part":
+			part = value
+		}
+	}
+	if implementer == "" {
+		return ""
+	}
+	return fmt.Sprintf("implementer %s part %s", implementer, part)
+}
+
+// WriteJSON writes every invocation as a single JSON object with the schema
+// version, a description of the host including the labels of the events that
+// were configured (see Events.Labels), and the invocation records in the same
+// form as NamedMetrics.WriteJSON under "regions". The report is written
+// compactly, on a single line.
+func (t TotalMetrics) WriteJSON(w io.Writer, events []string) error {
+	return t.WriteJSONIndent(w, events, "")
+}
+
+// WriteJSONIndent writes the report of WriteJSON with each field on its own
+// line, indented by the given string for every level of nesting. The report
+// is the same as the compact one once decoded.
+func (t TotalMetrics) WriteJSONIndent(w io.Writer, events []string, indent string) error {
+	report := jsonReport{
+		Schema:  JSONSchema,
+		Host:    ReadHost(),
+		Regions: make([]invocationRecord, 0, len(t)),
+	}
+	report.Host.Events = events
+	if report.Host.Events == nil {
+		report.Host.Events = []string{}
+	}
+	for _, nm := range t {
+		report.Regions = append(report.Regions, nm.record())
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", indent)
+	return enc.Encode(report)
+}
@@ -0,0 +1,138 @@
+package perforator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"acln.ro/perf"
+	"github.com/zyedidia/perforator/bininfo"
+)
+
+// A Branch is a call recorded in the Last Branch Record, from the function
+// containing the call instruction to the function that was called.
+type Branch struct {
+	From string
+	To   string
+}
+
+func (b Branch) String() string {
+	return b.From + " -> " + b.To
+}
+
+// joinBranches writes the calls as a comma-separated list.
+func joinBranches(branches []Branch) string {
+	calls := make([]string, len(branches))
+	for i, b := range branches {
+		calls[i] = b.String()
+	}
+	return strings.Join(calls, ", ")
+}
+
+// sample period of a branch recorder that is not armed, long enough that it
+// never overflows
+const lbrIdlePeriod = 1 << 62
+
+// A branchRecorder keeps the Last Branch Record of a thread in call-stack
+// mode, so that the kernel saves and restores it when the thread is switched
+// out (for example while it is stopped by ptrace). When armed, one sample
+// with the recorded calls is taken after the next instruction.
+type branchRecorder struct {
+	ev *perf.Event
+}
+
+func lbrAttr() *perf.Attr {
+	attr := &perf.Attr{
+		SampleFormat: perf.SampleFormat{
+			Tid:         true,
+			BranchStack: true,
+		},
+		BranchSampleFormat: perf.BranchSampleFormat{
+			Privilege: perf.BranchPrivilegeUser,
+			Sample:    perf.BranchSampleCallStack,
+		},
+		Options: perf.Options{
+			ExcludeKernel:     true,
+			ExcludeHypervisor: true,
+		},
+	}
+	perf.Instructions.Configure(attr)
+	attr.SetSamplePeriod(lbrIdlePeriod)
+	return attr
+}
+
+// checkLBR returns an error if the Last Branch Record cannot be used in
+// call-stack mode, because the CPU does not have one or it is not exposed
+// (in most virtual machines, for example).
+func checkLBR() error {
+	attr := lbrAttr()
+	ev, err := perf.Open(attr, perf.CallingThread, perf.AnyCPU, nil)
+	if err != nil {
+		return openError(attr, err)
+	}
+	return ev.Close()
+}
+
+func newBranchRecorder(tid, cpu int) (*branchRecorder, error) {
+	ev, err := perf.Open(lbrAttr(), tid, cpu, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open-lbr: %w", err)
+	}
+	err = ev.MapRing()
+	if err != nil {
+		ev.Close()
+		return nil, fmt.Errorf("map-ring: %w", err)
+	}
+	return &branchRecorder{ev}, nil
+}
+
+// arm takes a sample after the thread's next instruction. The event is
+// disabled once the sample is taken, so it must be collected before arming
+// again.
+func (b *branchRecorder) arm() error {
+	if err := b.ev.UpdatePeriod(1); err != nil {
+		return err
+	}
+	return b.ev.Refresh(1)
+}
+
+// collect returns the calls of the latest sample (innermost first), and
+// resumes recording without sampling. The calls made while the recorder was
+// disabled are missing from the next sample.
+func (b *branchRecorder) collect() ([]perf.BranchEntry, error) {
+	var calls []perf.BranchEntry
+	for b.ev.HasRecord() {
+		rec, err := b.ev.ReadRecord(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		switch rec := rec.(type) {
+		case *perf.SampleRecord:
+			calls = rec.BranchStack
+		case *perf.LostRecord:
+			calls = nil
+		}
+	}
+	if err := b.ev.UpdatePeriod(lbrIdlePeriod); err != nil {
+		return nil, err
+	}
+	return calls, b.ev.Enable()
+}
+
+func (b *branchRecorder) Close() error {
+	return b.ev.Close()
+}
+
+// symbolizeBranches converts the first n recorded calls to locations in bin
+// (see symbolizeAddr), given the load offset of bin. Addresses outside of
+// its code (in shared libraries, for example) are left as they are.
+func symbolizeBranches(bin *bininfo.BinFile, entries []perf.BranchEntry, off uint64, n int) []Branch {
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	branches := make([]Branch, len(entries))
+	for i, e := range entries {
+		branches[i] = Branch{symbolizeAddr(bin, e.From, off), symbolizeAddr(bin, e.To, off)}
+	}
+	return branches
+}
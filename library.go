@@ -0,0 +1,141 @@
+package perforator
+
+import (
+	"context"
+	"time"
+
+	"acln.ro/perf"
+	"github.com/zyedidia/perforator/utrace"
+)
+
+// Options configures how a Perforator measures its regions. The zero value
+// counts no events (only wall-clock time) in user code.
+type Options struct {
+	// Events to count in each region.
+	Events Events
+	// Include kernel and hypervisor code in the counts.
+	Kernel     bool
+	Hypervisor bool
+	// Count events in threads and processes created while a region is
+	// active.
+	Inherit bool
+	// Capture the call stack each time a region is entered.
+	Callers bool
+	// Run the target this many times and aggregate the results (0 is the
+	// same as 1).
+	Runs int
+	// Discard the first Warmup invocations of each region in each run.
+	Warmup int
+	// Stop profiling and kill the target after this long (0 for no limit).
+	Timeout time.Duration
+	// Separate debug file of the binary, if it is stripped (see
+	// BinOptions).
+	DebugFile string
+	// Check that address regions begin and end on instruction boundaries.
+	VerifyAddrs bool
+	// Subtract the overhead of a region invocation, measured with Calibrate
+	// before the target is run, from every invocation.
+	SubtractOverhead bool
+}
+
+// A Region specifies a region of the target to profile, using the same syntax
+// as the command-line tool: a function name, a 'regexp:' or 'glob:' selector,
+// or 'start-end' where start and end are file:line or hex addresses.
+type Region string
+
+// Results holds every invocation of the regions measured by a Perforator run.
+type Results struct {
+	Invocations TotalMetrics
+	// Overhead is the overhead subtracted from every invocation, if
+	// SubtractOverhead was set.
+	Overhead Metrics
+}
+
+// Stats aggregates the invocations by region, sorted by region name.
+func (r Results) Stats() []*RegionStats {
+	return r.Invocations.Stats()
+}
+
+// Region returns the aggregate statistics of the region with the given name,
+// or nil if it was never entered.
+func (r Results) Region(name string) *RegionStats {
+	for _, s := range r.Stats() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// A Perforator profiles regions of a binary. It hides the details of tracing
+// the target, so it can be used to measure regions from Go programs and tests
+// without running the command-line tool.
+type Perforator struct {
+	binary  string
+	opts    Options
+	regions []string
+}
+
+// New returns a Perforator for the given binary.
+func New(binary string, opts Options) *Perforator {
+	return &Perforator{
+		binary: binary,
+		opts:   opts,
+	}
+}
+
+// AddRegion adds a region to profile.
+func (p *Perforator) AddRegion(r Region) {
+	p.regions = append(p.regions, string(r))
+}
+
+// Run executes the binary with the given arguments and profiles the regions
+// until it exits, as many times as configured. If the timeout expires, the
+// results collected so far are returned along with context.DeadlineExceeded.
+func (p *Perforator) Run(args []string) (Results, error) {
+	ctx := context.Background()
+	if p.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.Timeout)
+		defer cancel()
+	}
+
+	attropts := perf.Options{
+		ExcludeKernel:     !p.opts.Kernel,
+		ExcludeHypervisor: !p.opts.Hypervisor,
+		Inherit:           p.opts.Inherit,
+	}
+	traceopts := utrace.Options{
+		Callers: p.opts.Callers,
+	}
+	binopts := BinOptions{
+		DebugFile:   p.opts.DebugFile,
+		VerifyAddrs: p.opts.VerifyAddrs,
+	}
+
+	var results Results
+	if p.opts.SubtractOverhead {
+		overhead, err := Calibrate(ctx, p.opts.Events, attropts, traceopts)
+		if err != nil {
+			return results, err
+		}
+		results.Overhead = overhead
+	}
+	for i := 0; i == 0 || i < p.opts.Runs; i++ {
+		warmup := NewWarmup(p.opts.Warmup)
+		total, err := run(ctx, p.binary, args, p.regions, 0, p.opts.Events, attropts, traceopts, binopts, nil, nil, nil)
+		for _, nm := range total {
+			if warmup.Keep(nm) {
+				nm.Run = i
+				if p.opts.SubtractOverhead {
+					nm.Metrics = nm.SubtractOverhead(results.Overhead)
+				}
+				results.Invocations = append(results.Invocations, nm)
+			}
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
@@ -3,10 +3,17 @@ package perforator
 import (
 	"io/ioutil"
 	"log"
+
+	"github.com/zyedidia/perforator/utrace"
 )
 
 var (
-	logger *log.Logger
+	logger   *log.Logger
+	logLevel = utrace.LevelDebug
+	// demangle C++ and Rust symbol names in results
+	demangle = true
+	// log that the raw events of every trace are recorded to
+	traceLog *TraceLog
 )
 
 func init() {
@@ -17,3 +24,36 @@ func init() {
 func SetLogger(l *log.Logger) {
 	logger = l
 }
+
+// SetLogLevel sets the amount of detail that is written to the logger, as
+// utrace.SetLogLevel does for the tracer's logger. At utrace.LevelDebug, the
+// default, the addresses that regions are resolved to are written as well.
+func SetLogLevel(l utrace.Level) {
+	logLevel = l
+}
+
+// infof writes a message to the logger at utrace.LevelInfo.
+func infof(format string, v ...interface{}) {
+	if logLevel >= utrace.LevelInfo {
+		logger.Printf(format, v...)
+	}
+}
+
+// debugf writes a message to the logger at utrace.LevelDebug.
+func debugf(format string, v ...interface{}) {
+	if logLevel >= utrace.LevelDebug {
+		logger.Printf(format, v...)
+	}
+}
+
+// SetDemangle enables or disables demangling of C++ and Rust symbol names in
+// results. Demangling is enabled by default.
+func SetDemangle(on bool) {
+	demangle = on
+}
+
+// SetTraceLog sets a log that the raw events of every subsequent trace are
+// recorded to, or disables recording if l is nil.
+func SetTraceLog(l *TraceLog) {
+	traceLog = l
+}
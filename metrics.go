@@ -3,21 +3,83 @@ package perforator
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 )
 
 // A Result represents a single event, marked by Label, and the counter value
-// returned by the perf monitor.
+// returned by the perf monitor. The value is the raw count; when the kernel
+// multiplexes counters the event is only counted for Running out of the
+// Enabled time, and ScaledValue should be used to estimate the full count.
 type Result struct {
-	Label string
-	Value uint64
+	Label   string
+	Value   uint64
+	Enabled time.Duration
+	Running time.Duration
+	// CoreWide is set if the event was counted for every process on a CPU
+	// rather than for a single thread, so it includes whatever else ran on
+	// that core.
+	CoreWide bool
+	// Cgroup is set if the event was counted for every process in a cgroup.
+	Cgroup bool
+	// Anomaly is set if the counter appeared to go backwards between the
+	// reads that the count is the difference of, or could not be read. The
+	// count is then 0 rather than a meaningless difference.
+	Anomaly bool
+}
+
+// Name returns the label of the event, marked if the count is core-wide or
+// covers a cgroup.
+func (r Result) Name() string {
+	if r.CoreWide {
+		return r.Label + " (core-wide)"
+	} else if r.Cgroup {
+		return r.Label + " (cgroup)"
+	}
+	return r.Label
+}
+
+// ScaledValue returns the value scaled by Enabled/Running to account for
+// multiplexing. It returns 0 if the event never ran.
+func (r Result) ScaledValue() uint64 {
+	if r.Running == 0 {
+		return 0
+	}
+	if r.Enabled == r.Running {
+		return r.Value
+	}
+	return uint64(float64(r.Value) * float64(r.Enabled) / float64(r.Running))
 }
 
 // Metrics stores a set of results and the time elapsed while they were
-// profiling.
+// profiling. Wall is the wall-clock time between entering and exiting the
+// region, measured without perf so it is available even if no events could
+// be opened.
 type Metrics struct {
 	Results []Result
 	Elapsed time.Duration
+	Wall    time.Duration
+	// Ratios are the derived ratios to show along with the results.
+	Ratios []Ratio
+}
+
+// Anomalous returns true if any of the results is an anomaly.
+func (m Metrics) Anomalous() bool {
+	for _, r := range m.Results {
+		if r.Anomaly {
+			return true
+		}
+	}
+	return false
+}
+
+// A Location identifies where a region begins in the target binary. The
+// address is relative to the binary (not including any PIE offset). File and
+// Line are only available if the binary has DWARF information.
+type Location struct {
+	Addr uint64
+	File string
+	Line int
 }
 
 // NamedMetrics associates a metrics structure with a name. This is useful for
@@ -25,45 +87,204 @@ type Metrics struct {
 type NamedMetrics struct {
 	Metrics
 	Name string
+	// Id is the index of the region in the list of regions given to Run.
+	Id  int
+	Loc Location
+	// Parents lists the regions that were active on the same thread when
+	// this region was entered, outermost first.
+	Parents []string
+	// Tid is the thread that executed the region, and Pid is the process
+	// that the thread belongs to.
+	Tid int
+	Pid int
+	// CPU is the CPU that the thread was running on when it entered the
+	// region, or -1 if it is unknown. The thread may have migrated to other
+	// CPUs before leaving the region.
+	CPU int
+	// Start and End are the CLOCK_MONOTONIC times at which the region was
+	// entered and exited.
+	Start time.Duration
+	End   time.Duration
+	// Callers is the symbolized call stack when the region was entered,
+	// innermost first (only if capturing callers was enabled).
+	Callers []string
+	// Branches are the calls recorded in the Last Branch Record when the
+	// region was entered, innermost first (only if capturing branches was
+	// enabled and supported).
+	Branches []Branch
+	// Run is the index of the run of the target that executed the region,
+	// when the target is run multiple times.
+	Run int
+	// Incomplete is set if the invocation never reached the end of the
+	// region, because the thread exited or left the region some other way
+	// (longjmp, for example). End is the time this was noticed, and the
+	// metrics were counted until then.
+	Incomplete bool
+	// StackMismatch is set if the region's return address was reached from
+	// a stack frame that did not enter it while the invocation was active,
+	// as happens when the stack is switched (by a coroutine library, for
+	// example). The invocation ended in the frame that entered it, but its
+	// counts may include unrelated code.
+	StackMismatch bool
+	// Series are the counts of each interval of the invocation, in order,
+	// if the counters were sampled at intervals (see Events.Interval).
+	Series []Bucket
 }
 
 // WriteTo pretty-prints the metrics and writes the result to a MetricsWriter.
 func (m NamedMetrics) WriteTo(table MetricsWriter) {
-	table.SetHeader([]string{"Event", fmt.Sprintf("Count (%s)", m.Name)})
+	name := m.Name
+	if m.Incomplete {
+		name += ", incomplete"
+	}
+	table.SetHeader([]string{"Event", fmt.Sprintf("Count (%s)", name)})
 
 	for _, r := range m.Results {
+		count := fmt.Sprintf("%d", r.ScaledValue())
+		if r.Anomaly {
+			count = "anomaly"
+		}
+		table.Append([]string{r.Name(), count})
+	}
+	for _, r := range m.Ratios {
 		table.Append([]string{
 			r.Label,
-			fmt.Sprintf("%d", r.Value),
+			r.Format(r.Value(m.Results)),
 		})
 	}
 	table.Append([]string{
 		"time-elapsed",
 		fmt.Sprintf("%s", m.Elapsed),
 	})
+	table.Append([]string{
+		"wall-time",
+		fmt.Sprintf("%s", m.Wall),
+	})
+	if len(m.Callers) > 0 {
+		table.Append([]string{
+			"callers",
+			strings.Join(m.Callers, " <- "),
+		})
+	}
+	if len(m.Branches) > 0 {
+		table.Append([]string{
+			"branches",
+			joinBranches(m.Branches),
+		})
+	}
 
 	table.Render()
 }
 
+// WriteSeries pretty-prints the counts of each interval of the invocation,
+// one row per interval, and writes the result to a MetricsWriter. Nothing is
+// written if the invocation has no series.
+func (m NamedMetrics) WriteSeries(table MetricsWriter) {
+	if len(m.Series) == 0 {
+		return
+	}
+	header := []string{fmt.Sprintf("Time (%s)", m.Name)}
+	for _, r := range m.Series[0].Results {
+		header = append(header, r.Name())
+	}
+	for _, r := range m.Series[0].Ratios {
+		header = append(header, r.Label)
+	}
+	header = append(header, "time-elapsed")
+	table.SetHeader(header)
+
+	for _, b := range m.Series {
+		row := []string{fmt.Sprintf("+%s", b.Start)}
+		for _, r := range b.Results {
+			row = append(row, fmt.Sprintf("%d", r.ScaledValue()))
+		}
+		for _, r := range b.Ratios {
+			row = append(row, r.Format(r.Value(b.Results)))
+		}
+		row = append(row, fmt.Sprintf("%s", b.Elapsed))
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+// A Warmup discards the first invocations of each region, which are often
+// slowed down by cold caches and lazily mapped pages.
+type Warmup struct {
+	n    int
+	seen map[string]int
+}
+
+// NewWarmup returns a Warmup that discards the first n invocations of each
+// region.
+func NewWarmup(n int) *Warmup {
+	return &Warmup{
+		n:    n,
+		seen: make(map[string]int),
+	}
+}
+
+// Keep returns true if the invocation is past the warm-up and should be
+// recorded.
+func (w *Warmup) Keep(nm NamedMetrics) bool {
+	if w.seen[nm.Name] < w.n {
+		w.seen[nm.Name]++
+		return false
+	}
+	return true
+}
+
 // TotalMetrics is a list of metrics and the region they are associated with.
 type TotalMetrics []NamedMetrics
 
+// Threads returns the IDs of all threads that executed a region, in order.
+func (t TotalMetrics) Threads() []int {
+	seen := make(map[int]bool)
+	var tids []int
+	for _, nm := range t {
+		if !seen[nm.Tid] {
+			seen[nm.Tid] = true
+			tids = append(tids, nm.Tid)
+		}
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+// ForThread returns the metrics for regions executed by the given thread.
+func (t TotalMetrics) ForThread(tid int) TotalMetrics {
+	var tm TotalMetrics
+	for _, nm := range t {
+		if nm.Tid == tid {
+			tm = append(tm, nm)
+		}
+	}
+	return tm
+}
+
 // WriteTo pretty-prints the metrics and writes the result to a MetricsWriter.
 // The sortKey and reverse parameters configure the table arrangement: which
 // entry to sort by and whether the sort should be in reverse order.
 func (t TotalMetrics) WriteTo(table MetricsWriter, sortKey string, reverse bool) {
 	var sortIdx int
+	sortRatio := -1
 	header := []string{"region"}
 	for _, m := range t {
 		for i, result := range m.Results {
 			if result.Label == sortKey {
 				sortIdx = i
 			}
-			header = append(header, result.Label)
+			header = append(header, result.Name())
+		}
+		for i, r := range m.Ratios {
+			if r.Label == sortKey {
+				sortRatio = i
+			}
+			header = append(header, r.Label)
 		}
 		break
 	}
-	header = append(header, "time-elapsed")
+	header = append(header, "time-elapsed", "wall-time")
 
 	table.SetHeader(header)
 
@@ -74,31 +295,55 @@ func (t TotalMetrics) WriteTo(table MetricsWriter, sortKey string, reverse bool)
 
 	var ss []kv
 	for _, v := range t {
-		ss = append(ss, kv{v.Name, v.Metrics})
+		name := v.Name
+		if v.Incomplete {
+			name += " (incomplete)"
+		} else if v.Anomalous() {
+			name += " (anomaly)"
+		}
+		ss = append(ss, kv{name, v.Metrics})
 	}
 
+	// without counters, only the times can be sorted by
+	if sortRatio < 0 && len(t) > 0 && len(t[0].Results) == 0 && sortKey != "time-elapsed" {
+		sortKey = "wall-time"
+	}
 	sort.Slice(ss, func(i, j int) bool {
-		if sortKey == "time-elapsed" {
-			vali := ss[i].Value.Elapsed
-			valj := ss[j].Value.Elapsed
+		if sortKey == "time-elapsed" || sortKey == "wall-time" {
+			vali, valj := ss[i].Value.Elapsed, ss[j].Value.Elapsed
+			if sortKey == "wall-time" {
+				vali, valj = ss[i].Value.Wall, ss[j].Value.Wall
+			}
+			if reverse {
+				return vali < valj
+			}
+			return valj < vali
+		}
+		if sortRatio >= 0 {
+			r := ss[i].Value.Ratios[sortRatio]
+			vali, _ := r.Value(ss[i].Value.Results)
+			valj, _ := r.Value(ss[j].Value.Results)
 			if reverse {
 				return vali < valj
 			}
 			return valj < vali
 		}
 		if reverse {
-			return ss[i].Value.Results[sortIdx].Value < ss[j].Value.Results[sortIdx].Value
+			return ss[i].Value.Results[sortIdx].ScaledValue() < ss[j].Value.Results[sortIdx].ScaledValue()
 		}
-		return ss[i].Value.Results[sortIdx].Value > ss[j].Value.Results[sortIdx].Value
+		return ss[i].Value.Results[sortIdx].ScaledValue() > ss[j].Value.Results[sortIdx].ScaledValue()
 	})
 
 	for _, kv := range ss {
 		row := []string{kv.Key}
 		m := kv.Value
 		for _, result := range m.Results {
-			row = append(row, fmt.Sprintf("%d", result.Value))
+			row = append(row, fmt.Sprintf("%d", result.ScaledValue()))
+		}
+		for _, r := range m.Ratios {
+			row = append(row, r.Format(r.Value(m.Results)))
 		}
-		row = append(row, fmt.Sprintf("%s", m.Elapsed))
+		row = append(row, fmt.Sprintf("%s", m.Elapsed), fmt.Sprintf("%s", m.Wall))
 		table.Append(row)
 	}
 
@@ -1,15 +1,22 @@
 package perforator
 
 import (
+	"context"
+	"debug/elf"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"time"
 
 	"acln.ro/perf"
 	"github.com/zyedidia/perforator/bininfo"
 	"github.com/zyedidia/perforator/utrace"
+	"golang.org/x/sys/unix"
 )
 
 // Events is a specification for which perf events should be tracked.  A Base
@@ -18,90 +25,316 @@ import (
 type Events struct {
 	Base   []perf.Configurator
 	Groups [][]perf.Configurator
+	// If NoReset is set, counters are never reset between invocations;
+	// instead they are read when a region is entered and the values are
+	// subtracted from the ones read when it exits.
+	NoReset bool
+	// Ratios are derived from pairs of events in the same group and
+	// reported along with each invocation's results.
+	Ratios []Ratio
+	// Branches is the number of calls to capture from the Last Branch
+	// Record when a region is entered, innermost first. If the CPU has no
+	// usable Last Branch Record, the call stack is captured by walking frame
+	// pointers instead (see utrace.Options.Callers).
+	Branches int
+	// Cgroup is the directory of a cgroup in the cgroup filesystem. If it
+	// is set, the Base events of every process in the cgroup are counted on
+	// every CPU (or only on the target's CPU, if it is pinned to one) while
+	// a region is active, instead of those of the thread executing the
+	// region. It cannot be used with Groups.
+	Cgroup string
+	// If SplitModes is set, every event is counted twice, in user code
+	// (labeled with perf's :u suffix, such as instructions:u) and in kernel
+	// code (instructions:k), whatever the exclusions of the counter options.
+	// Both counters are in the same group so that they share one window,
+	// and the base events are then counted in groups of two, so SplitModes
+	// cannot be used with Cgroup or gated counters.
+	SplitModes bool
+	// If Interval is set, the counters of every invocation in progress are
+	// also read at this interval, and the counts of each interval are
+	// reported as the invocation's Series, to show how a long region
+	// behaves over time (its instructions per cycle, for example).
+	Interval time.Duration
+}
+
+// An ExitError reports that the target exited with a non-zero status or was
+// killed by a signal. The metrics returned with it are complete.
+type ExitError struct {
+	Status unix.WaitStatus
+}
+
+func (e *ExitError) Error() string {
+	if e.Status.Signaled() {
+		return fmt.Sprintf("target killed by signal: %s", e.Status.Signal())
+	}
+	return fmt.Sprintf("target exited with status %d", e.Status.ExitStatus())
+}
+
+// ExitCode returns the target's exit code, or 128 plus the signal number if
+// it was killed by a signal (as a shell would report it).
+func (e *ExitError) ExitCode() int {
+	if e.Status.Signaled() {
+		return 128 + int(e.Status.Signal())
+	}
+	return e.Status.ExitStatus()
+}
+
+// exitError returns an ExitError if ws is the unsuccessful termination of the
+// target, and nil otherwise.
+func exitError(ws unix.WaitStatus) error {
+	if ws.Signaled() || ws.Exited() && ws.ExitStatus() != 0 {
+		return &ExitError{
+			Status: ws,
+		}
+	}
+	return nil
 }
 
 // Run executes the given command with tracing for certain events enabled. A
-// structure with all perf metrics is returned.
-func Run(target string, args []string,
+// structure with all perf metrics is returned. Region names may include
+// selectors such as 'regexp:' or 'glob:', which are expanded to every matching
+// function (see ExpandRegions); maxRegions limits the total number of regions
+// (0 for no limit). If ctx is done before the target finishes, the target is
+// detached (with all breakpoints removed) and killed, and the metrics
+// collected so far are returned along with the context's error. If immediate
+// is not nil, it is called with each region invocation as soon as it
+// completes. If the target exits unsuccessfully, an *ExitError is returned
+// with the metrics. If attropts.Inherit is set, the counters of a region also
+// count the threads and processes created while the region is active. The
+// executables of the target are read with binopts.
+func Run(ctx context.Context, target string, args []string,
+	regionNames []string,
+	maxRegions int,
+	events Events,
+	attropts perf.Options,
+	traceopts utrace.Options,
+	binopts BinOptions,
+	immediate func(NamedMetrics)) (TotalMetrics, error) {
+	return run(ctx, target, args, regionNames, maxRegions, events, attropts, traceopts, binopts, immediate, nil, nil)
+}
+
+// RunGated executes the target as Run does, but rather than measuring each
+// invocation of a region, it counts the Base events of each region with a
+// single set of counters that is inherited by every thread and child process
+// of the target. The counters of a region are enabled when a thread enters it
+// while no other thread is inside, and disabled when the last thread leaves,
+// and they are only read once the target has exited. The totals do not have
+// the error of resetting and reading counters around every invocation, but
+// while one thread is inside a region, the events of the other threads are
+// counted as well, and system calls are not excluded (see
+// utrace.Options.Syscalls). The totals are returned in the order of the region
+// names (after expanding selectors), with Wall the time that any thread was
+// inside the region, followed by the invocations, which only have wall-clock
+// times. Events.Cgroup cannot be used, and Events.Groups can only be used if
+// the kernel can inherit event groups (see Capabilities.InheritGroup).
+func RunGated(ctx context.Context, target string, args []string,
+	regionNames []string,
+	maxRegions int,
+	events Events,
+	attropts perf.Options,
+	traceopts utrace.Options,
+	binopts BinOptions,
+	immediate func(NamedMetrics)) (TotalMetrics, TotalMetrics, error) {
+	var gated TotalMetrics
+	total, err := run(ctx, target, args, regionNames, maxRegions, events, attropts, traceopts, binopts, immediate, &gated, nil)
+	return gated, total, err
+}
+
+// RunUntil executes the target as RunGated does, but stops it once the gated
+// count of the threshold's event in its region has reached the threshold's
+// count. The count is checked whenever an invocation of the region ends, so
+// it is normally exceeded by part of the last invocation. If the threshold is
+// reached, the target is detached and killed, and a *ThresholdError is
+// returned along with the metrics collected so far, reporting how many
+// invocations and how much time it took. If the target exits first, the
+// metrics are returned as from RunGated.
+func RunUntil(ctx context.Context, target string, args []string,
+	regionNames []string,
+	maxRegions int,
+	events Events,
+	attropts perf.Options,
+	traceopts utrace.Options,
+	binopts BinOptions,
+	threshold Threshold,
+	immediate func(NamedMetrics)) (TotalMetrics, TotalMetrics, error) {
+	var gated TotalMetrics
+	total, err := run(ctx, target, args, regionNames, maxRegions, events, attropts, traceopts, binopts, immediate, &gated, &threshold)
+	return gated, total, err
+}
+
+// run implements Run, and RunGated if gated is not nil, in which case the
+// gated totals are stored in it. If until is not nil as well, the target is
+// stopped once it is reached (see RunUntil). The executables of the trace are
+// read with binopts.
+func run(ctx context.Context, target string, args []string,
 	regionNames []string,
+	maxRegions int,
 	events Events,
 	attropts perf.Options,
-	immediate func() MetricsWriter) (TotalMetrics, error) {
+	traceopts utrace.Options,
+	binopts BinOptions,
+	immediate func(NamedMetrics),
+	gated *TotalMetrics,
+	until *Threshold) (TotalMetrics, error) {
 
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	path, err := exec.LookPath(target)
+	err := CheckExclusion(attropts)
 	if err != nil {
-		return TotalMetrics{}, fmt.Errorf("lookpath: %w", err)
+		return TotalMetrics{}, err
 	}
-
-	f, err := os.Open(path)
-	if err != nil {
-		return TotalMetrics{}, fmt.Errorf("open: %w", err)
+	if events.SplitModes {
+		if events.Cgroup != "" || gated != nil {
+			return TotalMetrics{}, ErrSplitModesScope
+		}
+		events = splitModes(events)
+	}
+	if attropts.Inherit && len(events.Groups) > 0 && !ProbeCapabilities().InheritGroup {
+		return TotalMetrics{}, ErrInheritGroup
+	}
+	if events.Cgroup != "" && len(events.Groups) > 0 {
+		return TotalMetrics{}, ErrCgroupGroup
+	}
+	if gated != nil && (len(events.Groups) > 0 && !ProbeCapabilities().InheritGroup || events.Cgroup != "") {
+		return TotalMetrics{}, ErrGatedScope
+	}
+	if gated != nil && events.Interval > 0 {
+		return TotalMetrics{}, ErrIntervalGated
 	}
 
-	bin, err := bininfo.Read(f, f.Name())
+	bin, specs, set, regionNames, err := loadRegions(target, regionNames, maxRegions, traceopts.FollowExec, binopts)
 	if err != nil {
-		return TotalMetrics{}, fmt.Errorf("elf-read: %w", err)
+		return TotalMetrics{}, err
+	}
+	if bin != nil && bin.Go() && !traceopts.Go {
+		infof("%s: Go program, matching region entries by goroutine\n", target)
+		traceopts.Go = true
+	}
+	untilId := -1
+	if until != nil {
+		untilId, err = until.find(regionNames, events.Base)
+		if err != nil {
+			return TotalMetrics{}, err
+		}
 	}
 
-	var regions []utrace.Region
-	var regionIds []int
+	// the set and region name of every region, so that regions can be
+	// found for processes that have exec'd a different executable
+	type regionRef struct {
+		set *regionSet
+		id  int
+	}
+	refs := make(map[utrace.Region]regionRef)
+	addSet := func(set *regionSet) {
+		for i, reg := range set.regions {
+			refs[reg] = regionRef{set, set.ids[i]}
+		}
+	}
+	addSet(set)
 
-	addregion := func(reg utrace.Region, id int) {
-		regions = append(regions, reg)
-		regionIds = append(regionIds, id)
+	ptable := make(map[int][]Profiler)
+	// stack of active region names for each thread
+	active := make(map[int][]int)
+	// state of the region invocations in progress
+	type invocation struct {
+		tid, id int
+	}
+	type entry struct {
+		time     time.Duration
+		cpu      int
+		callers  []string
+		branches []Branch
+	}
+	inflight := make(map[invocation]entry)
+	// each thread's Last Branch Record, and the invocation it is sampling
+	// the calls of
+	recorders := make(map[int]*branchRecorder)
+	sampling := make(map[int]invocation)
+	defer func() {
+		for _, rec := range recorders {
+			rec.Close()
+		}
+	}()
+	var series *sampler
+	if events.Interval > 0 {
+		series = newSampler(events.Interval, events.Ratios)
+		defer series.Close()
 	}
 
-	for i, name := range regionNames {
-		if strings.Contains(name, "-") {
-			reg, err := ParseRegion(name, bin)
+	if traceopts.FollowExec {
+		traceopts.Exec = func(pid int) (utrace.PieOffsetter, []utrace.Region, error) {
+			path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
 			if err != nil {
-				return TotalMetrics{}, fmt.Errorf("region-parse: %w", err)
+				return nil, nil, err
 			}
-
-			logger.Printf("%s: 0x%x-0x%x\n", name, reg.StartAddr, reg.EndAddr)
-
-			addregion(reg, i)
-		} else {
-			fnpc, fnerr := bin.FuncToPC(name)
-
-			if fnerr == nil {
-				logger.Printf("%s: 0x%x\n", name, fnpc)
-				addregion(&utrace.FuncRegion{
-					Addr: fnpc,
-				}, i)
+			// the process's counters and invocations in progress belong
+			// to the old executable
+			for _, prof := range ptable[pid] {
+				if series != nil {
+					series.cancel(prof)
+				}
+				prof.Close()
 			}
-
-			inlinings, err := bin.InlinedFuncToPCs(name)
-
-			if len(inlinings) == 0 {
-				logger.Printf("%s not inlined (error: %s)\n", name, err)
+			delete(ptable, pid)
+			delete(active, pid)
+			for inv := range inflight {
+				if inv.tid == pid {
+					delete(inflight, inv)
+				}
 			}
 
+			// the debug file only belongs to the target
+			exeopts := BinOptions{VerifyAddrs: binopts.VerifyAddrs}
+			exe, err := readELF(path, exeopts)
+			if err == nil && usesCode(specs) {
+				err = loadCode(exe, path, exeopts)
+			}
 			if err != nil {
-				if fnerr != nil {
-					if err != nil {
-						return TotalMetrics{}, fmt.Errorf("func-lookup: %w, inlined-func-lookup: %s", fnerr, err)
-					}
-				}
-
-				continue
+				infof("%d: %s: %v (no regions)\n", pid, path, err)
+				return utrace.NoPie{}, nil, nil
 			}
-			for _, in := range inlinings {
-				logger.Printf("%s (inlined): 0x%x-0x%x\n", name, in.Low, in.High)
-
-				addregion(&utrace.AddressRegion{
-					StartAddr: in.Low,
-					EndAddr:   in.High,
-				}, i)
+			infof("%d: resolving regions in %s\n", pid, path)
+			set, _, err := resolveRegions(specs, exe, true, binopts.VerifyAddrs)
+			if err != nil {
+				return nil, nil, err
 			}
+			addSet(set)
+			return exe, set.regions, nil
 		}
 	}
 
-	prog, pid, err := utrace.NewProgram(bin, target, args, regions)
-	if err != nil {
+	if err := checkRatios(events.Ratios, events.Groups); err != nil {
+		return TotalMetrics{}, err
+	}
+	branches := events.Branches
+	if branches > 0 {
+		if !ProbeCapabilities().LBR {
+			infof("last branch record unavailable, capturing callers instead\n")
+			branches = 0
+			traceopts.Callers = true
+		}
+	}
+
+	cpu := counterCPU(traceopts)
+	var cg *cgroupScope
+	if events.Cgroup != "" {
+		cg, err = openCgroup(events.Cgroup, cpu)
+		if err != nil {
+			return TotalMetrics{}, err
+		}
+		defer cg.Close()
+	}
+
+	var pie utrace.PieOffsetter = utrace.NoPie{}
+	if bin != nil {
+		pie = bin
+	}
+	prog, pid, err := utrace.NewProgram(pie, target, args, set.regions, traceopts)
+	var rerr *utrace.RegionError
+	if errors.As(err, &rerr) {
+		return TotalMetrics{}, fmt.Errorf("region %s: %w", regionNames[set.ids[rerr.Id]], rerr.Err)
+	} else if err != nil {
 		return TotalMetrics{}, err
 	}
 
@@ -129,79 +362,774 @@ func Run(target string, args []string,
 		}
 	}
 
+	var g *gate
+	if gated != nil {
+		g, err = openGate(pid, cpu, len(regionNames), base, groups)
+		if err != nil {
+			cleanup(prog, pid)
+			return TotalMetrics{}, err
+		}
+		defer func() {
+			*gated = g.totals(regionNames, set.locs)
+			g.Close()
+		}()
+		// invocations are only timed
+		base, groups = nil, nil
+	}
+
+	// make sure no breakpoints are left behind if tracing ends early
+	defer cleanup(prog, pid)
+	stop := interruptOnDone(ctx, pid)
+	defer stop()
+	started := time.Now()
+	if traceLog != nil {
+		if err := traceLog.run(regionNames, set.locs); err != nil {
+			return TotalMetrics{}, fmt.Errorf("record: %w", err)
+		}
+		defer traceLog.Flush()
+	}
+
 	total := make(TotalMetrics, 0)
-	ptable := make(map[int][]Profiler)
-	ptable[pid], err = makeProfilers(pid, len(regions), base, groups, fa)
+	ptable[pid], err = makeProfilers(pid, cpu, len(set.regions), base, groups, fa, events.NoReset, cg)
 	if err != nil {
 		return total, err
 	}
+	if branches > 0 {
+		recorders[pid], err = newBranchRecorder(pid, cpu)
+		if err != nil {
+			return total, err
+		}
+	}
 
+	var exitErr error
+	var reached *ThresholdError
 	for {
 		var ws utrace.Status
 
 		p, evs, err := prog.Wait(&ws)
-		if err == utrace.ErrFinishedTrace {
-			break
+		if p != nil && p.Pid() == pid && (ws.Exited() || ws.Signaled()) {
+			exitErr = exitError(ws.WaitStatus)
 		}
-		if err != nil {
+		// the last thread to exit may still leave regions open
+		finished := err == utrace.ErrFinishedTrace
+		if err != nil && !finished {
 			return total, fmt.Errorf("wait: %w", err)
 		}
+		if p == nil {
+			break
+		}
 
+		// each thread has its own profilers so that a region's events are
+		// only counted for the thread that executed it. They are opened
+		// at the thread's first event, since a program may create many
+		// threads (such as the Go runtime's) that never enter a region.
 		profilers, ok := ptable[p.Pid()]
-		if !ok {
-			ptable[p.Pid()], err = makeProfilers(p.Pid(), len(regions), base, groups, fa)
+		if !ok && len(evs) > 0 {
+			profilers, err = makeProfilers(p.Pid(), cpu, p.NumRegions(), base, groups, fa, events.NoReset, cg)
 			if err != nil {
 				return total, err
 			}
+			ptable[p.Pid()] = profilers
+			if branches > 0 {
+				recorders[p.Pid()], err = newBranchRecorder(p.Pid(), cpu)
+				if err != nil {
+					return total, err
+				}
+			}
+		}
+
+		// the sample armed when a region was entered is taken as soon as
+		// the thread continues, so it is ready at the thread's next stop
+		rec := recorders[p.Pid()]
+		if inv, ok := sampling[p.Pid()]; ok {
+			delete(sampling, p.Pid())
+			calls, err := rec.collect()
+			if err != nil {
+				infof("%d: lbr: %v\n", p.Pid(), err)
+			}
+			if e, ok := inflight[inv]; ok {
+				e.branches = symbolizeBranches(refs[p.Region(inv.id)].set.bin, calls, p.PieOffset(), branches)
+				inflight[inv] = e
+			}
 		}
 
 		for _, ev := range evs {
+			ref := refs[p.Region(ev.Id)]
+			raw := tracedEvent{
+				State:         ev.State,
+				Region:        ev.Id,
+				Id:            ref.id,
+				Tid:           p.Pid(),
+				Pid:           p.Tgid(),
+				CPU:           -1,
+				Time:          ev.Time,
+				StackMismatch: ev.StackMismatch,
+			}
 			switch ev.State {
 			case utrace.RegionStart:
-				logger.Printf("%d: Profiler %d enabled\n", p.Pid(), ev.Id)
+				active[p.Pid()] = append(active[p.Pid()], ref.id)
+				e := entry{
+					time: ev.Time,
+				}
+				if e.cpu, err = p.CPU(); err != nil {
+					infof("%d: cpu: %v\n", p.Pid(), err)
+					e.cpu = -1
+				}
+				if ev.Callers != nil {
+					e.callers = symbolize(ref.set.bin, ev.Callers)
+				}
+				inflight[invocation{p.Pid(), ev.Id}] = e
+				raw.CPU, raw.Callers = e.cpu, e.callers
+				if rec != nil {
+					if err := rec.arm(); err != nil {
+						infof("%d: lbr: %v\n", p.Pid(), err)
+					} else {
+						sampling[p.Pid()] = invocation{p.Pid(), ev.Id}
+					}
+				}
+				if g != nil {
+					g.enter(ref.id, ev.Time)
+				}
+				debugf("%d: Profiler %d enabled\n", p.Pid(), ev.Id)
 				profilers[ev.Id].Disable()
 				profilers[ev.Id].Reset()
 				profilers[ev.Id].Enable()
-			case utrace.RegionEnd:
+				if series != nil {
+					series.begin(profilers[ev.Id], ev.Time)
+				}
+			case utrace.RegionEnd, utrace.RegionAbandoned:
 				profilers[ev.Id].Disable()
-				logger.Printf("%d: Profiler %d disabled\n", p.Pid(), ev.Id)
+				if g != nil {
+					g.leave(ref.id, ev.Time)
+				}
+				debugf("%d: Profiler %d disabled\n", p.Pid(), ev.Id)
+				var parents []string
+				for _, id := range popActive(active, p.Pid(), ref.id) {
+					parents = append(parents, regionNames[id])
+				}
+				e := inflight[invocation{p.Pid(), ev.Id}]
+				delete(inflight, invocation{p.Pid(), ev.Id})
+				m := profilers[ev.Id].Metrics()
+				raw.Metrics = m
+				m.Wall = ev.Time - e.time
+				m.Ratios = events.Ratios
 				nm := NamedMetrics{
-					Metrics: profilers[ev.Id].Metrics(),
-					Name:    regionNames[regionIds[ev.Id]],
+					Metrics:       m,
+					Name:          regionNames[ref.id],
+					Id:            ref.id,
+					Loc:           ref.set.locs[ref.id],
+					Parents:       parents,
+					Tid:           p.Pid(),
+					Pid:           p.Tgid(),
+					CPU:           e.cpu,
+					Start:         e.time,
+					End:           ev.Time,
+					Callers:       e.callers,
+					Branches:      e.branches,
+					Incomplete:    ev.State == utrace.RegionAbandoned,
+					StackMismatch: ev.StackMismatch,
+				}
+				if series != nil {
+					nm.Series = series.end(profilers[ev.Id], raw.Metrics, ev.Time)
+				}
+				if nm.Incomplete {
+					infof("%d: %s left open (incomplete invocation)\n", p.Pid(), nm.Name)
 				}
 				total = append(total, nm)
-				writer := immediate()
-				if writer != nil {
-					nm.WriteTo(writer)
+				if immediate != nil {
+					immediate(nm)
+				}
+				if ref.id == untilId && reached == nil {
+					if n := g.count(untilId, until.Event); n >= until.Count {
+						reached = &ThresholdError{
+							Threshold: *until,
+							Value:     n,
+							Wall:      g.wall[untilId],
+							Elapsed:   time.Since(started),
+						}
+						for _, nm := range total {
+							if nm.Id == untilId {
+								reached.Invocations++
+							}
+						}
+					}
+				}
+			case utrace.RegionSyscallEnter:
+				profilers[ev.Id].Disable()
+			case utrace.RegionSyscallExit:
+				profilers[ev.Id].Enable()
+			case utrace.RegionPending:
+				infof("%d: %s pending (library unloaded)\n", p.Pid(), regionNames[ref.id])
+			case utrace.RegionArmed:
+				infof("%d: %s armed\n", p.Pid(), regionNames[ref.id])
+			}
+			if traceLog != nil {
+				if err := traceLog.event(raw); err != nil {
+					return total, fmt.Errorf("record: %w", err)
 				}
 			}
 		}
 
+		if reached != nil {
+			infof("%s: detaching from target\n", reached)
+			if err := cleanup(prog, pid); err != nil {
+				return total, fmt.Errorf("detach: %w", err)
+			}
+			// reap the target, which was killed, so that the wait of a
+			// later run does not find it
+			unix.Wait4(pid, nil, unix.WALL, nil)
+			return total, reached
+		}
+		if finished {
+			break
+		}
+		if ctx.Err() != nil {
+			return total, abort(ctx, prog, pid)
+		}
+
 		err = prog.Continue(p, ws)
 		if err != nil {
 			return total, fmt.Errorf("trace-continue: %w", err)
 		}
 	}
 
-	return total, nil
+	return total, exitErr
 }
 
-func makeProfilers(pid, n int, attrs []*perf.Attr, groups [][]*perf.Attr, fa *perf.Attr) ([]Profiler, error) {
+// counterCPU returns the CPU that counters should be opened on. Counters
+// normally follow their thread to any CPU, but if the target is pinned to a
+// single CPU they are opened on that CPU as well. A counter opened for a
+// thread on a specific CPU only counts while the thread runs on that CPU.
+func counterCPU(opts utrace.Options) int {
+	if opts.Affinity == nil || opts.Affinity.Count() != 1 {
+		return perf.AnyCPU
+	}
+	for cpu := 0; ; cpu++ {
+		if opts.Affinity.IsSet(cpu) {
+			return cpu
+		}
+	}
+}
+
+// popActive removes the innermost entry of the region from a thread's stack of
+// active regions, and returns the regions that enclose it.
+func popActive(active map[int][]int, tid, region int) []int {
+	stack := active[tid]
+	for j := len(stack) - 1; j >= 0; j-- {
+		if stack[j] == region {
+			parents := append([]int(nil), stack[:j]...)
+			active[tid] = append(stack[:j], stack[j+1:]...)
+			return parents
+		}
+	}
+	return nil
+}
+
+func makeProfilers(pid, cpu, n int, attrs []*perf.Attr, groups [][]*perf.Attr, fa *perf.Attr, noReset bool, cg *cgroupScope) ([]Profiler, error) {
 	profilers := make([]Profiler, n)
 	for i := 0; i < n; i++ {
-		mprof, err := NewMultiProfiler(attrs, pid, perf.AnyCPU)
+		if cg != nil {
+			prof, err := newCgroupSumProfiler(attrs, int(cg.dir.Fd()), cg.cpus)
+			if err != nil {
+				return nil, fmt.Errorf("profiler: %s: %w", cg.dir.Name(), err)
+			}
+			profilers[i] = prof
+			if noReset {
+				profilers[i] = NewDeltaProfiler(prof)
+			}
+			continue
+		}
+		mprof, err := NewMultiProfiler(attrs, pid, cpu)
 		if err != nil {
 			return nil, fmt.Errorf("profiler: %w", err)
 		}
 		for _, gattrs := range groups {
-			gprof, err := NewGroupProfiler(gattrs, pid, perf.AnyCPU)
+			gprof, err := NewGroupProfiler(gattrs, pid, cpu)
 			if err != nil {
 				return nil, fmt.Errorf("profiler: %w", err)
 			}
 			mprof.profilers = append(mprof.profilers, gprof)
 		}
 
-		profilers[i] = mprof
+		if noReset {
+			profilers[i] = NewDeltaProfiler(mprof)
+		} else {
+			profilers[i] = mprof
+		}
 	}
 	return profilers, nil
 }
+
+// interruptOnDone stops the target with SIGSTOP when ctx is done, so that a
+// trace loop waiting on the target wakes up and notices. The returned function
+// must be called once tracing has finished.
+func interruptOnDone(ctx context.Context, pid int) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			unix.Kill(pid, unix.SIGSTOP)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// abort ends a trace that was cut short by ctx.
+func abort(ctx context.Context, prog *utrace.Program, pid int) error {
+	infof("%s: detaching from target\n", ctx.Err())
+	err := cleanup(prog, pid)
+	// reap the target, which was killed, so that the wait of a later run
+	// does not find it
+	unix.Wait4(pid, nil, unix.WALL, nil)
+	if err != nil {
+		return fmt.Errorf("detach: %w", err)
+	}
+	return ctx.Err()
+}
+
+// cleanup detaches from any processes that are still traced, restoring the
+// original instructions at all breakpoints, and kills the target along with
+// the processes in its process group.
+func cleanup(prog *utrace.Program, pid int) error {
+	if prog.Finished() {
+		return nil
+	}
+	err := prog.Detach()
+	utrace.KillTarget(pid)
+	return err
+}
+
+// symbolize converts a list of addresses relative to the binary (such as
+// caller PCs) to locations with symbolizeAddr.
+func symbolize(bin *bininfo.BinFile, addrs []uint64) []string {
+	names := make([]string, len(addrs))
+	for i, addr := range addrs {
+		names[i] = symbolizeAddr(bin, addr, 0)
+	}
+	return names
+}
+
+// symbolizeAddr returns the location of a virtual address in a process that
+// loaded bin at the PIE offset off: the function that contains it, followed by
+// the offset into the function unless it is the function's first byte (such
+// as sum+0x1c), or the offset into the binary (bench+0x1020) if it is in the
+// binary's code but not inside any function, as in the PLT. Addresses outside
+// of the binary's code are written in hex.
+func symbolizeAddr(bin *bininfo.BinFile, addr, off uint64) string {
+	// a function whose symbol has no size extends to the next symbol, so
+	// the last one would cover every address after the binary's code
+	if bin == nil || addr < off || !bin.InExecSection(addr-off) {
+		return fmt.Sprintf("0x%x", addr)
+	}
+	pc := addr - off
+	fn, foff, err := bin.PCToFuncOffset(pc)
+	if err != nil {
+		return fmt.Sprintf("%s+0x%x", bin.Name(), pc)
+	} else if foff == 0 {
+		return symbolName(fn)
+	}
+	return fmt.Sprintf("%s+0x%x", symbolName(fn), foff)
+}
+
+// symbolName returns the name of a symbol as it should be shown in results.
+func symbolName(name string) string {
+	if demangle {
+		return bininfo.Demangle(name)
+	}
+	return name
+}
+
+// loadRegions reads the target executable and resolves the regions with the
+// given names in it, after expanding selectors. It returns the executable (nil
+// if it is a script and followExec is set), the expanded region names, and the
+// regions along with the names to show for them. The executable is read with
+// binopts.
+func loadRegions(target string, regionNames []string, maxRegions int, followExec bool, binopts BinOptions) (*bininfo.BinFile, []string, *regionSet, []string, error) {
+	bin, err := readBinary(target, binopts)
+	var elfErr *elf.FormatError
+	if followExec && errors.As(err, &elfErr) {
+		// a script's interpreter only execs the executable with the
+		// regions later on
+		infof("%s: not an executable (%v), resolving regions after exec\n", target, err)
+		bin = nil
+	} else if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	if bin != nil && usesCode(regionNames) {
+		path, _ := exec.LookPath(target)
+		if err := loadCode(bin, path, binopts); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	if bin != nil {
+		regionNames, err = ExpandRegions(regionNames, bin, maxRegions)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("region-expand: %w", err)
+		}
+	} else {
+		for _, name := range regionNames {
+			if strings.HasPrefix(name, "regexp:") || strings.HasPrefix(name, "glob:") || strings.HasPrefix(name, sourcePrefix) || strings.HasPrefix(name, rangePrefix) {
+				return nil, nil, nil, nil, fmt.Errorf("region selector %s: %s is not an executable", name, target)
+			}
+		}
+	}
+	specs := regionNames
+
+	set, names, err := resolveRegions(specs, bin, followExec, binopts.VerifyAddrs)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return bin, specs, set, names, nil
+}
+
+// BinOptions configures how the executables of a target are read.
+type BinOptions struct {
+	// DebugFile is a separate debug file (for example one created with
+	// 'objcopy --only-keep-debug') to read the target's symbols and DWARF
+	// information from, if they were stripped from the target. If it is
+	// empty, the debug file is searched for in the standard locations
+	// instead.
+	DebugFile string
+	// VerifyAddrs enables decoding the target's code to check that both
+	// ends of each address region are the start of an instruction, since a
+	// breakpoint in the middle of an instruction corrupts it.
+	VerifyAddrs bool
+}
+
+// readBinary finds the target executable in the PATH, checks that it can run
+// on this host (see utrace.CheckTarget), and reads its symbol and debugging
+// information. If the binary is stripped, the information is read from the
+// debug file of binopts, or else from a separate debug file found in the
+// standard locations or with debuginfod.
+func readBinary(target string, binopts BinOptions) (*bininfo.BinFile, error) {
+	path, err := utrace.CheckTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return readELF(path, binopts)
+}
+
+// readELF reads the ELF file at path, along with the debug file of binopts or
+// a separate debug file found for it.
+func readELF(path string, binopts BinOptions) (*bininfo.BinFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	bin, err := bininfo.Read(f, f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("elf-read: %w", err)
+	}
+	if binopts.VerifyAddrs {
+		if err := bin.LoadCode(f); err != nil {
+			return nil, fmt.Errorf("elf-code: %w", err)
+		}
+	}
+
+	debug := binopts.DebugFile
+	if debug == "" && (!bin.HasSymbols() || !bin.HasDebugInfo()) {
+		debug = bin.FindDebugFile(path)
+		if debug == "" && os.Getenv("DEBUGINFOD_URLS") != "" {
+			debug, err = bin.FetchDebugFile()
+			if err != nil {
+				infof("%s: %v\n", path, err)
+			}
+		}
+	}
+	if debug != "" {
+		infof("%s: reading debug file %s\n", path, debug)
+		df, err := os.Open(debug)
+		if err != nil {
+			return nil, fmt.Errorf("debug-file: %w", err)
+		}
+		defer df.Close()
+		err = bin.LoadDebug(df)
+		if err != nil {
+			return nil, fmt.Errorf("debug-file %s: %w", debug, err)
+		}
+	}
+	return bin, nil
+}
+
+// splitLibRegion splits a region written as lib:func, where lib is the path
+// or file name of a shared library (such as libssl.so). It returns false if
+// the region is not in a shared library.
+func splitLibRegion(s string) (lib, fn string, ok bool) {
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.HasPrefix(s[i:], "::") {
+		return "", "", false
+	}
+	lib, fn = s[:i], s[i+1:]
+	if !strings.Contains(filepath.Base(lib), ".so") || fn == "" {
+		return "", "", false
+	}
+	return lib, fn, true
+}
+
+// libResolvers returns functions that find fn in the shared library at a
+// given path, for use once the target has loaded the library: the first finds
+// its address, and the second its resolver if it is an indirect function.
+func libResolvers(fn string) (func(path string) (uint64, error), func(path string) (*utrace.Ifunc, error)) {
+	// the library read by the last call, which the other usually repeats
+	var lib *bininfo.BinFile
+	var libPath string
+	read := func(path string) (*bininfo.BinFile, error) {
+		if lib != nil && libPath == path {
+			return lib, nil
+		}
+		l, err := readELF(path, BinOptions{})
+		if err != nil {
+			return nil, err
+		}
+		lib, libPath = l, path
+		return lib, nil
+	}
+	resolve := func(path string) (uint64, error) {
+		lib, err := read(path)
+		if err != nil {
+			return 0, err
+		}
+		return lib.FuncToPC(fn)
+	}
+	resolveIfunc := func(path string) (*utrace.Ifunc, error) {
+		lib, err := read(path)
+		if err != nil {
+			return nil, err
+		}
+		resolver, ok := lib.IfuncToPC(fn)
+		if !ok {
+			return nil, nil
+		}
+		debugf("%s: indirect function in %s, resolver at 0x%x\n", fn, path, resolver)
+		return &utrace.Ifunc{
+			Resolver: resolver,
+			Slots:    lib.IfuncSlots(resolver),
+		}, nil
+	}
+	return resolve, resolveIfunc
+}
+
+// A regionSet holds the regions resolved in one executable. A process that
+// execs a different executable gets a new set.
+type regionSet struct {
+	bin     *bininfo.BinFile
+	regions []utrace.Region
+	// index of the region name that each region belongs to
+	ids []int
+	// location of each region name, by name index
+	locs []Location
+}
+
+// A regionKey identifies a region independently of the name that selected
+// it, so that a region selected by several names is only traced once.
+type regionKey struct {
+	typ        reflect.Type
+	start, end uint64
+	nested     bool
+	// library and symbol of a library region, whose address is not known
+	// until the library is loaded
+	lib, sym string
+}
+
+// keyOf returns the key of a region found in an executable.
+func keyOf(reg utrace.Region) regionKey {
+	key := regionKey{typ: reflect.TypeOf(reg)}
+	switch r := reg.(type) {
+	case *utrace.AddressRegion:
+		key.start, key.end = r.StartAddr, r.EndAddr
+	case *utrace.SpanRegion:
+		key.start, key.end, key.nested = r.StartAddr, r.EndAddr, r.Nested
+	case *utrace.FuncRegion:
+		key.start = r.Addr
+	case *utrace.RetsRegion:
+		key.start = r.Addr
+	case *utrace.IfuncRegion:
+		key.start = r.Resolver
+	}
+	return key
+}
+
+// resolveRegions finds the regions with the given names in bin, and returns
+// them along with the names to show for them in results. If lenient is set,
+// regions that cannot be found are skipped instead of returning an error,
+// since an executable reached through exec may only contain some of them. If
+// bin is nil, only shared library regions are resolved. A region that is
+// identical to one of an earlier name (such as a function that is also
+// selected by an alias of its symbol) is only traced once, for the earlier
+// name, and a name whose regions are all such duplicates is merged into the
+// earlier name, as "first, alias".
+func resolveRegions(specs []string, bin *bininfo.BinFile, lenient, verify bool) (*regionSet, []string, error) {
+	set := &regionSet{
+		bin:  bin,
+		locs: make([]Location, len(specs)),
+	}
+	names := make([]string, len(specs))
+
+	// the region index of each distinct region, the number of regions
+	// found for each name, and the duplicates among them with the name
+	// they duplicate
+	seen := make(map[regionKey]int)
+	found := make([]int, len(specs))
+	dups := make([]int, len(specs))
+	dupOf := make([]int, len(specs))
+	addkey := func(reg utrace.Region, key regionKey, addr uint64, id int) {
+		found[id]++
+		if i, ok := seen[key]; ok && set.ids[i] != id {
+			infof("%s: already traced for %s\n", specs[id], specs[set.ids[i]])
+			if dups[id] == 0 {
+				dupOf[id] = set.ids[i]
+			}
+			dups[id]++
+			return
+		}
+		seen[key] = len(set.regions)
+		// a library region has no location in the executable
+		if key.lib == "" && (len(set.ids) == 0 || set.ids[len(set.ids)-1] != id) {
+			loc := Location{
+				Addr: addr,
+			}
+			loc.File, loc.Line, _ = bin.PCToLine(addr)
+			set.locs[id] = loc
+		}
+		set.regions = append(set.regions, reg)
+		set.ids = append(set.ids, id)
+	}
+	addregion := func(reg utrace.Region, addr uint64, id int) {
+		addkey(reg, keyOf(reg), addr, id)
+	}
+	skip := func(err error) error {
+		if !lenient {
+			return err
+		}
+		infof("%v (skipped)\n", err)
+		return nil
+	}
+
+	for i, name := range specs {
+		names[i] = symbolName(name)
+		if lib, fn, ok := splitLibRegion(name); ok {
+			names[i] = lib + ":" + symbolName(fn)
+			infof("%s: in shared library %s\n", fn, lib)
+			// the function's address is only known once the library has
+			// been mapped by the target
+			resolve, resolveIfunc := libResolvers(fn)
+			addkey(&utrace.LibFuncRegion{
+				Lib:          lib,
+				Resolve:      resolve,
+				ResolveIfunc: resolveIfunc,
+			}, regionKey{lib: lib, sym: fn}, 0, i)
+		} else if bin == nil {
+			if err := skip(fmt.Errorf("region %s: no executable to find it in", name)); err != nil {
+				return nil, nil, err
+			}
+		} else if strings.HasPrefix(name, retsPrefix) {
+			reg, err := ParseRetsRegion(name, bin)
+			if err != nil {
+				if err := skip(fmt.Errorf("region %s: %w", name, err)); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			debugf("%s: 0x%x, returns at %#x\n", name, reg.Addr, reg.Rets)
+			names[i] = retsPrefix + symbolName(strings.TrimPrefix(name, retsPrefix))
+
+			addregion(reg, reg.Addr, i)
+		} else if isMarkers(name) {
+			span, err := ParseMarkers(name, bin)
+			if err != nil {
+				if err := skip(fmt.Errorf("region %s: %w", name, err)); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			debugf("%s: span 0x%x-0x%x\n", name, span.StartAddr, span.EndAddr)
+			names[i] = name
+
+			addregion(span, span.StartAddr, i)
+		} else if rest, _, ok := splitSpan(name); ok {
+			span, reg, err := ParseSpan(name, bin, verify)
+			if err != nil {
+				if err := skip(fmt.Errorf("region-parse: %w", err)); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			debugf("%s: span 0x%x-0x%x\n", name, span.StartAddr, span.EndAddr)
+			names[i] = strings.TrimSuffix(name, rest) + regionName(rest, reg, bin)
+
+			addregion(span, span.StartAddr, i)
+		} else if strings.Contains(name, "-") {
+			reg, err := ParseRegion(name, bin, verify)
+			if err != nil {
+				if err := skip(fmt.Errorf("region-parse: %w", err)); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			debugf("%s: 0x%x-0x%x\n", name, reg.StartAddr, reg.EndAddr)
+			names[i] = regionName(name, reg, bin)
+
+			addregion(reg, reg.StartAddr, i)
+		} else if resolver, ok := bin.IfuncToPC(name); ok {
+			// the symbol is the resolver, which chooses the function's
+			// implementation when the target is loaded
+			debugf("%s: indirect function, resolver at 0x%x\n", name, resolver)
+			addregion(&utrace.IfuncRegion{
+				Ifunc: utrace.Ifunc{
+					Resolver: resolver,
+					Slots:    bin.IfuncSlots(resolver),
+				},
+			}, resolver, i)
+		} else {
+			fnpc, fnerr := bin.FuncToPC(name)
+
+			if fnerr == nil {
+				debugf("%s: 0x%x\n", name, fnpc)
+				addregion(&utrace.FuncRegion{
+					Addr: fnpc,
+				}, fnpc, i)
+			}
+
+			inlinings, err := bin.InlinedFuncToPCs(name)
+
+			if len(inlinings) == 0 {
+				debugf("%s not inlined (error: %s)\n", name, err)
+			}
+
+			if err != nil {
+				if fnerr != nil {
+					err := fmt.Errorf("func-lookup: %w, inlined-func-lookup: %s", fnerr, err)
+					if err := skip(err); err != nil {
+						return nil, nil, err
+					}
+				}
+
+				continue
+			}
+			for _, in := range inlinings {
+				debugf("%s (inlined): 0x%x-0x%x\n", name, in.Low, in.High)
+
+				addregion(&utrace.AddressRegion{
+					StartAddr: in.Low,
+					EndAddr:   in.High,
+				}, in.Low, i)
+			}
+		}
+	}
+	for id := range specs {
+		if found[id] > 0 && dups[id] == found[id] && names[id] != names[dupOf[id]] {
+			names[dupOf[id]] += ", " + names[id]
+		}
+	}
+	return set, names, nil
+}
@@ -1,11 +1,30 @@
 package perforator
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
 	"os/exec"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 
 	"acln.ro/perf"
+	"github.com/zyedidia/perforator/utrace"
+	"github.com/zyedidia/perforator/utrace/ptrace"
+	"golang.org/x/sys/unix"
 )
 
 // Tests require permissions to run perf from user code (see the perf paranoid
@@ -45,6 +64,14 @@ func buildGo(src, out string, dwarf, pie bool) error {
 	return err
 }
 
+func buildC(src, out string, flags ...string) error {
+	args := append([]string{"-g", "-O2"}, flags...)
+	args = append(args, "-o", out, src)
+	cmd := exec.Command("cc", args...)
+	_, err := cmd.Output()
+	return err
+}
+
 func check(target string, regions []string, events []perf.Configurator, expected TotalMetrics, t *testing.T) {
 	evs := Events{
 		Base: events,
@@ -53,7 +80,7 @@ func check(target string, regions []string, events []perf.Configurator, expected
 		ExcludeKernel:     true,
 		ExcludeHypervisor: true,
 	}
-	total, err := Run(target, []string{}, regions, evs, opts, func() MetricsWriter { return nil })
+	total, err := Run(context.Background(), target, []string{}, regions, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
 	must(err, t)
 
 	for i, v := range total {
@@ -62,8 +89,8 @@ func check(target string, regions []string, events []perf.Configurator, expected
 			t.Errorf("unexpected result length %d", len(v.Results))
 		}
 		for i, result := range v.Results {
-			if abs(int(result.Value)-int(nm.Results[i].Value)) > near {
-				t.Errorf("unexpected result for %s: %d", nm.Name, result.Value)
+			if abs(int(result.ScaledValue())-int(nm.Results[i].Value)) > near {
+				t.Errorf("unexpected result for %s: %d", nm.Name, result.ScaledValue())
 			}
 		}
 	}
@@ -107,3 +134,2268 @@ func TestSingleRegion(t *testing.T) {
 	}
 	check("test/sum", regions, events, expected, t)
 }
+
+// Tests that a region nested in another is reported with the enclosing region
+// as its parent, and that exclusive counts leave out the nested invocations.
+func TestNestedRegions(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	total, err := Run(context.Background(), "test/twice", []string{}, []string{"main", "work"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 3 || total[2].Name != "main" {
+		t.Fatalf("unexpected invocations %+v", total)
+	}
+	for _, nm := range total[:2] {
+		if len(nm.Parents) != 1 || nm.Parents[0] != "main" {
+			t.Errorf("unexpected parents %v of %s", nm.Parents, nm.Name)
+		}
+	}
+
+	excl := total.Exclusive()
+	if excl[2].Wall != total[2].Wall-total[0].Wall-total[1].Wall {
+		t.Errorf("exclusive wall time %s of main, inclusive %s", excl[2].Wall, total[2].Wall)
+	}
+	if excl[0].Wall != total[0].Wall {
+		t.Errorf("exclusive wall time %s of work, inclusive %s", excl[0].Wall, total[0].Wall)
+	}
+}
+
+// Tests that a recursive function region is entered and exited once per
+// top-level call rather than once per recursive call.
+func TestRecursiveRegion(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildGo("test/fib.go", "test/fib", true, false), t)
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	total, err := Run(context.Background(), "test/fib", []string{}, []string{"main.fib"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+
+	// test/fib.go calls fib(20) three times
+	if len(total) != 3 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+	for _, nm := range total {
+		if abs(int(nm.Results[0].ScaledValue())-int(total[0].Results[0].ScaledValue())) > near {
+			t.Errorf("unexpected result for %s: %d", nm.Name, nm.Results[0].ScaledValue())
+		}
+	}
+}
+
+// Tests that the software profiler records all of its events for the calling
+// thread.
+func TestSoftwareProfiler(t *testing.T) {
+	runtime.LockOSThread()
+
+	p, err := NewSoftwareProfiler(perf.CallingThread, perf.AnyCPU, perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	})
+	must(err, t)
+	if err != nil {
+		return
+	}
+	defer p.Close()
+
+	must(p.Enable(), t)
+	// touch some fresh memory to cause page faults
+	buf := make([]byte, 1<<24)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = 1
+	}
+	must(p.Disable(), t)
+
+	m := p.Metrics()
+	if len(m.Results) != len(softwareProfilerEvents) {
+		t.Errorf("unexpected result length %d", len(m.Results))
+	}
+
+	b, err := json.Marshal(m)
+	must(err, t)
+	var decoded Metrics
+	must(json.Unmarshal(b, &decoded), t)
+	labels := []string{"page-faults", "context-switches", "cpu-migrations", "task-clock"}
+	if len(decoded.Results) != len(labels) {
+		t.Fatalf("unexpected marshaled metrics %s", b)
+	}
+	for i, l := range labels {
+		if decoded.Results[i].Label != l {
+			t.Errorf("result %d: label %q, expected %q", i, decoded.Results[i].Label, l)
+		}
+	}
+}
+
+// Tests that a counter opened from a raw attr counts the calling thread.
+func TestProfilerFromAttr(t *testing.T) {
+	runtime.LockOSThread()
+
+	attr := unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_TASK_CLOCK,
+		Bits:   unix.PerfBitDisabled | unix.PerfBitExcludeKernel | unix.PerfBitExcludeHv,
+	}
+	p, err := NewProfilerFromAttr(attr, perf.CallingThread, perf.AnyCPU, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer p.Close()
+
+	must(p.Enable(), t)
+	buf := make([]byte, 1<<24)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	must(p.Disable(), t)
+
+	m := p.Metrics()
+	if len(m.Results) != 1 || m.Results[0].Value == 0 || m.Results[0].Label != "attr 1:0x1" {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+
+	// the id, and the lost count on Linux 6.0 and later, follow the times
+	// in each read
+	for _, format := range []uint64{unix.PERF_FORMAT_ID | 1<<4, unix.PERF_FORMAT_ID} {
+		attr.Read_format = format
+		p, err := NewProfilerFromAttr(attr, perf.CallingThread, perf.AnyCPU, 0)
+		if err != nil {
+			continue
+		}
+		if m := p.Metrics(); len(m.Results) != 1 || m.Results[0].Anomaly {
+			t.Errorf("read format 0x%x: unexpected metrics %+v", format, m)
+		}
+		p.Close()
+	}
+
+	attr.Read_format = unix.PERF_FORMAT_GROUP
+	if _, err := NewProfilerFromAttr(attr, perf.CallingThread, perf.AnyCPU, 0); err == nil {
+		t.Error("raw attr in the group format allowed")
+	}
+}
+
+// Tests that a perf.Attr is converted to the perf_event_attr that the typed
+// constructors open.
+func TestSysAttr(t *testing.T) {
+	attr := sysAttr(&perf.Attr{
+		Type:   perf.SoftwareEvent,
+		Config: unix.PERF_COUNT_SW_PAGE_FAULTS,
+		SampleFormat: perf.SampleFormat{
+			IP:  true,
+			Tid: true,
+		},
+		CountFormat: perf.CountFormat{
+			Enabled: true,
+			Running: true,
+		},
+		Options: perf.Options{
+			Disabled:      true,
+			ExcludeKernel: true,
+			PreciseIP:     perf.RequestedZeroSkid,
+		},
+		Config1: 0x10001,
+	})
+	bits := unix.PerfBitDisabled | unix.PerfBitExcludeKernel | unix.PerfBitPreciseIPBit2
+	if attr.Type != unix.PERF_TYPE_SOFTWARE || attr.Config != unix.PERF_COUNT_SW_PAGE_FAULTS || attr.Ext1 != 0x10001 {
+		t.Errorf("unexpected event %d:0x%x (config1 0x%x)", attr.Type, attr.Config, attr.Ext1)
+	}
+	if attr.Bits != bits {
+		t.Errorf("got flags 0x%x, expected 0x%x", attr.Bits, bits)
+	}
+	if attr.Sample_type != unix.PERF_SAMPLE_IP|unix.PERF_SAMPLE_TID {
+		t.Errorf("unexpected sample type 0x%x", attr.Sample_type)
+	}
+	if attr.Read_format != unix.PERF_FORMAT_TOTAL_TIME_ENABLED|unix.PERF_FORMAT_TOTAL_TIME_RUNNING {
+		t.Errorf("unexpected read format 0x%x", attr.Read_format)
+	}
+	if attr.Size != uint32(unsafe.Sizeof(attr)) {
+		t.Errorf("unexpected size %d", attr.Size)
+	}
+}
+
+// Tests that an offcore response event is opened with its MSR value in
+// config1. Only Intel CPUs have these events, and the values that they accept
+// differ between microarchitectures.
+func TestOffcoreEvent(t *testing.T) {
+	runtime.LockOSThread()
+
+	ev, ok, err := parseRawEvent("cpu/event=0xb7,umask=0x01,offcore_rsp=0x10001/")
+	if !ok || err != nil || ev.config != 0x1b7 || ev.config1 != 0x10001 {
+		t.Fatalf("unexpected offcore event %+v (%v)", ev, err)
+	}
+	if !strings.Contains(ReadHost().CPU, "Intel") {
+		t.Skip("offcore response events are only available on Intel CPUs")
+	}
+	attr := unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_RAW,
+		Config: ev.config,
+		Ext1:   ev.config1,
+		Bits:   unix.PerfBitDisabled | unix.PerfBitExcludeKernel | unix.PerfBitExcludeHv,
+	}
+	p, err := NewProfilerFromAttr(attr, perf.CallingThread, perf.AnyCPU, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer p.Close()
+	if m := p.Metrics(); len(m.Results) != 1 || m.Results[0].Label != "r1b7,config1=0x10001" {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
+
+// Tests that the cache profiler counts the accesses made while filling a
+// buffer with at least one supported cache event.
+func TestCacheProfiler(t *testing.T) {
+	runtime.LockOSThread()
+
+	p, err := NewCacheProfiler(perf.CallingThread, perf.AnyCPU, perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer p.Close()
+
+	must(p.Enable(), t)
+	buf := make([]byte, 1<<24)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	must(p.Disable(), t)
+
+	prof := p.Profile()
+	if len(prof.Unsupported) == len(cacheProfilerEvents) {
+		t.Errorf("all cache events reported as unsupported")
+	}
+	b, err := json.Marshal(prof)
+	must(err, t)
+	if !bytes.Contains(b, []byte("l1d_read_accesses")) {
+		t.Errorf("unexpected marshaled profile %s", b)
+	}
+}
+
+// Tests that excluding kernel code from a profiler removes the instructions
+// executed during system calls.
+func TestExcludeKernel(t *testing.T) {
+	runtime.LockOSThread()
+
+	open := func(excludeKernel bool) *SingleProfiler {
+		attr := &perf.Attr{
+			CountFormat: perf.CountFormat{
+				Enabled: true,
+				Running: true,
+			},
+			Options: perf.Options{
+				Disabled:          true,
+				ExcludeKernel:     excludeKernel,
+				ExcludeHypervisor: true,
+			},
+		}
+		perf.Instructions.Configure(attr)
+		p, err := NewSingleProfiler(attr, perf.CallingThread, perf.AnyCPU)
+		if err != nil {
+			t.Skip("cannot profile kernel code:", err)
+		}
+		return p
+	}
+	user := open(true)
+	defer user.Close()
+	all := open(false)
+	defer all.Close()
+
+	must(user.Enable(), t)
+	must(all.Enable(), t)
+	for i := 0; i < 10000; i++ {
+		unix.Getppid()
+	}
+	must(all.Disable(), t)
+	must(user.Disable(), t)
+
+	u := user.Metrics().Results[0].ScaledValue()
+	a := all.Metrics().Results[0].ScaledValue()
+	if u >= a {
+		t.Errorf("user-only count %d is not less than the count including the kernel %d", u, a)
+	}
+}
+
+// Tests the running mean and standard deviation computation.
+func TestStat(t *testing.T) {
+	var s Stat
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		s.Add(v)
+	}
+	if s.N != 8 || s.Total != 40 || s.Mean() != 5 {
+		t.Errorf("unexpected stat: n=%d total=%f mean=%f", s.N, s.Total, s.Mean())
+	}
+	if math.Abs(s.Stddev()-math.Sqrt(32.0/7.0)) > 1e-9 {
+		t.Errorf("unexpected stddev: %f", s.Stddev())
+	}
+}
+
+// Tests that ratios are computed from their events, skipped when an event is
+// missing, and rejected when their events are in different groups.
+func TestRatios(t *testing.T) {
+	rs, err := ParseRatios("ipc,cache-miss-rate")
+	must(err, t)
+	results := []Result{
+		{Label: "instructions", Value: 300, Enabled: 1, Running: 1},
+		{Label: "cpu-cycles", Value: 200, Enabled: 1, Running: 1},
+	}
+	if v, ok := rs[0].Value(results); !ok || v != 1.5 {
+		t.Errorf("unexpected ipc %f", v)
+	}
+	if _, ok := rs[1].Value(results); ok {
+		t.Errorf("cache-miss-rate computed without its events")
+	}
+	if err := checkRatios(rs[:1], [][]perf.Configurator{{perf.Instructions}, {perf.CPUCycles}}); err == nil {
+		t.Errorf("ratio accepted with its events in different groups")
+	}
+}
+
+// Tests that hardware events and ratios are dropped, kernel events are
+// excluded and cgroup counters are rejected on a host that lacks support.
+func TestDegrade(t *testing.T) {
+	instructions := &perf.Attr{Label: "instructions", Type: perf.HardwareEvent}
+	cycles := &perf.Attr{Label: "cpu-cycles", Type: perf.HardwareEvent}
+	clock := &perf.Attr{Label: "task-clock", Type: perf.SoftwareEvent}
+	rs, err := ParseRatios("ipc")
+	must(err, t)
+	evs := Events{
+		Base:   []perf.Configurator{instructions, clock},
+		Groups: [][]perf.Configurator{{instructions, cycles}},
+		Ratios: rs,
+	}
+	var opts perf.Options
+	// a virtual machine without a PMU that does not allow kernel events
+	c := Capabilities{Software: true, Paranoid: "2"}
+	warnings, err := c.Degrade(&evs, &opts)
+	must(err, t)
+	if len(warnings) != 3 {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+	if len(evs.Base) != 1 || evs.Base[0] != clock || len(evs.Groups) != 0 || len(evs.Ratios) != 0 {
+		t.Errorf("hardware events left in %+v", evs)
+	}
+	if !opts.ExcludeKernel {
+		t.Errorf("kernel events not excluded")
+	}
+
+	evs = Events{Cgroup: "/sys/fs/cgroup"}
+	if _, err := c.Degrade(&evs, &opts); err == nil {
+		t.Errorf("cgroup counters accepted without support")
+	}
+}
+
+// Tests that events split into user and kernel counters are opened in the
+// same group.
+func TestSplitModes(t *testing.T) {
+	instructions := &perf.Attr{Label: "instructions", Type: perf.HardwareEvent}
+	cycles := &perf.Attr{Label: "cpu-cycles", Type: perf.HardwareEvent}
+	evs := splitModes(Events{
+		Base:   []perf.Configurator{instructions},
+		Groups: [][]perf.Configurator{{instructions, cycles}},
+	})
+	if len(evs.Base) != 0 || len(evs.Groups) != 2 || len(evs.Groups[0]) != 2 || len(evs.Groups[1]) != 4 {
+		t.Fatalf("unexpected groups %v", evs.Groups)
+	}
+	var labels []string
+	for _, c := range evs.Groups[1] {
+		var attr perf.Attr
+		c.Configure(&attr)
+		if attr.Options.ExcludeKernel == attr.Options.ExcludeUser {
+			t.Errorf("%s counts both user and kernel code", attr.Label)
+		}
+		labels = append(labels, attr.Label)
+	}
+	if strings.Join(labels, ",") != "instructions:u,instructions:k,cpu-cycles:u,cpu-cycles:k" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+}
+
+// clockProfiler counts the nanoseconds since it was created, as a counter
+// that keeps running while it is sampled.
+type clockProfiler struct {
+	start time.Time
+}
+
+func (p *clockProfiler) Enable() error  { return nil }
+func (p *clockProfiler) Disable() error { return nil }
+func (p *clockProfiler) Reset() error   { return nil }
+func (p *clockProfiler) Close() error   { return nil }
+func (p *clockProfiler) Metrics() Metrics {
+	d := time.Since(p.start)
+	return Metrics{
+		Results: []Result{{Label: "clock", Value: uint64(d), Enabled: d, Running: d}},
+		Elapsed: d,
+	}
+}
+
+// fixedProfiler always reports the same metrics.
+type fixedProfiler Metrics
+
+func (p fixedProfiler) Enable() error    { return nil }
+func (p fixedProfiler) Disable() error   { return nil }
+func (p fixedProfiler) Reset() error     { return nil }
+func (p fixedProfiler) Close() error     { return nil }
+func (p fixedProfiler) Metrics() Metrics { return Metrics(p) }
+
+// Tests that the counts of a cgroup are added up over the CPUs, and are
+// anomalous if the counter of any CPU is.
+func TestCgroupSum(t *testing.T) {
+	cpu := func(value uint64, anomaly bool) Profiler {
+		return fixedProfiler{
+			Results: []Result{{Label: "instructions", Value: value, Enabled: 2, Running: 1, Cgroup: true, Anomaly: anomaly}},
+		}
+	}
+	p := &cpuSumProfiler{MultiProfiler{profilers: []Profiler{cpu(10, false), cpu(0, true), cpu(5, false)}}}
+	m := p.Metrics()
+	if len(m.Results) != 1 || m.Results[0].Value != 30 || !m.Results[0].Anomaly || !m.Results[0].Cgroup {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
+
+// Tests that an invocation sampled at intervals is split into buckets that
+// add up to its total.
+func TestSeries(t *testing.T) {
+	s := newSampler(time.Millisecond, nil)
+	defer s.Close()
+	prof := &clockProfiler{start: time.Now()}
+	s.begin(prof, monotonicNow())
+	time.Sleep(20 * time.Millisecond)
+	m := prof.Metrics()
+	series := s.end(prof, m, monotonicNow())
+	if len(series) < 2 {
+		t.Fatalf("expected several buckets, got %d", len(series))
+	}
+	var sum uint64
+	for i, b := range series {
+		if i > 0 && b.Start <= series[i-1].Start {
+			t.Errorf("bucket %d starts at %s, before bucket %d", i, b.Start, i-1)
+		}
+		sum += b.Results[0].Value
+	}
+	if sum != m.Results[0].Value {
+		t.Errorf("buckets add up to %d, expected %d", sum, m.Results[0].Value)
+	}
+	if s.end(prof, m, monotonicNow()) != nil {
+		t.Error("series was not removed when the invocation ended")
+	}
+}
+
+// Tests that a counter that goes backwards is reported as an anomaly rather
+// than a huge difference, and left out of the statistics.
+func TestAnomaly(t *testing.T) {
+	read := func(v uint64) Metrics {
+		return Metrics{
+			Results: []Result{{Label: "instructions", Value: v, Enabled: time.Duration(v), Running: time.Duration(v)}},
+			Elapsed: time.Duration(v),
+		}
+	}
+	m, ok := subtractCounts(read(100), read(40))
+	if !ok || m.Anomalous() || m.Results[0].Value != 60 {
+		t.Errorf("unexpected difference %+v", m.Results[0])
+	}
+	m, ok = subtractCounts(read(40), read(100))
+	if ok || !m.Anomalous() || m.Results[0].Value != 0 {
+		t.Errorf("backwards counter not flagged: %+v", m.Results[0])
+	}
+
+	total := TotalMetrics{
+		{Name: "work", Metrics: read(10)},
+		{Name: "work", Metrics: m},
+	}
+	stats := total.Stats()
+	if stats[0].Count != 1 || stats[0].Anomalies != 1 || stats[0].Results[0].Total != 10 {
+		t.Errorf("unexpected stats: %d invocations, %d anomalies, total %.0f", stats[0].Count, stats[0].Anomalies, stats[0].Results[0].Total)
+	}
+}
+
+// Tests that counters that fail to be read are reported as anomalies with
+// their labels.
+func TestReadAnomaly(t *testing.T) {
+	runtime.LockOSThread()
+
+	attrs := []*perf.Attr{new(perf.Attr), new(perf.Attr)}
+	perf.TaskClock.Configure(attrs[0])
+	perf.PageFaults.Configure(attrs[1])
+	group, err := NewGroupProfiler(attrs, perf.CallingThread, perf.AnyCPU)
+	if err != nil {
+		t.Skip(err)
+	}
+	group.Close()
+	m := group.Metrics()
+	if len(m.Results) != 2 || !m.Anomalous() || m.Results[0].Label != "task-clock" || m.Results[1].Label != "page-faults" {
+		t.Errorf("unexpected group metrics %+v", m)
+	}
+
+	raw, err := NewProfilerFromAttr(unix.PerfEventAttr{
+		Type:   unix.PERF_TYPE_SOFTWARE,
+		Config: unix.PERF_COUNT_SW_TASK_CLOCK,
+	}, perf.CallingThread, perf.AnyCPU, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	raw.Close()
+	m = raw.Metrics()
+	if len(m.Results) != 1 || !m.Anomalous() || m.Results[0].Value != 0 {
+		t.Errorf("unexpected raw metrics %+v", m)
+	}
+}
+
+// Compares reading the memory of a traced process with a single
+// process_vm_readv call (ReadMem) to reading it a word at a time with
+// PTRACE_PEEKDATA, for the size of a stack frame and of a page, when run with
+// go test -bench ReadMem. Writing the same code back with WriteMem, which
+// falls back to PTRACE_POKEDATA for read-only text as when a breakpoint is
+// placed, is compared to PokeData as well.
+func BenchmarkReadMem(b *testing.B) {
+	if err := buildC("test/sleep.c", "test/sleep"); err != nil {
+		b.Fatal(err)
+	}
+	reads := []struct {
+		name string
+		read func(t *ptrace.Tracer, addr uintptr, data []byte) (int, error)
+	}{
+		{"ReadMem", (*ptrace.Tracer).ReadMem},
+		{"PeekData", (*ptrace.Tracer).PeekData},
+		{"WriteMem", (*ptrace.Tracer).WriteMem},
+		{"PokeData", (*ptrace.Tracer).PokeData},
+	}
+	for _, r := range reads {
+		for _, size := range []int{16, 4096} {
+			read := r.read
+			buf := make([]byte, size)
+			b.Run(fmt.Sprintf("%s/%d", r.name, size), func(b *testing.B) {
+				// each benchmark runs on its own goroutine, so it
+				// traces a target of its own
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+
+				bin, err := readBinary("test/sleep", BinOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				addr, err := bin.FuncToPC("work")
+				if err != nil {
+					b.Fatal(err)
+				}
+				regions := []utrace.Region{
+					&utrace.FuncRegion{
+						Addr: addr,
+					},
+				}
+				prog, pid, err := utrace.NewProgram(bin, "test/sleep", []string{}, regions, utrace.Options{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer unix.Wait4(pid, nil, unix.WALL, nil)
+				defer utrace.KillTarget(pid)
+				// PTRACE_PEEKDATA needs the target to be stopped, as it
+				// is at the entry of the region
+				for {
+					var ws utrace.Status
+					p, evs, err := prog.Wait(&ws)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(evs) > 0 {
+						break
+					}
+					if err := prog.Continue(p, ws); err != nil {
+						b.Fatal(err)
+					}
+				}
+				off, err := bin.PieOffset(pid)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				tracer := ptrace.NewTracer(pid)
+				// writes put back the code that is there
+				if _, err := tracer.ReadMem(uintptr(addr+off), buf); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := read(tracer, uintptr(addr+off), buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+var benchmarkSum uint64
+
+// Reports the events counted while summing a slice along with the time of
+// each sum, as instructions/op, cpu-cycles/op, and so on, when run with
+// go test -bench Sum.
+func BenchmarkSum(b *testing.B) {
+	numbers := make([]uint32, 1<<16)
+	for i := range numbers {
+		numbers[i] = uint32(i)
+	}
+	BenchmarkRegion(b, func() {
+		for _, n := range numbers {
+			benchmarkSum += uint64(n)
+		}
+	})
+}
+
+// Tests that histogram quantiles are within the bucket error and the maximum
+// is exact.
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for v := uint64(1); v <= 100000; v++ {
+		h.Add(v)
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		expected := q * 100000
+		if math.Abs(float64(h.Quantile(q))-expected) > expected*0.04 {
+			t.Errorf("p%.0f: got %d, expected about %.0f", q*100, h.Quantile(q), expected)
+		}
+	}
+	if h.Quantile(1) != 100000 || h.Max() != 100000 {
+		t.Errorf("unexpected max: %d", h.Max())
+	}
+}
+
+// Tests that nested regions are subtracted from their parents in folded
+// output.
+func TestFolded(t *testing.T) {
+	result := func(v uint64) Metrics {
+		return Metrics{
+			Results: []Result{
+				{Label: "instructions", Value: v, Enabled: 1, Running: 1},
+			},
+		}
+	}
+	total := TotalMetrics{
+		{Name: "inner", Parents: []string{"outer"}, Metrics: result(30)},
+		{Name: "outer", Metrics: result(100)},
+	}
+
+	b := &bytes.Buffer{}
+	must(total.WriteFolded(b, "instructions"), t)
+	expected := "outer 70\nouter;inner 30\n"
+	if b.String() != expected {
+		t.Errorf("unexpected folded output %q", b.String())
+	}
+}
+
+// Tests that scopes perf rejects are refused and CPU lists are parsed.
+func TestProfilerScope(t *testing.T) {
+	if err := checkScope(-1, perf.AnyCPU); err == nil {
+		t.Error("profiler for every process on every CPU allowed")
+	}
+	if err := checkScope(-2, 0); err == nil {
+		t.Error("invalid pid allowed")
+	}
+	for _, scope := range [][2]int{{0, -1}, {0, 1}, {-1, 1}} {
+		if err := checkScope(scope[0], scope[1]); err != nil {
+			t.Errorf("scope %v: %v", scope, err)
+		}
+	}
+	if err := checkCgroupScope(3, perf.AnyCPU); err == nil {
+		t.Error("profiler for a cgroup on every CPU allowed")
+	}
+
+	cpus, err := parseCPUList("0-2,5")
+	must(err, t)
+	if fmt.Sprint(cpus) != "[0 1 2 5]" {
+		t.Errorf("unexpected cpus %v", cpus)
+	}
+}
+
+// Tests that the invocations of each thread are aggregated separately and
+// sorted by thread ID.
+func TestThreadStats(t *testing.T) {
+	result := func(v uint64) Metrics {
+		return Metrics{
+			Results: []Result{
+				{Label: "instructions", Value: v, Enabled: 1, Running: 1},
+			},
+		}
+	}
+	total := TotalMetrics{
+		{Name: "work", Tid: 12, Metrics: result(10)},
+		{Name: "work", Tid: 11, Metrics: result(20)},
+		{Name: "work", Tid: 12, Metrics: result(30)},
+	}
+
+	stats := total.Stats()
+	if len(stats) != 1 || stats[0].Results[0].Total != 60 {
+		t.Fatalf("unexpected merged stats %+v", stats)
+	}
+	threads := stats[0].Threads
+	if len(threads) != 2 || threads[0].Tid != 11 || threads[1].Tid != 12 {
+		t.Fatalf("unexpected threads %+v", threads)
+	}
+	if threads[0].Results[0].Total != 20 || threads[1].Results[0].Total != 40 {
+		t.Errorf("unexpected per-thread totals %f, %f", threads[0].Results[0].Total, threads[1].Results[0].Total)
+	}
+}
+
+// Tests that the system calls made inside a region are reported.
+func TestSyscallStops(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/sleep.c", "test/sleep"), t)
+	bin, err := readBinary("test/sleep", BinOptions{})
+	must(err, t)
+	addr, err := bin.FuncToPC("work")
+	must(err, t)
+	regions := []utrace.Region{
+		&utrace.FuncRegion{
+			Addr: addr,
+		},
+	}
+	prog, _, err := utrace.NewProgram(bin, "test/sleep", []string{}, regions, utrace.Options{Syscalls: true})
+	must(err, t)
+
+	var enter, exit int
+	for {
+		var ws utrace.Status
+		p, evs, err := prog.Wait(&ws)
+		if err == utrace.ErrFinishedTrace {
+			break
+		}
+		must(err, t)
+		for _, ev := range evs {
+			switch ev.State {
+			case utrace.RegionSyscallEnter:
+				enter++
+			case utrace.RegionSyscallExit:
+				exit++
+			}
+		}
+		must(prog.Continue(p, ws), t)
+	}
+	// two invocations of work, which sleeps 10 times
+	if enter != 20 || exit != 20 {
+		t.Errorf("expected 20 system call entries and exits, got %d and %d", enter, exit)
+	}
+}
+
+// Tests that invocations are broken down by the CPU they were entered on.
+func TestCPUStats(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	var cpus unix.CPUSet
+	cpus.Set(0)
+	total, err := Run(context.Background(), "test/twice", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, utrace.Options{Affinity: &cpus}, BinOptions{}, nil)
+	must(err, t)
+	for _, nm := range total {
+		if nm.CPU != 0 {
+			t.Errorf("invocation of pinned target entered on cpu %d", nm.CPU)
+		}
+	}
+
+	total = append(total, NamedMetrics{Name: "work", CPU: 1}, NamedMetrics{Name: "work", CPU: -1})
+	stats := total.Stats()
+	cpu := stats[0].CPUs
+	if len(cpu) != 2 || cpu[0].CPU != 0 || cpu[0].Count != 2 || cpu[1].CPU != 1 || cpu[1].Count != 1 {
+		t.Errorf("unexpected per-cpu stats %+v", cpu)
+	}
+}
+
+// Tests that counts are abbreviated with thousands separators and SI
+// suffixes.
+func TestHumanCount(t *testing.T) {
+	tests := map[float64]string{
+		0:          "0",
+		12.34:      "12.3",
+		999:        "999",
+		1234:       "1,234",
+		999999:     "999,999",
+		49802557:   "49.8M",
+		1.5e9:      "1.5G",
+		999.6e6:    "1G",
+		123.456e12: "123T",
+	}
+	for v, want := range tests {
+		if got := humanCount(v); got != want {
+			t.Errorf("humanCount(%v) = %q, expected %q", v, got, want)
+		}
+	}
+}
+
+// Tests that the context of the slowest invocation is kept.
+func TestExtremes(t *testing.T) {
+	total := TotalMetrics{
+		{Name: "work", Tid: 11, Metrics: Metrics{Wall: 10}, Callers: []string{"a"}},
+		{Name: "work", Tid: 12, Metrics: Metrics{Wall: 30}, Callers: []string{"b"}},
+		{Name: "work", Tid: 11, Metrics: Metrics{Wall: 20}, Callers: []string{"c"}},
+	}
+
+	r := total.Stats()[0]
+	if r.WallMax.Value != 30 || r.WallMax.Tid != 12 || r.WallMax.Callers[0] != "b" {
+		t.Errorf("unexpected max %+v", r.WallMax)
+	}
+	if r.WallMin.Value != 10 || r.WallMin.Callers[0] != "a" {
+		t.Errorf("unexpected min %+v", r.WallMin)
+	}
+}
+
+// Tests that the timeline has the invocations in time order.
+func TestChromeTrace(t *testing.T) {
+	total := TotalMetrics{
+		{Name: "inner", Tid: 11, Start: 2000, End: 3000},
+		{Name: "outer", Tid: 11, Start: 1000, End: 4000},
+	}
+
+	b := &bytes.Buffer{}
+	must(total.WriteChromeTrace(b), t)
+	var trace struct {
+		TraceEvents []traceEvent
+	}
+	must(json.Unmarshal(b.Bytes(), &trace), t)
+	var order []string
+	for _, ev := range trace.TraceEvents {
+		order = append(order, ev.Ph+" "+ev.Name)
+	}
+	if strings.Join(order, ",") != "B outer,B inner,E inner,E outer" {
+		t.Errorf("unexpected order %v", order)
+	}
+}
+
+// Tests that the JSON report carries the schema version, host events and
+// regions, and that its compact and indented forms agree.
+func TestJSONReport(t *testing.T) {
+	total := TotalMetrics{
+		{Name: "sum", Metrics: Metrics{
+			Results: []Result{
+				{Label: "instructions", Value: 100, Enabled: 1, Running: 1},
+			},
+		}},
+	}
+
+	events := []string{"instructions", "cpu-cycles"}
+	b := &bytes.Buffer{}
+	must(total.WriteJSON(b, events), t)
+	var report struct {
+		Schema int
+		Host   Host
+		// decoded generically so that renamed fields are caught
+		Regions []map[string]interface{}
+	}
+	must(json.Unmarshal(b.Bytes(), &report), t)
+	if report.Schema != JSONSchema || !reflect.DeepEqual(report.Host.Events, events) || len(report.Regions) != 1 {
+		t.Errorf("unexpected report %s", b.String())
+	}
+	if report.Regions[0]["region"] != "sum" {
+		t.Errorf("unexpected region record %v", report.Regions[0])
+	}
+
+	pretty := &bytes.Buffer{}
+	must(total.WriteJSONIndent(pretty, events, "  "), t)
+	if bytes.Count(b.Bytes(), []byte("\n")) != 1 || !bytes.Contains(pretty.Bytes(), []byte("\n  \"schema\": ")) {
+		t.Errorf("unexpected layout of compact report %q or indented report %q", b.String(), pretty.String())
+	}
+	var compact, indented interface{}
+	must(json.Unmarshal(b.Bytes(), &compact), t)
+	must(json.Unmarshal(pretty.Bytes(), &indented), t)
+	if !reflect.DeepEqual(compact, indented) {
+		t.Errorf("indented report %s differs from compact report %s", pretty.String(), b.String())
+	}
+}
+
+// Tests that base and group events are labelled, including when split into
+// user and kernel counters.
+func TestEventLabels(t *testing.T) {
+	cycles := &perf.Attr{Label: "cpu-cycles", Type: perf.HardwareEvent}
+	clock := &perf.Attr{Label: "task-clock", Type: perf.SoftwareEvent}
+	events := Events{
+		Base:   []perf.Configurator{cycles},
+		Groups: [][]perf.Configurator{{clock}},
+	}
+	if l := events.Labels(); !reflect.DeepEqual(l, []string{"cpu-cycles", "task-clock"}) {
+		t.Errorf("unexpected labels %v", l)
+	}
+	events.SplitModes = true
+	if l := events.Labels(); !reflect.DeepEqual(l, []string{"cpu-cycles:u", "cpu-cycles:k", "task-clock:u", "task-clock:k"}) {
+		t.Errorf("unexpected labels with split modes %v", l)
+	}
+}
+
+// Tests that the CPU model is read from x86-64 and arm64 /proc/cpuinfo.
+func TestCPUModel(t *testing.T) {
+	x86 := "processor\t: 0\nvendor_id\t: GenuineIntel\nmodel name\t: Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz\n\nprocessor\t: 1\nmodel name\t: other\n"
+	arm64 := "processor\t: 0\nBogoMIPS\t: 50.00\nCPU implementer\t: 0x41\nCPU architecture: 8\nCPU part\t: 0xd0c\n\nprocessor\t: 1\nCPU implementer\t: 0x42\nCPU part\t: 0xd0d\n"
+	if m := cpuModel(strings.NewReader(x86)); m != "Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz" {
+		t.Errorf("unexpected x86-64 model %q", m)
+	}
+	if m := cpuModel(strings.NewReader(arm64)); m != "implementer 0x41 part 0xd0c" {
+		t.Errorf("unexpected arm64 model %q", m)
+	}
+}
+
+// Tests that Prometheus output names metrics after their events and escapes
+// region labels.
+func TestPrometheus(t *testing.T) {
+	total := TotalMetrics{
+		{Name: `say "hi"`, Metrics: Metrics{
+			Results: []Result{
+				{Label: "l1d-read-misses", Value: 100, Enabled: 1, Running: 1},
+			},
+		}},
+	}
+
+	b := &bytes.Buffer{}
+	must(total.WritePrometheus(b), t)
+	want := `perforator_region_l1d_read_misses_total{region="say \"hi\"",event="l1d-read-misses"} 100`
+	if !strings.Contains(b.String(), want+"\n") {
+		t.Errorf("missing %s in:\n%s", want, b.String())
+	}
+}
+
+// protoField is a field of a decoded protobuf message.
+type protoField struct {
+	num   int
+	value uint64
+	data  []byte
+}
+
+// decodeProto splits a protobuf message into its varint and length-delimited
+// fields, which are the only wire types that WritePprof uses.
+func decodeProto(data []byte, t *testing.T) []protoField {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		f := protoField{num: int(key >> 3)}
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("truncated field %d", f.num)
+		}
+		data = data[n:]
+		switch key & 7 {
+		case wireVarint:
+			f.value = v
+		case wireBytes:
+			f.data, data = data[:v], data[v:]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", key&7, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// decodePacked decodes a packed repeated varint field.
+func decodePacked(data []byte) []uint64 {
+	var xs []uint64
+	for len(data) > 0 {
+		x, n := binary.Uvarint(data)
+		data = data[n:]
+		xs = append(xs, x)
+	}
+	return xs
+}
+
+// Tests that a pprof profile decodes to one sample and location per region,
+// with the events as sample types and the file and line of each region that
+// has a location.
+func TestPprof(t *testing.T) {
+	evs := []Result{
+		{Label: "instructions", Value: 100, Enabled: 1, Running: 1},
+		{Label: "branch-misses", Value: 3, Enabled: 1, Running: 1},
+	}
+	total := TotalMetrics{
+		{Name: "loop", Loc: Location{Addr: 0x1130, File: "loop.c", Line: 12}, Metrics: Metrics{Results: evs}},
+		{Name: "loop", Loc: Location{Addr: 0x1130, File: "loop.c", Line: 12}, Metrics: Metrics{Results: evs}},
+		{Name: "work", Metrics: Metrics{Results: evs}},
+	}
+
+	b := &bytes.Buffer{}
+	must(total.WritePprof(b), t)
+	gz, err := gzip.NewReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type function struct {
+		name, file string
+	}
+	type location struct {
+		fn   uint64
+		line uint64
+	}
+	var (
+		strs      []string
+		types     [][2]uint64
+		samples   [][]uint64
+		locations = make(map[uint64]location)
+		functions = make(map[uint64]function)
+		fnStrs    = make(map[uint64][2]uint64)
+	)
+	for _, f := range decodeProto(data, t) {
+		switch f.num {
+		case 1:
+			var vt [2]uint64
+			for _, g := range decodeProto(f.data, t) {
+				vt[g.num-1] = g.value
+			}
+			types = append(types, vt)
+		case 2:
+			var locs, values []uint64
+			for _, g := range decodeProto(f.data, t) {
+				switch g.num {
+				case 1:
+					locs = decodePacked(g.data)
+				case 2:
+					values = decodePacked(g.data)
+				}
+			}
+			samples = append(samples, append(locs, values...))
+		case 4:
+			var id uint64
+			var loc location
+			for _, g := range decodeProto(f.data, t) {
+				switch g.num {
+				case 1:
+					id = g.value
+				case 4:
+					for _, h := range decodeProto(g.data, t) {
+						switch h.num {
+						case 1:
+							loc.fn = h.value
+						case 2:
+							loc.line = h.value
+						}
+					}
+				}
+			}
+			locations[id] = loc
+		case 5:
+			var id uint64
+			var name, file uint64
+			for _, g := range decodeProto(f.data, t) {
+				switch g.num {
+				case 1:
+					id = g.value
+				case 2:
+					name = g.value
+				case 4:
+					file = g.value
+				}
+			}
+			fnStrs[id] = [2]uint64{name, file}
+		case 6:
+			strs = append(strs, string(f.data))
+		}
+	}
+	// the string table is written last, so functions are resolved afterwards
+	for id, s := range fnStrs {
+		functions[id] = function{name: strs[s[0]], file: strs[s[1]]}
+	}
+
+	var names []string
+	for _, vt := range types {
+		names = append(names, strs[vt[0]]+"/"+strs[vt[1]])
+	}
+	want := []string{"instructions/count", "branch-misses/count", "invocations/count", "time-elapsed/nanoseconds", "wall-time/nanoseconds"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got sample types %v, expected %v", names, want)
+	}
+	if len(samples) != 2 || len(locations) != 2 {
+		t.Fatalf("got %d samples and %d locations, expected 2 of each", len(samples), len(locations))
+	}
+
+	for _, sample := range samples {
+		// the location id, followed by one value per sample type
+		if len(sample) != 1+len(want) {
+			t.Errorf("sample %v has %d values, expected %d", sample, len(sample)-1, len(want))
+			continue
+		}
+		loc := locations[sample[0]]
+		fn := functions[loc.fn]
+		switch fn.name {
+		case "loop":
+			if fn.file != "loop.c" || loc.line != 12 {
+				t.Errorf("loop: got %s:%d, expected loop.c:12", fn.file, loc.line)
+			}
+			if sample[1] != 200 || sample[2] != 6 || sample[3] != 2 {
+				t.Errorf("loop: got values %v", sample[1:])
+			}
+		case "work":
+			if fn.file != "" || loc.line != 0 {
+				t.Errorf("work: got %s:%d without a location", fn.file, loc.line)
+			}
+			if sample[1] != 100 || sample[3] != 1 {
+				t.Errorf("work: got values %v", sample[1:])
+			}
+		default:
+			t.Errorf("unexpected function %q", fn.name)
+		}
+	}
+}
+
+// Tests that invocations are sent to a stream's client, and that the stream
+// keeps working after the client disconnects.
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perforator")
+	must(err, t)
+	defer os.RemoveAll(dir)
+	path := dir + "/stream.sock"
+
+	s, err := NewStream(path)
+	must(err, t)
+	conn, err := net.Dial("unix", path)
+	must(err, t)
+	// the client is registered in the background
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := len(s.clients)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	must(s.Write(NamedMetrics{Name: "sum"}), t)
+	var rec map[string]interface{}
+	must(json.NewDecoder(conn).Decode(&rec), t)
+	if rec["region"] != "sum" {
+		t.Errorf("unexpected record %v", rec)
+	}
+
+	conn.Close()
+	for i := 0; i < 10; i++ {
+		must(s.Write(NamedMetrics{Name: "sum"}), t)
+	}
+	must(s.Close(), t)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed: %v", err)
+	}
+}
+
+// Tests that a region is measured in both the parent and the child of a
+// fork.
+func TestForkRegion(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/fork.c", "test/fork"), t)
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	total, err := Run(context.Background(), "test/fork", []string{}, []string{"work"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+
+	if len(total) != 2 {
+		t.Fatalf("unexpected number of invocations %d", len(total))
+	}
+	if total[0].Tid == total[1].Tid {
+		t.Errorf("region was not measured in both processes")
+	}
+}
+
+// Tests that regions are found at the right addresses in both position
+// independent (ET_DYN) and fixed-address (ET_EXEC) builds of a program.
+func TestPie(t *testing.T) {
+	runtime.LockOSThread()
+
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	var counts []uint64
+	for _, flag := range []string{"-pie", "-no-pie"} {
+		must(buildC("test/sum.c", "test/sum"+flag, "-fPIE", flag), t)
+
+		f, err := elf.Open("test/sum" + flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ := f.Type
+		f.Close()
+		if flag == "-no-pie" && typ != elf.ET_EXEC || flag == "-pie" && typ != elf.ET_DYN {
+			t.Fatalf("%s: unexpected elf type %s", flag, typ)
+		}
+
+		total, err := Run(context.Background(), "test/sum"+flag, []string{}, []string{"sum"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+		must(err, t)
+		if len(total) != 1 {
+			t.Fatalf("%s: unexpected number of invocations %d", flag, len(total))
+		}
+		counts = append(counts, total[0].Results[0].Value)
+	}
+	if math.Abs(float64(counts[0])-float64(counts[1])) > 0.1*float64(counts[0]) {
+		t.Errorf("instruction counts differ between builds: %d, %d", counts[0], counts[1])
+	}
+}
+
+// Tests that regions can be found in a stripped binary through its
+// .gnu_debuglink.
+func TestDebugLink(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/sum.c", "test/sum-stripped"), t)
+	for _, args := range [][]string{
+		{"objcopy", "--only-keep-debug", "test/sum-stripped", "test/sum-stripped.debug"},
+		{"strip", "--strip-all", "test/sum-stripped"},
+		{"objcopy", "--add-gnu-debuglink=test/sum-stripped.debug", "test/sum-stripped"},
+	} {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Skipf("%s: %v: %s", args[0], err, out)
+		}
+	}
+
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	total, err := Run(context.Background(), "test/sum-stripped", []string{}, []string{"sum"}, 0, evs, perf.Options{ExcludeKernel: true, ExcludeHypervisor: true}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 1 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests that each invocation of a region is measured on its own, both when
+// counters are reset and when they are read and subtracted.
+func TestInvocationDeltas(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	for _, noReset := range []bool{false, true} {
+		evs := Events{
+			Groups: [][]perf.Configurator{
+				{perf.Instructions, perf.BranchInstructions},
+			},
+			NoReset: noReset,
+		}
+		total, err := Run(context.Background(), "test/twice", []string{}, []string{"work"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+		must(err, t)
+
+		if len(total) != 2 {
+			t.Fatalf("unexpected number of invocations %d", len(total))
+		}
+		for i := range total[0].Results {
+			a := total[0].Results[i].Value
+			b := total[1].Results[i].Value
+			if a == 0 || math.Abs(float64(a)-float64(b)) > 0.1*float64(a) {
+				t.Errorf("no-reset=%v: %s differs between invocations: %d, %d", noReset, total[0].Results[i].Label, a, b)
+			}
+		}
+	}
+}
+
+// Tests profiling through the library interface.
+func TestPerforator(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	p := New("test/twice", Options{
+		Events: Events{
+			Base: []perf.Configurator{
+				perf.Instructions,
+			},
+		},
+	})
+	p.AddRegion("work")
+	results, err := p.Run(nil)
+	must(err, t)
+
+	work := results.Region("work")
+	if work == nil {
+		t.Fatal("region was never entered")
+	}
+	if work.Count != 2 {
+		t.Errorf("region entered %d times, expected 2", work.Count)
+	}
+}
+
+func ExamplePerforator() {
+	p := New("./bench", Options{
+		Events: Events{
+			Base: []perf.Configurator{
+				perf.Instructions,
+			},
+		},
+	})
+	p.AddRegion("sum")
+	results, err := p.Run([]string{"-n", "1000"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, r := range results.Stats() {
+		fmt.Printf("%s: %d calls, %.0f instructions on average\n", r.Name, r.Count, r.Results[0].Mean())
+	}
+}
+
+// Tests that an unsuccessful exit of the target is reported.
+func TestExitCode(t *testing.T) {
+	runtime.LockOSThread()
+
+	_, err := Run(context.Background(), "/bin/false", []string{}, nil, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+	if exitErr.ExitCode() != 1 {
+		t.Errorf("unexpected exit code %d", exitErr.ExitCode())
+	}
+}
+
+// Tests that the target's initial stops are handled the same way every time
+// it is started.
+func TestStartStress(t *testing.T) {
+	runtime.LockOSThread()
+
+	for i := 0; i < 1000; i++ {
+		_, err := Run(context.Background(), "/bin/true", []string{}, nil, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+		if err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+	}
+}
+
+// Tests that a trap executed by the target itself is delivered to it.
+func TestForeignTrap(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/trap.c", "test/trap"), t)
+	total, err := Run(context.Background(), "test/trap", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 1 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests a region in a shared library that is loaded after the target starts.
+func TestLibRegion(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/libm.c", "test/libm", "-Wl,--no-as-needed", "-lm"), t)
+	total, err := Run(context.Background(), "test/libm", []string{}, []string{"libm.so:frexp"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 3 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+	for _, nm := range total {
+		if nm.Name != "libm.so:frexp" {
+			t.Errorf("unexpected region name %s", nm.Name)
+		}
+	}
+}
+
+// Tests a region in a library that is loaded and unloaded repeatedly with
+// dlopen/dlclose.
+func TestDlopenRegion(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/dlopen.c", "test/dlopen", "-Wl,--no-as-needed", "-ldl"), t)
+	total, err := Run(context.Background(), "test/dlopen", []string{}, []string{"libm.so:frexp"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 3 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests that regions are found in an executable that a wrapper script execs.
+func TestFollowExec(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/sum.c", "test/sum-wrapped"), t)
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	total, err := Run(context.Background(), "test/wrapper.sh", []string{}, []string{"sum"}, 0, evs, opts, utrace.Options{FollowExec: true}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 1 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests that invocations left with longjmp or by exiting are reported as
+// incomplete.
+func TestIncomplete(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/longjmp.c", "test/longjmp"), t)
+	total, err := Run(context.Background(), "test/longjmp", []string{}, []string{"jump", "stop"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 4 {
+		t.Fatalf("unexpected number of invocations %d", len(total))
+	}
+	for _, nm := range total {
+		if !nm.Incomplete {
+			t.Errorf("invocation of %s not marked incomplete", nm.Name)
+		}
+	}
+	stats := total.Stats()
+	if stats[0].Name != "jump" || stats[0].Incomplete != 3 || stats[0].Count != 0 {
+		t.Errorf("unexpected stats %+v", stats[0])
+	}
+}
+
+// Tests that a function that tail calls itself through another function is
+// measured as a single invocation.
+func TestTailCall(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/tail.c", "test/tail"), t)
+	total, err := Run(context.Background(), "test/tail", []string{}, []string{"even"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 3 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+	for _, nm := range total {
+		if nm.Incomplete {
+			t.Errorf("invocation of %s marked incomplete", nm.Name)
+		}
+	}
+}
+
+// Tests that a span pairs each entry with the next end, and that a nested
+// span counts repeated entries.
+func TestSpan(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/span.c", "test/span"), t)
+	bin, err := readBinary("test/span", BinOptions{})
+	must(err, t)
+	acquire, err := bin.FuncToPC("acquire")
+	must(err, t)
+	release, err := bin.FuncToPC("release")
+	must(err, t)
+	loc := fmt.Sprintf("0x%x-0x%x", acquire, release)
+
+	total, err := Run(context.Background(), "test/span", []string{}, []string{"span:" + loc, "nested-span:" + loc}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	// the second acquire abandons the first entry of the span, but is
+	// counted by the nested span
+	incomplete := map[string]int{
+		"span:acquire-release":        1,
+		"nested-span:acquire-release": 0,
+	}
+	stats := total.Stats()
+	if len(stats) != len(incomplete) {
+		t.Fatalf("unexpected number of regions %d", len(stats))
+	}
+	for _, r := range stats {
+		if n, ok := incomplete[r.Name]; !ok || r.Count != 4 || r.Incomplete != n {
+			t.Errorf("unexpected stats for %s: %d complete, %d incomplete", r.Name, r.Count, r.Incomplete)
+		}
+	}
+}
+
+// Tests that a region is delimited by calls to the markers of
+// include/perforator.h, even when they are made from different functions.
+func TestMarkers(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/markers.c", "test/markers"), t)
+	total, err := Run(context.Background(), "test/markers", []string{}, []string{"markers"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	stats := total.Stats()
+	if len(stats) != 1 || stats[0].Name != "markers" || stats[0].Count != 3 || stats[0].Incomplete != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// Tests that a function with several return instructions is measured the
+// same whether it ends at its return address or at its return instructions.
+func TestRetsRegion(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/rets.c", "test/rets"), t)
+	bin, err := readBinary("test/rets", BinOptions{})
+	must(err, t)
+	must(loadCode(bin, "test/rets", BinOptions{}), t)
+	reg, err := ParseRetsRegion("rets:classify", bin)
+	must(err, t)
+	if len(reg.Rets) < 2 {
+		t.Skipf("classify was compiled with %d return instructions", len(reg.Rets))
+	}
+
+	total, err := Run(context.Background(), "test/rets", []string{}, []string{"classify", "rets:classify"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	stats := total.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("unexpected number of regions %d", len(stats))
+	}
+	for _, r := range stats {
+		if r.Count != 30 || r.Incomplete != 0 {
+			t.Errorf("unexpected stats for %s: %d complete, %d incomplete", r.Name, r.Count, r.Incomplete)
+		}
+	}
+}
+
+// Tests that invocations are flagged when the region's return address is
+// reached on another stack.
+func TestStackMismatch(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/coro.c", "test/coro"), t)
+	total, err := Run(context.Background(), "test/coro", []string{}, []string{"yield"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	mismatched := 0
+	for _, nm := range total {
+		if nm.StackMismatch {
+			mismatched++
+		}
+	}
+	if mismatched == 0 {
+		t.Errorf("no invocations of %d flagged", len(total))
+	}
+}
+
+// Tests that a region is no longer measured once it reaches the limit.
+func TestLimit(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/tail.c", "test/tail"), t)
+	total, err := Run(context.Background(), "test/tail", []string{}, []string{"even"}, 0, Events{}, perf.Options{}, utrace.Options{Limit: 2}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 2 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests that threads running a region while another thread removes its
+// breakpoint are not killed by a trap they hit just before it was removed.
+func TestLimitThreads(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/threads.c", "test/threads", "-pthread"), t)
+	total, err := Run(context.Background(), "test/threads", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, utrace.Options{Limit: 1}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) == 0 {
+		t.Errorf("no invocations of work")
+	}
+}
+
+// Tests that a Go program whose goroutines move between threads in the middle
+// of a region runs to completion, with every call to the region either
+// measured or reported as incomplete.
+func TestGoroutines(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildGo("test/goroutines.go", "test/goroutines", true, false), t)
+	opts := utrace.Options{
+		Env: append(os.Environ(), "GOMAXPROCS=4"),
+	}
+	total, err := Run(context.Background(), "test/goroutines", []string{}, []string{"main.work"}, 0, Events{}, perf.Options{}, opts, BinOptions{}, nil)
+	must(err, t)
+	// test/goroutines.go calls work 50 times in each of 8 goroutines
+	if len(total) != 400 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests that only every Kth invocation is measured with a sample rate.
+func TestSampleRate(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	total, err := Run(context.Background(), "test/twice", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, utrace.Options{SampleRate: 2}, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 1 {
+		t.Errorf("unexpected number of invocations %d", len(total))
+	}
+}
+
+// Tests that the target's output can be redirected to a file.
+func TestChildStdout(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	f, err := ioutil.TempFile("", "perforator")
+	must(err, t)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = Run(context.Background(), "test/twice", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, utrace.Options{Stdout: f}, BinOptions{}, nil)
+	must(err, t)
+	out, err := ioutil.ReadFile(f.Name())
+	must(err, t)
+	if string(out) != "999999000000\n" {
+		t.Errorf("unexpected target output %q", out)
+	}
+}
+
+// Tests that a region outside the target's memory is reported clearly.
+func TestUnmappedRegion(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	_, err := Run(context.Background(), "test/twice", []string{}, []string{"0x10000000-0x10000010"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "not mapped") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Tests that sampling a multithreaded target, without pinning it to a CPU,
+// attributes samples to the function its threads run. The highest precise_ip
+// level is requested, which a software event falls back from if the kernel
+// does not support it.
+func TestSample(t *testing.T) {
+	must(buildC("test/threads.c", "test/threads"), t)
+	prof, err := Sample(context.Background(), "test/threads", []string{}, perf.TaskClock, SampleOptions{
+		Period:  100000,
+		Precise: perf.MustHaveZeroSkid,
+	}, perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prof.Precise > perf.MustHaveZeroSkid || prof.Total == 0 || len(prof.Funcs) == 0 {
+		t.Fatalf("unexpected profile %+v", prof)
+	}
+	if prof.Funcs[0].Name != "work" {
+		t.Errorf("most samples in %s rather than work: %+v", prof.Funcs[0].Name, prof.Funcs)
+	}
+}
+
+// Tests that addresses are symbolized relative to the function that contains
+// them, or to the binary outside of any function.
+func TestSymbolize(t *testing.T) {
+	must(buildC("test/twice.c", "test/twice"), t)
+	f, err := elf.Open("test/twice")
+	must(err, t)
+	syms, err := f.Symbols()
+	f.Close()
+	must(err, t)
+	var main elf.Symbol
+	for _, sym := range syms {
+		if sym.Name == "main" {
+			main = sym
+		}
+	}
+	bin, err := readBinary("test/twice", BinOptions{})
+	must(err, t)
+	work, err := bin.FuncToPC("work")
+	must(err, t)
+
+	const off = 0x555555554000
+	expected := map[uint64]string{
+		work + off:       "work",
+		work + 0x3 + off: "work+0x3",
+		off - 0x10:       fmt.Sprintf("0x%x", uint64(off-0x10)),
+		1<<40 + off:      fmt.Sprintf("0x%x", uint64(1<<40+off)),
+	}
+	// the alignment padding after main, if any, is in no function
+	end := bin.LinkToPC(main.Value + main.Size)
+	if _, err := bin.PCToFunc(end); err != nil && bin.InExecSection(end) {
+		expected[end+off] = fmt.Sprintf("twice+0x%x", end)
+	}
+	for addr, name := range expected {
+		if s := symbolizeAddr(bin, addr, off); s != name {
+			t.Errorf("0x%x: got %s, expected %s", addr, s, name)
+		}
+	}
+}
+
+// Tests that a region ending in the middle of an instruction is rejected when
+// addresses are verified.
+func TestVerifyAddrs(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice"), t)
+	bin, err := readBinary("test/twice", BinOptions{})
+	must(err, t)
+	addr, err := bin.FuncToPC("work")
+	must(err, t)
+
+	region := fmt.Sprintf("0x%x-0x%x", addr, addr+2)
+	_, err = Run(context.Background(), "test/twice", []string{}, []string{region}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{VerifyAddrs: true}, nil)
+	if err == nil || !strings.Contains(err.Error(), "not the start of an instruction") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	p := New("test/twice", Options{VerifyAddrs: true})
+	p.AddRegion(Region(region))
+	_, err = p.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "not the start of an instruction") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Tests that the addresses of a region are those of the binary, which select
+// the same code whether or not the target is loaded at a random address, and
+// in a position-independent executable whose first segment is not linked at
+// address 0.
+func TestPieAddress(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/twice.c", "test/twice", "-fPIE", "-pie"), t)
+	targets := []string{"test/twice"}
+	// only the gold linker keeps such an executable position-independent
+	if buildC("test/twice.c", "test/twice-based", "-fPIE", "-pie", "-fuse-ld=gold", "-Wl,-Ttext-segment=0x200000") == nil {
+		targets = append(targets, "test/twice-based")
+	}
+
+	// with address space randomization disabled, as setarch -R does, for
+	// the targets started by this thread
+	const addrNoRandomize = 0x0040000
+	persona, _, errno := unix.Syscall(unix.SYS_PERSONALITY, 0xffffffff, 0, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer unix.Syscall(unix.SYS_PERSONALITY, persona, 0, 0)
+
+	for _, target := range targets {
+		f, err := elf.Open(target)
+		must(err, t)
+		syms, err := f.Symbols()
+		f.Close()
+		must(err, t)
+		var work uint64
+		for _, sym := range syms {
+			if sym.Name == "work" {
+				work = sym.Value
+			}
+		}
+		bin, err := readBinary(target, BinOptions{})
+		must(err, t)
+		pc, err := bin.FuncToPC("work")
+		must(err, t)
+		loop, err := bin.LineToPC("twice.c", 9)
+		must(err, t)
+		region := fmt.Sprintf("0x%x-0x%x", work, loop+work-pc)
+
+		for _, random := range []bool{true, false} {
+			p := persona
+			if !random {
+				p |= addrNoRandomize
+			}
+			unix.Syscall(unix.SYS_PERSONALITY, p, 0, 0)
+
+			total, err := Run(context.Background(), target, []string{}, []string{region}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+			if err != nil {
+				t.Errorf("%s (random: %t): %v", target, random, err)
+			} else if len(total) != 2 || total[0].Incomplete || !strings.HasPrefix(total[0].Name, "work-work+") {
+				t.Errorf("%s (random: %t): unexpected invocations %v", target, random, total)
+			}
+			if !random {
+				first, err := Resolve(target, nil, []string{region}, 0, utrace.Options{}, BinOptions{})
+				must(err, t)
+				second, err := Resolve(target, nil, []string{region}, 0, utrace.Options{}, BinOptions{})
+				must(err, t)
+				if first[0].Start != second[0].Start {
+					t.Errorf("%s: loaded at different addresses without randomization", target)
+				}
+			}
+		}
+	}
+}
+
+// Tests that the overhead of an empty region is measured and can be
+// subtracted.
+func TestCalibrate(t *testing.T) {
+	runtime.LockOSThread()
+
+	overhead, err := Calibrate(context.Background(), Events{}, perf.Options{}, utrace.Options{})
+	must(err, t)
+	if overhead.Wall <= 0 {
+		t.Fatalf("unexpected overhead %+v", overhead)
+	}
+	m := Metrics{Wall: overhead.Wall + 5}.SubtractOverhead(overhead)
+	if m.Wall != 5 {
+		t.Errorf("unexpected wall time %s after subtracting %s", m.Wall, overhead.Wall)
+	}
+}
+
+// Tests that a run cut short by a timeout still returns the invocations that
+// completed.
+func TestTimeout(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/spin.c", "test/spin"), t)
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	total, err := Run(ctx, "test/spin", []string{}, []string{"work"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if len(total) == 0 {
+		t.Errorf("no partial results")
+	}
+}
+
+// Tests that breakpoints work with a trap instruction longer than one byte.
+func TestMultiByteTrap(t *testing.T) {
+	runtime.LockOSThread()
+
+	if runtime.GOARCH != "amd64" {
+		t.Skip("int 3 is an amd64 instruction")
+	}
+	must(buildC("test/twice.c", "test/twice"), t)
+	opts := utrace.Options{
+		// int 3
+		Trap: []byte{0xcd, 0x03},
+	}
+	total, err := Run(context.Background(), "test/twice", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, opts, BinOptions{}, nil)
+	must(err, t)
+	if len(total) != 2 {
+		t.Errorf("expected 2 invocations, got %d", len(total))
+	}
+}
+
+// Tests that detaching restores the original instructions at breakpoints and
+// leaves the target running.
+func TestDetach(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/spin.c", "test/spin"), t)
+
+	f, err := elf.Open("test/spin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addr uint64
+	for _, s := range syms {
+		if s.Name == "work" {
+			addr = s.Value
+		}
+	}
+	orig := make([]byte, len(utrace.BreakInstr()))
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && addr >= p.Vaddr && addr < p.Vaddr+p.Filesz {
+			_, err = p.ReadAt(orig, int64(addr-p.Vaddr))
+			must(err, t)
+		}
+	}
+
+	bin, err := readBinary("test/spin", BinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions := []utrace.Region{
+		&utrace.FuncRegion{
+			Addr: addr,
+		},
+	}
+	prog, pid, err := utrace.NewProgram(bin, "test/spin", []string{}, regions, utrace.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Wait4(pid, nil, 0, nil)
+	defer unix.Kill(pid, unix.SIGKILL)
+
+	// wait until the region has been entered once
+	for {
+		var ws utrace.Status
+		p, evs, err := prog.Wait(&ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(evs) > 0 {
+			break
+		}
+		must(prog.Continue(p, ws), t)
+	}
+	must(prog.Detach(), t)
+
+	off, err := bin.PieOffset(pid)
+	must(err, t)
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	b := make([]byte, len(orig))
+	_, err = mem.ReadAt(b, int64(addr+off))
+	must(err, t)
+	if !bytes.Equal(b, orig) {
+		t.Errorf("breakpoint not removed: found %x, expected %x", b, orig)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var ws unix.WaitStatus
+	wpid, err := unix.Wait4(pid, &ws, unix.WNOHANG, nil)
+	must(err, t)
+	if wpid != 0 {
+		t.Errorf("target stopped running after detach: %v", ws)
+	}
+}
+
+// Tests that the addresses of a dry run are relocated to where the target is
+// loaded.
+func TestResolve(t *testing.T) {
+	must(buildC("test/rets.c", "test/rets"), t)
+	regions, err := Resolve("test/rets", []string{}, []string{"classify", "rets:classify"}, 0, utrace.Options{}, BinOptions{})
+	must(err, t)
+	if len(regions) != 2 {
+		t.Fatalf("unexpected number of regions %d", len(regions))
+	}
+	for _, r := range regions {
+		offset := r.Start - r.Addr
+		if r.Addr == 0 || offset%uint64(os.Getpagesize()) != 0 {
+			t.Errorf("%s: start 0x%x is not relocated from 0x%x", r.Name, r.Start, r.Addr)
+		}
+		if r.Name == "rets:classify" && len(r.Rets) == 0 {
+			t.Errorf("%s: no return instructions", r.Name)
+		}
+	}
+}
+
+// Tests that an indirect function is measured at the implementation chosen by
+// its resolver.
+func TestIfunc(t *testing.T) {
+	runtime.LockOSThread()
+
+	for _, flags := range [][]string{nil, {"-static"}} {
+		if err := buildC("test/ifunc.c", "test/ifunc", flags...); err != nil && flags != nil {
+			// the static C library may not be installed
+			t.Logf("%v: %v", flags, err)
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		total, err := Run(context.Background(), "test/ifunc", []string{}, []string{"scale"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+		must(err, t)
+		stats := total.Stats()
+		if len(stats) != 1 || stats[0].Count != 10 || stats[0].Incomplete != 0 {
+			t.Errorf("%v: unexpected stats %+v", flags, stats)
+		}
+	}
+}
+
+// Tests that the gated total of a single-threaded region matches the sum of
+// its invocations.
+func TestGated(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/rets.c", "test/rets"), t)
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	total, err := Run(context.Background(), "test/rets", []string{}, []string{"classify"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	var sum uint64
+	for _, nm := range total {
+		sum += nm.Results[0].Value
+	}
+
+	gated, invocations, err := RunGated(context.Background(), "test/rets", []string{}, []string{"classify"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	if len(invocations) != 30 || len(gated) != 1 {
+		t.Fatalf("unexpected number of invocations %d and regions %d", len(invocations), len(gated))
+	}
+	if len(invocations[0].Results) != 0 {
+		t.Errorf("invocations were counted: %v", invocations[0].Results)
+	}
+	n := gated[0].Results[0].Value
+	if math.Abs(float64(n)-float64(sum)) > 0.1*float64(sum) {
+		t.Errorf("gated total %d differs from the sum of invocations %d", n, sum)
+	}
+
+	// groups are counted as inherited groups, if the kernel can read them
+	evs.Groups = [][]perf.Configurator{{perf.CPUCycles}}
+	gated, _, err = RunGated(context.Background(), "test/rets", []string{}, []string{"classify"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	if !ProbeCapabilities().InheritGroup {
+		if err != ErrGatedScope {
+			t.Errorf("groups were not rejected: %v", err)
+		}
+	} else if err != nil {
+		t.Errorf("groups were rejected: %v", err)
+	} else if len(gated) != 1 || len(gated[0].Results) != 2 {
+		t.Errorf("unexpected gated totals with a group %+v", gated)
+	}
+}
+
+// Tests that the target is stopped once a region has counted a threshold of
+// events, before it completes all of its invocations.
+func TestThreshold(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/rets.c", "test/rets"), t)
+	evs := Events{
+		Base: []perf.Configurator{
+			perf.Instructions,
+		},
+	}
+	opts := perf.Options{
+		ExcludeKernel:     true,
+		ExcludeHypervisor: true,
+	}
+	total, err := Run(context.Background(), "test/rets", []string{}, []string{"classify"}, 0, evs, opts, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	var sum uint64
+	for _, nm := range total[:10] {
+		sum += nm.Results[0].Value
+	}
+
+	threshold := Threshold{Event: "instructions", Count: sum}
+	gated, invocations, err := RunUntil(context.Background(), "test/rets", []string{}, []string{"classify"}, 0, evs, opts, utrace.Options{}, BinOptions{}, threshold, nil)
+	var reached *ThresholdError
+	if !errors.As(err, &reached) {
+		t.Fatalf("threshold of %d was not reached: %v", sum, err)
+	}
+	if reached.Region != "classify" || reached.Invocations != len(invocations) || reached.Invocations >= 30 {
+		t.Errorf("unexpected threshold report %+v with %d invocations", reached, len(invocations))
+	}
+	if n := gated[0].Results[0].Value; n < sum {
+		t.Errorf("stopped at %d instructions, before the threshold of %d", n, sum)
+	}
+
+	threshold.Event = "cpu-cycles"
+	if _, _, err := RunUntil(context.Background(), "test/rets", []string{}, []string{"classify"}, 0, evs, opts, utrace.Options{}, BinOptions{}, threshold, nil); err == nil {
+		t.Errorf("threshold of an event that is not counted was accepted")
+	}
+}
+
+// Tests that the invocations reconstructed from a trace log are the same as
+// those of the trace it recorded.
+func TestTraceLog(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/rets.c", "test/rets"), t)
+	b := &bytes.Buffer{}
+	l, err := NewTraceLog(b)
+	must(err, t)
+	SetTraceLog(l)
+	defer SetTraceLog(nil)
+
+	var runs []TotalMetrics
+	for i := 0; i < 2; i++ {
+		total, err := Run(context.Background(), "test/rets", []string{}, []string{"classify", "main"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+		must(err, t)
+		runs = append(runs, total)
+	}
+
+	replayed, err := ReadTraceLog(bytes.NewReader(b.Bytes()))
+	must(err, t)
+	if len(replayed) != len(runs) {
+		t.Fatalf("expected %d runs, got %d", len(runs), len(replayed))
+	}
+	for i := range runs {
+		// empty and missing results are the same
+		if fmt.Sprint(replayed[i]) != fmt.Sprint(runs[i]) {
+			t.Errorf("run %d was not replayed as it was traced", i)
+		}
+	}
+
+	// a log cut short is read up to its last complete record
+	replayed, err = ReadTraceLog(bytes.NewReader(b.Bytes()[:b.Len()-3]))
+	must(err, t)
+	if len(replayed) != 2 || len(replayed[1]) != len(runs[1])-1 {
+		t.Errorf("unexpected runs of a truncated log")
+	}
+}
+
+// Tests that a missing or non-executable target is reported before it is
+// started.
+func TestTargetErrors(t *testing.T) {
+	runtime.LockOSThread()
+
+	_, err := Run(context.Background(), "test/nonexistent", []string{}, []string{"main"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing target: unexpected error %v", err)
+	}
+	_, err = Run(context.Background(), "test/sum.c", []string{}, []string{"main"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("non-executable target: unexpected error %v", err)
+	}
+}
+
+// Tests that source: and range: selectors expand to the functions of the
+// program's own code.
+func TestExpandModule(t *testing.T) {
+	must(buildC("test/sum.c", "test/sum"), t)
+	bin, err := readBinary("test/sum", BinOptions{})
+	must(err, t)
+
+	names, err := ExpandRegions([]string{"source:sum.c"}, bin, 0)
+	must(err, t)
+	if strings.Join(names, ",") != "main,sum" {
+		t.Errorf("source:sum.c expanded to %v", names)
+	}
+	names, err = ExpandRegions([]string{"range:.text"}, bin, 0)
+	must(err, t)
+	found := false
+	for _, name := range names {
+		if name == "_init" {
+			t.Errorf("range:.text includes _init")
+		}
+		found = found || name == "sum"
+	}
+	if !found {
+		t.Errorf("range:.text does not include sum: %v", names)
+	}
+	if _, err := ExpandRegions([]string{"range:.text"}, bin, 1); err == nil {
+		t.Errorf("range:.text was not limited")
+	}
+}
+
+// Tests that the regions of a regions file are read without blank lines and
+// comments, and are expanded and limited along with the other regions.
+func TestRegionsFile(t *testing.T) {
+	must(buildC("test/sum.c", "test/sum"), t)
+	bin, err := readBinary("test/sum", BinOptions{})
+	must(err, t)
+
+	f, err := ioutil.TempFile("", "perforator")
+	must(err, t)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# regions of sum.c\n\n  source:sum.c  \n\t# main is given as well\n   \n")
+	must(err, t)
+	f.Close()
+
+	regions, err := ReadRegionsFile(f.Name())
+	must(err, t)
+	if strings.Join(regions, ",") != "source:sum.c" {
+		t.Errorf("unexpected regions %q", regions)
+	}
+	names, err := ExpandRegions(append([]string{"main"}, regions...), bin, 3)
+	must(err, t)
+	if strings.Join(names, ",") != "main,main,sum" {
+		t.Errorf("regions expanded to %v", names)
+	}
+	if _, err := ExpandRegions(append([]string{"main"}, regions...), bin, 2); err == nil {
+		t.Errorf("regions of the file were not limited")
+	}
+}
+
+// Tests that a region is measured the same way when most functions of the
+// program are regions as when it is the only one.
+func TestManyRegions(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/rets.c", "test/rets"), t)
+	counts := make([]map[string]int, 2)
+	// _start is left out, since it is not called and has no return address
+	for i, regions := range [][]string{{"classify", "main"}, {"regexp:^[^_]", "range:.init", "range:.fini"}} {
+		total, err := Run(context.Background(), "test/rets", []string{}, regions, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+		must(err, t)
+		counts[i] = make(map[string]int)
+		for _, r := range total.Stats() {
+			if r.Incomplete != 0 {
+				t.Errorf("%v: %d incomplete invocations of %s", regions, r.Incomplete, r.Name)
+			}
+			counts[i][r.Name] = r.Count
+		}
+	}
+	for _, name := range []string{"classify", "main"} {
+		if counts[0][name] != counts[1][name] || counts[0][name] == 0 {
+			t.Errorf("%s: %d invocations alone, %d with every function", name, counts[0][name], counts[1][name])
+		}
+	}
+}
+
+// Tests that two names for the same function are traced as one region.
+func TestAliasRegions(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/alias.c", "test/alias"), t)
+	total, err := Run(context.Background(), "test/alias", []string{}, []string{"work", "work_alias"}, 0, Events{}, perf.Options{}, utrace.Options{}, BinOptions{}, nil)
+	must(err, t)
+	stats := total.Stats()
+	if len(stats) != 1 || stats[0].Name != "work, work_alias" || stats[0].Count != 5 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// Tests that regions are only merged if they are the same region: a library
+// function selected twice is traced once, but a span and a nested span of the
+// same addresses are traced separately.
+func TestRegionKeys(t *testing.T) {
+	set, _, err := resolveRegions([]string{"libm.so:cos", "libm.so:cos", "libm.so:sin"}, nil, false, false)
+	must(err, t)
+	if len(set.regions) != 2 {
+		t.Errorf("got %d library regions, expected 2", len(set.regions))
+	}
+
+	must(buildC("test/sum.c", "test/sum"), t)
+	bin, err := readBinary("test/sum", BinOptions{})
+	must(err, t)
+	addr, err := bin.FuncToPC("sum")
+	must(err, t)
+	span := fmt.Sprintf("span:0x%x-0x%x", addr, addr+1)
+	set, _, err = resolveRegions([]string{span, "nested-" + span, span}, bin, false, false)
+	must(err, t)
+	if len(set.regions) != 2 {
+		t.Errorf("got %d span regions, expected 2", len(set.regions))
+	}
+}
+
+// Tests that the target and the processes it creates run in a process group
+// of their own, which is killed as a whole if tracing stops abnormally.
+func TestProcessGroup(t *testing.T) {
+	runtime.LockOSThread()
+
+	must(buildC("test/fork.c", "test/fork"), t)
+	// a target reading from a terminal stays in the terminal's group
+	null, err := os.Open(os.DevNull)
+	must(err, t)
+	defer null.Close()
+	pgids := make(map[int]bool)
+	pids := make(map[int]bool)
+	_, err = Run(context.Background(), "test/fork", []string{}, []string{"work"}, 0, Events{}, perf.Options{}, utrace.Options{Stdin: null}, BinOptions{}, func(nm NamedMetrics) {
+		pgid, err := unix.Getpgid(nm.Pid)
+		must(err, t)
+		pgids[pgid] = true
+		pids[nm.Pid] = true
+	})
+	must(err, t)
+	if len(pgids) != 1 || len(pids) != 2 {
+		t.Fatalf("unexpected process groups %v of processes %v", pgids, pids)
+	}
+	for pgid := range pgids {
+		if !pids[pgid] || pgid == unix.Getpgrp() {
+			t.Errorf("process group %d is not the target's own", pgid)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package perforator
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// This file implements just enough of the pprof profile.proto format
+// (https://github.com/google/pprof/blob/master/proto/profile.proto) to export
+// region metrics. Each region becomes a single sample whose values are the
+// event totals, and whose location refers to a function named after the
+// region.
+
+// protobuf wire types
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.data)
+}
+
+func (b *protoBuffer) packedUint64(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p.data)
+}
+
+func (b *protoBuffer) packedInt64(field int, xs []int64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(uint64(x))
+	}
+	b.bytes(field, p.data)
+}
+
+// a string table that deduplicates strings; index 0 is always ""
+type stringTable struct {
+	strs  []string
+	index map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{
+		strs: []string{""},
+		index: map[string]int64{
+			"": 0,
+		},
+	}
+}
+
+func (t *stringTable) id(s string) int64 {
+	if i, ok := t.index[s]; ok {
+		return i
+	}
+	i := int64(len(t.strs))
+	t.strs = append(t.strs, s)
+	t.index[s] = i
+	return i
+}
+
+// WritePprof writes the per-region totals of every event as a gzipped pprof
+// profile. The profile has one sample type per event, plus the number of
+// invocations and the elapsed time. If DWARF line information was available,
+// region locations include the file and line of the region start.
+func (t TotalMetrics) WritePprof(w io.Writer) error {
+	stats := t.Stats()
+	strs := newStringTable()
+	var prof protoBuffer
+
+	valueType := func(typ, unit string) *protoBuffer {
+		var vt protoBuffer
+		vt.int64(1, strs.id(typ))
+		vt.int64(2, strs.id(unit))
+		return &vt
+	}
+
+	// sample types (field 1)
+	var labels []string
+	for _, r := range stats {
+		labels = r.Labels
+		break
+	}
+	for _, l := range labels {
+		prof.message(1, valueType(l, "count"))
+	}
+	prof.message(1, valueType("invocations", "count"))
+	prof.message(1, valueType("time-elapsed", "nanoseconds"))
+	prof.message(1, valueType("wall-time", "nanoseconds"))
+
+	for i, r := range stats {
+		id := uint64(i + 1)
+
+		// sample (field 2)
+		values := make([]int64, 0, len(labels)+3)
+		for j := range labels {
+			var v int64
+			if j < len(r.Results) {
+				v = int64(r.Results[j].Total)
+			}
+			values = append(values, v)
+		}
+		values = append(values, int64(r.Count), int64(r.Elapsed.Total), int64(r.Wall.Total))
+
+		var sample protoBuffer
+		sample.packedUint64(1, []uint64{id})
+		sample.packedInt64(2, values)
+		prof.message(2, &sample)
+
+		// location (field 4)
+		var line protoBuffer
+		line.uint64(1, id)
+		line.int64(2, int64(r.Loc.Line))
+
+		var loc protoBuffer
+		loc.uint64(1, id)
+		loc.uint64(3, r.Loc.Addr)
+		loc.message(4, &line)
+		prof.message(4, &loc)
+
+		// function (field 5)
+		var fn protoBuffer
+		fn.uint64(1, id)
+		fn.int64(2, strs.id(r.Name))
+		fn.int64(3, strs.id(r.Name))
+		fn.int64(4, strs.id(r.Loc.File))
+		fn.int64(5, int64(r.Loc.Line))
+		prof.message(5, &fn)
+	}
+
+	// time_nanos (field 9)
+	prof.int64(9, time.Now().UnixNano())
+
+	// string table (field 6) goes last since it is filled in above
+	for _, s := range strs.strs {
+		prof.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(prof.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -2,9 +2,15 @@ package perforator
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	"acln.ro/perf"
+	"golang.org/x/sys/unix"
 )
 
 // A Profiler supports profiling for a certain amount of time and then
@@ -13,9 +19,16 @@ type Profiler interface {
 	Enable() error
 	Disable() error
 	Reset() error
+	Close() error
 	Metrics() Metrics
 }
 
+// ErrInheritGroup is returned when inherited counters are requested for a
+// group of events on a kernel that cannot read inherited counters in the group
+// format (PERF_FORMAT_GROUP), as older kernels cannot (see
+// Capabilities.InheritGroup).
+var ErrInheritGroup = errors.New("inherited counters cannot be used with event groups")
+
 // MultiError stores multiple errors.
 type MultiError struct {
 	errs []error
@@ -43,45 +56,164 @@ func MultiErr(errs []error) error {
 
 // A SingleProfiler profiles one event
 type SingleProfiler struct {
-	*perf.Event
-	// perf tracks "enabled time" but does not reset it when "reset" is called
-	// so whenever there is a reset we manually track the time enabled so far
-	// so that we can subtract it from the total
+	fd    int
+	label string
+	// number of values in a read of the counter, as set by its read format
+	values int
+	// perf tracks "enabled time" and "running time" but does not reset them
+	// when "reset" is called so whenever there is a reset we manually track
+	// the times so far so that we can subtract them from the totals
 	enabled time.Duration
+	running time.Duration
+	// set if every process on a CPU is counted
+	coreWide bool
+	// set if every process in a cgroup is counted
+	cgroup bool
 }
 
 // NewSingleProfiler opens a new profiler for the given event and process.
+// The pid and cpu select what is counted (see checkScope). The attr is
+// opened as NewProfilerFromAttr opens a raw attr.
 func NewSingleProfiler(attr *perf.Attr, pid, cpu int) (*SingleProfiler, error) {
-	p, err := perf.Open(attr, pid, cpu, nil)
-	return &SingleProfiler{
-		Event: p,
-	}, err
+	return openAttr(sysAttr(attr), attr.Label, pid, cpu, 0)
+}
+
+// checkScope returns an error if pid and cpu do not form one of the
+// combinations that perf supports:
+//
+//   - pid >= 0, cpu == -1 (perf.AnyCPU): the thread pid, on any CPU. This is
+//     what regions are measured with.
+//   - pid >= 0, cpu >= 0: the thread pid, only while it runs on the CPU.
+//   - pid == -1, cpu >= 0: every process on the CPU (core-wide). The counts
+//     include whatever else runs on that core, so they are marked as
+//     core-wide in the results.
+//   - pid == -1, cpu == -1: every process on every CPU, which perf rejects.
+func checkScope(pid, cpu int) error {
+	if pid < -1 || cpu < -1 {
+		return fmt.Errorf("invalid profiler scope pid %d, cpu %d", pid, cpu)
+	}
+	if pid == -1 && cpu == -1 {
+		return errors.New("a profiler for every process (pid -1) must be opened on a single CPU")
+	}
+	return nil
+}
+
+// CheckExclusion returns an error if the options exclude user, kernel, and
+// hypervisor code, since no events would ever be counted.
+func CheckExclusion(opts perf.Options) error {
+	if opts.ExcludeUser && opts.ExcludeKernel && opts.ExcludeHypervisor {
+		return errors.New("user, kernel, and hypervisor code are all excluded, so no events would be counted")
+	}
+	return nil
+}
+
+// openError adds information about the event to an error from perf.Open.
+func openError(attr *perf.Attr, err error) error {
+	if err == nil {
+		return nil
+	}
+	if attr.Type == perf.RawEvent && errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("raw event %s (config 0x%x) is not supported by this CPU: %w", attr.Label, attr.Config, err)
+	}
+	if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("not allowed to open %s: /proc/sys/kernel/perf_event_paranoid is %s; "+
+			"lower it (e.g. to 1 for user-space events, or -1 for kernel events) or run with CAP_PERFMON: %w",
+			attr.Label, paranoidSetting(), err)
+	}
+	return err
+}
+
+// paranoidSetting returns the setting of perf_event_paranoid, which restricts
+// the events that unprivileged users may open, or "unknown".
+func paranoidSetting() string {
+	paranoid, err := ioutil.ReadFile("/proc/sys/kernel/perf_event_paranoid")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(paranoid))
+}
+
+// Enable counting.
+func (p *SingleProfiler) Enable() error {
+	return p.ioctl(unix.PERF_EVENT_IOC_ENABLE)
+}
+
+// Disable counting.
+func (p *SingleProfiler) Disable() error {
+	return p.ioctl(unix.PERF_EVENT_IOC_DISABLE)
 }
 
 // Reset all metrics collected so far.
 func (p *SingleProfiler) Reset() error {
-	c, err := p.ReadCount()
+	c, err := p.read()
 	if err != nil {
 		return err
 	}
 	p.enabled = c.Enabled
-	return p.Event.Reset()
+	p.running = c.Running
+	return p.ioctl(unix.PERF_EVENT_IOC_RESET)
+}
+
+// Close the counter.
+func (p *SingleProfiler) Close() error {
+	return unix.Close(p.fd)
+}
+
+func (p *SingleProfiler) ioctl(req uint) error {
+	if err := unix.IoctlSetInt(p.fd, req, 0); err != nil {
+		return fmt.Errorf("%s: %w", p.label, err)
+	}
+	return nil
+}
+
+// read reads the counter's value and its enabled and running times, which
+// are followed by a value for each other bit of the read format (such as
+// the id).
+func (p *SingleProfiler) read() (perf.Count, error) {
+	buf := make([]byte, 8*p.values)
+	n, err := unix.Read(p.fd, buf)
+	if err != nil {
+		return perf.Count{}, fmt.Errorf("%s: %w", p.label, err)
+	}
+	if n < 3*8 {
+		return perf.Count{}, fmt.Errorf("%s: short read of %d bytes", p.label, n)
+	}
+	return perf.Count{
+		Value:   binary.LittleEndian.Uint64(buf[0:]),
+		Enabled: time.Duration(binary.LittleEndian.Uint64(buf[8:])),
+		Running: time.Duration(binary.LittleEndian.Uint64(buf[16:])),
+		Label:   p.label,
+	}, nil
 }
 
 // Metrics returns the collected metrics.
 func (p *SingleProfiler) Metrics() Metrics {
-	c, _ := p.ReadCount()
-	if c.Enabled != c.Running {
-		logger.Printf("%s: multiplexing occurred (enabled: %s, running %s)\n", c.Label, c.Enabled, c.Running)
+	c, err := p.read()
+	if err != nil {
+		infof("%s: read: %v\n", p.label, err)
+	}
+	enabled := c.Enabled - p.enabled
+	running := c.Running - p.running
+	anomaly := err != nil || enabled < 0 || running < 0
+	if anomaly {
+		infof("%s: counter went backwards (enabled: %s, running %s)\n", p.label, enabled, running)
+		c.Value, enabled, running = 0, 0, 0
+	} else if enabled != running {
+		infof("%s: multiplexing occurred (enabled: %s, running %s)\n", p.label, enabled, running)
 	}
 	return Metrics{
 		Results: []Result{
 			{
-				Value: uint64(float64(c.Value) * float64(c.Enabled) / float64(c.Running)),
-				Label: c.Label,
+				Value:    c.Value,
+				Label:    p.label,
+				Enabled:  enabled,
+				Running:  running,
+				CoreWide: p.coreWide,
+				Cgroup:   p.cgroup,
+				Anomaly:  anomaly,
 			},
 		},
-		Elapsed: c.Enabled - p.enabled,
+		Elapsed: enabled,
 	}
 }
 
@@ -89,23 +221,58 @@ func (p *SingleProfiler) Metrics() Metrics {
 // groups of events.
 type MultiProfiler struct {
 	profilers []Profiler
+	// labels of the events that the CPU does not support
+	unsupported []string
 }
 
 // NewMultiProfiler initializes a profiler for recording multiple perf events
-// at once.
+// at once. Each event is opened on its own, and events that the CPU does not
+// support are skipped and left out of the metrics, so that the same events
+// can be requested on different microarchitectures. An error is only
+// returned if an event fails for another reason (such as permissions), or if
+// none of the events are supported.
 func NewMultiProfiler(attrs []*perf.Attr, pid, cpu int) (*MultiProfiler, error) {
-	profs := make([]Profiler, len(attrs))
+	if err := checkScope(pid, cpu); err != nil {
+		return nil, err
+	}
+	return newMultiProfiler(attrs, func(attr *perf.Attr) (*SingleProfiler, error) {
+		return NewSingleProfiler(attr, pid, cpu)
+	})
+}
+
+// newMultiProfiler opens each event with open, skipping the events that the
+// CPU does not support.
+func newMultiProfiler(attrs []*perf.Attr, open func(attr *perf.Attr) (*SingleProfiler, error)) (*MultiProfiler, error) {
+	p := &MultiProfiler{}
 	var errs []error
-	for i, attr := range attrs {
-		p, err := NewSingleProfiler(attr, pid, cpu)
-		if err != nil {
+	for _, attr := range attrs {
+		prof, err := open(attr)
+		if unsupported(err) {
+			infof("%s: not supported by this CPU, skipping (%v)\n", attr.Label, err)
+			p.unsupported = append(p.unsupported, attr.Label)
+			continue
+		} else if err != nil {
 			errs = append(errs, err)
+			continue
 		}
-		profs[i] = p
+		p.profilers = append(p.profilers, prof)
 	}
-	return &MultiProfiler{
-		profilers: profs,
-	}, MultiErr(errs)
+	if len(errs) == 0 && len(attrs) > 0 && len(p.profilers) == 0 {
+		errs = append(errs, fmt.Errorf("none of the events are supported by this CPU: %s", strings.Join(p.unsupported, ", ")))
+	}
+	return p, MultiErr(errs)
+}
+
+// unsupported returns true if an error from opening an event means that the
+// CPU (or the kernel's driver for it) does not support the event.
+func unsupported(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
+
+// Unsupported returns the labels of the events that were skipped because the
+// CPU does not support them.
+func (p *MultiProfiler) Unsupported() []string {
+	return p.unsupported
 }
 
 // Enable recording of all events.
@@ -144,6 +311,18 @@ func (p *MultiProfiler) Reset() error {
 	return MultiErr(errs)
 }
 
+// Close all profilers.
+func (p *MultiProfiler) Close() error {
+	var errs []error
+	for _, prof := range p.profilers {
+		err := prof.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return MultiErr(errs)
+}
+
 // Metrics returns the collected metrics.
 func (p *MultiProfiler) Metrics() Metrics {
 	results := make([]Result, 0, len(p.profilers))
@@ -159,17 +338,185 @@ func (p *MultiProfiler) Metrics() Metrics {
 	}
 }
 
+// The software events recorded by a profiler created with NewSoftwareProfiler.
+var softwareProfilerEvents = []perf.SoftwareCounter{
+	perf.PageFaults,
+	perf.ContextSwitches,
+	perf.CPUMigrations,
+	perf.TaskClock,
+}
+
+// NewSoftwareProfiler creates a profiler for the software events that are
+// useful for correlating region timing with scheduling noise: page faults,
+// context switches, CPU migrations, and the task clock. The user, kernel, and
+// hypervisor exclusion settings are taken from opts. The profiler starts
+// disabled.
+func NewSoftwareProfiler(pid, cpu int, opts perf.Options) (*MultiProfiler, error) {
+	if err := CheckExclusion(opts); err != nil {
+		return nil, err
+	}
+	attrs := make([]*perf.Attr, 0, len(softwareProfilerEvents))
+	for _, ev := range softwareProfilerEvents {
+		attr := &perf.Attr{
+			CountFormat: perf.CountFormat{
+				Enabled: true,
+				Running: true,
+			},
+			Options: perf.Options{
+				Disabled:          true,
+				ExcludeUser:       opts.ExcludeUser,
+				ExcludeKernel:     opts.ExcludeKernel,
+				ExcludeHypervisor: opts.ExcludeHypervisor,
+			},
+		}
+		ev.Configure(attr)
+		attrs = append(attrs, attr)
+	}
+	return NewMultiProfiler(attrs, pid, cpu)
+}
+
+// The cache events recorded by a profiler created with NewCacheProfiler.
+var cacheProfilerEvents = []cacheEvent{
+	{perf.L1D, perf.Read, perf.Access, "l1d-read-accesses"},
+	{perf.L1D, perf.Read, perf.Miss, "l1d-read-misses"},
+	{perf.L1D, perf.Write, perf.Access, "l1d-write-accesses"},
+	{perf.L1D, perf.Write, perf.Miss, "l1d-write-misses"},
+	{perf.LL, perf.Read, perf.Access, "ll-read-accesses"},
+	{perf.LL, perf.Read, perf.Miss, "ll-read-misses"},
+	{perf.LL, perf.Write, perf.Access, "ll-write-accesses"},
+	{perf.LL, perf.Write, perf.Miss, "ll-write-misses"},
+	{perf.DTLB, perf.Read, perf.Access, "dtlb-read-accesses"},
+	{perf.DTLB, perf.Read, perf.Miss, "dtlb-read-misses"},
+	{perf.DTLB, perf.Write, perf.Access, "dtlb-write-accesses"},
+	{perf.DTLB, perf.Write, perf.Miss, "dtlb-write-misses"},
+}
+
+// A CacheProfile holds the counts measured by a CacheProfiler, scaled for
+// multiplexing. Events that the CPU does not support are listed in
+// Unsupported, and their counts are nil (and omitted from JSON) rather than
+// zero.
+type CacheProfile struct {
+	L1DReadAccesses   *uint64  `json:"l1d_read_accesses,omitempty"`
+	L1DReadMisses     *uint64  `json:"l1d_read_misses,omitempty"`
+	L1DWriteAccesses  *uint64  `json:"l1d_write_accesses,omitempty"`
+	L1DWriteMisses    *uint64  `json:"l1d_write_misses,omitempty"`
+	LLReadAccesses    *uint64  `json:"ll_read_accesses,omitempty"`
+	LLReadMisses      *uint64  `json:"ll_read_misses,omitempty"`
+	LLWriteAccesses   *uint64  `json:"ll_write_accesses,omitempty"`
+	LLWriteMisses     *uint64  `json:"ll_write_misses,omitempty"`
+	DTLBReadAccesses  *uint64  `json:"dtlb_read_accesses,omitempty"`
+	DTLBReadMisses    *uint64  `json:"dtlb_read_misses,omitempty"`
+	DTLBWriteAccesses *uint64  `json:"dtlb_write_accesses,omitempty"`
+	DTLBWriteMisses   *uint64  `json:"dtlb_write_misses,omitempty"`
+	Unsupported       []string `json:"unsupported,omitempty"`
+}
+
+// A CacheProfiler profiles the L1 data cache, last-level cache, and data TLB
+// with the generalized hardware cache events (PERF_TYPE_HW_CACHE).
+type CacheProfiler struct {
+	*MultiProfiler
+}
+
+// NewCacheProfiler creates a profiler for read and write accesses and misses
+// in the L1 data cache, the last-level cache, and the data TLB. Most CPUs
+// only support some of these events, so events that cannot be opened are
+// skipped (and reported in the profile as unsupported). The user, kernel, and
+// hypervisor exclusion settings are taken from opts. The profiler starts
+// disabled.
+func NewCacheProfiler(pid, cpu int, opts perf.Options) (*CacheProfiler, error) {
+	if err := CheckExclusion(opts); err != nil {
+		return nil, err
+	}
+	attrs := make([]*perf.Attr, 0, len(cacheProfilerEvents))
+	for _, ev := range cacheProfilerEvents {
+		attr := &perf.Attr{
+			CountFormat: perf.CountFormat{
+				Enabled: true,
+				Running: true,
+			},
+			Options: perf.Options{
+				Disabled:          true,
+				ExcludeUser:       opts.ExcludeUser,
+				ExcludeKernel:     opts.ExcludeKernel,
+				ExcludeHypervisor: opts.ExcludeHypervisor,
+			},
+		}
+		ev.Configure(attr)
+		attrs = append(attrs, attr)
+	}
+	mprof, err := NewMultiProfiler(attrs, pid, cpu)
+	if err != nil {
+		mprof.Close()
+		return nil, err
+	}
+	return &CacheProfiler{
+		MultiProfiler: mprof,
+	}, nil
+}
+
+// Profile returns the collected cache counts.
+func (p *CacheProfiler) Profile() CacheProfile {
+	prof := CacheProfile{
+		Unsupported: p.Unsupported(),
+	}
+	fields := map[string]**uint64{
+		"l1d-read-accesses":   &prof.L1DReadAccesses,
+		"l1d-read-misses":     &prof.L1DReadMisses,
+		"l1d-write-accesses":  &prof.L1DWriteAccesses,
+		"l1d-write-misses":    &prof.L1DWriteMisses,
+		"ll-read-accesses":    &prof.LLReadAccesses,
+		"ll-read-misses":      &prof.LLReadMisses,
+		"ll-write-accesses":   &prof.LLWriteAccesses,
+		"ll-write-misses":     &prof.LLWriteMisses,
+		"dtlb-read-accesses":  &prof.DTLBReadAccesses,
+		"dtlb-read-misses":    &prof.DTLBReadMisses,
+		"dtlb-write-accesses": &prof.DTLBWriteAccesses,
+		"dtlb-write-misses":   &prof.DTLBWriteMisses,
+	}
+	for _, r := range p.Metrics().Results {
+		if f, ok := fields[r.Label]; ok {
+			v := r.ScaledValue()
+			*f = &v
+		}
+	}
+	return prof
+}
+
 // A GroupProfiler profiles a set of events as one group so that the events
 // cannot be multiplexed with respect to each other.
 type GroupProfiler struct {
 	*perf.Event
-	enabled time.Duration
+	enabled  time.Duration
+	running  time.Duration
+	coreWide bool
+	// labels of the events in the group, for reporting a failed read
+	labels []string
 }
 
 // NewGroupProfiler creates a profiler for measuring the set of given perf
-// events as a group (no multiplexing).
+// events as a group (no multiplexing). All counters in the group are read
+// atomically with a single read of the group leader, so they always share the
+// same enabled/running window and ratios between them (such as IPC) are
+// consistent. The pid and cpu select what is counted (see checkScope).
 func NewGroupProfiler(attrs []*perf.Attr, pid, cpu int) (*GroupProfiler, error) {
+	if err := checkScope(pid, cpu); err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		if attr.Options.Inherit && !ProbeCapabilities().InheritGroup {
+			return nil, ErrInheritGroup
+		}
+	}
+
 	var g perf.Group
+	if len(attrs) > 0 {
+		// The group's count format and options are applied to the leader.
+		// Request IDs so that each value read from the leader can be
+		// matched with its event.
+		g.CountFormat = attrs[0].CountFormat
+		g.CountFormat.ID = true
+		g.Options = attrs[0].Options
+	}
 	for i, attr := range attrs {
 		if i != 0 {
 			attr.Options.Disabled = false
@@ -177,8 +524,24 @@ func NewGroupProfiler(attrs []*perf.Attr, pid, cpu int) (*GroupProfiler, error)
 		g.Add(attr)
 	}
 	hw, err := g.Open(pid, cpu)
+	if err != nil && len(attrs) > 0 {
+		culprit := attrs[0]
+		for _, attr := range attrs {
+			if attr.Type == perf.RawEvent {
+				culprit = attr
+				break
+			}
+		}
+		err = openError(culprit, err)
+	}
+	labels := make([]string, len(attrs))
+	for i, attr := range attrs {
+		labels[i] = attr.Label
+	}
 	return &GroupProfiler{
-		Event: hw,
+		Event:    hw,
+		coreWide: pid == -1,
+		labels:   labels,
 	}, err
 }
 
@@ -189,31 +552,147 @@ func (p *GroupProfiler) Reset() error {
 		return err
 	}
 	p.enabled = gc.Enabled
+	p.running = gc.Running
 	return p.Event.Reset()
 }
 
 // Metrics returns the collected group event metrics.
 func (p *GroupProfiler) Metrics() Metrics {
-	gc, _ := p.ReadGroupCount()
-
-	if gc.Running == 0 {
-		return Metrics{}
+	gc, err := p.ReadGroupCount()
+	if err != nil {
+		infof("group: read: %v\n", err)
 	}
 
-	scale := float64(gc.Enabled) / float64(gc.Running)
-	if gc.Enabled != gc.Running {
-		logger.Printf("%s: multiplexing occurred (enabled: %s, running %s)\n", "group", gc.Enabled, gc.Running)
+	enabled := gc.Enabled - p.enabled
+	running := gc.Running - p.running
+	anomaly := err != nil || enabled < 0 || running < 0
+	if anomaly {
+		infof("group: counters went backwards (enabled: %s, running %s)\n", enabled, running)
+		enabled, running = 0, 0
+	} else if running == 0 {
+		// the group was never scheduled, so its events are reported with
+		// zero values rather than left out, which would leave the results
+		// of some invocations shorter than the others
+		infof("group: never running (enabled: %s)\n", enabled)
+		results := make([]Result, 0, len(p.labels))
+		for _, l := range p.labels {
+			results = append(results, Result{
+				Label:    l,
+				Enabled:  enabled,
+				CoreWide: p.coreWide,
+			})
+		}
+		return Metrics{
+			Results: results,
+			Elapsed: enabled,
+		}
+	} else if enabled != running {
+		infof("%s: multiplexing occurred (enabled: %s, running %s)\n", "group", enabled, running)
 	}
 
 	var results []Result
 	for _, v := range gc.Values {
-		results = append(results, Result{
-			Value: uint64(float64(v.Value) * scale),
-			Label: v.Label,
-		})
+		r := Result{
+			Value:    v.Value,
+			Label:    v.Label,
+			Enabled:  enabled,
+			Running:  running,
+			CoreWide: p.coreWide,
+			Anomaly:  anomaly,
+		}
+		if anomaly {
+			r.Value = 0
+		}
+		results = append(results, r)
+	}
+	if err != nil {
+		// nothing was read, so every event of the group is reported as
+		// anomalous rather than dropped
+		for _, l := range p.labels {
+			results = append(results, Result{
+				Label:    l,
+				CoreWide: p.coreWide,
+				Anomaly:  true,
+			})
+		}
 	}
 	return Metrics{
 		Results: results,
-		Elapsed: gc.Enabled - p.enabled,
+		Elapsed: enabled,
+	}
+}
+
+// A DeltaProfiler wraps a profiler so that its counters are never reset.
+// Instead, Reset reads the current values and Metrics reports the difference
+// from them.
+type DeltaProfiler struct {
+	Profiler
+	start Metrics
+}
+
+// NewDeltaProfiler returns a profiler that measures with p by reading and
+// subtracting rather than resetting.
+func NewDeltaProfiler(p Profiler) *DeltaProfiler {
+	return &DeltaProfiler{
+		Profiler: p,
+	}
+}
+
+// Reset records the current metrics as the starting point.
+func (p *DeltaProfiler) Reset() error {
+	p.start = p.Profiler.Metrics()
+	return nil
+}
+
+// Metrics returns the metrics collected since the last Reset. If a counter
+// reads lower than it did at the Reset, the counters are read again, and a
+// counter that still went backwards is reported as 0 and marked as an
+// anomaly.
+func (p *DeltaProfiler) Metrics() Metrics {
+	m, ok := subtractCounts(p.Profiler.Metrics(), p.start)
+	if !ok {
+		infof("counters went backwards since they were reset, reading again\n")
+		m, _ = subtractCounts(p.Profiler.Metrics(), p.start)
+	}
+	return m
+}
+
+// subtractCounts returns the metrics with the counts of an earlier read of the
+// same counters, start, subtracted. Counts that are lower than at the start
+// are set to 0 and marked as anomalies, and ok is false if there are any.
+func subtractCounts(m, start Metrics) (Metrics, bool) {
+	ok := true
+	for i := range m.Results {
+		if i >= len(start.Results) {
+			break
+		}
+		r, s := &m.Results[i], start.Results[i]
+		value, vok := counterDelta(r.Value, s.Value)
+		if !vok || r.Enabled < s.Enabled || r.Running < s.Running {
+			r.Value, r.Enabled, r.Running = 0, 0, 0
+			r.Anomaly = true
+			ok = false
+			continue
+		}
+		r.Value = value
+		r.Enabled -= s.Enabled
+		r.Running -= s.Running
+	}
+	m.Elapsed -= start.Elapsed
+	if m.Elapsed < 0 {
+		m.Elapsed = 0
+	}
+	return m, ok
+}
+
+// counterDelta returns the difference between two reads of a cumulative
+// counter, and false if the later value, cur, is lower. A counter never goes
+// backwards (a 64-bit count of events does not wrap around in any realistic
+// run), so a lower value means that the reads raced with a reset; the
+// unsigned difference would be a huge count.
+func counterDelta(cur, prev uint64) (uint64, bool) {
+	if cur < prev {
+		return 0, false
 	}
+	return cur - prev, true
 }
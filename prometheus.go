@@ -0,0 +1,84 @@
+package perforator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// prefix of the names of the metrics written by WritePrometheus
+const prometheusPrefix = "perforator_region_"
+
+// WritePrometheus writes the totals of every region in the Prometheus text
+// exposition format, for node_exporter's textfile collector, for example.
+// Each event becomes a counter named after it, such as
+// perforator_region_instructions_total{region="sum",event="instructions"},
+// with the total (scaled for multiplexing) of the region's complete
+// invocations. The number of invocations and the total wall-clock time are
+// written as perforator_region_invocations_total and
+// perforator_region_wall_seconds_total.
+func (t TotalMetrics) WritePrometheus(w io.Writer) error {
+	stats := t.Stats()
+
+	type sample struct {
+		labels string
+		value  float64
+	}
+	type family struct {
+		name, help string
+		samples    []sample
+	}
+	var families []*family
+	index := make(map[string]*family)
+	add := func(name, help, labels string, value float64) {
+		f, ok := index[name]
+		if !ok {
+			f = &family{name: name, help: help}
+			index[name] = f
+			families = append(families, f)
+		}
+		f.samples = append(f.samples, sample{labels, value})
+	}
+
+	for _, r := range stats {
+		region := "region=" + prometheusQuote(r.Name)
+		add(prometheusPrefix+"invocations_total", "Complete invocations of the region.", region, float64(r.Count))
+		add(prometheusPrefix+"wall_seconds_total", "Wall-clock time spent in the region.", region, r.Wall.Total/1e9)
+		for i, l := range r.Labels {
+			name := prometheusPrefix + prometheusName(l) + "_total"
+			labels := region + ",event=" + prometheusQuote(l)
+			add(name, fmt.Sprintf("Count of the %s event in the region.", l), labels, r.Results[i].Total)
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(b, "# TYPE %s counter\n", f.name)
+		for _, s := range f.samples {
+			fmt.Fprintf(b, "%s{%s} %s\n", f.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	return b.Flush()
+}
+
+// prometheusName converts an event label to a valid part of a metric name, by
+// replacing the characters that cannot be used with underscores.
+func prometheusName(label string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, label)
+}
+
+// prometheusQuote quotes a label value, escaping backslashes, double quotes,
+// and newlines.
+func prometheusQuote(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
@@ -0,0 +1,195 @@
+package perforator
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"unsafe"
+
+	"acln.ro/perf"
+	"golang.org/x/sys/unix"
+)
+
+// NewProfilerFromAttr opens a counter from a fully specified perf_event_attr,
+// as perf_event_open(2) does with the pid, cpu, and flags (such as
+// PERF_FLAG_PID_CGROUP, in which case pid is the file descriptor of a cgroup
+// directory). This gives access to every field of the attr, such as
+// precise_ip or the hardware breakpoint fields, at the cost of the checks
+// that the typed constructors make. The group leader is always -1, so the
+// counter is opened on its own. Raw events that take an extra register, such
+// as Intel's offcore response events, have it set in Ext1 (config1); raw
+// events parsed from a descriptor with an offcore_rsp or config1 field set it
+// in perf.Attr.Config1 for the typed constructors.
+//
+// The counter is read as a single value, so the read format must not include
+// PERF_FORMAT_GROUP; the enabled and running times are always added to it so
+// that the counts can be scaled for multiplexing. A size of 0 is set to the
+// size of unix.PerfEventAttr.
+//
+// The typed constructors NewSingleProfiler and NewCgroupProfiler convert
+// their perf.Attr to a perf_event_attr and open it the same way.
+func NewProfilerFromAttr(attr unix.PerfEventAttr, pid, cpu, flags int) (*SingleProfiler, error) {
+	return openAttr(attr, rawAttrLabel(&attr), pid, cpu, flags)
+}
+
+// openAttr implements NewProfilerFromAttr, labelling the counter with label.
+func openAttr(attr unix.PerfEventAttr, label string, pid, cpu, flags int) (*SingleProfiler, error) {
+	cgroup := flags&unix.PERF_FLAG_PID_CGROUP != 0
+	if cgroup {
+		if err := checkCgroupScope(pid, cpu); err != nil {
+			return nil, err
+		}
+	} else if err := checkScope(pid, cpu); err != nil {
+		return nil, err
+	}
+	if attr.Read_format&unix.PERF_FORMAT_GROUP != 0 {
+		return nil, errors.New("a raw attr cannot be read in the group format (PERF_FORMAT_GROUP)")
+	}
+	if attr.Size == 0 {
+		attr.Size = uint32(unsafe.Sizeof(attr))
+	}
+	attr.Read_format |= unix.PERF_FORMAT_TOTAL_TIME_ENABLED | unix.PERF_FORMAT_TOTAL_TIME_RUNNING
+
+	fd, err := unix.PerfEventOpen(&attr, pid, cpu, -1, flags|unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		pattr := &perf.Attr{
+			Label:  label,
+			Type:   perf.EventType(attr.Type),
+			Config: attr.Config,
+		}
+		return nil, openError(pattr, fmt.Errorf("perf_event_open: %w", err))
+	}
+	return &SingleProfiler{
+		fd:       fd,
+		label:    label,
+		values:   1 + bits.OnesCount64(attr.Read_format),
+		coreWide: pid == -1 && !cgroup,
+		cgroup:   cgroup,
+	}, nil
+}
+
+// sysAttr converts a perf.Attr to the perf_event_attr that acln.ro/perf
+// would open for it.
+func sysAttr(attr *perf.Attr) unix.PerfEventAttr {
+	return unix.PerfEventAttr{
+		Type:               uint32(attr.Type),
+		Size:               uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Config:             attr.Config,
+		Sample:             attr.Sample,
+		Sample_type:        sampleType(attr.SampleFormat),
+		Read_format:        readFormat(attr.CountFormat),
+		Bits:               optionBits(attr.Options),
+		Wakeup:             attr.Wakeup,
+		Bp_type:            attr.BreakpointType,
+		Ext1:               attr.Config1,
+		Ext2:               attr.Config2,
+		Branch_sample_type: uint64(attr.BranchSampleFormat.Privilege) | uint64(attr.BranchSampleFormat.Sample),
+		Sample_regs_user:   attr.SampleRegistersUser,
+		Sample_stack_user:  attr.SampleStackUser,
+		Clockid:            attr.ClockID,
+		Sample_regs_intr:   attr.SampleRegistersIntr,
+		Aux_watermark:      attr.AuxWatermark,
+		Sample_max_stack:   attr.SampleMaxStack,
+	}
+}
+
+// An attrBit is a bit of a perf_event_attr field, and whether it is set.
+type attrBit struct {
+	on  bool
+	bit uint64
+}
+
+// setBits returns the bits that are set.
+func setBits(flags []attrBit) uint64 {
+	var set uint64
+	for _, b := range flags {
+		if b.on {
+			set |= b.bit
+		}
+	}
+	return set
+}
+
+// optionBits returns the flag bits of a perf_event_attr for opts.
+func optionBits(opts perf.Options) uint64 {
+	set := setBits([]attrBit{
+		{opts.Disabled, unix.PerfBitDisabled},
+		{opts.Inherit, unix.PerfBitInherit},
+		{opts.Pinned, unix.PerfBitPinned},
+		{opts.Exclusive, unix.PerfBitExclusive},
+		{opts.ExcludeUser, unix.PerfBitExcludeUser},
+		{opts.ExcludeKernel, unix.PerfBitExcludeKernel},
+		{opts.ExcludeHypervisor, unix.PerfBitExcludeHv},
+		{opts.ExcludeIdle, unix.PerfBitExcludeIdle},
+		{opts.Mmap, unix.PerfBitMmap},
+		{opts.Comm, unix.PerfBitComm},
+		{opts.Freq, unix.PerfBitFreq},
+		{opts.InheritStat, unix.PerfBitInheritStat},
+		{opts.EnableOnExec, unix.PerfBitEnableOnExec},
+		{opts.Task, unix.PerfBitTask},
+		{opts.Watermark, unix.PerfBitWatermark},
+		{opts.MmapData, unix.PerfBitMmapData},
+		{opts.SampleIDAll, unix.PerfBitSampleIDAll},
+		{opts.ExcludeHost, unix.PerfBitExcludeHost},
+		{opts.ExcludeGuest, unix.PerfBitExcludeGuest},
+		{opts.ExcludeCallchainKernel, unix.PerfBitExcludeCallchainKernel},
+		{opts.ExcludeCallchainUser, unix.PerfBitExcludeCallchainUser},
+		{opts.Mmap2, unix.PerfBitMmap2},
+		{opts.CommExec, unix.PerfBitCommExec},
+		{opts.UseClockID, unix.PerfBitUseClockID},
+		{opts.ContextSwitch, unix.PerfBitContextSwitch},
+		// namespaces follows write_backward, which perf.Options does not
+		// expose
+		{opts.Namespaces, unix.CBitFieldMaskBit28},
+	})
+	// precise_ip is the two bits starting at PerfBitPreciseIPBit1
+	return set | uint64(opts.PreciseIP&3)*unix.PerfBitPreciseIPBit1
+}
+
+// sampleType returns the sample_type of a perf_event_attr for format.
+func sampleType(format perf.SampleFormat) uint64 {
+	return setBits([]attrBit{
+		{format.IP, unix.PERF_SAMPLE_IP},
+		{format.Tid, unix.PERF_SAMPLE_TID},
+		{format.Time, unix.PERF_SAMPLE_TIME},
+		{format.Addr, unix.PERF_SAMPLE_ADDR},
+		{format.Count, unix.PERF_SAMPLE_READ},
+		{format.Callchain, unix.PERF_SAMPLE_CALLCHAIN},
+		{format.ID, unix.PERF_SAMPLE_ID},
+		{format.CPU, unix.PERF_SAMPLE_CPU},
+		{format.Period, unix.PERF_SAMPLE_PERIOD},
+		{format.StreamID, unix.PERF_SAMPLE_STREAM_ID},
+		{format.Raw, unix.PERF_SAMPLE_RAW},
+		{format.BranchStack, unix.PERF_SAMPLE_BRANCH_STACK},
+		{format.UserRegisters, unix.PERF_SAMPLE_REGS_USER},
+		{format.UserStack, unix.PERF_SAMPLE_STACK_USER},
+		{format.Weight, unix.PERF_SAMPLE_WEIGHT},
+		{format.DataSource, unix.PERF_SAMPLE_DATA_SRC},
+		{format.Identifier, unix.PERF_SAMPLE_IDENTIFIER},
+		{format.Transaction, unix.PERF_SAMPLE_TRANSACTION},
+		{format.IntrRegisters, unix.PERF_SAMPLE_REGS_INTR},
+		{format.PhysicalAddress, unix.PERF_SAMPLE_PHYS_ADDR},
+	})
+}
+
+// readFormat returns the read_format of a perf_event_attr for format.
+func readFormat(format perf.CountFormat) uint64 {
+	return setBits([]attrBit{
+		{format.Enabled, unix.PERF_FORMAT_TOTAL_TIME_ENABLED},
+		{format.Running, unix.PERF_FORMAT_TOTAL_TIME_RUNNING},
+		{format.ID, unix.PERF_FORMAT_ID},
+		{format.Group, unix.PERF_FORMAT_GROUP},
+	})
+}
+
+// rawAttrLabel names the event of a raw attr, as perf does for raw events
+// (r1c2, with the config1 of offcore events) and by type and config for the
+// others.
+func rawAttrLabel(attr *unix.PerfEventAttr) string {
+	if attr.Type == unix.PERF_TYPE_RAW && attr.Ext1 != 0 {
+		return fmt.Sprintf("r%x,config1=0x%x", attr.Config, attr.Ext1)
+	} else if attr.Type == unix.PERF_TYPE_RAW {
+		return fmt.Sprintf("r%x", attr.Config)
+	}
+	return fmt.Sprintf("attr %d:0x%x", attr.Type, attr.Config)
+}
@@ -0,0 +1,369 @@
+package perforator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/zyedidia/perforator/utrace"
+)
+
+// traceMagic starts every trace log, followed by the format version.
+const (
+	traceMagic   = "PRFTRACE"
+	traceVersion = 1
+)
+
+// Kinds of records in a trace log.
+const (
+	// the start of a run, with the name and location of every region
+	recordRun = 'B'
+	// a raw event of the trace
+	recordEvent = 'E'
+)
+
+// ErrTraceLog is returned when a trace log is not in the format written by
+// TraceLog.
+var ErrTraceLog = errors.New("not a perforator trace log")
+
+// A TraceLog records every raw event of the traces of Run (set with
+// SetTraceLog) to a compact binary file, so that the invocations can be
+// reconstructed later with ReadTraceLog without running the target again.
+// Each event is recorded with the region, its state, the thread and process,
+// the CPU the region was entered on, the CLOCK_MONOTONIC time, and a snapshot
+// of the counters when the region ends. Callers are recorded, but branches
+// captured from the Last Branch Record are not.
+type TraceLog struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+// NewTraceLog writes the header of a trace log to w and returns the log. The
+// log must be flushed with Flush once tracing has finished.
+func NewTraceLog(w io.Writer) (*TraceLog, error) {
+	l := &TraceLog{
+		w:   bufio.NewWriter(w),
+		buf: make([]byte, binary.MaxVarintLen64),
+	}
+	l.w.WriteString(traceMagic)
+	l.uvarint(traceVersion)
+	return l, l.w.Flush()
+}
+
+// Flush writes any buffered records to the underlying writer.
+func (l *TraceLog) Flush() error {
+	return l.w.Flush()
+}
+
+func (l *TraceLog) uvarint(v uint64) {
+	n := binary.PutUvarint(l.buf, v)
+	l.w.Write(l.buf[:n])
+}
+
+func (l *TraceLog) varint(v int64) {
+	n := binary.PutVarint(l.buf, v)
+	l.w.Write(l.buf[:n])
+}
+
+func (l *TraceLog) str(s string) {
+	l.uvarint(uint64(len(s)))
+	l.w.WriteString(s)
+}
+
+func (l *TraceLog) flag(b bool) {
+	if b {
+		l.w.WriteByte(1)
+	} else {
+		l.w.WriteByte(0)
+	}
+}
+
+// run records the start of a run of the target with the given regions.
+func (l *TraceLog) run(names []string, locs []Location) error {
+	l.w.WriteByte(recordRun)
+	l.uvarint(uint64(len(names)))
+	for i, name := range names {
+		l.str(name)
+		l.str(locs[i].File)
+		l.uvarint(uint64(locs[i].Line))
+		l.uvarint(locs[i].Addr)
+	}
+	return l.w.Flush()
+}
+
+// A tracedEvent is a raw event of a trace as it is recorded in a trace log.
+type tracedEvent struct {
+	State utrace.RegionState
+	// Region is the index of the region in the traced process, and Id is
+	// the index of its name.
+	Region, Id    int
+	Tid, Pid, CPU int
+	Time          time.Duration
+	StackMismatch bool
+	Callers       []string
+	// Metrics are only recorded when a region ends or is abandoned.
+	Metrics Metrics
+}
+
+// event records a raw event. Events are buffered, so they may not be written
+// out until the log is flushed.
+func (l *TraceLog) event(ev tracedEvent) error {
+	l.w.WriteByte(recordEvent)
+	l.w.WriteByte(byte(ev.State))
+	l.uvarint(uint64(ev.Region))
+	l.uvarint(uint64(ev.Id))
+	l.varint(int64(ev.Tid))
+	l.varint(int64(ev.Pid))
+	l.varint(int64(ev.CPU))
+	l.varint(int64(ev.Time))
+	l.flag(ev.StackMismatch)
+	l.uvarint(uint64(len(ev.Callers)))
+	for _, c := range ev.Callers {
+		l.str(c)
+	}
+	l.varint(int64(ev.Metrics.Elapsed))
+	l.uvarint(uint64(len(ev.Metrics.Results)))
+	for _, r := range ev.Metrics.Results {
+		l.str(r.Label)
+		l.uvarint(r.Value)
+		l.varint(int64(r.Enabled))
+		l.varint(int64(r.Running))
+		l.flag(r.CoreWide)
+		l.flag(r.Cgroup)
+	}
+	// errors are sticky, so the last write reports any of them
+	_, err := l.w.Write(nil)
+	return err
+}
+
+// A traceReader decodes the records of a trace log.
+type traceReader struct {
+	r *bufio.Reader
+}
+
+func (t traceReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(t.r)
+}
+
+func (t traceReader) int() (int, error) {
+	v, err := binary.ReadVarint(t.r)
+	return int(v), err
+}
+
+func (t traceReader) str() (string, error) {
+	n, err := t.uvarint()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(t.r, b)
+	return string(b), err
+}
+
+func (t traceReader) flag() (bool, error) {
+	b, err := t.r.ReadByte()
+	return b != 0, err
+}
+
+// loc reads the name and location of a region.
+func (t traceReader) loc() (string, Location, error) {
+	var loc Location
+	name, err := t.str()
+	if err != nil {
+		return "", loc, err
+	}
+	if loc.File, err = t.str(); err != nil {
+		return "", loc, err
+	}
+	line, err := t.uvarint()
+	if err != nil {
+		return "", loc, err
+	}
+	loc.Line = int(line)
+	loc.Addr, err = t.uvarint()
+	return name, loc, err
+}
+
+// event reads a raw event, after its record kind.
+func (t traceReader) event() (tracedEvent, error) {
+	var ev tracedEvent
+	state, err := t.r.ReadByte()
+	if err != nil {
+		return ev, err
+	}
+	ev.State = utrace.RegionState(state)
+	region, err := t.uvarint()
+	if err != nil {
+		return ev, err
+	}
+	id, err := t.uvarint()
+	if err != nil {
+		return ev, err
+	}
+	ev.Region, ev.Id = int(region), int(id)
+	for _, v := range []*int{&ev.Tid, &ev.Pid, &ev.CPU} {
+		if *v, err = t.int(); err != nil {
+			return ev, err
+		}
+	}
+	now, err := t.int()
+	if err != nil {
+		return ev, err
+	}
+	ev.Time = time.Duration(now)
+	if ev.StackMismatch, err = t.flag(); err != nil {
+		return ev, err
+	}
+	n, err := t.uvarint()
+	if err != nil {
+		return ev, err
+	}
+	for i := uint64(0); i < n; i++ {
+		c, err := t.str()
+		if err != nil {
+			return ev, err
+		}
+		ev.Callers = append(ev.Callers, c)
+	}
+	elapsed, err := t.int()
+	if err != nil {
+		return ev, err
+	}
+	ev.Metrics.Elapsed = time.Duration(elapsed)
+	if n, err = t.uvarint(); err != nil {
+		return ev, err
+	}
+	for i := uint64(0); i < n; i++ {
+		var r Result
+		if r.Label, err = t.str(); err != nil {
+			return ev, err
+		}
+		if r.Value, err = t.uvarint(); err != nil {
+			return ev, err
+		}
+		enabled, err := t.int()
+		if err != nil {
+			return ev, err
+		}
+		running, err := t.int()
+		if err != nil {
+			return ev, err
+		}
+		r.Enabled, r.Running = time.Duration(enabled), time.Duration(running)
+		if r.CoreWide, err = t.flag(); err != nil {
+			return ev, err
+		}
+		if r.Cgroup, err = t.flag(); err != nil {
+			return ev, err
+		}
+		ev.Metrics.Results = append(ev.Metrics.Results, r)
+	}
+	return ev, nil
+}
+
+// ReadTraceLog reads a trace log written by TraceLog and reconstructs the
+// invocations of every run that it recorded, in the order they completed,
+// as Run returned them. The invocations have no branches, since these are not
+// recorded, and no derived ratios, which may be added afterwards. A log cut
+// short (because perforator was killed, for example) is read up to its last
+// complete record.
+func ReadTraceLog(r io.Reader) ([]TotalMetrics, error) {
+	t := traceReader{bufio.NewReader(r)}
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(t.r, magic); err != nil || !bytes.Equal(magic, []byte(traceMagic)) {
+		return nil, ErrTraceLog
+	}
+	version, err := t.uvarint()
+	if err != nil {
+		return nil, ErrTraceLog
+	}
+	if version != traceVersion {
+		return nil, fmt.Errorf("trace log version %d is not supported (expected %d)", version, traceVersion)
+	}
+
+	var runs []TotalMetrics
+	var names []string
+	var locs []Location
+	type invocation struct {
+		tid, region int
+	}
+	var inflight map[invocation]tracedEvent
+	var active map[int][]int
+	for {
+		kind, err := t.r.ReadByte()
+		if err == io.EOF {
+			return runs, nil
+		} else if err != nil {
+			return runs, err
+		}
+		switch kind {
+		case recordRun:
+			n, err := t.uvarint()
+			if err != nil {
+				return runs, truncated(err)
+			}
+			names, locs = make([]string, n), make([]Location, n)
+			for i := range names {
+				if names[i], locs[i], err = t.loc(); err != nil {
+					return runs, truncated(err)
+				}
+			}
+			inflight = make(map[invocation]tracedEvent)
+			active = make(map[int][]int)
+			runs = append(runs, TotalMetrics{})
+		case recordEvent:
+			ev, err := t.event()
+			if err != nil {
+				return runs, truncated(err)
+			}
+			if len(runs) == 0 || ev.Id >= len(names) {
+				return runs, fmt.Errorf("trace log: event of unknown region %d", ev.Id)
+			}
+			inv := invocation{ev.Tid, ev.Region}
+			switch ev.State {
+			case utrace.RegionStart:
+				active[ev.Tid] = append(active[ev.Tid], ev.Id)
+				inflight[inv] = ev
+			case utrace.RegionEnd, utrace.RegionAbandoned:
+				var parents []string
+				for _, id := range popActive(active, ev.Tid, ev.Id) {
+					parents = append(parents, names[id])
+				}
+				start := inflight[inv]
+				delete(inflight, inv)
+				m := ev.Metrics
+				m.Wall = ev.Time - start.Time
+				runs[len(runs)-1] = append(runs[len(runs)-1], NamedMetrics{
+					Metrics:       m,
+					Name:          names[ev.Id],
+					Id:            ev.Id,
+					Loc:           locs[ev.Id],
+					Parents:       parents,
+					Tid:           ev.Tid,
+					Pid:           ev.Pid,
+					CPU:           start.CPU,
+					Start:         start.Time,
+					End:           ev.Time,
+					Callers:       start.Callers,
+					Incomplete:    ev.State == utrace.RegionAbandoned,
+					StackMismatch: ev.StackMismatch,
+				})
+			}
+		default:
+			return runs, fmt.Errorf("trace log: unknown record %q", kind)
+		}
+	}
+}
+
+// truncated reports a record cut short at the end of a trace log as the end
+// of the log.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
@@ -1,7 +1,12 @@
 package perforator
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -12,21 +17,38 @@ import (
 func parseLocation(s string, bin *bininfo.BinFile) (uint64, error) {
 	if strings.Contains(s, ":") {
 		parts := strings.Split(s, ":")
+		if len(parts) != 2 {
+			return 0, fmt.Errorf("invalid location %s: expected file:line", s)
+		}
 		file, lineStr := parts[0], parts[1]
 		line, err := strconv.Atoi(lineStr)
 		if err != nil {
-			return 0, err
+			return 0, fmt.Errorf("invalid line number in %s: %w", s, err)
 		}
 		return bin.LineToPC(file, line)
 	}
-	return strconv.ParseUint(s, 0, 64)
+	return parseAddr(s, bin)
+}
+
+// parseAddr parses a hexadecimal address of the binary, at which it was
+// linked, and returns it as a PC of the binary.
+func parseAddr(s string, bin *bininfo.BinFile) (uint64, error) {
+	addr, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bin.LinkToPC(addr), nil
 }
 
 // ParseRegion parses an address region. The region is written as loc-loc,
 // where 'loc' is a location specified as either a file:line source code
 // location (if the elf binary has DWARF debugging information), or a direct
-// hexadecimal address in the form 0x...
-func ParseRegion(s string, bin *bininfo.BinFile) (*utrace.AddressRegion, error) {
+// hexadecimal address in the form 0x... The addresses are those of the
+// binary, as shown by objdump or nm, rather than of a running instance, so the
+// same region can be used whether or not the binary is loaded at a random
+// address. If verify is set, the ends of the region are checked to be the
+// start of an instruction (see BinOptions.VerifyAddrs).
+func ParseRegion(s string, bin *bininfo.BinFile, verify bool) (*utrace.AddressRegion, error) {
 	parts := strings.Split(s, "-")
 	if len(parts) != 2 {
 		return nil, errors.New("invalid region")
@@ -41,8 +63,320 @@ func ParseRegion(s string, bin *bininfo.BinFile) (*utrace.AddressRegion, error)
 		return nil, err
 	}
 
-	return &utrace.AddressRegion{
+	reg := &utrace.AddressRegion{
 		StartAddr: start,
 		EndAddr:   end,
+	}
+	return reg, checkRegion(reg, bin, verify)
+}
+
+// Prefixes of a span region, written as span:loc-loc or nested-span:loc-loc.
+const (
+	spanPrefix       = "span:"
+	nestedSpanPrefix = "nested-span:"
+)
+
+// ParseSpan parses a span region, written as span:loc-loc (or
+// nested-span:loc-loc to count repeated entries before the end) with the
+// locations of ParseRegion. Unlike an address region, the ends of a span may
+// be in different functions (see utrace.SpanRegion). The address region that
+// the span was parsed from is also returned. The ends of the span are verified
+// as in ParseRegion.
+func ParseSpan(s string, bin *bininfo.BinFile, verify bool) (*utrace.SpanRegion, *utrace.AddressRegion, error) {
+	rest, nested, ok := splitSpan(s)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid span %s: expected %sloc-loc", s, spanPrefix)
+	}
+	reg, err := ParseRegion(rest, bin, verify)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &utrace.SpanRegion{
+		StartAddr: reg.StartAddr,
+		EndAddr:   reg.EndAddr,
+		Nested:    nested,
+	}, reg, nil
+}
+
+// splitSpan removes the prefix of a span region, and reports whether the span
+// is nested.
+func splitSpan(s string) (rest string, nested, ok bool) {
+	if strings.HasPrefix(s, nestedSpanPrefix) {
+		return strings.TrimPrefix(s, nestedSpanPrefix), true, true
+	}
+	if strings.HasPrefix(s, spanPrefix) {
+		return strings.TrimPrefix(s, spanPrefix), false, true
+	}
+	return s, false, false
+}
+
+// A region delimited by calls to marker functions is written as
+// markers:begin-end, or as markers alone for the markers declared in
+// include/perforator.h.
+const (
+	markersPrefix = "markers:"
+	markers       = "markers"
+	beginMarker   = "perforator_begin"
+	endMarker     = "perforator_end"
+)
+
+// ParseMarkers parses a region delimited by marker functions (see
+// markersPrefix). The region begins each time the begin marker is called and
+// ends at the next call to the end marker, so its counters only run between
+// the two calls. It is a span (see utrace.SpanRegion), so the markers may be
+// called from different functions, and a second call to the begin marker
+// before the end discards the first.
+func ParseMarkers(s string, bin *bininfo.BinFile) (*utrace.SpanRegion, error) {
+	begin, end := beginMarker, endMarker
+	if s != markers {
+		parts := strings.Split(strings.TrimPrefix(s, markersPrefix), "-")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid markers %s: expected %sbegin-end", s, markersPrefix)
+		}
+		begin, end = parts[0], parts[1]
+	}
+	start, err := bin.FuncToPC(begin)
+	if err != nil {
+		return nil, fmt.Errorf("marker %s: %w", begin, err)
+	}
+	stop, err := bin.FuncToPC(end)
+	if err != nil {
+		return nil, fmt.Errorf("marker %s: %w", end, err)
+	}
+	if start == stop {
+		return nil, fmt.Errorf("invalid markers %s: %s and %s are the same function", s, begin, end)
+	}
+	return &utrace.SpanRegion{
+		StartAddr: start,
+		EndAddr:   stop,
 	}, nil
 }
+
+// isMarkers returns true if s is a region delimited by marker functions.
+func isMarkers(s string) bool {
+	return s == markers || strings.HasPrefix(s, markersPrefix)
+}
+
+// prefix of a function region that ends at the function's return
+// instructions
+const retsPrefix = "rets:"
+
+// usesCode returns true if any of the region specs needs the target's code to
+// be decoded.
+func usesCode(specs []string) bool {
+	for _, s := range specs {
+		if strings.HasPrefix(s, retsPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCode reads the code of the executable at path into bin, unless it was
+// already read with binopts to verify addresses.
+func loadCode(bin *bininfo.BinFile, path string, binopts BinOptions) error {
+	if binopts.VerifyAddrs {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("elf-code: %w", err)
+	}
+	defer f.Close()
+	if err := bin.LoadCode(f); err != nil {
+		return fmt.Errorf("elf-code: %w", err)
+	}
+	return nil
+}
+
+// ParseRetsRegion finds the function written as rets:function, and the
+// return instructions that end it (see utrace.RetsRegion). The binary's code
+// must have been loaded.
+func ParseRetsRegion(s string, bin *bininfo.BinFile) (*utrace.RetsRegion, error) {
+	fn := strings.TrimPrefix(s, retsPrefix)
+	pc, err := bin.FuncToPC(fn)
+	if err != nil {
+		return nil, fmt.Errorf("func-lookup: %w", err)
+	}
+	rets, err := bin.FuncReturns(pc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return &utrace.RetsRegion{
+		Addr: pc,
+		Rets: rets,
+	}, nil
+}
+
+// regionName returns a readable name for an address region given as s. The
+// ends of the region that were given as addresses are replaced with their
+// location relative to a symbol, or to the binary, if one is known (see
+// symbolizeAddr).
+func regionName(s string, reg *utrace.AddressRegion, bin *bininfo.BinFile) string {
+	parts := strings.Split(s, "-")
+	addrs := []uint64{reg.StartAddr, reg.EndAddr}
+	for i := range parts {
+		if strings.Contains(parts[i], ":") {
+			continue
+		}
+		if name := symbolizeAddr(bin, addrs[i], 0); !strings.HasPrefix(name, "0x") {
+			parts[i] = name
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// checkRegion verifies that both ends of an address region are inside a
+// function (if the binary has a symbol table), since a breakpoint outside of
+// the code would corrupt the target.
+// If the binary has line information, addresses that are not known to begin
+// an instruction are reported in the log. If verify is set, an address that
+// is not the start of an instruction is an error.
+func checkRegion(reg *utrace.AddressRegion, bin *bininfo.BinFile, verify bool) error {
+	for _, addr := range []uint64{reg.StartAddr, reg.EndAddr} {
+		if verify {
+			ok, err := bin.IsInstructionStart(addr)
+			if err != nil {
+				return fmt.Errorf("cannot verify 0x%x: %w", addr, err)
+			} else if !ok {
+				fn, off, _ := bin.PCToFuncOffset(addr)
+				return fmt.Errorf("invalid region: 0x%x (%s+0x%x) is not the start of an instruction", addr, fn, off)
+			}
+		}
+		fn, err := bin.PCToFunc(addr)
+		if !bin.HasSymbols() {
+			// the dynamic symbols of a stripped binary only cover its
+			// exported functions
+			continue
+		} else if err != nil {
+			if bin.Pie() {
+				return fmt.Errorf("invalid region: 0x%x is not inside any function (addresses are relative to the binary, not those of a running instance)", addr)
+			}
+			return fmt.Errorf("invalid region: 0x%x is not inside any function", addr)
+		}
+		if ok, err := bin.IsLineBoundary(addr); err == nil && !ok {
+			infof("warning: 0x%x (in %s) is not a known instruction boundary\n", addr, fn)
+		}
+	}
+	return nil
+}
+
+// Prefixes of the selectors that expand to every function in a source file or
+// directory (source:path), or in an address range or executable section
+// (range:start-end or range:.text).
+const (
+	sourcePrefix = "source:"
+	rangePrefix  = "range:"
+)
+
+// ExpandRegions replaces each selector in names with the functions in the
+// binary's symbol table that it selects: 'regexp:pattern' and 'glob:pattern'
+// select the functions whose names match the pattern, 'source:path' those
+// defined in a source file whose path contains path (so a directory selects
+// all of its files), and 'range:start-end' those that start at an address in
+// the range, which may also be given as the name of an executable section
+// (such as range:.text, which leaves out the PLT and the startup code in
+// .init). Other region names are returned unchanged. If maxRegions is
+// positive and the expansion results in more regions, an error is returned.
+func ExpandRegions(names []string, bin *bininfo.BinFile, maxRegions int) ([]string, error) {
+	var expanded []string
+	for _, name := range names {
+		var fns []string
+		if strings.HasPrefix(name, "regexp:") {
+			re, err := regexp.Compile(strings.TrimPrefix(name, "regexp:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid region selector %s: %w", name, err)
+			}
+			fns = bin.MatchFuncs(re.MatchString)
+		} else if strings.HasPrefix(name, "glob:") {
+			pattern := strings.TrimPrefix(name, "glob:")
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid region selector %s: %w", name, err)
+			}
+			fns = bin.MatchFuncs(func(fn string) bool {
+				ok, _ := path.Match(pattern, fn)
+				return ok
+			})
+		} else if strings.HasPrefix(name, sourcePrefix) {
+			file := strings.TrimPrefix(name, sourcePrefix)
+			var err error
+			fns, err = bin.FuncsInSource(func(f string) bool {
+				return strings.Contains(f, file)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("region selector %s: %w", name, err)
+			}
+		} else if strings.HasPrefix(name, rangePrefix) {
+			start, end, err := parseRange(strings.TrimPrefix(name, rangePrefix), bin)
+			if err != nil {
+				return nil, fmt.Errorf("invalid region selector %s: %w", name, err)
+			}
+			fns = bin.FuncsInRange(start, end)
+		} else {
+			expanded = append(expanded, name)
+			continue
+		}
+
+		if len(fns) == 0 {
+			return nil, fmt.Errorf("region selector %s: no matching functions", name)
+		}
+		infof("%s: matched %d functions\n", name, len(fns))
+		expanded = append(expanded, fns...)
+	}
+
+	if maxRegions > 0 && len(expanded) > maxRegions {
+		return nil, fmt.Errorf("%d regions selected, more than the maximum of %d (use a more specific selector or raise the limit)", len(expanded), maxRegions)
+	}
+	return expanded, nil
+}
+
+// ReadRegionsFile reads a list of region names and selectors from a file, one
+// per line, to be expanded along with any others by ExpandRegions. Surrounding
+// whitespace is removed, and blank lines and comment lines, which start with
+// #, are skipped.
+func ReadRegionsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var regions []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		regions = append(regions, line)
+	}
+	return regions, scanner.Err()
+}
+
+// parseRange parses the range of a range: selector, either start-end with
+// hexadecimal addresses or the name of an executable section.
+func parseRange(s string, bin *bininfo.BinFile) (uint64, uint64, error) {
+	if strings.HasPrefix(s, ".") {
+		start, end, ok := bin.SectionRange(s)
+		if !ok {
+			return 0, 0, fmt.Errorf("no executable section %s", s)
+		}
+		return start, end, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("expected start-end or a section name")
+	}
+	start, err := parseAddr(parts[0], bin)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseAddr(parts[1], bin)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("range ends before it starts")
+	}
+	return start, end, nil
+}
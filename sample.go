@@ -0,0 +1,295 @@
+package perforator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"acln.ro/perf"
+	"github.com/zyedidia/perforator/utrace"
+	"golang.org/x/sys/unix"
+)
+
+// SampleOptions configures statistical sampling. If Freq is non-zero, samples
+// are taken Freq times per second, otherwise one sample is taken every Period
+// occurrences of the event. If Affinity is not nil, the target is restricted
+// to the given CPUs. Signals received on the Signals channel are forwarded to
+// the target, and Stdout and Stderr replace the target's output streams if
+// they are not nil. Env and Dir set the target's environment and working
+// directory (see utrace.Options). Precise is the highest precise_ip level to
+// request for the sampled instruction pointer (see openPrecise). DebugFile is
+// read for the target's symbols if they were stripped (see BinOptions).
+type SampleOptions struct {
+	Period    uint64
+	Freq      uint64
+	Precise   perf.Skid
+	Affinity  *unix.CPUSet
+	Signals   <-chan os.Signal
+	Stdout    *os.File
+	Stderr    *os.File
+	Env       []string
+	Dir       string
+	DebugFile string
+}
+
+// FuncSamples is the number of samples attributed to a function.
+type FuncSamples struct {
+	Name    string
+	Samples uint64
+}
+
+// A SampleProfile is the result of a sampling run.
+type SampleProfile struct {
+	Event string
+	Funcs []FuncSamples
+	// Total is the number of samples received, and Lost is the number of
+	// samples the kernel dropped because the ring buffer was full.
+	Total uint64
+	Lost  uint64
+	// Precise is the precise_ip level that the event was opened with, which
+	// may be lower than the one requested.
+	Precise perf.Skid
+}
+
+// Sample executes the given command and samples the instruction pointer of
+// every thread whenever the event overflows its sample period. Samples are
+// attributed to the functions in the target's symbol table. Unlike Run, no
+// breakpoints are placed in the target, so the overhead is much lower, but
+// the results are statistical. If ctx is done before the target finishes, the
+// target is detached and killed, and the samples collected so far are returned
+// along with the context's error.
+func Sample(ctx context.Context, target string, args []string,
+	event perf.Configurator,
+	sampleopts SampleOptions,
+	attropts perf.Options) (*SampleProfile, error) {
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	err := CheckExclusion(attropts)
+	if err != nil {
+		return nil, err
+	}
+
+	bin, err := readBinary(target, BinOptions{DebugFile: sampleopts.DebugFile})
+	if err != nil {
+		return nil, err
+	}
+
+	traceopts := utrace.Options{
+		Affinity: sampleopts.Affinity,
+		Signals:  sampleopts.Signals,
+		Stdout:   sampleopts.Stdout,
+		Stderr:   sampleopts.Stderr,
+		Env:      sampleopts.Env,
+		Dir:      sampleopts.Dir,
+	}
+	prog, pid, err := utrace.NewProgram(bin, target, args, nil, traceopts)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup(prog, pid)
+
+	attr := &perf.Attr{
+		SampleFormat: perf.SampleFormat{
+			IP:  true,
+			Tid: true,
+		},
+		Options: attropts,
+	}
+	event.Configure(attr)
+	// threads created after the event is opened are sampled as well, which
+	// the kernel only allows for an event that is mapped if it is bound to
+	// a CPU, so one event is opened on each CPU the target may run on, as
+	// perf record does
+	attr.Options.Inherit = true
+	attr.Options.Disabled = false
+	if sampleopts.Freq != 0 {
+		attr.SetSampleFreq(sampleopts.Freq)
+	} else {
+		attr.SetSamplePeriod(sampleopts.Period)
+	}
+	attr.SetWakeupEvents(1)
+
+	cpus := []int{counterCPU(traceopts)}
+	if cpus[0] == perf.AnyCPU {
+		cpus, err = onlineCPUs()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var evs []*perf.Event
+	defer func() {
+		for _, ev := range evs {
+			ev.Close()
+		}
+	}()
+	precise := sampleopts.Precise
+	for _, cpu := range cpus {
+		ev, err := openPrecise(attr, precise, pid, cpu)
+		if err != nil {
+			return nil, fmt.Errorf("open-sample: %w", openError(attr, err))
+		}
+		evs = append(evs, ev)
+		// the other CPUs support the same level
+		precise = attr.Options.PreciseIP
+		// the perf package takes care of reading records that wrap
+		// around the end of the ring buffer
+		err = ev.MapRing()
+		if err != nil {
+			return nil, fmt.Errorf("map-ring: %w", err)
+		}
+	}
+
+	off, err := bin.PieOffset(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	prof := &SampleProfile{
+		Event:   attr.Label,
+		Precise: attr.Options.PreciseIP,
+	}
+	counts := make(map[string]uint64)
+	// records of the events of different CPUs are read concurrently
+	var mu sync.Mutex
+	record := func(rec perf.Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch rec := rec.(type) {
+		case *perf.SampleRecord:
+			// samples are counted by function, and those in the
+			// binary's code outside of any function by address
+			name := "[unknown]"
+			if rec.IP >= off && bin.InExecSection(rec.IP-off) {
+				if fn, err := bin.PCToFunc(rec.IP - off); err == nil {
+					name = symbolName(fn)
+				} else {
+					name = symbolizeAddr(bin, rec.IP, off)
+				}
+			}
+			counts[name]++
+			prof.Total++
+		case *perf.LostRecord:
+			infof("lost %d samples\n", rec.Lost)
+			prof.Lost += rec.Lost
+		}
+	}
+
+	// Records are read concurrently with tracing so that the ring buffers
+	// do not fill up, and drained once the target has finished.
+	rctx, cancel := context.WithCancel(context.Background())
+	var readers sync.WaitGroup
+	for _, ev := range evs {
+		readers.Add(1)
+		go func(ev *perf.Event) {
+			defer readers.Done()
+			for {
+				rec, err := ev.ReadRecord(rctx)
+				if errors.Is(err, perf.ErrBadRecord) {
+					continue
+				} else if err != nil {
+					return
+				}
+				record(rec)
+			}
+		}(ev)
+	}
+
+	stop := interruptOnDone(ctx, pid)
+	defer stop()
+
+	var traceErr error
+	for {
+		var ws utrace.Status
+
+		p, _, err := prog.Wait(&ws)
+		if p != nil && p.Pid() == pid && (ws.Exited() || ws.Signaled()) {
+			traceErr = exitError(ws.WaitStatus)
+		}
+		if err == utrace.ErrFinishedTrace {
+			break
+		}
+		if err != nil {
+			cancel()
+			readers.Wait()
+			return nil, fmt.Errorf("wait: %w", err)
+		}
+
+		if ctx.Err() != nil {
+			traceErr = abort(ctx, prog, pid)
+			break
+		}
+
+		err = prog.Continue(p, ws)
+		if err != nil {
+			cancel()
+			readers.Wait()
+			return nil, fmt.Errorf("continue: %w", err)
+		}
+	}
+
+	cancel()
+	readers.Wait()
+	for _, ev := range evs {
+		for ev.HasRecord() {
+			rec, err := ev.ReadRecord(context.Background())
+			if err != nil {
+				break
+			}
+			record(rec)
+		}
+	}
+
+	for name, n := range counts {
+		prof.Funcs = append(prof.Funcs, FuncSamples{
+			Name:    name,
+			Samples: n,
+		})
+	}
+	sort.Slice(prof.Funcs, func(i, j int) bool {
+		if prof.Funcs[i].Samples != prof.Funcs[j].Samples {
+			return prof.Funcs[i].Samples > prof.Funcs[j].Samples
+		}
+		return prof.Funcs[i].Name < prof.Funcs[j].Name
+	})
+
+	return prof, traceErr
+}
+
+// openPrecise opens a sampling event with the highest precise_ip level up to
+// precise that the event supports. The instruction pointer of a sample is
+// usually a few instructions past the one that overflowed the counter (skid);
+// higher levels ask the CPU to reduce it, with PEBS on Intel or IBS on AMD.
+// Which levels are available depends on the CPU and the event, so the level
+// is lowered until the event opens, down to arbitrary skid. The level that
+// was used is left in attr.
+func openPrecise(attr *perf.Attr, precise perf.Skid, pid, cpu int) (*perf.Event, error) {
+	for {
+		attr.Options.PreciseIP = precise
+		ev, err := perf.Open(attr, pid, cpu, nil)
+		if err == nil || precise == perf.CanHaveArbitrarySkid || !unsupported(err) {
+			return ev, err
+		}
+		infof("%s: precise_ip %d not supported, trying %d (%v)\n", attr.Label, precise, precise-1, err)
+		precise--
+	}
+}
+
+// WriteTo writes a table of the functions with the most samples, along with
+// the percentage of all samples in each function.
+func (s *SampleProfile) WriteTo(table MetricsWriter) {
+	table.SetHeader([]string{"function", "samples", "percent"})
+	for _, f := range s.Funcs {
+		table.Append([]string{
+			f.Name,
+			fmt.Sprintf("%d", f.Samples),
+			fmt.Sprintf("%.2f%%", 100*float64(f.Samples)/float64(s.Total)),
+		})
+	}
+	table.Render()
+}
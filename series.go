@@ -0,0 +1,144 @@
+package perforator
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrIntervalGated is returned when a time series is requested for gated
+// counters, which are shared by every invocation and cannot be read for one.
+var ErrIntervalGated = errors.New("gated counters cannot be sampled at intervals")
+
+// A Bucket holds the counts of one interval of a region invocation (see
+// Events.Interval). Start is the time from entering the region to the
+// beginning of the interval, and Wall the length of the interval; the last
+// bucket of an invocation ends when the region is left, so it is usually
+// shorter than the others.
+type Bucket struct {
+	Start time.Duration
+	Metrics
+}
+
+// A sampler reads the counters of the active region invocations at a fixed
+// interval, from its own goroutine, while the tracer handles the events of
+// the target. Profilers may be read from any thread, so the counters keep
+// running while they are sampled.
+type sampler struct {
+	mu     sync.Mutex
+	series map[Profiler]*series
+	ratios []Ratio
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// series is the time series of an invocation in progress.
+type series struct {
+	start   time.Duration
+	last    Metrics
+	lastAt  time.Duration
+	buckets []Bucket
+}
+
+// newSampler starts sampling every interval. The sampler must be closed once
+// tracing ends.
+func newSampler(interval time.Duration, ratios []Ratio) *sampler {
+	s := &sampler{
+		series: make(map[Profiler]*series),
+		ratios: ratios,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.tick()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// tick appends a bucket to every series in progress.
+func (s *sampler) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for prof, ser := range s.series {
+		ser.add(prof.Metrics(), monotonicNow(), s.ratios)
+	}
+}
+
+// begin starts the series of the invocation counted by prof, which was entered
+// at the given time and has just been reset.
+func (s *sampler) begin(prof Profiler, now time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series[prof] = &series{
+		start:  now,
+		lastAt: now,
+	}
+}
+
+// end finishes the series of the invocation counted by prof with its final
+// metrics, m, and returns its buckets. It must be called before prof is reset
+// for another invocation.
+func (s *sampler) end(prof Profiler, m Metrics, now time.Duration) []Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ser, ok := s.series[prof]
+	if !ok {
+		return nil
+	}
+	delete(s.series, prof)
+	ser.add(m, now, s.ratios)
+	return ser.buckets
+}
+
+// cancel discards the series of the invocation counted by prof, which must
+// be called before prof is closed.
+func (s *sampler) cancel(prof Profiler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.series, prof)
+}
+
+// Close stops sampling.
+func (s *sampler) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+// add appends the difference between m and the last metrics read as a bucket
+// ending at the given time.
+func (ser *series) add(m Metrics, now time.Duration, ratios []Ratio) {
+	b := Bucket{
+		Start: ser.lastAt - ser.start,
+		Metrics: Metrics{
+			Results: make([]Result, len(m.Results)),
+			Elapsed: m.Elapsed,
+			Wall:    now - ser.lastAt,
+			Ratios:  ratios,
+		},
+	}
+	copy(b.Results, m.Results)
+	// a counter that went backwards is marked in the bucket
+	b.Metrics, _ = subtractCounts(b.Metrics, ser.last)
+	ser.buckets = append(ser.buckets, b)
+	ser.last, ser.lastAt = m, now
+}
+
+// monotonicNow returns the current CLOCK_MONOTONIC time, the clock of the
+// region events.
+func monotonicNow() time.Duration {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return time.Duration(ts.Nano())
+}
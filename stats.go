@@ -0,0 +1,469 @@
+package perforator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Stat accumulates the number of values, total, mean, and variance of a
+// series of values without storing the values themselves.
+type Stat struct {
+	N     uint64
+	Total float64
+
+	mean float64
+	m2   float64
+}
+
+// Add a value to the series.
+func (s *Stat) Add(v float64) {
+	// Welford's online algorithm
+	s.N++
+	s.Total += v
+	delta := v - s.mean
+	s.mean += delta / float64(s.N)
+	s.m2 += delta * (v - s.mean)
+}
+
+// Mean returns the mean of the series.
+func (s *Stat) Mean() float64 {
+	return s.mean
+}
+
+// Stddev returns the sample standard deviation of the series.
+func (s *Stat) Stddev() float64 {
+	if s.N < 2 {
+		return 0
+	}
+	return math.Sqrt(s.m2 / float64(s.N-1))
+}
+
+// An Extreme is the invocation of a region with the smallest or largest value
+// of an event, kept so that outliers can be tracked down.
+type Extreme struct {
+	Value uint64
+	// Start is the time the invocation was entered, Tid is the thread that
+	// executed it, and Run is the run of the target it belongs to.
+	Start time.Duration
+	Tid   int
+	Run   int
+	// Callers and Branches are the invocation's call stack and the calls
+	// leading to it, if they were captured.
+	Callers  []string
+	Branches []Branch
+}
+
+func extreme(nm NamedMetrics, v uint64) Extreme {
+	return Extreme{
+		Value:    v,
+		Start:    nm.Start,
+		Tid:      nm.Tid,
+		Run:      nm.Run,
+		Callers:  nm.Callers,
+		Branches: nm.Branches,
+	}
+}
+
+// caller returns the call path of the invocation as text, or "-" if it was not
+// captured.
+func (e Extreme) caller() string {
+	if len(e.Callers) > 0 {
+		return strings.Join(e.Callers, " <- ")
+	} else if len(e.Branches) > 0 {
+		return joinBranches(e.Branches)
+	}
+	return "-"
+}
+
+// RegionStats aggregates all invocations of a single region. Besides the
+// running statistics, a histogram of each event's per-invocation values is
+// kept to estimate percentiles.
+type RegionStats struct {
+	Name  string
+	Loc   Location
+	Count int
+	// number of separate runs of the target that executed the region
+	Runs    int
+	Labels  []string
+	Ratios  []Ratio
+	Results []Stat
+	Hists   []Histogram
+	// Min and Max are the invocations with the smallest and largest value
+	// of each event (only kept by AddInvocation).
+	Min []Extreme
+	Max []Extreme
+	// Elapsed time in nanoseconds
+	Elapsed Stat
+	// Wall-clock time in nanoseconds
+	Wall     Stat
+	WallHist Histogram
+	WallMin  Extreme
+	WallMax  Extreme
+	// Incomplete is the number of invocations that never reached the end of
+	// the region. They are not included in the statistics.
+	Incomplete int
+	// Anomalies is the number of invocations with a counter that went
+	// backwards (see Result.Anomaly). They are not included in the
+	// statistics either.
+	Anomalies int
+	// Tid is the thread for per-thread statistics, or 0 for the merged
+	// statistics of all threads.
+	Tid int
+	// Threads holds the statistics of each thread that executed the region,
+	// sorted by thread ID. Threads that have exited keep the totals of the
+	// invocations they completed.
+	Threads []*RegionStats
+	// CPU is the CPU for per-CPU statistics, or -1 for the merged
+	// statistics of all CPUs.
+	CPU int
+	// CPUs holds the statistics of the invocations entered on each CPU,
+	// sorted by CPU. Invocations whose CPU is unknown are left out.
+	CPUs []*RegionStats
+}
+
+// NewRegionStats returns an empty aggregate for the given region.
+func NewRegionStats(name string) *RegionStats {
+	return &RegionStats{
+		Name: name,
+		CPU:  -1,
+	}
+}
+
+// Add the metrics from one invocation of the region.
+func (r *RegionStats) Add(m Metrics) {
+	r.init(m)
+	r.Count++
+	for i, result := range m.Results {
+		if i < len(r.Results) {
+			r.Results[i].Add(float64(result.ScaledValue()))
+			r.Hists[i].Add(result.ScaledValue())
+		}
+	}
+	r.Elapsed.Add(float64(m.Elapsed))
+	r.Wall.Add(float64(m.Wall))
+	r.WallHist.Add(uint64(m.Wall))
+}
+
+// AddInvocation adds the metrics of an invocation like Add, and keeps the
+// invocation's context if it has the smallest or largest value of an event or
+// of the wall-clock time so far.
+func (r *RegionStats) AddInvocation(nm NamedMetrics) {
+	first := r.Count == 0
+	r.Add(nm.Metrics)
+	for i, result := range nm.Results {
+		if i < len(r.Min) {
+			v := result.ScaledValue()
+			if first || v < r.Min[i].Value {
+				r.Min[i] = extreme(nm, v)
+			}
+			if first || v > r.Max[i].Value {
+				r.Max[i] = extreme(nm, v)
+			}
+		}
+	}
+	wall := uint64(nm.Wall)
+	if first || wall < r.WallMin.Value {
+		r.WallMin = extreme(nm, wall)
+	}
+	if first || wall > r.WallMax.Value {
+		r.WallMax = extreme(nm, wall)
+	}
+}
+
+// AddIncomplete counts an invocation that never reached the end of the
+// region. Its metrics are not added to the statistics.
+func (r *RegionStats) AddIncomplete(m Metrics) {
+	r.init(m)
+	r.Incomplete++
+}
+
+// AddAnomaly counts an invocation with a counter that went backwards. Its
+// metrics are not added to the statistics.
+func (r *RegionStats) AddAnomaly(m Metrics) {
+	r.init(m)
+	r.Anomalies++
+}
+
+func (r *RegionStats) init(m Metrics) {
+	if r.Labels == nil && len(m.Results) > 0 {
+		for _, result := range m.Results {
+			r.Labels = append(r.Labels, result.Label)
+		}
+		r.Results = make([]Stat, len(r.Labels))
+		r.Hists = make([]Histogram, len(r.Labels))
+		r.Min = make([]Extreme, len(r.Labels))
+		r.Max = make([]Extreme, len(r.Labels))
+		r.Ratios = m.Ratios
+	}
+}
+
+// Ratio computes a derived ratio over all invocations of the region, from the
+// totals of its events.
+func (r *RegionStats) Ratio(ratio Ratio) (float64, bool) {
+	return ratio.compute(func(label string) (float64, bool) {
+		for i, l := range r.Labels {
+			if l == label {
+				return r.Results[i].Total, true
+			}
+		}
+		return 0, false
+	})
+}
+
+// Stats aggregates the metrics of every invocation by region. The result is
+// sorted by region name so that output ordering is stable across runs.
+func (t TotalMetrics) Stats() []*RegionStats {
+	regions := make(map[string]*RegionStats)
+	type regionRun struct {
+		name string
+		run  int
+	}
+	runs := make(map[regionRun]bool)
+	type regionThread struct {
+		name string
+		tid  int
+	}
+	threads := make(map[regionThread]*RegionStats)
+	type regionCPU struct {
+		name string
+		cpu  int
+	}
+	cpus := make(map[regionCPU]*RegionStats)
+	cpuRuns := make(map[regionCPU]map[int]bool)
+	var stats []*RegionStats
+	for _, nm := range t {
+		r, ok := regions[nm.Name]
+		if !ok {
+			r = NewRegionStats(nm.Name)
+			r.Loc = nm.Loc
+			regions[nm.Name] = r
+			stats = append(stats, r)
+		}
+		if !runs[regionRun{nm.Name, nm.Run}] {
+			runs[regionRun{nm.Name, nm.Run}] = true
+			r.Runs++
+		}
+
+		th, ok := threads[regionThread{nm.Name, nm.Tid}]
+		if !ok {
+			th = NewRegionStats(nm.Name)
+			th.Loc = nm.Loc
+			th.Tid = nm.Tid
+			// a thread only exists in a single run of the target
+			th.Runs = 1
+			threads[regionThread{nm.Name, nm.Tid}] = th
+			r.Threads = append(r.Threads, th)
+		}
+		cpu := cpus[regionCPU{nm.Name, nm.CPU}]
+		if cpu == nil && nm.CPU >= 0 {
+			cpu = NewRegionStats(nm.Name)
+			cpu.Loc = nm.Loc
+			cpu.CPU = nm.CPU
+			cpus[regionCPU{nm.Name, nm.CPU}] = cpu
+			cpuRuns[regionCPU{nm.Name, nm.CPU}] = make(map[int]bool)
+			r.CPUs = append(r.CPUs, cpu)
+		}
+		if cpu != nil && !cpuRuns[regionCPU{nm.Name, nm.CPU}][nm.Run] {
+			cpuRuns[regionCPU{nm.Name, nm.CPU}][nm.Run] = true
+			cpu.Runs++
+		}
+
+		if nm.Incomplete {
+			r.AddIncomplete(nm.Metrics)
+			th.AddIncomplete(nm.Metrics)
+			if cpu != nil {
+				cpu.AddIncomplete(nm.Metrics)
+			}
+			continue
+		}
+		if nm.Anomalous() {
+			r.AddAnomaly(nm.Metrics)
+			th.AddAnomaly(nm.Metrics)
+			if cpu != nil {
+				cpu.AddAnomaly(nm.Metrics)
+			}
+			continue
+		}
+		r.AddInvocation(nm)
+		th.AddInvocation(nm)
+		if cpu != nil {
+			cpu.AddInvocation(nm)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	for _, r := range stats {
+		sort.Slice(r.Threads, func(i, j int) bool {
+			return r.Threads[i].Tid < r.Threads[j].Tid
+		})
+		sort.Slice(r.CPUs, func(i, j int) bool {
+			return r.CPUs[i].CPU < r.CPUs[j].CPU
+		})
+	}
+	return stats
+}
+
+// WriteStatsTo writes one row per region with the number of invocations and
+// the total, mean, standard deviation, requested percentiles, and maximum of
+// each event, followed by the derived ratios (computed from the totals), and
+// the same statistics for the wall-clock time (except the standard
+// deviation). Percentiles are given between 0 and 100. If the
+// invocations come from multiple runs of the target, the number of runs that
+// executed each region is shown as well, and so are the numbers of incomplete
+// and anomalous invocations if any region has them. If perThread is set, each region's row
+// is followed by a row for every thread that executed it, and if perCPU is
+// set, by a row for every CPU that the region was entered on.
+func (t TotalMetrics) WriteStatsTo(table MetricsWriter, percentiles []float64, perThread, perCPU bool) {
+	stats := t.Stats()
+	multirun, incomplete, anomalies := false, false, false
+	for _, r := range stats {
+		if r.Runs > 1 {
+			multirun = true
+		}
+		if r.Incomplete > 0 {
+			incomplete = true
+		}
+		if r.Anomalies > 0 {
+			anomalies = true
+		}
+	}
+
+	pcols := func(label string) []string {
+		var cols []string
+		for _, p := range percentiles {
+			cols = append(cols, fmt.Sprintf("%s-p%s", label, strconv.FormatFloat(p, 'f', -1, 64)))
+		}
+		return append(cols, label+"-max")
+	}
+
+	header := []string{"region", "count"}
+	if multirun {
+		header = append(header, "runs")
+	}
+	if incomplete {
+		header = append(header, "incomplete")
+	}
+	if anomalies {
+		header = append(header, "anomalies")
+	}
+	for _, r := range stats {
+		for _, l := range r.Labels {
+			header = append(header, l+"-total", l+"-mean", l+"-stddev")
+			header = append(header, pcols(l)...)
+		}
+		for _, ratio := range r.Ratios {
+			header = append(header, ratio.Label)
+		}
+		break
+	}
+	header = append(header, "time-elapsed-total", "time-elapsed-mean", "time-elapsed-stddev")
+	header = append(header, "wall-total", "wall-mean")
+	header = append(header, pcols("wall")...)
+	table.SetHeader(header)
+
+	row := func(r *RegionStats) []string {
+		name := r.Name
+		if r.Tid != 0 {
+			name = fmt.Sprintf("%s (tid %d)", r.Name, r.Tid)
+		} else if r.CPU >= 0 {
+			name = fmt.Sprintf("%s (cpu %d)", r.Name, r.CPU)
+		}
+		row := []string{name, fmt.Sprintf("%d", r.Count)}
+		if multirun {
+			row = append(row, fmt.Sprintf("%d", r.Runs))
+		}
+		if incomplete {
+			row = append(row, fmt.Sprintf("%d", r.Incomplete))
+		}
+		if anomalies {
+			row = append(row, fmt.Sprintf("%d", r.Anomalies))
+		}
+		for i := range r.Results {
+			s := &r.Results[i]
+			row = append(row,
+				fmt.Sprintf("%.0f", s.Total),
+				fmt.Sprintf("%.2f", s.Mean()),
+				fmt.Sprintf("%.2f", s.Stddev()),
+			)
+			for _, p := range percentiles {
+				row = append(row, fmt.Sprintf("%d", r.Hists[i].Quantile(p/100)))
+			}
+			row = append(row, fmt.Sprintf("%d", r.Hists[i].Max()))
+		}
+		for _, ratio := range r.Ratios {
+			row = append(row, ratio.Format(r.Ratio(ratio)))
+		}
+		row = append(row,
+			fmt.Sprintf("%s", time.Duration(r.Elapsed.Total)),
+			fmt.Sprintf("%s", time.Duration(r.Elapsed.Mean())),
+			fmt.Sprintf("%s", time.Duration(r.Elapsed.Stddev())),
+			fmt.Sprintf("%s", time.Duration(r.Wall.Total)),
+			fmt.Sprintf("%s", time.Duration(r.Wall.Mean())),
+		)
+		for _, p := range percentiles {
+			row = append(row, fmt.Sprintf("%s", time.Duration(r.WallHist.Quantile(p/100))))
+		}
+		return append(row, fmt.Sprintf("%s", time.Duration(r.WallHist.Max())))
+	}
+
+	for _, r := range stats {
+		table.Append(row(r))
+		if perThread {
+			for _, th := range r.Threads {
+				table.Append(row(th))
+			}
+		}
+		if perCPU {
+			for _, cpu := range r.CPUs {
+				table.Append(row(cpu))
+			}
+		}
+	}
+
+	table.Render()
+}
+
+// WriteExtremesTo writes the invocations with the smallest and largest value
+// of each event and of the wall-clock time, for every region: the value, the
+// thread, when the invocation started (relative to the first invocation of
+// its run), and its callers or recorded calls if they were captured.
+func (t TotalMetrics) WriteExtremesTo(table MetricsWriter) {
+	// start of each run of the target
+	first := make(map[int]time.Duration)
+	for _, nm := range t {
+		if start, ok := first[nm.Run]; !ok || nm.Start < start {
+			first[nm.Run] = nm.Start
+		}
+	}
+
+	table.SetHeader([]string{"region", "event", "extreme", "value", "tid", "start", "callers"})
+	row := func(r *RegionStats, label, kind, value string, e Extreme) {
+		table.Append([]string{
+			r.Name,
+			label,
+			kind,
+			value,
+			fmt.Sprintf("%d", e.Tid),
+			fmt.Sprintf("+%s", e.Start-first[e.Run]),
+			e.caller(),
+		})
+	}
+	for _, r := range t.Stats() {
+		if r.Count == 0 {
+			continue
+		}
+		for i, l := range r.Labels {
+			row(r, l, "min", fmt.Sprintf("%d", r.Min[i].Value), r.Min[i])
+			row(r, l, "max", fmt.Sprintf("%d", r.Max[i].Value), r.Max[i])
+		}
+		row(r, "wall-time", "min", time.Duration(r.WallMin.Value).String(), r.WallMin)
+		row(r, "wall-time", "max", time.Duration(r.WallMax.Value).String(), r.WallMax)
+	}
+
+	table.Render()
+}
@@ -0,0 +1,157 @@
+package perforator
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// number of invocation records buffered for each client of a Stream before
+// records are dropped
+const streamBuffer = 4096
+
+// time given to the clients of a Stream to read their remaining records when
+// it is closed
+const streamCloseTimeout = time.Second
+
+// A Stream sends invocation records to the clients connected to a Unix
+// socket, as a live feed of a run. Each invocation is written as a single line
+// of JSON in the form of NamedMetrics.WriteJSON. Clients may connect and
+// disconnect at any time, and only receive the invocations that complete while
+// they are connected. Records are written to each client in the background, so
+// a slow client never holds up the target; if a client falls too far behind,
+// the records it cannot keep up with are dropped.
+type Stream struct {
+	ln   net.Listener
+	path string
+
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+type streamClient struct {
+	conn    net.Conn
+	lines   chan []byte
+	dropped int
+}
+
+// NewStream listens for clients on a Unix socket created at path. The socket
+// is removed when the stream is closed.
+func NewStream(path string) (*Stream, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("stream: %w", err)
+	}
+	s := &Stream{
+		ln:      ln,
+		path:    path,
+		clients: make(map[*streamClient]bool),
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *Stream) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &streamClient{
+			conn:  conn,
+			lines: make(chan []byte, streamBuffer),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		infof("stream: client connected\n")
+		go s.send(c)
+	}
+}
+
+// send writes the records queued for a client until the client disconnects
+// or the stream is closed.
+func (s *Stream) send(c *streamClient) {
+	defer s.wg.Done()
+	defer c.conn.Close()
+	for line := range c.lines {
+		if _, err := c.conn.Write(line); err != nil {
+			infof("stream: client disconnected: %v\n", err)
+			s.mu.Lock()
+			s.remove(c)
+			s.mu.Unlock()
+			// drain the records that were queued in the meantime
+			for range c.lines {
+			}
+			return
+		}
+	}
+}
+
+// remove stops sending records to a client. The stream's lock must be held.
+func (s *Stream) remove(c *streamClient) {
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	close(c.lines)
+	if c.dropped > 0 {
+		infof("stream: %d records dropped for a slow client\n", c.dropped)
+	}
+}
+
+// Write queues the invocation for every connected client. It does not wait
+// for the clients to receive it, and only fails if the invocation cannot be
+// encoded.
+func (s *Stream) Write(nm NamedMetrics) error {
+	var b bytes.Buffer
+	if err := nm.WriteJSON(&b); err != nil {
+		return err
+	}
+	line := b.Bytes()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		select {
+		case c.lines <- line:
+		default:
+			c.dropped++
+		}
+	}
+	return nil
+}
+
+// Close stops accepting clients, sends the queued records to the connected
+// clients, and disconnects them. Clients that do not read their records
+// within streamCloseTimeout are disconnected without them.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	deadline := time.Now().Add(streamCloseTimeout)
+	for c := range s.clients {
+		c.conn.SetWriteDeadline(deadline)
+		s.remove(c)
+	}
+	s.mu.Unlock()
+
+	err := s.ln.Close()
+	s.wg.Wait()
+	if rerr := os.Remove(s.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,22 @@
+#include <stdio.h>
+
+volatile int sink;
+
+__attribute__((noinline)) int work(int n) {
+    for (int i = 0; i < n; i++) {
+        sink += i;
+    }
+    return sink;
+}
+
+// a second symbol for the same function, as C libraries define for many of
+// theirs
+int work_alias(int n) __attribute__((weak, alias("work")));
+
+int main() {
+    for (int i = 0; i < 5; i++) {
+        work_alias(1000);
+    }
+    printf("%d\n", sink);
+    return 0;
+}
@@ -0,0 +1,37 @@
+#include <stdio.h>
+#include <ucontext.h>
+
+static ucontext_t main_ctx, coro_ctx;
+static char coro_stack[64 * 1024];
+volatile int steps;
+
+// Switches to the other context, which resumes by returning from its own
+// call of yield, on a different stack.
+__attribute__((noinline)) void yield(ucontext_t *from, ucontext_t *to) {
+    swapcontext(from, to);
+}
+
+__attribute__((noinline)) void step(ucontext_t *from, ucontext_t *to) {
+    steps++;
+    yield(from, to);
+    steps++;
+}
+
+static void coro() {
+    for (int i = 0; i < 3; i++) {
+        step(&coro_ctx, &main_ctx);
+    }
+}
+
+int main() {
+    getcontext(&coro_ctx);
+    coro_ctx.uc_stack.ss_sp = coro_stack;
+    coro_ctx.uc_stack.ss_size = sizeof(coro_stack);
+    coro_ctx.uc_link = &main_ctx;
+    makecontext(&coro_ctx, coro, 0);
+    for (int i = 0; i < 3; i++) {
+        step(&main_ctx, &coro_ctx);
+    }
+    printf("%d\n", steps);
+    return 0;
+}
@@ -0,0 +1,20 @@
+#include <dlfcn.h>
+#include <stdio.h>
+
+// Loads and unloads libm repeatedly, calling frexp each time it is loaded.
+int main() {
+    double x = 1;
+    for (int i = 0; i < 3; i++) {
+        void* lib = dlopen("libm.so.6", RTLD_NOW);
+        if (!lib) {
+            fprintf(stderr, "%s\n", dlerror());
+            return 1;
+        }
+        double (*frexp)(double, int*) = dlsym(lib, "frexp");
+        int e;
+        x = frexp(x + 3, &e);
+        dlclose(lib);
+    }
+    printf("%f\n", x);
+    return 0;
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const calls = 3
+
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+
+func main() {
+	runtime.LockOSThread()
+	for i := 0; i < calls; i++ {
+		fmt.Println(fib(20))
+	}
+}
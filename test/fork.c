@@ -0,0 +1,23 @@
+#include <stdio.h>
+#include <stdint.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+#define SIZE 1000000
+
+__attribute__((noinline)) uint64_t work() {
+    uint64_t sum = 0;
+    for (volatile int i = 0; i < SIZE; i++) {
+        sum += i;
+    }
+    return sum;
+}
+
+int main() {
+    pid_t pid = fork();
+    printf("%lu\n", work());
+    if (pid != 0) {
+        waitpid(pid, NULL, 0);
+    }
+    return 0;
+}
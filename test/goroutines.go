@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+const (
+	goroutines = 8
+	calls      = 50
+)
+
+var sink int
+
+// work yields in the middle of each call, so the runtime may resume it on
+// another thread.
+//
+//go:noinline
+func work(n int) int {
+	s := 0
+	for i := 0; i < n; i++ {
+		s += i * i
+		if i == n/2 {
+			runtime.Gosched()
+		}
+	}
+	return s
+}
+
+func main() {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < calls; i++ {
+				s := work(10000)
+				mu.Lock()
+				sink += s
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Println(sink != 0)
+}
@@ -0,0 +1,32 @@
+#include <stdio.h>
+
+volatile int sink;
+
+__attribute__((noinline)) static int scale_fast(int x) {
+    return x * 2;
+}
+
+__attribute__((noinline)) static int scale_slow(int x) {
+    int y = 0;
+    for (int i = 0; i < 2; i++) {
+        y += x;
+    }
+    return y;
+}
+
+// chooses the implementation when the program is loaded, as glibc does for
+// memcpy
+static void* resolve_scale(void) {
+    return sink ? (void*) scale_slow : (void*) scale_fast;
+}
+
+int scale(int x) __attribute__((ifunc("resolve_scale")));
+
+int main() {
+    int sum = 0;
+    for (int i = 0; i < 10; i++) {
+        sum += scale(i);
+    }
+    printf("%d\n", sum);
+    return 0;
+}
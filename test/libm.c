@@ -0,0 +1,12 @@
+#include <math.h>
+#include <stdio.h>
+
+int main(int argc, char** argv) {
+    volatile double x = argc;
+    for (int i = 0; i < 3; i++) {
+        int e;
+        x = frexp(x + 3, &e);
+    }
+    printf("%f\n", x);
+    return 0;
+}
@@ -0,0 +1,40 @@
+#include <setjmp.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+static jmp_buf env;
+static volatile int leave = 1;
+
+// Leaves through longjmp, so the function does not return.
+__attribute__((noinline)) void jump(int i) {
+    printf("%d\n", i);
+    if (leave) {
+        longjmp(env, 1);
+    }
+}
+
+// Exits the process while the function is active.
+__attribute__((noinline)) void stop() {
+    if (leave) {
+        exit(0);
+    }
+}
+
+// Calls jump from three call sites, since a function entered again from the
+// same call site and frame is taken to be a tail call.
+int main() {
+    if (setjmp(env) == 0) {
+        jump(0);
+        printf("not reached\n");
+    }
+    if (setjmp(env) == 0) {
+        jump(1);
+        printf("not reached\n");
+    }
+    if (setjmp(env) == 0) {
+        jump(2);
+        printf("not reached\n");
+    }
+    stop();
+    return 1;
+}
@@ -0,0 +1,33 @@
+#include <stdio.h>
+
+#include "../include/perforator.h"
+
+__attribute__((noinline)) int work(int n) {
+    int sum = 0;
+    for (int i = 0; i < n; i++) {
+        sum += i;
+    }
+    return sum;
+}
+
+// ends the measurement that its caller began
+__attribute__((noinline)) int finish(int n) {
+    int sum = work(n);
+    perforator_end();
+    return sum;
+}
+
+int main() {
+    int sum = 0;
+    for (int i = 0; i < 2; i++) {
+        perforator_begin();
+        sum += work(1000);
+        perforator_end();
+    }
+    perforator_begin();
+    sum += finish(1000);
+    // not measured
+    sum += work(1000);
+    printf("%d\n", sum);
+    return 0;
+}
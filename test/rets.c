@@ -0,0 +1,28 @@
+#include <stdio.h>
+
+volatile int sink;
+
+// at -O2, each early return gets its own return instruction
+__attribute__((noinline)) int classify(int x) {
+    if (x % 3 == 0) {
+        sink = x;
+        return 3;
+    }
+    if (x % 5 == 0) {
+        sink = x * 2;
+        return 5;
+    }
+    for (int i = 0; i < x; i++) {
+        sink += i;
+    }
+    return 0;
+}
+
+int main() {
+    int sum = 0;
+    for (int i = 1; i <= 30; i++) {
+        sum += classify(i);
+    }
+    printf("%d\n", sum);
+    return 0;
+}
@@ -0,0 +1,16 @@
+#include <stdio.h>
+#include <time.h>
+
+__attribute__((noinline)) void work() {
+    struct timespec ts = {0, 1000000};
+    for (int i = 0; i < 10; i++) {
+        nanosleep(&ts, NULL);
+    }
+}
+
+int main() {
+    work();
+    work();
+    printf("done\n");
+    return 0;
+}
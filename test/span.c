@@ -0,0 +1,36 @@
+#include <stdio.h>
+
+volatile int held;
+
+__attribute__((noinline)) void acquire() {
+    held++;
+}
+
+__attribute__((noinline)) void release() {
+    held--;
+}
+
+__attribute__((noinline)) int work(int n) {
+    int sum = 0;
+    for (int i = 0; i < n; i++) {
+        sum += i;
+    }
+    return sum;
+}
+
+int main() {
+    int sum = 0;
+    for (int i = 0; i < 3; i++) {
+        acquire();
+        sum += work(100);
+        release();
+    }
+    // acquired again before it is released
+    acquire();
+    acquire();
+    sum += work(100);
+    release();
+    release();
+    printf("%d\n", sum);
+    return 0;
+}
@@ -0,0 +1,22 @@
+#include <stdio.h>
+#include <stdint.h>
+
+#define SIZE 1000000
+
+__attribute__((noinline)) uint64_t work() {
+    uint64_t sum = 0;
+    for (volatile int i = 0; i < SIZE; i++) {
+        sum += i;
+    }
+    return sum;
+}
+
+int main() {
+    uint64_t total = 0;
+    // never terminates on its own
+    for (;;) {
+        total += work();
+    }
+    printf("%lu\n", total);
+    return 0;
+}
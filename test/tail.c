@@ -0,0 +1,28 @@
+#include <stdio.h>
+
+__attribute__((noinline)) long odd(long n);
+
+// Mutually recursive functions that tail call each other, so each call to
+// even runs as a single frame.
+__attribute__((noinline)) long even(long n) {
+    if (n == 0) {
+        return 1;
+    }
+    return odd(n - 1);
+}
+
+__attribute__((noinline)) long odd(long n) {
+    if (n == 0) {
+        return 0;
+    }
+    return even(n - 1);
+}
+
+int main() {
+    long total = 0;
+    for (volatile long i = 0; i < 3; i++) {
+        total += even(10 + i);
+    }
+    printf("%ld\n", total);
+    return 0;
+}
@@ -0,0 +1,46 @@
+#include <pthread.h>
+#include <stdio.h>
+#include <stdint.h>
+
+#define CALLS 10000
+
+__attribute__((noinline)) uint64_t work(uint64_t n) {
+    uint64_t sum = 0;
+    for (volatile uint64_t i = 0; i < n; i++) {
+        sum += i;
+    }
+    return sum;
+}
+
+// Each thread calls work from its own call site, so that the breakpoints at
+// the end of the region are not shared.
+#define RUN(name)                                  \
+    __attribute__((noinline)) void* name(void* arg) { \
+        uint64_t total = 0;                        \
+        for (int i = 0; i < CALLS; i++) {          \
+            total += work(100);                    \
+        }                                          \
+        *(uint64_t*) arg = total;                  \
+        return NULL;                               \
+    }
+
+RUN(run0)
+RUN(run1)
+RUN(run2)
+RUN(run3)
+
+int main() {
+    void* (*runs[])(void*) = {run0, run1, run2, run3};
+    pthread_t threads[4];
+    uint64_t totals[4];
+    for (int i = 0; i < 4; i++) {
+        pthread_create(&threads[i], NULL, runs[i], &totals[i]);
+    }
+    uint64_t total = 0;
+    for (int i = 0; i < 4; i++) {
+        pthread_join(threads[i], NULL);
+        total += totals[i];
+    }
+    printf("%lu\n", total);
+    return 0;
+}
@@ -0,0 +1,30 @@
+#include <signal.h>
+#include <stdint.h>
+
+static volatile int traps = 0;
+
+static void handler(int sig) {
+    traps++;
+}
+
+// Executes its own trap instruction, which the tracer must deliver to the
+// program rather than mistake for one of its breakpoints.
+__attribute__((noinline)) uint64_t work() {
+    uint64_t sum = 0;
+    for (volatile int i = 0; i < 1000; i++) {
+        sum += i;
+    }
+#if defined(__x86_64__)
+    __asm__ volatile("int3");
+#else
+    raise(SIGTRAP);
+#endif
+    return sum;
+}
+
+int main() {
+    signal(SIGTRAP, handler);
+    work();
+    // the exit status reports whether the trap was delivered exactly once
+    return traps == 1 ? 0 : 1;
+}
@@ -0,0 +1,3 @@
+#!/bin/sh
+# Runs the sum benchmark through a wrapper script, like a launcher would.
+exec "$(dirname "$0")/sum-wrapped" "$@"
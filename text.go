@@ -0,0 +1,113 @@
+package perforator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// WriteText writes a summary of every region as aligned columns of plain text:
+// the region, its number of invocations, and the total and mean of each event
+// and of the wall-clock time. Column widths adapt to the values, and counts
+// are abbreviated to be easy to read at a glance (see humanCount), so one of
+// the other formats should be used to process the results further.
+// Incomplete invocations are left out.
+func (t TotalMetrics) WriteText(w io.Writer) error {
+	stats := t.Stats()
+
+	header := []string{"region", "count"}
+	for _, r := range stats {
+		for _, l := range r.Labels {
+			header = append(header, l+" total", l+" mean")
+		}
+		break
+	}
+	header = append(header, "wall total", "wall mean")
+
+	rows := [][]string{header}
+	for _, r := range stats {
+		row := []string{r.Name, humanCount(float64(r.Count))}
+		for i := range r.Results {
+			s := &r.Results[i]
+			row = append(row, humanCount(s.Total), humanCount(s.Mean()))
+		}
+		row = append(row,
+			humanDuration(time.Duration(r.Wall.Total)),
+			humanDuration(time.Duration(r.Wall.Mean())),
+		)
+		rows = append(rows, row)
+	}
+
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for i, col := range row {
+			if n := len([]rune(col)); i < len(widths) && n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	for _, row := range rows {
+		var b strings.Builder
+		for i, col := range row {
+			if i >= len(widths) {
+				break
+			}
+			// region names are left-aligned, and numbers right-aligned
+			pad := strings.Repeat(" ", widths[i]-len([]rune(col)))
+			if i == 0 {
+				b.WriteString(col + pad)
+			} else {
+				b.WriteString("  " + pad + col)
+			}
+		}
+		b.WriteString("\n")
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SI prefixes used to abbreviate large counts, from 10^6 upwards.
+var siPrefixes = []string{"M", "G", "T", "P", "E"}
+
+// humanCount formats a count for reading: below a million it is written in
+// full with thousands separators (with one decimal if it is not a whole
+// number, as for a mean), and from a million upwards with three significant
+// digits and an SI prefix, such as 49.8M.
+func humanCount(v float64) string {
+	if v >= 1e6 {
+		v /= 1e6
+		i := 0
+		for v >= 999.5 && i < len(siPrefixes)-1 {
+			v /= 1e3
+			i++
+		}
+		return fmt.Sprintf("%.3g%s", v, siPrefixes[i])
+	}
+
+	v = math.Round(v*10) / 10
+	whole := uint64(v)
+	s := fmt.Sprintf("%d", whole)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	if tenths := math.Round((v - float64(whole)) * 10); tenths != 0 {
+		s += fmt.Sprintf(".%.0f", tenths)
+	}
+	return s
+}
+
+// humanDuration rounds a duration to a precision that is easy to read, keeping
+// at least three significant digits.
+func humanDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	}
+	return d.String()
+}
@@ -0,0 +1,43 @@
+package utrace
+
+import (
+	"github.com/zyedidia/perforator/utrace/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+// An arch describes the architecture-specific details of placing software
+// breakpoints and inspecting the registers of a stopped process.
+type arch interface {
+	// BreakInstr returns the trap instruction used for software breakpoints.
+	BreakInstr() []byte
+	// TrapPCAdjust returns how far the PC has advanced past the breakpoint
+	// address by the time the given trap instruction is reported to the
+	// tracer.
+	TrapPCAdjust(trap []byte) uint64
+	// GetPC returns the program counter.
+	GetPC(regs *unix.PtraceRegs) uint64
+	// SetPC assigns the program counter.
+	SetPC(regs *unix.PtraceRegs, pc uint64)
+	// StackPointer returns the stack pointer.
+	StackPointer(regs *unix.PtraceRegs) uint64
+	// FramePointer returns the frame pointer register, rbp on x86-64 and
+	// x29 on arm64, which holds the address of the current frame record in
+	// code compiled with frame pointers.
+	FramePointer(regs *unix.PtraceRegs) uint64
+	// ReturnAddr returns the return address of a function that has just been
+	// called, given the registers at the function's first instruction.
+	ReturnAddr(regs *unix.PtraceRegs, p *Proc) (uint64, error)
+	// ReturnSP returns the stack pointer at the return address of a function
+	// whose first instruction ran with the stack pointer sp.
+	ReturnSP(sp uint64) uint64
+	// ReturnValue returns the value returned by a function, given the
+	// registers at its return address.
+	ReturnValue(regs *unix.PtraceRegs) uint64
+	// Goroutine returns the register that holds the current goroutine in
+	// Go code compiled with the register-based calling convention.
+	Goroutine(regs *unix.PtraceRegs) uint64
+	// GetRegs fetches the general purpose registers of the tracee.
+	GetRegs(t *ptrace.Tracer, regs *unix.PtraceRegs) error
+	// SetRegs assigns the general purpose registers of the tracee.
+	SetRegs(t *ptrace.Tracer, regs *unix.PtraceRegs) error
+}
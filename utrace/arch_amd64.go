@@ -0,0 +1,79 @@
+package utrace
+
+import (
+	"debug/elf"
+	"encoding/binary"
+
+	"github.com/zyedidia/perforator/utrace/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+var hostArch arch = amd64{}
+
+// hostMachine is the ELF machine of the executables that can run on the host.
+const hostMachine = elf.EM_X86_64
+
+type amd64 struct{}
+
+// BreakInstr returns the int3 instruction.
+func (amd64) BreakInstr() []byte {
+	return []byte{0xCC}
+}
+
+// TrapPCAdjust returns the size of the trap instruction (1 for int3), since
+// the trap is reported after the instruction executes.
+func (amd64) TrapPCAdjust(trap []byte) uint64 {
+	return uint64(len(trap))
+}
+
+func (amd64) GetPC(regs *unix.PtraceRegs) uint64 {
+	return regs.Rip
+}
+
+func (amd64) SetPC(regs *unix.PtraceRegs, pc uint64) {
+	regs.Rip = pc
+}
+
+func (amd64) StackPointer(regs *unix.PtraceRegs) uint64 {
+	return regs.Rsp
+}
+
+// FramePointer returns rbp, the frame pointer register.
+func (amd64) FramePointer(regs *unix.PtraceRegs) uint64 {
+	return regs.Rbp
+}
+
+// ReturnAddr reads the return address from the top of the stack. It is
+// assumed that a call instruction has just been executed.
+func (amd64) ReturnAddr(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	b := make([]byte, 8)
+	_, err := p.tracer.ReadMem(uintptr(regs.Rsp), b)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// ReturnSP accounts for the return address popped by ret.
+func (amd64) ReturnSP(sp uint64) uint64 {
+	return sp + 8
+}
+
+// ReturnValue returns rax.
+func (amd64) ReturnValue(regs *unix.PtraceRegs) uint64 {
+	return regs.Rax
+}
+
+// Goroutine returns r14, which holds the current goroutine in Go code since
+// Go 1.17.
+func (amd64) Goroutine(regs *unix.PtraceRegs) uint64 {
+	return regs.R14
+}
+
+func (amd64) GetRegs(t *ptrace.Tracer, regs *unix.PtraceRegs) error {
+	return t.GetRegs(regs)
+}
+
+func (amd64) SetRegs(t *ptrace.Tracer, regs *unix.PtraceRegs) error {
+	return t.SetRegs(regs)
+}
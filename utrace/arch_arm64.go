@@ -0,0 +1,78 @@
+package utrace
+
+import (
+	"debug/elf"
+
+	"github.com/zyedidia/perforator/utrace/ptrace"
+	"golang.org/x/sys/unix"
+)
+
+var hostArch arch = arm64{}
+
+// hostMachine is the ELF machine of the executables that can run on the host.
+const hostMachine = elf.EM_AARCH64
+
+// the link register is x30
+const arm64LR = 30
+
+type arm64 struct{}
+
+// BreakInstr returns the 'brk #0' instruction (0xd4200000).
+func (arm64) BreakInstr() []byte {
+	return []byte{0x00, 0x00, 0x20, 0xd4}
+}
+
+// TrapPCAdjust returns 0 because the PC still points at the brk instruction
+// when the trap is reported.
+func (arm64) TrapPCAdjust(trap []byte) uint64 {
+	return 0
+}
+
+func (arm64) GetPC(regs *unix.PtraceRegs) uint64 {
+	return regs.Pc
+}
+
+func (arm64) SetPC(regs *unix.PtraceRegs, pc uint64) {
+	regs.Pc = pc
+}
+
+func (arm64) StackPointer(regs *unix.PtraceRegs) uint64 {
+	return regs.Sp
+}
+
+// FramePointer returns x29, the frame pointer register.
+func (arm64) FramePointer(regs *unix.PtraceRegs) uint64 {
+	return regs.Regs[29]
+}
+
+// ReturnAddr returns the link register. It is assumed that a branch-and-link
+// has just been executed, so the function prologue has not yet spilled it.
+func (arm64) ReturnAddr(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	return regs.Regs[arm64LR], nil
+}
+
+// ReturnSP returns sp, since the return address is kept in the link register
+// rather than on the stack.
+func (arm64) ReturnSP(sp uint64) uint64 {
+	return sp
+}
+
+// ReturnValue returns x0.
+func (arm64) ReturnValue(regs *unix.PtraceRegs) uint64 {
+	return regs.Regs[0]
+}
+
+// Goroutine returns x28, which holds the current goroutine in Go code.
+func (arm64) Goroutine(regs *unix.PtraceRegs) uint64 {
+	return regs.Regs[28]
+}
+
+// GetRegs uses PTRACE_GETREGSET since arm64 does not support PTRACE_GETREGS.
+func (arm64) GetRegs(t *ptrace.Tracer, regs *unix.PtraceRegs) error {
+	return t.GetRegSet(regs)
+}
+
+// SetRegs uses PTRACE_SETREGSET since arm64 does not support PTRACE_SETREGS.
+func (arm64) SetRegs(t *ptrace.Tracer, regs *unix.PtraceRegs) error {
+	return t.SetRegSet(regs)
+}
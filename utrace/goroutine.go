@@ -0,0 +1,88 @@
+package utrace
+
+import "time"
+
+// A threadGroup holds the software breakpoints shared by the threads of a Go
+// process (see Options.Go). The runtime runs goroutines on any of its threads,
+// so a goroutine that entered a region on one thread may reach the region's
+// return address on another, which must recognize the trap even though it
+// did not place it.
+type threadGroup struct {
+	// original instructions at the breakpoints placed by any thread, and
+	// the breakpoints removed while another thread may have hit them
+	breakpoints map[uintptr][]byte
+	retired     map[uintptr]bool
+	threads     map[int]*Proc
+}
+
+// join adds t to the thread group of its process, creating the group with t's
+// breakpoints if t is the first thread traced in it.
+func (p *Program) join(t *Proc) {
+	if !p.opts.Go {
+		return
+	}
+	g, ok := p.groups[t.tgid]
+	if !ok {
+		g = &threadGroup{
+			breakpoints: t.breakpoints,
+			retired:     t.retired,
+			threads:     make(map[int]*Proc),
+		}
+		p.groups[t.tgid] = g
+	}
+	t.group = g
+	t.breakpoints, t.retired = g.breakpoints, g.retired
+	g.threads[t.Pid()] = t
+}
+
+// leave removes t from its thread group, when it exits or execs.
+func (p *Program) leave(t *Proc) {
+	g := t.group
+	if g == nil {
+		return
+	}
+	delete(g.threads, t.Pid())
+	if len(g.threads) == 0 && p.groups[t.tgid] == g {
+		delete(p.groups, t.tgid)
+	}
+	t.group = nil
+}
+
+// needsBreak returns true if a thread of the group other than p is waiting on
+// the given address.
+func (g *threadGroup) needsBreak(p *Proc, pc uint64) bool {
+	for _, t := range g.threads {
+		if t != p && !t.exited && t.needsBreak(pc) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrated abandons the entries of goroutine g in the other threads of p's
+// group when g reaches their return address pc on p. The counters of those
+// threads only measured part of the invocation, since the goroutine moved to
+// p while it was inside the region. The threads may be running, so their
+// RegionAbandoned events are delivered at their next stop.
+func (p *Proc) migrated(pc, g uint64, now time.Duration) {
+	for _, t := range p.group.threads {
+		if t == p || t.exited {
+			continue
+		}
+		for _, i := range t.entered() {
+			r := &t.regions[i]
+			n := r.returning(pc, 0, g)
+			if n == 0 {
+				continue
+			}
+			infof("%d: region %d returned on thread %d (abandoned)\n", t.Pid(), r.id, p.Pid())
+			for ; n > 0; n-- {
+				r.pop()
+			}
+			t.track(i)
+			if r.depth() == 0 {
+				t.pending = append(t.pending, r.ended(RegionAbandoned, now))
+			}
+		}
+	}
+}
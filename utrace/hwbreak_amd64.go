@@ -0,0 +1,88 @@
+package utrace
+
+const (
+	// offsetof(struct user, u_debugreg) on amd64
+	debugRegOffset = 848
+	numDebugRegs   = 4
+	dr6            = 6
+	dr7            = 7
+)
+
+func debugReg(i int) uintptr {
+	return uintptr(debugRegOffset + i*8)
+}
+
+// setHardwareBreak programs a free debug register (DR0-DR3) to trap on
+// execution of pc. Debug registers that are already enabled in DR7 are never
+// touched, so that registers in use by the target are not clobbered. It
+// returns false if no debug register is available.
+func (p *Proc) setHardwareBreak(pc uint64) (bool, error) {
+	ctl, err := p.tracer.PeekUser(debugReg(dr7))
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < numDebugRegs; i++ {
+		// slot is locally or globally enabled by someone else
+		if ctl&(3<<(2*i)) != 0 {
+			continue
+		}
+
+		err = p.tracer.PokeUser(debugReg(i), pc)
+		if err != nil {
+			return false, err
+		}
+		// RW=00 (instruction execution), LEN=00 (1 byte), local enable
+		ctl &^= 0xf << (16 + 4*i)
+		ctl |= 1 << (2 * i)
+		err = p.tracer.PokeUser(debugReg(dr7), ctl)
+		if err != nil {
+			return false, err
+		}
+
+		p.hwbreaks[uintptr(pc)] = i
+		return true, nil
+	}
+	return false, nil
+}
+
+// removeHardwareBreak disables the given debug register slot in DR7, leaving
+// all other bits of DR7 as they were.
+func (p *Proc) removeHardwareBreak(slot int) error {
+	ctl, err := p.tracer.PeekUser(debugReg(dr7))
+	if err != nil {
+		return err
+	}
+	ctl &^= 1 << (2 * slot)
+	ctl &^= 0xf << (16 + 4*slot)
+	err = p.tracer.PokeUser(debugReg(dr7), ctl)
+	if err != nil {
+		return err
+	}
+	return p.tracer.PokeUser(debugReg(slot), 0)
+}
+
+// hardwareTrap reports whether the most recent trap was caused by one of our
+// debug registers by checking DR6. The status bits are cleared if so since
+// the processor never clears them itself.
+func (p *Proc) hardwareTrap() (bool, error) {
+	if len(p.hwbreaks) == 0 {
+		return false, nil
+	}
+
+	status, err := p.tracer.PeekUser(debugReg(dr6))
+	if err != nil {
+		return false, err
+	}
+
+	hit := false
+	for _, slot := range p.hwbreaks {
+		if status&(1<<slot) != 0 {
+			hit = true
+		}
+	}
+	if !hit {
+		return false, nil
+	}
+	return true, p.tracer.PokeUser(debugReg(dr6), status&^0xf)
+}
@@ -0,0 +1,16 @@
+package utrace
+
+// Hardware breakpoints are not implemented on arm64, so software breakpoints
+// are always used.
+
+func (p *Proc) setHardwareBreak(pc uint64) (bool, error) {
+	return false, nil
+}
+
+func (p *Proc) removeHardwareBreak(slot int) error {
+	return nil
+}
+
+func (p *Proc) hardwareTrap() (bool, error) {
+	return false, nil
+}
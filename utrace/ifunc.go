@@ -0,0 +1,176 @@
+package utrace
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// An Ifunc is the resolver of an indirect function (ELF symbol type
+// STT_GNU_IFUNC), such as memcpy in glibc. The symbol of an indirect function
+// is the address of its resolver, which the dynamic linker (or the startup
+// code of a static executable) calls when the program is loaded to choose the
+// implementation for the CPU, so a region for the function begins at the
+// address the resolver returns. The resolver is trapped to read its result
+// when it returns. A shared library loaded at startup has been relocated by
+// the time it is reported, so for libraries the result is also read from the
+// GOT entries that the dynamic linker sets to it.
+type Ifunc struct {
+	// Resolver is the address of the resolver, relative to the file that
+	// contains it.
+	Resolver uint64
+	// Slots are the addresses of the GOT entries that are set to the
+	// resolver's result (its IRELATIVE relocations), relative to the file.
+	Slots []uint64
+
+	// address of the implementation relative to the file, once known
+	impl uint64
+}
+
+// An IfuncRegion is an indirect function in the executable (see Ifunc). It
+// begins when the implementation chosen by the resolver is called and ends
+// when it returns. Its breakpoint is placed once the resolver has returned,
+// before the program's main function runs.
+type IfuncRegion struct {
+	Ifunc
+}
+
+// Start returns the address of the implementation, or 0 if the resolver has
+// not returned yet.
+func (r *IfuncRegion) Start(p *Proc) uint64 {
+	if r.impl == 0 {
+		return 0
+	}
+	return r.impl + p.pieOffset
+}
+
+// End returns the return address of the function (see FuncRegion).
+func (r *IfuncRegion) End(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	return hostArch.ReturnAddr(regs, p)
+}
+
+// indirect returns the resolver of a region that is an indirect function,
+// along with the load base of the file that contains it in p. It returns nil
+// if the region is not an indirect function or its library is not mapped.
+func indirect(r Region, p *Proc) (*Ifunc, uint64) {
+	switch r := r.(type) {
+	case *IfuncRegion:
+		return &r.Ifunc, p.pieOffset
+	case *LibFuncRegion:
+		base, ok := p.libs[r.Lib]
+		if r.ifunc == nil || !ok {
+			return nil, 0
+		}
+		return r.ifunc, base
+	}
+	return nil, 0
+}
+
+// resolver returns the address of the resolver of region r in p if r is an
+// indirect function whose implementation is not known yet, or 0.
+func (p *Proc) resolver(r Region) uint64 {
+	f, base := indirect(r, p)
+	if f == nil || f.impl != 0 || p.removed[r] {
+		return 0
+	}
+	return base + f.Resolver
+}
+
+// readSlots looks for the result of the resolver of f in its GOT entries, in
+// the file mapped at base. An entry has the result once it has been relocated
+// to an address in the file's mappings.
+func (p *Proc) readSlots(f *Ifunc, base uint64, path string, maps []mapping) {
+	b := make([]byte, 8)
+	for _, slot := range f.Slots {
+		if _, err := p.tracer.ReadMem(uintptr(base+slot), b); err != nil {
+			continue
+		}
+		impl := binary.LittleEndian.Uint64(b)
+		for _, m := range maps {
+			if m.path == path && impl >= base && impl >= m.start && impl < m.end {
+				debugf("%d: indirect function at 0x%x resolved to 0x%x (relocated)\n", p.Pid(), base+f.Resolver, impl)
+				f.impl = impl - base
+				return
+			}
+		}
+	}
+}
+
+// handleResolver follows the resolvers of indirect functions when the
+// process stops at pc. When a resolver is called, its return address is
+// trapped, and when it returns, the region's breakpoint is placed at the
+// implementation it chose.
+func (p *Proc) handleResolver(pc uint64, regs *unix.PtraceRegs, now time.Duration) ([]Event, error) {
+	var events []Event
+	arm := func(r *activeRegion) error {
+		start := r.region.Start(p)
+		if p.armed(start) {
+			return nil
+		}
+		if err := p.setBreak(start); err != nil {
+			return &RegionError{Id: r.id, Err: err}
+		}
+		events = append(events, Event{
+			Id:    r.id,
+			State: RegionArmed,
+			Time:  now,
+		})
+		// threads sharing memory must know about the new breakpoint
+		p.libsChanged = true
+		return nil
+	}
+
+	if ids, ok := p.resolving[pc]; ok {
+		delete(p.resolving, pc)
+		impl := hostArch.ReturnValue(regs)
+		for _, id := range ids {
+			r := &p.regions[id]
+			f, base := indirect(r.region, p)
+			if f == nil || f.impl != 0 {
+				continue
+			}
+			debugf("%d: indirect function at 0x%x resolved to 0x%x\n", p.Pid(), base+f.Resolver, impl)
+			f.impl = impl - base
+			if !p.needsBreak(base + f.Resolver) {
+				if err := p.removeStart(base + f.Resolver); err != nil {
+					return events, err
+				}
+			}
+			if err := arm(r); err != nil {
+				return events, err
+			}
+		}
+	}
+
+	if !p.index().resolvers[pc] {
+		return events, nil
+	}
+	var ids []int
+	for i := range p.regions {
+		r := &p.regions[i]
+		f, base := indirect(r.region, p)
+		if f == nil || base+f.Resolver != pc || p.removed[r.region] {
+			continue
+		}
+		if f.impl != 0 {
+			// the resolver already returned in another process
+			if err := arm(r); err != nil {
+				return events, err
+			}
+			continue
+		}
+		ids = append(ids, i)
+	}
+	if len(ids) > 0 {
+		ret, err := hostArch.ReturnAddr(regs, p)
+		if err != nil {
+			return events, err
+		}
+		p.resolving[ret] = ids
+		if err := p.setBreak(ret); err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
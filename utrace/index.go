@@ -0,0 +1,82 @@
+package utrace
+
+import "sort"
+
+// A regionIndex finds the regions that start at an address without scanning
+// every region of the process, which matters when there are thousands of
+// them. Start addresses only change when the process loads a new executable
+// or maps or unmaps libraries, after which the index is rebuilt.
+type regionIndex struct {
+	// indices of the regions that start at each address
+	starts map[uint64][]int
+	// indices of the regions whose start was not known when the index was
+	// built: indirect functions whose resolver had not returned (possibly
+	// in another process), and functions in libraries that are not mapped
+	unknown []int
+	// addresses of the resolvers of indirect functions
+	resolvers map[uint64]bool
+}
+
+// index returns the index of the process's regions, building it if the start
+// addresses may have changed since it was last used.
+func (p *Proc) index() *regionIndex {
+	if p.idx != nil {
+		return p.idx
+	}
+	idx := &regionIndex{
+		starts:    make(map[uint64][]int),
+		resolvers: make(map[uint64]bool),
+	}
+	for i := range p.regions {
+		r := p.regions[i].region
+		if start := r.Start(p); start != 0 {
+			idx.starts[start] = append(idx.starts[start], i)
+		} else {
+			idx.unknown = append(idx.unknown, i)
+		}
+		if f, base := indirect(r, p); f != nil {
+			idx.resolvers[base+f.Resolver] = true
+		}
+	}
+	p.idx = idx
+	return idx
+}
+
+// startingAt returns the indices of the regions that start at pc, in order.
+func (p *Proc) startingAt(pc uint64) []int {
+	idx := p.index()
+	ids := idx.starts[pc]
+	found := false
+	for _, i := range idx.unknown {
+		if p.regions[i].region.Start(p) == pc {
+			// the indexed slice must not be modified
+			ids = append(ids[:len(ids):len(ids)], i)
+			found = true
+		}
+	}
+	if found {
+		sort.Ints(ids)
+	}
+	return ids
+}
+
+// track records whether region i has entries in progress, after entries were
+// pushed or popped.
+func (p *Proc) track(i int) {
+	if p.regions[i].depth() > 0 {
+		p.inside[i] = true
+	} else {
+		delete(p.inside, i)
+	}
+}
+
+// entered returns the indices of the regions with entries in progress, in
+// order.
+func (p *Proc) entered() []int {
+	ids := make([]int, 0, len(p.inside))
+	for i := range p.inside {
+		ids = append(ids, i)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,447 @@
+package utrace
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A LibFuncRegion is a function in a shared library loaded by the target.
+// Libraries are mapped by the dynamic linker after the target starts (or
+// later with dlopen), so the function's address is resolved once its library
+// appears in the process's address space, and the region's breakpoint is only
+// placed then.
+type LibFuncRegion struct {
+	// Lib is the library's path, or its file name (such as libssl.so), which
+	// also matches versioned names (such as libssl.so.3).
+	Lib string
+	// Resolve returns the address of the function relative to the library
+	// file at path (not including the library's load base).
+	Resolve func(path string) (uint64, error)
+	// ResolveIfunc, if not nil, is called before Resolve and returns the
+	// resolver of the function if it is an indirect function in the library
+	// file at path (see Ifunc), or nil if it is not.
+	ResolveIfunc func(path string) (*Ifunc, error)
+
+	// address resolved for the library file at path
+	addr uint64
+	path string
+	// resolver of the function, if it is an indirect function
+	ifunc *Ifunc
+}
+
+// Start returns the address of the function, or 0 if its library is not
+// mapped in the process or the implementation of the indirect function has not
+// been chosen yet.
+func (l *LibFuncRegion) Start(p *Proc) uint64 {
+	base, ok := p.libs[l.Lib]
+	if !ok {
+		return 0
+	}
+	if l.ifunc != nil {
+		if l.ifunc.impl == 0 {
+			return 0
+		}
+		return base + l.ifunc.impl
+	}
+	return base + l.addr
+}
+
+// End returns the return address of the function (see FuncRegion).
+func (l *LibFuncRegion) End(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	return hostArch.ReturnAddr(regs, p)
+}
+
+// matches returns true if the mapped file at path is the region's library.
+func (l *LibFuncRegion) matches(path string) bool {
+	if strings.Contains(l.Lib, "/") {
+		return path == l.Lib
+	}
+	name := filepath.Base(path)
+	return name == l.Lib || strings.HasPrefix(name, l.Lib+".")
+}
+
+// resolve finds the function's address in the library file at path.
+func (l *LibFuncRegion) resolve(path string) error {
+	if l.path == path {
+		return nil
+	}
+	if l.ResolveIfunc != nil {
+		f, err := l.ResolveIfunc(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if f != nil {
+			l.addr, l.path, l.ifunc = 0, path, f
+			return nil
+		}
+	}
+	addr, err := l.Resolve(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	l.addr, l.path, l.ifunc = addr, path, nil
+	return nil
+}
+
+// A mapping is a file mapped in a process's address space.
+type mapping struct {
+	start  uint64
+	end    uint64
+	offset uint64
+	path   string
+}
+
+// readMaps returns the file mappings of a process from /proc/pid/maps.
+func readMaps(pid int) ([]mapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var maps []mapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		start, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		end, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		offset, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil {
+			continue
+		}
+		maps = append(maps, mapping{
+			start:  start,
+			end:    end,
+			offset: offset,
+			path:   strings.Join(fields[5:], " "),
+		})
+	}
+	return maps, scanner.Err()
+}
+
+// addrMapped returns true if addr is in any mapping of the process.
+func addrMapped(pid int, addr uint64) (bool, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var start, end uint64
+		if _, err := fmt.Sscanf(scanner.Text(), "%x-%x", &start, &end); err != nil {
+			continue
+		}
+		if addr >= start && addr < end {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// hasLibRegions returns true if any of the regions is in a shared library.
+func hasLibRegions(regions []Region) bool {
+	for _, r := range regions {
+		if _, ok := r.(*LibFuncRegion); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loaderBreak returns the address of the dynamic linker's _dl_debug_state
+// function in the process. The dynamic linker calls it whenever it has mapped
+// or unmapped libraries, so a breakpoint there reports library loads. It
+// returns 0 if the process has no dynamic linker (it is statically linked).
+func loaderBreak(pid int) (uint64, error) {
+	exe, err := elf.Open(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer exe.Close()
+
+	var interp string
+	for _, prog := range exe.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data := make([]byte, prog.Filesz)
+			_, err := prog.ReadAt(data, 0)
+			if err != nil {
+				return 0, err
+			}
+			interp = strings.TrimRight(string(data), "\x00")
+		}
+	}
+	if interp == "" {
+		return 0, nil
+	}
+	// the maps show the resolved path of the interpreter
+	interp, err = filepath.EvalSymlinks(interp)
+	if err != nil {
+		return 0, err
+	}
+
+	ld, err := elf.Open(interp)
+	if err != nil {
+		return 0, err
+	}
+	defer ld.Close()
+	syms, err := ld.DynamicSymbols()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", interp, err)
+	}
+	var vaddr uint64
+	for _, prog := range ld.Progs {
+		if prog.Type == elf.PT_LOAD {
+			vaddr = prog.Vaddr
+			break
+		}
+	}
+
+	maps, err := readMaps(pid)
+	if err != nil {
+		return 0, err
+	}
+	for _, sym := range syms {
+		if sym.Name != "_dl_debug_state" {
+			continue
+		}
+		for _, m := range maps {
+			if m.path == interp && m.offset == 0 {
+				return m.start + sym.Value - vaddr, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%s: could not find _dl_debug_state", interp)
+}
+
+// mapLibs records the load base of each region's library that appears in
+// maps and was not mapped before. It returns true if any new library was
+// found.
+func (p *Proc) mapLibs(regions []Region, maps []mapping) (bool, error) {
+	mapped := false
+	for _, r := range regions {
+		l, ok := r.(*LibFuncRegion)
+		if !ok {
+			continue
+		}
+		if _, ok := p.libs[l.Lib]; ok {
+			continue
+		}
+		for _, m := range maps {
+			if m.offset != 0 || !l.matches(m.path) {
+				continue
+			}
+			if err := l.resolve(m.path); err != nil {
+				return mapped, err
+			}
+			p.libs[l.Lib] = m.start
+			p.idx = nil
+			debugf("%d: %s mapped at 0x%x\n", p.Pid(), m.path, m.start)
+			if l.ifunc != nil && l.ifunc.impl == 0 {
+				p.readSlots(l.ifunc, m.start, m.path, maps)
+			}
+			mapped = true
+			break
+		}
+	}
+	return mapped, nil
+}
+
+// unmapLibs forgets the libraries that are no longer in maps (they were
+// unloaded with dlclose). The software breakpoints in them disappeared with
+// their mappings, so they are dropped without restoring the original
+// instructions. It returns the ids of the regions that became pending.
+func (p *Proc) unmapLibs(maps []mapping) ([]int, error) {
+	var pending []int
+	unmapped := make(map[string]bool)
+	for i := range p.regions {
+		r := &p.regions[i]
+		l, ok := r.region.(*LibFuncRegion)
+		if !ok {
+			continue
+		}
+		base, ok := p.libs[l.Lib]
+		if !ok {
+			continue
+		}
+		if !unmapped[l.Lib] && isMapped(l, base, maps) {
+			continue
+		}
+		unmapped[l.Lib] = true
+
+		for _, addr := range []uint64{l.Start(p), p.resolver(l)} {
+			if addr == 0 {
+				continue
+			}
+			if slot, ok := p.hwbreaks[uintptr(addr)]; ok {
+				delete(p.hwbreaks, uintptr(addr))
+				if err := p.removeHardwareBreak(slot); err != nil {
+					return pending, err
+				}
+			}
+			delete(p.breakpoints, uintptr(addr))
+		}
+		pending = append(pending, r.id)
+	}
+	for lib := range unmapped {
+		infof("%d: %s unmapped\n", p.Pid(), lib)
+		delete(p.libs, lib)
+		p.idx = nil
+	}
+	return pending, nil
+}
+
+// isMapped returns true if the library of l is still mapped at base.
+func isMapped(l *LibFuncRegion, base uint64, maps []mapping) bool {
+	for _, m := range maps {
+		if m.start == base && m.offset == 0 && l.matches(m.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLibs is called when the dynamic linker reports a change to the loaded
+// libraries. Regions in unloaded libraries become pending, and the
+// breakpoints of regions in newly loaded libraries are placed. A library may
+// be loaded again at a different address after it was unloaded, in which case
+// its regions are armed again at the new address.
+func (p *Proc) loadLibs(now time.Duration) ([]Event, error) {
+	maps, err := readMaps(p.Pid())
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	pending, err := p.unmapLibs(maps)
+	for _, id := range pending {
+		events = append(events, Event{
+			Id:    id,
+			State: RegionPending,
+			Time:  now,
+		})
+	}
+	if err != nil {
+		return events, err
+	}
+
+	mapped, err := p.mapLibs(p.regionList(), maps)
+	if err != nil {
+		return events, err
+	}
+	p.libsChanged = mapped || len(pending) > 0
+	if !mapped {
+		return events, nil
+	}
+	for i := range p.regions {
+		r := &p.regions[i]
+		if _, ok := r.region.(*LibFuncRegion); !ok {
+			continue
+		}
+		start := r.region.Start(p)
+		if start == 0 {
+			// the resolver of an indirect function that has not run yet
+			// is trapped to find the implementation
+			if resolver := p.resolver(r.region); resolver != 0 {
+				if err := p.setBreak(resolver); err != nil {
+					return events, &RegionError{Id: r.id, Err: err}
+				}
+			}
+			continue
+		}
+		if p.armed(start) || p.removed[r.region] {
+			continue
+		}
+		if err := p.setBreak(start); err != nil {
+			return events, &RegionError{Id: r.id, Err: err}
+		}
+		events = append(events, Event{
+			Id:    r.id,
+			State: RegionArmed,
+			Time:  now,
+		})
+	}
+	return events, nil
+}
+
+// armed returns true if a breakpoint is placed at pc.
+func (p *Proc) armed(pc uint64) bool {
+	_, sw := p.breakpoints[uintptr(pc)]
+	_, hw := p.hwbreaks[uintptr(pc)]
+	return sw || hw
+}
+
+// Pending returns true if the region with the given id is in a shared library
+// that is not currently mapped in the process, so its breakpoint is deferred
+// until the library is loaded.
+func (p *Proc) Pending(id int) bool {
+	for _, r := range p.regions {
+		if r.id == id {
+			return r.region.Start(p) == 0
+		}
+	}
+	return false
+}
+
+// shareLibs gives t (which shares memory with p) the library bases and
+// software breakpoints that p has for library regions and indirect functions,
+// after libraries were loaded or unloaded, or the resolver of an indirect
+// function returned.
+func (p *Proc) shareLibs(t *Proc) {
+	for i := range p.regions {
+		r := p.regions[i].region
+		if _, ok := r.(*LibFuncRegion); !ok {
+			continue
+		}
+		// breakpoints in unloaded libraries are gone
+		if old := r.Start(t); old != 0 && old != r.Start(p) {
+			delete(t.breakpoints, uintptr(old))
+		}
+	}
+	t.libs = make(map[string]uint64, len(p.libs))
+	for lib, base := range p.libs {
+		t.libs[lib] = base
+	}
+	t.idx = nil
+	for i := range p.regions {
+		r := p.regions[i].region
+		switch r.(type) {
+		case *LibFuncRegion, *IfuncRegion:
+		default:
+			continue
+		}
+		if f, base := indirect(r, p); f != nil && f.impl != 0 && !p.armed(base+f.Resolver) {
+			// the resolver's breakpoint was removed once it returned
+			t.retire(uintptr(base + f.Resolver))
+		}
+		for _, addr := range []uint64{r.Start(p), p.resolver(r)} {
+			orig, ok := p.breakpoints[uintptr(addr)]
+			if !ok {
+				continue
+			}
+			if _, ok := t.breakpoints[uintptr(addr)]; !ok {
+				t.breakpoints[uintptr(addr)] = append([]byte(nil), orig...)
+			}
+		}
+	}
+}
@@ -5,7 +5,26 @@ import (
 	"log"
 )
 
-var logger *log.Logger
+// A Level is the amount of detail that is written to the logger (see
+// SetLogLevel).
+type Level int
+
+const (
+	// LevelQuiet writes nothing.
+	LevelQuiet Level = iota
+	// LevelInfo writes what happens to the target and its regions, such as
+	// the threads it creates, the signals it receives, and the invocations
+	// that it abandons.
+	LevelInfo
+	// LevelDebug also writes the details of tracing, such as the addresses
+	// of breakpoints, the stops of the target at them, and its load offset.
+	LevelDebug
+)
+
+var (
+	logger *log.Logger
+	level  = LevelDebug
+)
 
 func init() {
 	logger = log.New(ioutil.Discard, "", 0)
@@ -15,3 +34,24 @@ func init() {
 func SetLogger(l *log.Logger) {
 	logger = l
 }
+
+// SetLogLevel sets the amount of detail that is written to the logger. Every
+// message is written by default, to a logger that discards them unless one is
+// set with SetLogger.
+func SetLogLevel(l Level) {
+	level = l
+}
+
+// infof writes a message to the logger at LevelInfo.
+func infof(format string, v ...interface{}) {
+	if level >= LevelInfo {
+		logger.Printf(format, v...)
+	}
+}
+
+// debugf writes a message to the logger at LevelDebug.
+func debugf(format string, v ...interface{}) {
+	if level >= LevelDebug {
+		logger.Printf(format, v...)
+	}
+}
@@ -6,3 +6,12 @@ type PieOffsetter interface {
 	// be 0 if ASLR/PIE is not enabled.
 	PieOffset(pid int) (uint64, error)
 }
+
+// NoPie is a PieOffsetter for executables whose addresses are not used, such
+// as an interpreter that runs a script. It always returns 0.
+type NoPie struct{}
+
+// PieOffset returns 0.
+func (NoPie) PieOffset(pid int) (uint64, error) {
+	return 0, nil
+}
@@ -0,0 +1,92 @@
+package utrace
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// A BreakpointMode selects how breakpoints are placed in the target.
+type BreakpointMode int
+
+const (
+	// SoftwareBreakpoints overwrite instructions with a trap instruction.
+	SoftwareBreakpoints BreakpointMode = iota
+	// HardwareBreakpoints use the CPU's debug registers (DR0-DR3 on amd64)
+	// so the target's text is never modified. When no debug register is
+	// free, a software breakpoint is used instead.
+	HardwareBreakpoints
+)
+
+// Options configures how a program is traced.
+type Options struct {
+	Breakpoints BreakpointMode
+	// Trap is the instruction written at software breakpoints, instead of
+	// the architecture's default (see BreakInstr). It must raise SIGTRAP,
+	// such as 'int 3' (0xcd 0x03) on amd64. A trap longer than the
+	// instruction it replaces also overwrites the start of the next one, so
+	// it must not be used where the program may jump to that instruction.
+	Trap []byte
+	// Callers enables capturing the call stack (by walking frame pointers)
+	// whenever a region is entered.
+	Callers bool
+	// Affinity restricts the target (and the threads and processes it
+	// creates) to the given CPUs, if it is not nil.
+	Affinity *unix.CPUSet
+	// Signals received on this channel are forwarded to the target while it
+	// is traced, if it is not nil. SIGINT and SIGQUIT are not forwarded if
+	// the target is in the terminal's foreground process group, since a
+	// terminal sends them to the whole group and the target already
+	// receives them.
+	Signals <-chan os.Signal
+	// Stdin, Stdout and Stderr are the standard streams of the target. The
+	// target shares the tracer's own for each one that is nil.
+	Stdin  *os.File
+	Stdout *os.File
+	Stderr *os.File
+	// Env is the environment of the target, in the form "key=value". If it
+	// is nil, the target inherits the tracer's environment.
+	Env []string
+	// Dir is the working directory of the target, or the tracer's if it is
+	// empty. A relative path to the target is still resolved from the
+	// tracer's working directory.
+	Dir string
+	// FollowExec keeps tracing processes after they call execve. Otherwise
+	// a process is no longer traced once it has exec'd.
+	FollowExec bool
+	// Exec is called when a followed process has called execve, with the
+	// process's pid once the new executable is loaded. It returns the
+	// executable's PIE offsetter and the regions to trace in it, which
+	// replace the process's regions (events for the process use ids into
+	// the new list). If Exec is nil, no regions are traced after an exec.
+	Exec func(pid int) (PieOffsetter, []Region, error)
+	// Limit stops tracing a region once it has been completed this many
+	// times (by any process), if it is not 0. The breakpoint at the start of
+	// the region is removed so that the rest of the run is not slowed down,
+	// but invocations that are already in progress still end normally.
+	Limit int
+	// Syscalls stops the threads at the entry and exit of every system call
+	// they make while a region is active in them, which Wait reports as
+	// RegionSyscallEnter and RegionSyscallExit events for each active
+	// region. The threads are only stopped this way inside regions, but
+	// every system call made there costs two more stops.
+	Syscalls bool
+	// SampleRate measures only every Nth invocation of each region in each
+	// process, if it is greater than 1. The other invocations only hit the
+	// breakpoint at the region's start, which is left in place to count
+	// them, and not the one at its end.
+	SampleRate int
+	// Go traces a program built by the Go toolchain, whose runtime moves
+	// goroutines between its threads. The entries of a region are matched
+	// with their ends by goroutine rather than by stack frame, since a
+	// goroutine's stack moves when it grows, and the threads of a process
+	// share their software breakpoints, so that an end reached on another
+	// thread than the entry is recognized. An invocation is only measured
+	// if it ends on the thread that entered it: it is abandoned if its
+	// goroutine reaches the end on another thread, or if the thread enters
+	// the region for another goroutine in the meantime. Software
+	// breakpoints are always used, since debug registers belong to a single
+	// thread. The goroutine is read from the register the runtime keeps it
+	// in, so on amd64 the program must be built with Go 1.17 or later.
+	Go bool
+}
@@ -1,113 +1,335 @@
 package utrace
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zyedidia/perforator/utrace/ptrace"
 	"golang.org/x/sys/unix"
 )
 
 var (
-	interrupt = []byte{0xCC}
-
 	ErrInvalidBreakpoint = errors.New("Invalid breakpoint")
+
+	// returned by handleInterrupt for a SIGTRAP that was not caused by one
+	// of our breakpoints
+	errForeignTrap = errors.New("SIGTRAP not caused by a breakpoint")
 )
 
+// BreakInstr returns the instruction used for software breakpoints on this
+// architecture.
+func BreakInstr() []byte {
+	return hostArch.BreakInstr()
+}
+
 // A Proc is a single instance of a traced process. On Linux this may be a
 // process or a thread (they are equivalent, except for the visible address
 // space).
 type Proc struct {
 	tracer    *ptrace.Tracer
 	regions   []activeRegion
+	pie       PieOffsetter
 	pieOffset uint64
 	exited    bool
+	mode      BreakpointMode
+	callers   bool
+	sample    int
+	// stop at system calls made inside regions, and whether the process is
+	// between the entry and exit of one
+	syscalls  bool
+	inSyscall bool
+	// instruction written at software breakpoints
+	trap []byte
 
 	breakpoints map[uintptr][]byte
+	// software breakpoints that another thread sharing this one's memory
+	// removed, which this thread may have hit before they were removed
+	retired map[uintptr]bool
+	// breakpoints to re-insert after stepping over the original instruction
+	rearm []uint64
+	// signals received while stepping that have not been delivered yet
+	signals []unix.Signal
+	// ptrace-event stops received while stepping, such as a clone() by the
+	// stepped instruction, which Program.Wait returns before new stops
+	stops []unix.WaitStatus
+	// thread group (threads in the same group share memory)
+	tgid int
+	// hardware breakpoints, mapped to their debug register slot
+	hwbreaks map[uintptr]int
+	// true while the process is in a ptrace-stop
+	stopped bool
+	// load bases of the libraries of library regions, by region Lib
+	libs map[string]uint64
+	// address of the dynamic linker's breakpoint for library loads (or 0)
+	loader uint64
+	// set when libraries were loaded by the last interrupt
+	libsChanged bool
+	// regions of the resolvers of indirect functions in progress, by return
+	// address
+	resolving map[uint64][]int
+	// regions that are no longer entered (shared by all processes of the
+	// program)
+	removed map[Region]bool
+	// index of the regions by start address (nil when it must be rebuilt),
+	// and the indices of the regions with entries in progress
+	idx    *regionIndex
+	inside map[int]bool
+	// threads sharing this one's breakpoints, in Go mode (see
+	// Options.Go), and events of this thread found while handling another
+	// thread's stop, returned by its next stop
+	group   *threadGroup
+	pending []Event
 }
 
 // Starts a new process from the given information and begins tracing.
-func startProc(pie PieOffsetter, target string, args []string, regions []Region) (*Proc, error) {
+func startProc(pie PieOffsetter, target string, args []string, regions []Region, opts Options) (*Proc, error) {
+	if _, err := CheckTarget(target); err != nil {
+		return nil, err
+	}
 	cmd := exec.Command(target, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	stdin := stream(opts.Stdin, os.Stdin)
+	cmd.Stdout = stream(opts.Stdout, os.Stdout)
+	cmd.Stderr = stream(opts.Stderr, os.Stderr)
+	cmd.Stdin = stdin
+	cmd.Env = opts.Env
+	cmd.Dir = opts.Dir
+	if cmd.Dir != "" && !filepath.IsAbs(cmd.Path) {
+		path, err := filepath.Abs(cmd.Path)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Path = path
+	}
 	cmd.SysProcAttr = &unix.SysProcAttr{
 		Ptrace: true,
+		// a process group of its own lets the target be killed along
+		// with every process it creates, but a target that reads from a
+		// terminal must stay in the terminal's foreground group
+		Setpgid: !terminal(stdin),
 	}
 
 	err := cmd.Start()
 	if err != nil {
 		return nil, err
 	}
-	// wait for execve
-	cmd.Wait()
+	// The target is traced with PTRACE_TRACEME, so it stops with SIGTRAP
+	// once it has called execve. cmd.Wait is not used, since it would take
+	// the stop for the exit of the target and release it.
+	pid := cmd.Process.Pid
+	var ws unix.WaitStatus
+	_, err = unix.Wait4(pid, &ws, unix.WALL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wait-exec: %w", err)
+	} else if !ws.Stopped() || ws.StopSignal() != unix.SIGTRAP {
+		return nil, fmt.Errorf("wait-exec: received %v (status 0x%x) instead of SIGTRAP", ws.StopSignal(), int(ws))
+	}
+
+	p, err := traceStarted(pid, pie, regions, opts)
+	if err != nil {
+		// reap the target, so that its exit is not taken for that of a
+		// process traced later
+		unix.Kill(pid, unix.SIGKILL)
+		for {
+			_, werr := unix.Wait4(pid, &ws, unix.WALL, nil)
+			if werr != nil || ws.Exited() || ws.Signaled() {
+				break
+			}
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// traceStarted traces a target stopped at its execve, and continues it once
+// its breakpoints are placed.
+func traceStarted(pid int, pie PieOffsetter, regions []Region, opts Options) (*Proc, error) {
+	if opts.Affinity != nil {
+		err := unix.SchedSetaffinity(pid, opts.Affinity)
+		if err != nil {
+			return nil, fmt.Errorf("set-affinity: %w", err)
+		}
+	}
 
 	options := unix.PTRACE_O_EXITKILL | unix.PTRACE_O_TRACECLONE |
 		unix.PTRACE_O_TRACEFORK | unix.PTRACE_O_TRACEVFORK |
-		unix.PTRACE_O_TRACEEXEC
+		unix.PTRACE_O_TRACEEXEC | unix.PTRACE_O_TRACESYSGOOD
 
-	p, err := newTracedProc(cmd.Process.Pid, pie, regions, nil)
+	// the target is seized again to handle group stops and interrupt its
+	// threads
+	err := ptrace.NewTracer(pid).ReAttach(options)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("re-attach: %w", err)
 	}
-	err = p.tracer.ReAttachAndContinue(options)
+	p, err := newTracedProc(pid, pie, regions, nil, nil, opts)
 	if err != nil {
 		return nil, err
 	}
+	return p, p.cont(0, false)
+}
 
-	// Wait for the initial SIGTRAP created because we are attaching
-	// with ReAttachAndContinue to properly handle group stops.
-	var ws unix.WaitStatus
-	_, err = unix.Wait4(p.tracer.Pid(), &ws, 0, nil)
+// terminal returns true if f is a terminal.
+func terminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// stream returns f, or def if f is nil. The streams of the target are always
+// files: any other reader or writer would be copied through a pipe that only
+// exec.Cmd.Wait waits for, and the target is never waited for that way.
+func stream(f, def *os.File) *os.File {
+	if f == nil {
+		return def
+	}
+	return f
+}
+
+// Begins tracing an already existing process
+func newTracedProc(pid int, pie PieOffsetter, regions []Region, breaks map[uintptr][]byte, removed map[Region]bool, opts Options) (*Proc, error) {
+	tgid, _, err := procStatus(pid)
 	if err != nil {
 		return nil, err
-	} else if ws.StopSignal() != unix.SIGTRAP {
-		return nil, errors.New("wait: received non SIGTRAP: " + ws.StopSignal().String())
 	}
-	err = p.cont(0, false)
 
-	return p, err
+	trap := opts.Trap
+	if len(trap) == 0 {
+		trap = hostArch.BreakInstr()
+	}
+	mode := opts.Breakpoints
+	if opts.Go {
+		mode = SoftwareBreakpoints
+	}
+	p := &Proc{
+		tracer:   ptrace.NewTracer(pid),
+		trap:     trap,
+		mode:     mode,
+		callers:  opts.Callers,
+		sample:   opts.SampleRate,
+		syscalls: opts.Syscalls,
+		tgid:     tgid,
+		removed:  removed,
+	}
+	err = p.load(pie, regions, breaks)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-// Begins tracing an already existing process
-func newTracedProc(pid int, pie PieOffsetter, regions []Region, breaks map[uintptr][]byte) (*Proc, error) {
-	off, err := pie.PieOffset(pid)
+// load places the breakpoints for the regions in the process's executable.
+// Breakpoints that are already in breaks were placed by a process sharing (or
+// copied from) this one's memory, so only their original bytes are recorded.
+// It is also used after an exec to start over in the new executable, since
+// the old address space and its breakpoints are gone.
+func (p *Proc) load(pie PieOffsetter, regions []Region, breaks map[uintptr][]byte) error {
+	off, err := pie.PieOffset(p.Pid())
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	logger.Printf("%d: PIE offset is 0x%x\n", pid, off)
+	debugf("%d: PIE offset is 0x%x\n", p.Pid(), off)
 
-	p := &Proc{
-		tracer:      ptrace.NewTracer(pid),
-		regions:     make([]activeRegion, 0, len(regions)),
-		pieOffset:   off,
-		breakpoints: make(map[uintptr][]byte),
+	p.pie = pie
+	p.pieOffset = off
+	p.regions = make([]activeRegion, 0, len(regions))
+	p.breakpoints = make(map[uintptr][]byte)
+	p.retired = make(map[uintptr]bool)
+	p.hwbreaks = make(map[uintptr]int)
+	p.libs = make(map[string]uint64)
+	p.loader = 0
+	p.resolving = make(map[uint64][]int)
+	p.idx = nil
+	p.inside = make(map[int]bool)
+	p.rearm = nil
+	// an exec does not report its return once the old regions are gone
+	p.inSyscall = false
+
+	starts := make([]uint64, 0, len(regions)+1)
+	if hasLibRegions(regions) {
+		p.loader, err = loaderBreak(p.Pid())
+		if err != nil {
+			return fmt.Errorf("dynamic linker: %w", err)
+		}
+		if p.loader != 0 {
+			starts = append(starts, p.loader)
+		}
+		maps, err := readMaps(p.Pid())
+		if err != nil {
+			return err
+		}
+		if _, err := p.mapLibs(regions, maps); err != nil {
+			return err
+		}
+	}
+	for _, r := range regions {
+		if p.removed[r] {
+			continue
+		}
+		start := r.Start(p)
+		if start == 0 {
+			// indirect functions start where their resolver says
+			start = p.resolver(r)
+		}
+		starts = append(starts, start)
 	}
 
-	for id, r := range regions {
-		addr := uintptr(r.Start(p))
+	for _, start := range starts {
+		// library regions get their breakpoint once the library is mapped
+		if start == 0 {
+			continue
+		}
+		addr := uintptr(start)
 		if orig, ok := breaks[addr]; ok {
 			p.breakpoints[addr] = make([]byte, len(orig))
 			copy(p.breakpoints[addr], orig)
 		} else {
-			err := p.setBreak(r.Start(p))
+			err := p.setBreak(start)
 			if err != nil {
-				return nil, err
+				for id, r := range regions {
+					if r.Start(p) == start {
+						return &RegionError{Id: id, Err: err}
+					}
+				}
+				return err
 			}
 		}
+	}
 
+	for id, r := range regions {
 		p.regions = append(p.regions, activeRegion{
-			region:       r,
-			state:        RegionStart,
-			curInterrupt: r.Start(p),
-			id:           id,
+			region: r,
+			id:     id,
 		})
 	}
+	return nil
+}
 
-	return p, nil
+// Region returns the region with the given id in the process. Ids index the
+// regions given when the process began tracing, or the ones returned by
+// Options.Exec after its last exec.
+func (p *Proc) Region(id int) Region {
+	return p.regions[id].region
+}
+
+// NumRegions returns the number of regions traced in the process.
+func (p *Proc) NumRegions() int {
+	return len(p.regions)
+}
+
+// regionList returns the regions traced in the process.
+func (p *Proc) regionList() []Region {
+	regions := make([]Region, 0, len(p.regions))
+	for _, r := range p.regions {
+		regions = append(regions, r.region)
+	}
+	return regions
 }
 
 func (p *Proc) setBreak(pc uint64) error {
@@ -118,29 +340,84 @@ func (p *Proc) setBreak(pc uint64) error {
 		// breakpoint already exists
 		return nil
 	}
+	if _, ok := p.hwbreaks[pcptr]; ok {
+		return nil
+	}
+
+	if p.mode == HardwareBreakpoints {
+		ok, err := p.setHardwareBreak(pc)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		debugf("%d: no debug registers available, using software breakpoint at 0x%x\n", p.Pid(), pc)
+	}
+
+	// a trap longer than one byte must not overwrite part of another, or
+	// the other's trap would be saved as the original instruction
+	for i := uintptr(1); i < uintptr(len(p.trap)); i++ {
+		for _, other := range []uintptr{pcptr - i, pcptr + i} {
+			if _, ok := p.breakpoints[other]; ok {
+				return fmt.Errorf("breakpoint at 0x%x: overlaps the %d-byte trap at 0x%x", pc, len(p.trap), other)
+			}
+		}
+	}
 
-	orig := make([]byte, len(interrupt))
-	_, err = p.tracer.PeekData(pcptr, orig)
+	// the peeks and pokes of ptrace access whole aligned words, so they do
+	// not cross into the next page even at the end of a mapping
+	orig := make([]byte, len(p.trap))
+	_, err = p.tracer.ReadMem(pcptr, orig)
 	if err != nil {
-		return err
+		return p.memError(pc, err)
 	}
-	_, err = p.tracer.PokeData(pcptr, interrupt)
+	_, err = p.tracer.WriteMem(pcptr, p.trap)
 	if err != nil {
-		return err
+		return p.memError(pc, err)
 	}
 
 	p.breakpoints[pcptr] = orig
+	delete(p.retired, pcptr)
 	return nil
 }
 
+// retire forgets the software breakpoint at addr, which another thread
+// sharing this one's memory removed (restoring the original instruction)
+// while this thread was running. This thread may have hit the trap just
+// before, in which case its stop has not been handled yet.
+func (p *Proc) retire(addr uintptr) {
+	if _, ok := p.breakpoints[addr]; ok {
+		delete(p.breakpoints, addr)
+		p.retired[addr] = true
+	}
+}
+
+// memError describes a failure to place a breakpoint at addr, noting whether
+// the address is mapped at all.
+func (p *Proc) memError(addr uint64, err error) error {
+	if ok, merr := addrMapped(p.Pid(), addr); merr == nil && !ok {
+		return fmt.Errorf("breakpoint at 0x%x: address is not mapped in process %d: %w", addr, p.Pid(), err)
+	}
+	return fmt.Errorf("breakpoint at 0x%x: %w", addr, err)
+}
+
 func (p *Proc) removeBreak(pc uint64) error {
 	pcptr := uintptr(pc)
+	if slot, ok := p.hwbreaks[pcptr]; ok {
+		delete(p.hwbreaks, pcptr)
+		return p.removeHardwareBreak(slot)
+	}
 	orig, ok := p.breakpoints[pcptr]
 	if !ok {
 		return ErrInvalidBreakpoint
 	}
-	_, err := p.tracer.PokeData(pcptr, orig)
+	_, err := p.tracer.WriteMem(pcptr, orig)
 	delete(p.breakpoints, pcptr)
+	if p.group != nil {
+		// another thread of the group may have hit it already
+		p.retired[pcptr] = true
+	}
 	return err
 }
 
@@ -149,48 +426,162 @@ func (p *Proc) removeBreak(pc uint64) error {
 type Event struct {
 	Id    int
 	State RegionState
+	// Time is the CLOCK_MONOTONIC time at which the breakpoint that caused
+	// the event was handled.
+	Time time.Duration
+	// Callers holds the return addresses on the call stack when a region is
+	// entered, innermost first, if capturing callers is enabled. Addresses
+	// are relative to the binary (the PIE offset has been removed).
+	Callers []uint64
+	// StackMismatch is set at the end of a region if, while it was active,
+	// the return address of an entry was reached from a stack frame that
+	// did not enter the region (so the stack was switched, or unwound
+	// without returning).
+	StackMismatch bool
 }
 
 func (p *Proc) handleInterrupt() ([]Event, error) {
-	var regs unix.PtraceRegs
-	p.tracer.GetRegs(&regs)
-	regs.Rip -= uint64(len(interrupt))
-	p.tracer.SetRegs(&regs)
+	// taken first to keep our own processing out of region timings
+	now := monotonic()
 
-	logger.Printf("%d: interrupt at 0x%x\n", p.Pid(), regs.Rip)
+	// a SIGTRAP sent with kill/tgkill/sigqueue has a non-positive si_code,
+	// while traps raised by the CPU have a positive one
+	code, err := p.tracer.SigInfoCode()
+	if err != nil {
+		return nil, err
+	}
+	if code <= 0 {
+		return nil, errForeignTrap
+	}
 
-	err := p.removeBreak(regs.Rip)
+	var regs unix.PtraceRegs
+	hostArch.GetRegs(p.tracer, &regs)
+
+	hw, err := p.hardwareTrap()
 	if err != nil {
 		return nil, err
 	}
 
+	// debug register traps occur before the instruction executes, so the PC
+	// only needs adjusting for software breakpoints
+	pc := hostArch.GetPC(&regs)
+	if !hw {
+		pc -= hostArch.TrapPCAdjust(p.trap)
+		// the target may execute its own trap instructions
+		_, ok := p.breakpoints[uintptr(pc)]
+		if !ok && !p.retired[uintptr(pc)] {
+			return nil, errForeignTrap
+		}
+		hostArch.SetPC(&regs, pc)
+		hostArch.SetRegs(p.tracer, &regs)
+		if !ok {
+			// the original instruction is back, and executes when the
+			// thread is resumed
+			debugf("%d: rewinding over removed breakpoint at 0x%x\n", p.Pid(), pc)
+			p.libsChanged = false
+			return nil, nil
+		}
+	}
+
+	debugf("%d: interrupt at 0x%x\n", p.Pid(), pc)
+
 	events := make([]Event, 0)
-	for i, r := range p.regions {
-		var err error
-		if r.curInterrupt == regs.Rip {
-			events = append(events, Event{
-				Id:    r.id,
-				State: r.state,
-			})
-			switch r.state {
-			case RegionStart:
-				p.regions[i].state = RegionEnd
-				var addr uint64
-				addr, err = r.region.End(regs.Rsp, p)
-				if err != nil {
-					return nil, err
+	p.libsChanged = false
+	if pc == p.loader {
+		evs, err := p.loadLibs(now)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evs...)
+	}
+	evs, err := p.handleResolver(pc, &regs, now)
+	events = append(events, evs...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the goroutine running on the thread, in Go mode
+	var g uint64
+	if p.group != nil {
+		g = hostArch.Goroutine(&regs)
+	}
+
+	// returns are handled before entries, for all regions, so that a region
+	// whose end is the start of another region (or of itself) exits before
+	// the other is entered
+	for _, i := range p.entered() {
+		r := &p.regions[i]
+		sp := hostArch.StackPointer(&regs)
+		if n := r.returning(pc, sp, g); n > 0 {
+			if n > 1 {
+				infof("%d: %d nested entries of region %d left without reaching their end\n", p.Pid(), n-1, r.id)
+			}
+			for ; n > 0; n-- {
+				r.pop()
+			}
+			p.track(i)
+			if r.depth() == 0 {
+				events = append(events, r.ended(RegionEnd, now))
+			}
+		} else if g == 0 && r.strayReturn(pc) && !p.removed[r.region] {
+			// calls after the region's start was removed are not
+			// entries, so their returns are not stray
+			debugf("%d: return address of region %d reached with stack pointer 0x%x, which does not match any entry\n", p.Pid(), r.id, sp)
+			r.mismatch = true
+		}
+	}
+	if g != 0 {
+		p.migrated(pc, g, now)
+	}
+	for _, i := range p.startingAt(pc) {
+		r := &p.regions[i]
+		if !p.removed[r.region] {
+			if r.depth() == 0 && r.skip(p.sample) {
+				continue
+			}
+			sp := hostArch.StackPointer(&regs)
+			addr, err := r.region.End(&regs, p)
+			if err != nil {
+				return nil, err
+			}
+			if p.abandoned(r, sp, addr, g) {
+				infof("%d: region %d left without reaching its end\n", p.Pid(), r.id)
+				events = append(events, r.ended(RegionAbandoned, now))
+			}
+			p.track(i)
+			if r.tailCall(addr, sp) {
+				infof("%d: tail call into region %d\n", p.Pid(), r.id)
+				continue
+			}
+
+			r.push(addr, sp, g)
+			p.track(i)
+			if r.depth() == 1 {
+				ev := Event{
+					Id:    r.id,
+					State: RegionStart,
+					Time:  now,
 				}
-				p.regions[i].curInterrupt = addr
-				err = p.setBreak(addr)
-			case RegionEnd:
-				p.regions[i].state = RegionStart
-				p.regions[i].curInterrupt = r.region.Start(p)
-				err = p.setBreak(p.regions[i].curInterrupt)
-			default:
-				return nil, errors.New("invalid state")
+				if p.callers {
+					ev.Callers = p.callStack(&regs, r.region, addr)
+				}
+				events = append(events, ev)
+			}
+			err = p.setEnd(r, addr, pc)
+			if err != nil {
+				return nil, err
 			}
 		}
-		if err != nil {
+	}
+
+	// If another invocation may still hit this address, the breakpoint is
+	// only lifted to step over the original instruction once the threads
+	// sharing its memory are halted (see Program.Continue), so that they
+	// cannot run past it in the meantime.
+	if p.needsBreak(pc) || (p.group != nil && p.group.needsBreak(p, pc)) {
+		p.rearm = append(p.rearm, pc)
+	} else if p.armed(pc) {
+		if err := p.removeBreak(pc); err != nil {
 			return nil, err
 		}
 	}
@@ -198,21 +589,437 @@ func (p *Proc) handleInterrupt() ([]Event, error) {
 	return events, nil
 }
 
+// setEnd places the breakpoints that end an entry of a region, at its end
+// address, or at the return instructions of a RetsRegion.
+func (p *Proc) setEnd(r *activeRegion, addr, start uint64) error {
+	rr, ok := r.region.(*RetsRegion)
+	if !ok {
+		return p.setBreak(addr)
+	}
+	if r.rets == nil {
+		r.rets = make(map[uint64]bool)
+		for _, ret := range rr.Rets {
+			// a function that is only a return ends when it is
+			// entered again
+			if ret+p.pieOffset != start {
+				r.rets[ret+p.pieOffset] = true
+			}
+		}
+	}
+	for ret := range r.rets {
+		if err := p.setBreak(ret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abandoned checks if entering a region with the given stack pointer (and
+// return address, for functions) means that earlier entries were left without
+// reaching the region's end, as happens when a function is left with longjmp
+// or an exception. A deeper stack frame (lower stack pointer) is a nested
+// entry, such as from a recursive call, but the same or a shallower frame can
+// only reach the start again by leaving the region, unless it is a tail call.
+// Abandoned entries are removed, and true is returned if the region is no
+// longer active. Spans ignore the stack: a nested span is never abandoned, and
+// any other span abandons its entry when it is entered again.
+//
+// In Go mode, g is the goroutine entering the region. Other entries of the
+// same goroutine are always nested, since its stack may have moved, and
+// entries of another goroutine are abandoned, since the thread no longer runs
+// it.
+func (p *Proc) abandoned(r *activeRegion, sp, ret, g uint64) bool {
+	if r.depth() == 0 {
+		return false
+	}
+	if s, ok := r.region.(*SpanRegion); ok {
+		if s.Nested {
+			return false
+		}
+		for r.depth() > 0 {
+			r.pop()
+		}
+		return true
+	}
+	if g != 0 {
+		if r.gs[r.depth()-1] == g {
+			return false
+		}
+		for r.depth() > 0 {
+			r.pop()
+		}
+		return true
+	}
+	for r.depth() > 0 && sp >= r.sps[r.depth()-1] && !r.tailCall(ret, sp) {
+		r.pop()
+	}
+	return r.depth() == 0
+}
+
+// maximum number of frames captured by callStack
+const maxCallers = 64
+
+// callStack walks the frame pointer chain to find the return addresses on the
+// stack. If the region is a function that has just been called, its return
+// address is known but its frame has not been set up yet, so the walk starts
+// with the caller's frame. The walk stops at the first frame that does not
+// look valid, so programs compiled without frame pointers produce short (or
+// empty) stacks.
+func (p *Proc) callStack(regs *unix.PtraceRegs, r Region, ret uint64) []uint64 {
+	var callers []uint64
+	switch r.(type) {
+	case *FuncRegion, *LibFuncRegion, *RetsRegion, *IfuncRegion:
+		callers = append(callers, ret-p.pieOffset)
+	}
+
+	fp := hostArch.FramePointer(regs)
+	frame := make([]byte, 16)
+	for len(callers) < maxCallers && fp != 0 {
+		_, err := p.tracer.ReadMem(uintptr(fp), frame)
+		if err != nil {
+			break
+		}
+		next := binary.LittleEndian.Uint64(frame[:8])
+		pc := binary.LittleEndian.Uint64(frame[8:])
+		if pc == 0 || pc < p.pieOffset {
+			break
+		}
+		callers = append(callers, pc-p.pieOffset)
+		// the stack grows down, so each caller's frame is above its callee's
+		if next <= fp {
+			break
+		}
+		fp = next
+	}
+	return callers
+}
+
+// needsBreak returns true if any region is waiting on the given address.
+func (p *Proc) needsBreak(pc uint64) bool {
+	if p.loader != 0 && pc == p.loader {
+		return true
+	}
+	if _, ok := p.resolving[pc]; ok {
+		return true
+	}
+	for _, i := range p.startingAt(pc) {
+		if !p.removed[p.regions[i].region] {
+			return true
+		}
+	}
+	if p.index().resolvers[pc] {
+		for _, r := range p.regions {
+			if p.resolver(r.region) == pc {
+				return true
+			}
+		}
+	}
+	for _, i := range p.entered() {
+		r := &p.regions[i]
+		if r.rets != nil {
+			if r.depth() > 0 && r.rets[pc] {
+				return true
+			}
+			continue
+		}
+		for _, ret := range r.returns {
+			if ret == pc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeStart removes the breakpoint at the start of a region that is no
+// longer entered.
+func (p *Proc) removeStart(start uint64) error {
+	for i, pc := range p.rearm {
+		if pc == start {
+			// no longer stepped over
+			p.rearm = append(p.rearm[:i], p.rearm[i+1:]...)
+			break
+		}
+	}
+	if !p.armed(start) {
+		return nil
+	}
+	return p.removeBreak(start)
+}
+
+// needsStep returns true if a breakpoint was hit and must be lifted to step
+// over the original instruction, and then re-inserted.
+func (p *Proc) needsStep() bool {
+	return len(p.rearm) != 0
+}
+
+// stepOver lifts the breakpoints that were hit, single-steps their original
+// instructions and then re-inserts the breakpoints. Signals that arrive before
+// the step completes are saved and delivered when the process is next
+// continued, and ptrace-event stops are saved for Program.Wait, so the
+// breakpoints are always re-inserted.
+func (p *Proc) stepOver() error {
+	if !p.needsStep() {
+		return nil
+	}
+
+	for _, pc := range p.rearm {
+		// another thread of a Go process may have removed it already
+		if !p.armed(pc) {
+			continue
+		}
+		if err := p.removeBreak(pc); err != nil {
+			return err
+		}
+	}
+
+	err := p.tracer.SingleStep(0)
+	if err != nil {
+		return err
+	}
+
+	var ws unix.WaitStatus
+	for {
+		_, err = unix.Wait4(p.Pid(), &ws, unix.WALL, nil)
+		if err != nil {
+			return err
+		}
+		if ws.Exited() || ws.Signaled() {
+			p.exit()
+			return nil
+		}
+		if ws.Stopped() && ws.StopSignal() == unix.SIGTRAP && ws.TrapCause() == 0 {
+			break
+		}
+		if ws.Stopped() && (statusPtraceEventStop(ws) || ws.TrapCause() > 0) {
+			debugf("%d: received ptrace event %d while stepping (queued)\n", p.Pid(), int(ws)>>16)
+			p.stops = append(p.stops, ws)
+		} else if ws.Stopped() && ws.StopSignal() != unix.SIGTRAP {
+			debugf("%d: received signal '%s' while stepping (delayed)\n", p.Pid(), ws.StopSignal())
+			p.signals = append(p.signals, ws.StopSignal())
+		}
+		err = p.tracer.SingleStep(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pc := range p.rearm {
+		err = p.setBreak(pc)
+		if err != nil {
+			return err
+		}
+	}
+	p.rearm = p.rearm[:0]
+	return nil
+}
+
 func (p *Proc) cont(sig unix.Signal, groupStop bool) error {
 	if p.exited {
 		return nil
 	}
 	if groupStop {
+		p.stopped = false
 		return p.tracer.Listen()
 	}
+	err := p.stepOver()
+	if err != nil || p.exited || len(p.stops) > 0 {
+		// a process with stops from stepping stays stopped until Wait
+		// has returned them
+		return err
+	}
+	if sig == 0 && len(p.signals) > 0 {
+		sig = p.signals[0]
+		p.signals = p.signals[1:]
+	}
+	p.stopped = false
+	if p.syscalls && p.active() {
+		return p.tracer.Syscall(sig)
+	}
 	return p.tracer.Cont(sig)
 }
 
+// active returns true if any region is active in the process.
+func (p *Proc) active() bool {
+	return len(p.inside) > 0
+}
+
+// handleSyscall is called when the process stops at the entry or exit of a
+// system call made inside a region. It returns a RegionSyscallEnter or
+// RegionSyscallExit event for every active region.
+func (p *Proc) handleSyscall() []Event {
+	now := monotonic()
+	state := RegionState(RegionSyscallEnter)
+	if p.inSyscall {
+		state = RegionSyscallExit
+	}
+	p.inSyscall = !p.inSyscall
+
+	var events []Event
+	for _, i := range p.entered() {
+		events = append(events, Event{
+			Id:    p.regions[i].id,
+			State: state,
+			Time:  now,
+		})
+	}
+	return events
+}
+
+// Detach removes every breakpoint from the process, restoring the original
+// instructions, and stops tracing it. If the process is stopped on a
+// breakpoint it is rewound so that it resumes at the original instruction.
+func (p *Proc) Detach() error {
+	return p.detach(nil)
+}
+
+// detach removes every breakpoint from the process and stops tracing it. The
+// wait status of the process's current stop must be given if that stop has
+// not been handled yet; if the process is running it is interrupted first. A
+// process stopped on a software breakpoint that was not handled has its PC
+// rewound so that the original instruction executes after detaching.
+func (p *Proc) detach(ws *unix.WaitStatus) error {
+	if p.exited {
+		return nil
+	}
+	if !p.stopped {
+		err := p.tracer.Interrupt()
+		if err != nil {
+			return err
+		}
+		var status unix.WaitStatus
+		_, err = unix.Wait4(p.Pid(), &status, unix.WALL, nil)
+		if err != nil {
+			return err
+		}
+		if status.Exited() || status.Signaled() {
+			p.exit()
+			return nil
+		}
+		ws = &status
+	}
+
+	var sig unix.Signal
+	if ws != nil && ws.Stopped() {
+		if ws.StopSignal() == unix.SIGTRAP && ws.TrapCause() == 0 {
+			var regs unix.PtraceRegs
+			err := hostArch.GetRegs(p.tracer, &regs)
+			if err != nil {
+				return err
+			}
+			pc := hostArch.GetPC(&regs) - hostArch.TrapPCAdjust(p.trap)
+			if _, ok := p.breakpoints[uintptr(pc)]; ok || p.retired[uintptr(pc)] {
+				debugf("%d: rewinding to 0x%x before detaching\n", p.Pid(), pc)
+				hostArch.SetPC(&regs, pc)
+				err = hostArch.SetRegs(p.tracer, &regs)
+				if err != nil {
+					return err
+				}
+			}
+		} else if ws.StopSignal() != unix.SIGTRAP && !statusPtraceEventStop(*ws) {
+			sig = ws.StopSignal()
+		}
+	}
+	if sig == 0 && len(p.signals) > 0 {
+		sig = p.signals[0]
+	}
+
+	for addr := range p.breakpoints {
+		err := p.removeBreak(uint64(addr))
+		if err != nil {
+			return err
+		}
+	}
+	for addr := range p.hwbreaks {
+		err := p.removeBreak(uint64(addr))
+		if err != nil {
+			return err
+		}
+	}
+	p.rearm = nil
+
+	infof("%d: detaching\n", p.Pid())
+	err := p.tracer.Detach(sig)
+	// the process is no longer traced, so treat it as if it exited
+	p.exit()
+	return err
+}
+
 func (p *Proc) exit() {
 	p.exited = true
 }
 
+// abandonAll ends every region that is still active when the process exits,
+// and returns a RegionAbandoned event for each of them.
+func (p *Proc) abandonAll(now time.Duration) []Event {
+	var events []Event
+	for i := range p.regions {
+		r := &p.regions[i]
+		if r.depth() == 0 {
+			continue
+		}
+		infof("%d: region %d still active at exit\n", p.Pid(), r.id)
+		r.returns, r.sps, r.gs = nil, nil, nil
+		p.track(i)
+		events = append(events, r.ended(RegionAbandoned, now))
+	}
+	return events
+}
+
+// monotonic returns the current CLOCK_MONOTONIC time.
+func monotonic() time.Duration {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return time.Duration(ts.Nano())
+}
+
+// procStatus reads the thread group ID and parent PID of a process from
+// /proc.
+func procStatus(pid int) (tgid int, ppid int, err error) {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Tgid:") {
+			tgid, _ = strconv.Atoi(strings.TrimSpace(line[len("Tgid:"):]))
+		} else if strings.HasPrefix(line, "PPid:") {
+			ppid, _ = strconv.Atoi(strings.TrimSpace(line[len("PPid:"):]))
+		}
+	}
+	return tgid, ppid, nil
+}
+
 // Pid returns this process's PID.
 func (p *Proc) Pid() int {
 	return p.tracer.Pid()
 }
+
+// PieOffset returns the offset at which the process's executable was loaded,
+// which is subtracted from the addresses reported for it.
+func (p *Proc) PieOffset() uint64 {
+	return p.pieOffset
+}
+
+// Tgid returns the ID of the process (thread group) that this thread belongs
+// to.
+func (p *Proc) Tgid() int {
+	return p.tgid
+}
+
+// CPU returns the CPU that the thread last ran on. While the thread is stopped
+// at a breakpoint, this is the CPU it was running on when it hit it.
+func (p *Proc) CPU() (int, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", p.Pid()))
+	if err != nil {
+		return 0, err
+	}
+	// the command name may contain spaces, and is followed by the other
+	// fields, of which the processor is the 39th
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 37 {
+		return 0, fmt.Errorf("/proc/%d/stat: missing processor field", p.Pid())
+	}
+	return strconv.Atoi(fields[36])
+}
@@ -1,24 +1,41 @@
 // Package utrace provides an interface for tracing user-level code with
 // ptrace. The implementation transparently places and removes software
-// breakpoints to regain control from a traced program. Multithreaded programs
-// are supported with the caveat that each region may only be executed once
-// (ever) by a certain thread. In other words, it is best to only use utrace
-// for tracing single threaded programs, but if the program is multithreaded it
-// will still work as long as only one of the threads executes the region of
-// interest.
+// breakpoints to regain control from a traced program. Every thread keeps its
+// own stack of the region invocations in progress, so a region may be entered
+// by several threads at once, and recursively or nested in other regions by
+// the same thread. Threads and child processes created with clone, fork, or
+// vfork are traced as soon as they start, with the breakpoints of their
+// parent, and processes may be followed through exec (see
+// Options.FollowExec). Threads that share memory share its breakpoints: while
+// one of them steps over a breakpoint, the others are halted so that none of
+// them can miss it.
 //
 // NOTE: make sure runtime.LockOSThread() has been called before using any of
 // the following functions, and may not unlock the thread until you are
 // finished calling any trace functions.
+//
+// A Program and its processes are owned by the thread that created them: the
+// kernel only accepts ptrace requests from the tracing thread, and none of
+// their state (such as the breakpoints of each process) is locked. Every
+// traced thread's stop is handled one at a time by Wait and Continue, so the
+// breakpoints of threads that share memory are only modified while the
+// thread doing so is stopped. Wait, Continue and Detach return
+// ErrWrongThread when called from another thread.
 package utrace
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
 
-var ErrFinishedTrace = errors.New("tracing finished")
+var (
+	ErrFinishedTrace = errors.New("tracing finished")
+	ErrWrongThread   = errors.New("program used from a thread other than the one tracing it")
+)
 
 // Status represents a return status from a call to Wait.
 type Status struct {
@@ -36,19 +53,45 @@ type Status struct {
 type Program struct {
 	procs    map[int]*Proc
 	untraced map[int]*Proc
+	// parents of new threads/children that have not yet stopped
+	parents map[int]*Proc
+	// stops collected while other threads were halted, to be returned by
+	// Wait before waiting for new ones
+	queued []waitResult
 
 	regions     []Region
 	pie         PieOffsetter
+	opts        Options
 	breakpoints map[uintptr][]byte
+	// number of completed invocations of each region, and the regions that
+	// reached Options.Limit
+	completed map[Region]int
+	removed   map[Region]bool
+	// thread groups sharing breakpoints in Go mode, by tgid
+	groups map[int]*threadGroup
+	// closed when tracing has finished
+	done chan struct{}
+	// thread that created the program, the only one allowed to use it
+	owner int
 }
 
+// programs whose tracing has not finished, with the pids of their targets
+var (
+	liveMu sync.Mutex
+	live   = make(map[*Program]int)
+)
+
 // NewProgram returns a new running program created from the given elf binary
 // file and instantiation command 'target args...'. The list of regions
 // specifies which regions in the target to track. When Wait is called, it will
 // block until the target process or one of its threads/children begins or
-// finishes executing a region.
-func NewProgram(pie PieOffsetter, target string, args []string, regions []Region) (*Program, int, error) {
-	proc, err := startProc(pie, target, args, regions)
+// finishes executing a region. The options configure how breakpoints are
+// placed. The target is started in a process group of its own (so that
+// KillTarget and KillAll also kill the processes it creates), unless its
+// standard input is a terminal, which it must stay in the foreground group of
+// to read from.
+func NewProgram(pie PieOffsetter, target string, args []string, regions []Region, opts Options) (*Program, int, error) {
+	proc, err := startProc(pie, target, args, regions, opts)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -57,29 +100,106 @@ func NewProgram(pie PieOffsetter, target string, args []string, regions []Region
 	prog.procs = map[int]*Proc{
 		proc.Pid(): proc,
 	}
+	prog.untraced = make(map[int]*Proc)
+	prog.parents = make(map[int]*Proc)
 	prog.regions = regions
 	prog.pie = pie
+	prog.opts = opts
 	prog.breakpoints = make(map[uintptr][]byte)
 	for k, v := range proc.breakpoints {
 		prog.breakpoints[k] = make([]byte, len(v))
 		copy(prog.breakpoints[k], v)
 	}
+	prog.completed = make(map[Region]int)
+	prog.removed = make(map[Region]bool)
+	proc.removed = prog.removed
+	prog.groups = make(map[int]*threadGroup)
+	prog.join(proc)
+	prog.done = make(chan struct{})
+	prog.owner = unix.Gettid()
+	if opts.Signals != nil {
+		go forwardSignals(opts.Signals, proc.Pid(), prog.done)
+	}
+	liveMu.Lock()
+	live[prog] = proc.Pid()
+	liveMu.Unlock()
 
 	return prog, proc.Pid(), err
 }
 
+// KillTarget kills the target process pid with SIGKILL, along with every
+// process in its process group if it leads one.
+func KillTarget(pid int) error {
+	if pgid, err := unix.Getpgid(pid); err == nil && pgid == pid {
+		return unix.Kill(-pid, unix.SIGKILL)
+	}
+	return unix.Kill(pid, unix.SIGKILL)
+}
+
+// KillAll kills the targets of every program whose tracing has not finished,
+// along with their processes, without detaching from them first. It is meant
+// for a tracer that exits abnormally, on a fatal error or a panic, so that no
+// process is left running with breakpoints in it. A target in a process group
+// of its own is killed with the whole group, which includes its descendants
+// that were never traced, and otherwise every traced process of the program
+// is killed. It must be called from the thread tracing the programs, as a
+// deferred recover in main would be.
+func KillAll() {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	for p, pid := range live {
+		KillTarget(pid)
+		for tid := range p.procs {
+			unix.Kill(tid, unix.SIGKILL)
+		}
+		for tid := range p.untraced {
+			unix.Kill(tid, unix.SIGKILL)
+		}
+		delete(live, p)
+	}
+}
+
 // Wait blocks until a thread/child process enters or exits a region. The wait
 // status will be placed in the 'status' variable. The affected process will be
 // returned. Since multiple regions may be affected (if two regions end on the
 // same address), a list of events is returned indicating which regions were
-// affected and whether they have been entered or exited by the process.
+// affected and whether they have been entered or exited by the process. When
+// a process exits, a RegionAbandoned event is returned for every region it
+// left open, even if the error is ErrFinishedTrace. In Go mode, the events
+// of a thread may also include RegionAbandoned events found while handling
+// the stops of other threads (see Options.Go).
 func (p *Program) Wait(status *Status) (*Proc, []Event, error) {
-	ws := &status.WaitStatus
+	proc, events, err := p.wait(status)
+	if proc != nil && len(proc.pending) > 0 {
+		events = append(proc.pending, events...)
+		proc.pending = nil
+	}
+	return proc, events, err
+}
 
-	wpid, err := unix.Wait4(-1, ws, 0, nil)
-	if err != nil {
+func (p *Program) wait(status *Status) (*Proc, []Event, error) {
+	if err := p.checkOwner(); err != nil {
 		return nil, nil, err
 	}
+	ws := &status.WaitStatus
+
+	if len(p.procs) == 0 {
+		p.finish()
+		return nil, nil, ErrFinishedTrace
+	}
+
+	var wpid int
+	var err error
+	stepped := false
+	if len(p.queued) > 0 {
+		wpid, *ws, stepped = p.queued[0].pid, p.queued[0].status, p.queued[0].stepped
+		p.queued = p.queued[1:]
+	} else {
+		wpid, err = unix.Wait4(-1, ws, 0, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	status.sig = 0
 	status.groupStop = false
@@ -87,60 +207,426 @@ func (p *Program) Wait(status *Status) (*Proc, []Event, error) {
 	proc, ok := p.procs[wpid]
 	if !ok {
 		proc, untraced = p.untraced[wpid]
+		if !untraced && (ws.Exited() || ws.Signaled()) {
+			// an unknown process that has already exited, such as the
+			// target of an earlier trace, is reaped rather than adopted
+			debugf("%d: unknown process exited\n", wpid)
+			delete(p.parents, wpid)
+			return p.wait(status)
+		}
 		if !untraced {
-			proc, err = newTracedProc(wpid, p.pie, p.regions, p.breakpoints)
+			// The new thread/child shares (or for fork, has a copy of) its
+			// parent's memory, so it must know about every breakpoint
+			// the parent has placed.
+			breaks, pie, regions := p.breakpoints, p.pie, p.regions
+			if parent := p.parentOf(wpid); parent != nil {
+				// the parent may have exec'd a different executable
+				breaks, pie, regions = parent.breakpoints, parent.pie, parent.regionList()
+			}
+			delete(p.parents, wpid)
+
+			proc, err = newTracedProc(wpid, pie, regions, breaks, p.removed, p.opts)
 			if err != nil {
 				return nil, nil, err
 			}
 			p.procs[wpid] = proc
-			logger.Printf("%d: new process created (tracing enabled)\n", wpid)
+			p.join(proc)
+			proc.stopped = ws.Stopped()
+			infof("%d: new process created (tracing enabled)\n", wpid)
 			return proc, nil, nil
 		}
 	}
 
+	if ws.Stopped() {
+		proc.stopped = true
+	}
+
 	if ws.Exited() || ws.Signaled() {
-		logger.Printf("%d: exited\n", wpid)
+		infof("%d: exited\n", wpid)
 		delete(p.procs, wpid)
 		proc.exit()
+		p.leave(proc)
 
+		var events []Event
+		if !untraced {
+			events = proc.abandonAll(monotonic())
+		}
 		if len(p.procs) == 0 {
-			return proc, nil, ErrFinishedTrace
+			p.finish()
+			return proc, events, ErrFinishedTrace
 		}
+		return proc, events, nil
 	} else if !ws.Stopped() {
 		return proc, nil, nil
+	} else if ws.StopSignal() == unix.SIGTRAP|0x80 {
+		// marked by PTRACE_O_TRACESYSGOOD
+		debugf("%d: system call stop\n", wpid)
+		if untraced {
+			return proc, nil, nil
+		}
+		return proc, proc.handleSyscall(), nil
 	} else if ws.StopSignal() != unix.SIGTRAP {
-		if statusPtraceEventStop(*ws) {
+		if statusPtraceEventStop(*ws) && stepped {
+			// the step already resumed the process from the group stop,
+			// so it can only be continued
+			infof("%d: received group stop while stepping\n", wpid)
+		} else if statusPtraceEventStop(*ws) {
 			status.groupStop = true
-			logger.Printf("%d: received group stop\n", wpid)
+			infof("%d: received group stop\n", wpid)
 		} else {
-			logger.Printf("%d: received signal '%s'\n", wpid, ws.StopSignal())
+			infof("%d: received signal '%s'\n", wpid, ws.StopSignal())
 			status.sig = ws.StopSignal()
 		}
 	} else if ws.TrapCause() == unix.PTRACE_EVENT_CLONE {
 		newpid, err := proc.tracer.GetEventMsg()
-		logger.Printf("%d: called clone() = %d (err=%v)\n", wpid, newpid, err)
+		infof("%d: called clone() = %d (err=%v)\n", wpid, newpid, err)
+		p.addChild(proc, int(newpid), err)
 	} else if ws.TrapCause() == unix.PTRACE_EVENT_FORK {
-		logger.Printf("%d: called fork()\n", wpid)
+		newpid, err := proc.tracer.GetEventMsg()
+		infof("%d: called fork() = %d (err=%v)\n", wpid, newpid, err)
+		p.addChild(proc, int(newpid), err)
 	} else if ws.TrapCause() == unix.PTRACE_EVENT_VFORK {
-		logger.Printf("%d: called vfork()\n", wpid)
+		newpid, err := proc.tracer.GetEventMsg()
+		infof("%d: called vfork() = %d (err=%v)\n", wpid, newpid, err)
+		p.addChild(proc, int(newpid), err)
+	} else if ws.TrapCause() == unix.PTRACE_EVENT_STOP {
+		debugf("%d: interrupted\n", wpid)
 	} else if ws.TrapCause() == unix.PTRACE_EVENT_EXEC {
-		logger.Printf("%d: called exec() (tracing disabled)\n", wpid)
-		delete(p.procs, wpid)
-		p.untraced[wpid] = proc
+		// a thread other than the leader that calls exec takes over the
+		// leader's pid, and its old tid is never reported again
+		if former, err := proc.tracer.GetEventMsg(); err == nil && int(former) != wpid {
+			delete(p.procs, int(former))
+		}
+		// the other threads are gone along with the old address space
+		p.leave(proc)
+		delete(p.groups, proc.tgid)
+		if !p.opts.FollowExec {
+			infof("%d: called exec() (tracing disabled)\n", wpid)
+			proc.syscalls = false
+			delete(p.procs, wpid)
+			p.untraced[wpid] = proc
+			return proc, nil, nil
+		}
+		infof("%d: called exec() (following)\n", wpid)
+		var pie PieOffsetter = NoPie{}
+		var regions []Region
+		if p.opts.Exec != nil {
+			pie, regions, err = p.opts.Exec(wpid)
+			if err != nil {
+				return nil, nil, fmt.Errorf("exec: %w", err)
+			}
+		}
+		err = proc.load(pie, regions, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exec: %w", err)
+		}
+		p.join(proc)
 	} else if !untraced {
 		events, err := proc.handleInterrupt()
+		if err == errForeignTrap {
+			// deliver the SIGTRAP to the process as if it were not traced
+			infof("%d: %v\n", wpid, err)
+			status.sig = unix.SIGTRAP
+			return proc, nil, nil
+		}
 		if err != nil {
 			return nil, nil, err
 		}
+		if proc.libsChanged {
+			// threads sharing memory see the new breakpoints too
+			for _, t := range p.procs {
+				if t != proc && t.tgid == proc.tgid {
+					proc.shareLibs(t)
+				}
+			}
+		}
+		if p.opts.Limit > 0 {
+			err = p.limit(proc, events)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
 		return proc, events, nil
 	}
 	return proc, nil, nil
 }
 
+// limit counts the regions completed by the events, and stops tracing those
+// that have reached Options.Limit.
+func (p *Program) limit(pr *Proc, events []Event) error {
+	for _, ev := range events {
+		if ev.State != RegionEnd {
+			continue
+		}
+		r := pr.regions[ev.Id].region
+		p.completed[r]++
+		if p.completed[r] == p.opts.Limit {
+			infof("%d: region %d completed %d times (removing)\n", pr.Pid(), ev.Id, p.opts.Limit)
+			err := p.remove(pr, r)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove stops tracing entries to the region in every process. The breakpoint
+// at its start is removed from the memory of the given (stopped) process and
+// the threads that share it, unless one of them still needs it. Other
+// processes remove theirs the next time they reach it.
+func (p *Program) remove(pr *Proc, r Region) error {
+	p.removed[r] = true
+	start := r.Start(pr)
+	if start == 0 {
+		return nil
+	}
+	var shared []*Proc
+	for _, t := range p.procs {
+		if t.tgid != pr.tgid {
+			continue
+		}
+		if t.needsBreak(start) {
+			return nil
+		}
+		if t != pr {
+			shared = append(shared, t)
+		}
+	}
+	for _, t := range shared {
+		// threads of a group share the breakpoint itself
+		if t.group == nil {
+			t.retire(uintptr(start))
+		}
+	}
+	return pr.removeStart(start)
+}
+
 // Continue resumes execution of the given process. The wait status must be
 // passed to replay any signals that were received while waiting.
 func (p *Program) Continue(pr *Proc, status Status) error {
-	return pr.cont(status.sig, status.groupStop)
+	if err := p.checkOwner(); err != nil {
+		return err
+	}
+	// While a breakpoint is removed to step over it, another thread could
+	// execute the same address and miss it, so all other threads sharing
+	// memory with the process are halted until the breakpoint is back.
+	var halted []*Proc
+	if pr.needsStep() && !status.groupStop {
+		halted = p.haltThreads(pr)
+	}
+
+	err := pr.cont(status.sig, status.groupStop)
+	p.queueSteps(pr)
+	if pr.exited {
+		// the process may exit while stepping over a breakpoint, in which
+		// case Wait will never see it exit
+		delete(p.procs, pr.Pid())
+		p.leave(pr)
+	}
+
+	for _, t := range halted {
+		if cerr := t.cont(0, false); cerr != nil && err == nil {
+			err = cerr
+		}
+		p.queueSteps(t)
+	}
+	return err
+}
+
+// queueSteps queues the stops that pr received while stepping over a
+// breakpoint for Wait.
+func (p *Program) queueSteps(pr *Proc) {
+	for _, ws := range pr.stops {
+		p.queued = append(p.queued, waitResult{
+			pid:     pr.Pid(),
+			status:  ws,
+			stepped: true,
+		})
+	}
+	pr.stops = nil
+}
+
+// Finished returns true if no processes are being traced anymore.
+func (p *Program) Finished() bool {
+	return len(p.procs) == 0
+}
+
+// Detach stops tracing every process in the program and removes all
+// breakpoints so that the processes can keep running normally. Processes that
+// are running are interrupted first.
+func (p *Program) Detach() error {
+	if err := p.checkOwner(); err != nil {
+		return err
+	}
+	queued := make(map[int]unix.WaitStatus)
+	for _, q := range p.queued {
+		queued[q.pid] = q.status
+	}
+	p.queued = nil
+
+	var err error
+	for pid, pr := range p.procs {
+		var derr error
+		if ws, ok := queued[pid]; ok {
+			derr = pr.detach(&ws)
+		} else {
+			derr = pr.detach(nil)
+		}
+		if derr != nil && err == nil {
+			err = derr
+		}
+		delete(p.procs, pid)
+	}
+	for pid, pr := range p.untraced {
+		pr.tracer.Detach(0)
+		delete(p.untraced, pid)
+	}
+	p.finish()
+	return err
+}
+
+// checkOwner returns ErrWrongThread if the calling thread is not the one that
+// created the program.
+func (p *Program) checkOwner() error {
+	if unix.Gettid() != p.owner {
+		return ErrWrongThread
+	}
+	return nil
+}
+
+// finish stops forwarding signals once tracing has ended.
+func (p *Program) finish() {
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	liveMu.Lock()
+	delete(live, p)
+	liveMu.Unlock()
+}
+
+// forwardSignals sends the signals received on sigs to the target until done
+// is closed. The target stops when the signal is delivered, and Wait reports
+// the signal so that it is passed on when the target is continued. A target
+// in a process group of its own receives them with its whole group, as it
+// would from a terminal.
+func forwardSignals(sigs <-chan os.Signal, pid int, done <-chan struct{}) {
+	for {
+		select {
+		case s := <-sigs:
+			sig, ok := s.(unix.Signal)
+			if !ok {
+				continue
+			}
+			if (sig == unix.SIGINT || sig == unix.SIGQUIT) && foreground(pid) {
+				infof("%d: not forwarding '%s' sent by the terminal\n", pid, sig)
+				continue
+			}
+			infof("%d: forwarding signal '%s'\n", pid, sig)
+			if pgid, err := unix.Getpgid(pid); err == nil && pgid == pid {
+				unix.Kill(-pid, sig)
+			} else {
+				unix.Kill(pid, sig)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// foreground returns true if the process is in the foreground process group
+// of the terminal on stdin.
+func foreground(pid int) bool {
+	fg, err := unix.IoctlGetInt(0, unix.TIOCGPGRP)
+	if err != nil {
+		return false
+	}
+	pgid, err := unix.Getpgid(pid)
+	return err == nil && pgid == fg
+}
+
+type waitResult struct {
+	pid    int
+	status unix.WaitStatus
+	// set for a stop received while stepping over a breakpoint, after
+	// which the process was stopped by the step instead
+	stepped bool
+}
+
+func (p *Program) isQueued(pid int) bool {
+	for _, q := range p.queued {
+		if q.pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// haltThreads interrupts every running thread in the same thread group as pr
+// and returns the threads that must be continued afterwards. If a thread
+// stops for another reason before the interrupt takes effect, that stop is
+// queued for Wait and the thread is left stopped.
+func (p *Program) haltThreads(pr *Proc) []*Proc {
+	var halted []*Proc
+	for pid, t := range p.procs {
+		if t == pr || t.tgid != pr.tgid || t.exited || p.isQueued(pid) {
+			continue
+		}
+		if err := t.tracer.Interrupt(); err != nil {
+			continue
+		}
+
+		var ws unix.WaitStatus
+		_, err := unix.Wait4(pid, &ws, unix.WALL, nil)
+		if err != nil {
+			continue
+		}
+		t.stopped = ws.Stopped()
+		if ws.Stopped() && ws.StopSignal() == unix.SIGTRAP && ws.TrapCause() == unix.PTRACE_EVENT_STOP {
+			halted = append(halted, t)
+		} else {
+			p.queued = append(p.queued, waitResult{
+				pid:    pid,
+				status: ws,
+			})
+		}
+	}
+	return halted
+}
+
+// addChild records the parent of a new thread/child so that the child can be
+// traced with the parent's breakpoints once it stops. If the child has
+// already stopped and been traced, there is nothing to do.
+func (p *Program) addChild(parent *Proc, pid int, err error) {
+	if err != nil {
+		return
+	}
+	if _, ok := p.procs[pid]; ok {
+		return
+	}
+	p.parents[pid] = parent
+}
+
+// parentOf returns the traced parent of a new thread/child. The child's
+// initial stop may be reported before the parent's clone/fork event, in which
+// case the parent is found via /proc instead.
+func (p *Program) parentOf(pid int) *Proc {
+	if parent, ok := p.parents[pid]; ok {
+		return parent
+	}
+
+	tgid, ppid, err := procStatus(pid)
+	if err != nil {
+		return nil
+	}
+	// threads belong to the parent's thread group, children of fork are
+	// children of the parent process
+	if tgid != pid {
+		return p.procs[tgid]
+	}
+	return p.procs[ppid]
 }
 
 func statusPtraceEventStop(status unix.WaitStatus) bool {
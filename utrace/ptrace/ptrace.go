@@ -1,9 +1,16 @@
 package ptrace
 
 import (
+	"fmt"
+	"unsafe"
+
 	"golang.org/x/sys/unix"
 )
 
+// ntPrstatus selects the general purpose registers in PTRACE_GETREGSET and
+// PTRACE_SETREGSET (NT_PRSTATUS in elf.h).
+const ntPrstatus = 1
+
 // A Tracer keeps track of a process and allows running ptrace functions on
 // that process.
 type Tracer struct {
@@ -17,15 +24,76 @@ func NewTracer(pid int) *Tracer {
 	}
 }
 
-// ReAttachAndContinue re-attaches to a traced process with PTRACE_SEIZE.  The
-// Ptrace API is a bit of a mess and requires a hack to get group stops to work
-// properly with multithreaded programs. If the tracer re-attaches to the child
-// with PTRACE_SEIZE then group stops will work properly.
-func (t *Tracer) ReAttachAndContinue(options int) error {
-	unix.Kill(t.pid, unix.SIGSTOP)
-	unix.PtraceDetach(t.pid)
-	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(t.pid), 0, uintptr(options), 0, 0)
-	unix.Kill(t.pid, unix.SIGCONT)
+// ReAttach re-attaches to a process traced with PTRACE_TRACEME, which must be
+// in a ptrace-stop (such as the SIGTRAP at its execve), with PTRACE_SEIZE and
+// the given options. Only a process attached with PTRACE_SEIZE reports group
+// stops properly and can be interrupted (see Listen and Interrupt), but a
+// child can only ask to be traced with PTRACE_TRACEME, so it is detached and
+// seized again. The process is kept stopped while it is detached by a SIGSTOP,
+// and each of its stops is waited for before moving on, so it never runs in
+// between. It is left in the stop of the SIGCONT that resumes it from the
+// SIGSTOP, to be continued with Cont.
+func (t *Tracer) ReAttach(options int) error {
+	if err := unix.Kill(t.pid, unix.SIGSTOP); err != nil {
+		return err
+	}
+	if err := unix.PtraceDetach(t.pid); err != nil {
+		return err
+	}
+	// the SIGSTOP is delivered once the process is detached, and the
+	// resulting stop is only reported to its parent
+	if err := t.waitStop(unix.WUNTRACED, unix.SIGSTOP, false); err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE, uintptr(t.pid), 0, uintptr(options), 0, 0)
+	if errno != 0 {
+		return error(errno)
+	}
+	// seizing a stopped process turns its stop into a group stop
+	if err := t.waitStop(0, unix.SIGSTOP, true); err != nil {
+		return err
+	}
+	// SIGCONT ends the group stop, which the process reports when it is
+	// listening, and is then delivered to it like any other signal
+	if err := unix.Kill(t.pid, unix.SIGCONT); err != nil {
+		return err
+	}
+	if err := t.Listen(); err != nil {
+		return err
+	}
+	if err := t.waitStop(0, unix.SIGTRAP, true); err != nil {
+		return err
+	}
+	if err := t.Cont(0); err != nil {
+		return err
+	}
+	return t.waitStop(0, unix.SIGCONT, false)
+}
+
+// waitStop waits for the process to stop with the given signal, as a
+// PTRACE_EVENT_STOP if event is set, and returns an error if it does anything
+// else.
+func (t *Tracer) waitStop(options int, sig unix.Signal, event bool) error {
+	var ws unix.WaitStatus
+	_, err := unix.Wait4(t.pid, &ws, options|unix.WALL, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case ws.Exited():
+		return fmt.Errorf("wait: exited with status %d", ws.ExitStatus())
+	case ws.Signaled():
+		return fmt.Errorf("wait: killed by %v", ws.Signal())
+	case !ws.Stopped() || ws.StopSignal() != sig || (int(ws)>>16 == unix.PTRACE_EVENT_STOP) != event:
+		return fmt.Errorf("wait: expected %v stop, received %v (status 0x%x)", sig, ws.StopSignal(), int(ws))
+	}
+	return nil
+}
+
+// Detach stops tracing the process and resumes it, delivering the given
+// signal if it is non-zero.
+func (t *Tracer) Detach(sig unix.Signal) error {
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_DETACH, uintptr(t.pid), 0, uintptr(sig), 0, 0)
 	if err == 0 {
 		return nil
 	}
@@ -47,6 +115,15 @@ func (t *Tracer) Cont(sig unix.Signal) error {
 	return unix.PtraceCont(t.pid, int(sig))
 }
 
+// SingleStep executes a single instruction in the child.
+func (t *Tracer) SingleStep(sig unix.Signal) error {
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SINGLESTEP, uintptr(t.pid), 0, uintptr(sig), 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
 // Syscall continues execution of the child until the next syscall event.
 func (t *Tracer) Syscall(sig unix.Signal) error {
 	err := unix.PtraceSyscall(t.pid, int(sig))
@@ -62,6 +139,16 @@ func (t *Tracer) Listen() error {
 	return error(err)
 }
 
+// Interrupt stops the child. The child must have been attached with
+// PTRACE_SEIZE (see ReAttach).
+func (t *Tracer) Interrupt() error {
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_INTERRUPT, uintptr(t.pid), 0, 0, 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
 // SetRegs assigns the registers of the tracee.
 func (t *Tracer) SetRegs(regs *unix.PtraceRegs) error {
 	return unix.PtraceSetRegs(t.pid, regs)
@@ -72,6 +159,66 @@ func (t *Tracer) GetRegs(regs *unix.PtraceRegs) error {
 	return unix.PtraceGetRegs(t.pid, regs)
 }
 
+// GetRegSet fetches the general purpose registers of the tracee with
+// PTRACE_GETREGSET. This must be used on architectures that do not support
+// PTRACE_GETREGS (such as arm64).
+func (t *Tracer) GetRegSet(regs *unix.PtraceRegs) error {
+	iov := unix.Iovec{
+		Base: (*byte)(unsafe.Pointer(regs)),
+		Len:  uint64(unsafe.Sizeof(*regs)),
+	}
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_GETREGSET, uintptr(t.pid), ntPrstatus, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
+// SetRegSet assigns the general purpose registers of the tracee with
+// PTRACE_SETREGSET.
+func (t *Tracer) SetRegSet(regs *unix.PtraceRegs) error {
+	iov := unix.Iovec{
+		Base: (*byte)(unsafe.Pointer(regs)),
+		Len:  uint64(unsafe.Sizeof(*regs)),
+	}
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SETREGSET, uintptr(t.pid), ntPrstatus, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
+// PeekUser reads the word at offset 'addr' in the tracee's USER area.
+func (t *Tracer) PeekUser(addr uintptr) (uint64, error) {
+	var data uint64
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_PEEKUSR, uintptr(t.pid), addr, uintptr(unsafe.Pointer(&data)), 0, 0)
+	if err == 0 {
+		return data, nil
+	}
+	return 0, error(err)
+}
+
+// SigInfoCode returns the si_code of the signal that caused the tracee's
+// current signal-delivery-stop.
+func (t *Tracer) SigInfoCode() (int32, error) {
+	// siginfo_t is 128 bytes and begins with si_signo, si_errno, si_code
+	var info [128]byte
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_GETSIGINFO, uintptr(t.pid), 0, uintptr(unsafe.Pointer(&info[0])), 0, 0)
+	if err == 0 {
+		return *(*int32)(unsafe.Pointer(&info[8])), nil
+	}
+	return 0, error(err)
+}
+
+// PokeUser writes the word 'data' at offset 'addr' in the tracee's USER area.
+func (t *Tracer) PokeUser(addr uintptr, data uint64) error {
+	_, _, err := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_POKEUSR, uintptr(t.pid), addr, uintptr(data), 0, 0)
+	if err == 0 {
+		return nil
+	}
+	return error(err)
+}
+
 // PeekData reads len(data) bytes at 'addr' in the child and places the bytes
 // in the data slice. It returns the amount of data read or an error.
 func (t *Tracer) PeekData(addr uintptr, data []byte) (int, error) {
@@ -86,7 +233,7 @@ func (t *Tracer) PeekData(addr uintptr, data []byte) (int, error) {
 	return nread, nil
 }
 
-// PeekText is the same as PeekData, except for the text segment. On AMD64
+// PeekText is the same as PeekData, except for the text segment. On Linux
 // there is no difference between PeekData and PeekText.
 func (t *Tracer) PeekText(addr uintptr, data []byte) (int, error) {
 	var nread int
@@ -113,7 +260,7 @@ func (t *Tracer) PokeData(addr uintptr, data []byte) (int, error) {
 	return nwritten, nil
 }
 
-// PokeText is the same as PokeData on AMD64.
+// PokeText is the same as PokeData on Linux.
 func (t *Tracer) PokeText(addr uintptr, data []byte) (int, error) {
 	var nwritten int
 	for nwritten < len(data) {
@@ -157,6 +304,36 @@ func (t *Tracer) WriteVM(addr uintptr, data []byte) (int, error) {
 	return unix.ProcessVMWritev(t.pid, []unix.Iovec{localIov}, []unix.RemoteIovec{remoteIov}, 0)
 }
 
+// ReadMem reads len(data) bytes at 'addr' in the child with a single
+// process_vm_readv call. If the system call is unavailable or fails (for
+// example due to permissions), it falls back to reading one word at a time
+// with PeekData.
+func (t *Tracer) ReadMem(addr uintptr, data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	n, err := t.ReadVM(addr, data)
+	if err == nil && n == len(data) {
+		return n, nil
+	}
+	return t.PeekData(addr, data)
+}
+
+// WriteMem writes data to the child's memory at 'addr' with a single
+// process_vm_writev call. Since process_vm_writev respects the child's page
+// protections, it falls back to PokeData when the write fails, which is
+// always the case for read-only text pages.
+func (t *Tracer) WriteMem(addr uintptr, data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	n, err := t.WriteVM(addr, data)
+	if err == nil && n == len(data) {
+		return n, nil
+	}
+	return t.PokeData(addr, data)
+}
+
 // Pid returns the PID of the traced process.
 func (t *Tracer) Pid() int {
 	return t.pid
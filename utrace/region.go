@@ -1,17 +1,38 @@
 package utrace
 
 import (
-	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // A Region defines a start and an end address.
 type Region interface {
 	Start(p *Proc) uint64
-	End(sp uint64, p *Proc) (uint64, error)
+	End(regs *unix.PtraceRegs, p *Proc) (uint64, error)
+}
+
+// A RegionError is returned when the breakpoint at the start of a region
+// cannot be placed. Id is the index of the region.
+type RegionError struct {
+	Id  int
+	Err error
+}
+
+func (e *RegionError) Error() string {
+	return fmt.Sprintf("region %d: %v", e.Id, e.Err)
+}
+
+func (e *RegionError) Unwrap() error {
+	return e.Err
 }
 
 // An AddressRegion is the simplest possible region that directly stores the
-// start and end addresses.
+// start and end addresses. If the start address is reached again by the same
+// stack frame before the end address, control must have left the region some
+// other way (for example, by jumping out of a loop), and the earlier entry is
+// abandoned.
 type AddressRegion struct {
 	StartAddr uint64
 	EndAddr   uint64
@@ -23,10 +44,33 @@ func (a *AddressRegion) Start(p *Proc) uint64 {
 }
 
 // End returns this region's end address.
-func (a *AddressRegion) End(sp uint64, p *Proc) (uint64, error) {
+func (a *AddressRegion) End(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
 	return a.EndAddr + p.pieOffset, nil
 }
 
+// A SpanRegion spans from one address to another without regard to the stack,
+// so it can cover code that starts in one function and ends in another, such
+// as a critical section from a lock's acquisition to its release. Each time
+// the start is reached it is paired with the next time the end is reached by
+// the same thread. If the start is reached again before the end, the earlier
+// entry is abandoned, unless Nested is set, in which case the entries are
+// counted and the region ends when the end has been reached as many times.
+type SpanRegion struct {
+	StartAddr uint64
+	EndAddr   uint64
+	Nested    bool
+}
+
+// Start returns this region's start address.
+func (s *SpanRegion) Start(p *Proc) uint64 {
+	return s.StartAddr + p.pieOffset
+}
+
+// End returns this region's end address.
+func (s *SpanRegion) End(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	return s.EndAddr + p.pieOffset, nil
+}
+
 // A FuncRegion refers to a function, where the region begins at the start of
 // the function and ends when the function returns.
 type FuncRegion struct {
@@ -38,19 +82,35 @@ func (f *FuncRegion) Start(p *Proc) uint64 {
 	return f.Addr + p.pieOffset
 }
 
-// End calculates the return address of this function given the current stack
-// frame. It is assumed that a call instruction has just been executed, so the
-// return address is at the top of the stack.
-func (f *FuncRegion) End(sp uint64, p *Proc) (uint64, error) {
-	b := make([]byte, 8)
-	// read the return address from the top of the stack
-	_, err := p.tracer.ReadVM(uintptr(sp), b)
-	if err != nil {
-		return 0, err
-	}
+// End calculates the return address of this function given the registers at
+// function entry. It is assumed that a call instruction has just been
+// executed, so the return address is at the top of the stack (amd64) or in the
+// link register (arm64).
+func (f *FuncRegion) End(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	return hostArch.ReturnAddr(regs, p)
+}
+
+// A RetsRegion refers to a function like a FuncRegion, but ends as soon as
+// one of the function's own return instructions (at the addresses in Rets) is
+// reached in the frame that entered it, before the return executes, rather
+// than at its return address. If the function is left by a tail call to
+// another function, which returns on its behalf, the region is not ended, and
+// the invocation is abandoned when the function is next entered from the same
+// frame.
+type RetsRegion struct {
+	Addr uint64
+	Rets []uint64
+}
+
+// Start returns this region's start address.
+func (r *RetsRegion) Start(p *Proc) uint64 {
+	return r.Addr + p.pieOffset
+}
 
-	retaddr := binary.LittleEndian.Uint64(b)
-	return retaddr, nil
+// End returns the address the function returns to, as for a FuncRegion,
+// although the region does not end there.
+func (r *RetsRegion) End(regs *unix.PtraceRegs, p *Proc) (uint64, error) {
+	return hostArch.ReturnAddr(regs, p)
 }
 
 // A RegionState represents the current state of the region.
@@ -63,12 +123,150 @@ const (
 	// RegionEnd indicates that the child has just finished execution of this
 	// region.
 	RegionEnd
+	// RegionAbandoned indicates that the child left this region without
+	// reaching its end, or exited while the region was active, so the
+	// previous RegionStart has no matching RegionEnd.
+	RegionAbandoned
+	// RegionPending indicates that the shared library containing this
+	// region was unloaded, so the region is not active until the library is
+	// loaded again.
+	RegionPending
+	// RegionArmed indicates that the shared library containing this region
+	// was loaded, or the resolver of its indirect function returned, and the
+	// region's breakpoint has been placed.
+	RegionArmed
+	// RegionSyscallEnter indicates that the child entered a system call
+	// while this region was active (only if Options.Syscalls is set).
+	RegionSyscallEnter
+	// RegionSyscallExit indicates that the system call of the previous
+	// RegionSyscallEnter returned.
+	RegionSyscallExit
 )
 
 type activeRegion struct {
-	region       Region
-	state        RegionState
-	curInterrupt uint64
+	region Region
+	// return addresses of the invocations in progress, innermost last
+	returns []uint64
+	// stack pointers when each invocation was entered
+	sps []uint64
+	// goroutines that entered each invocation (in Go mode, otherwise 0)
+	gs []uint64
+	// number of outermost entries, for sampling
+	entries int
+	// addresses of the return instructions that end a RetsRegion
+	rets map[uint64]bool
+	// set if the return address of an entry was reached from a different
+	// stack frame since the region was entered
+	mismatch bool
 
 	id int
 }
+
+func (r *activeRegion) push(ret, sp, g uint64) {
+	r.returns = append(r.returns, ret)
+	r.sps = append(r.sps, sp)
+	r.gs = append(r.gs, g)
+}
+
+// skip counts an outermost entry of the region and returns true if it should
+// not be measured, because only every kth entry is.
+func (r *activeRegion) skip(k int) bool {
+	if k <= 1 {
+		return false
+	}
+	r.entries++
+	return (r.entries-1)%k != 0
+}
+
+func (r *activeRegion) pop() {
+	r.returns = r.returns[:len(r.returns)-1]
+	r.sps = r.sps[:len(r.sps)-1]
+	r.gs = r.gs[:len(r.gs)-1]
+}
+
+// returning returns the number of entries that end when the child reaches
+// the return address pc with the stack pointer sp, or 0 if none do. Usually
+// this is the innermost entry alone, but if nested entries were left without
+// returning (by longjmp to an outer invocation, for example) the outer entry's
+// return also ends them. Recursive calls from the same call site share a
+// return address, so for functions the stack pointer must also match the
+// frame of the entry that returns.
+//
+// A RetsRegion ends at its return instructions instead, where the stack
+// pointer is the same as at the entry.
+//
+// In Go mode, g is the goroutine reaching pc, and entries are matched by
+// goroutine instead of by stack pointer, since the runtime moves a
+// goroutine's stack when it grows.
+func (r *activeRegion) returning(pc, sp, g uint64) int {
+	for i := len(r.returns) - 1; i >= 0; i-- {
+		if g != 0 && r.gs[i] != g {
+			continue
+		}
+		if r.rets != nil {
+			if r.rets[pc] && (g != 0 || sp == r.sps[i]) {
+				return len(r.returns) - i
+			}
+			continue
+		}
+		if r.returns[i] == pc && (!r.function() || g != 0 || sp == hostArch.ReturnSP(r.sps[i])) {
+			return len(r.returns) - i
+		}
+	}
+	return 0
+}
+
+// strayReturn returns true if pc is the return address of one of the
+// function's entries, but was reached from a stack frame that did not enter
+// it (see returning). A function that tail calls another returns through the
+// other, in the frame that entered it, so this only happens if the stack was
+// switched or unwound in some other way, and the counts of the invocation may
+// include unrelated code.
+func (r *activeRegion) strayReturn(pc uint64) bool {
+	if !r.function() || r.rets != nil {
+		return false
+	}
+	for _, ret := range r.returns {
+		if ret == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// ended returns the event for the end of the region's outermost entry, and
+// clears the record of stray returns for the next entry.
+func (r *activeRegion) ended(state RegionState, now time.Duration) Event {
+	ev := Event{
+		Id:            r.id,
+		State:         state,
+		Time:          now,
+		StackMismatch: r.mismatch,
+	}
+	r.mismatch = false
+	return ev
+}
+
+// tailCall checks if entering the region with the given return address and
+// stack pointer continues the innermost entry rather than starting a new one.
+// A function that tail calls itself (directly or through other functions)
+// reaches its start again in the same frame and with the same return
+// address, and a single return ends both.
+func (r *activeRegion) tailCall(ret, sp uint64) bool {
+	n := r.depth()
+	return r.function() && n > 0 && r.returns[n-1] == ret && r.sps[n-1] == sp
+}
+
+// function returns true if the region ends when a function returns.
+func (r *activeRegion) function() bool {
+	switch r.region.(type) {
+	case *FuncRegion, *LibFuncRegion, *RetsRegion, *IfuncRegion:
+		return true
+	}
+	return false
+}
+
+// depth returns the number of nested invocations of the region in progress.
+func (r *activeRegion) depth() int {
+	return len(r.returns)
+}
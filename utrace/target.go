@@ -0,0 +1,72 @@
+package utrace
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CheckTarget finds the target in the PATH (if its name has no slash) and
+// checks that it can be executed on this host before it is started, so that a
+// missing file, a file without execute permission, or a binary built for
+// another architecture is reported clearly instead of by exec. Scripts that
+// start with #! are accepted. It returns the path of the target. The errors
+// for a missing file and a file that is not executable wrap os.ErrNotExist
+// and os.ErrPermission.
+func CheckTarget(target string) (string, error) {
+	path := target
+	if !strings.Contains(target, "/") {
+		p, err := exec.LookPath(target)
+		if err != nil {
+			return "", fmt.Errorf("%s: no executable with this name in $PATH (%w)", target, os.ErrNotExist)
+		}
+		path = p
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: no such file (%w)", target, os.ErrNotExist)
+	} else if err != nil {
+		return "", fmt.Errorf("%s: %v", target, err)
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s: is a directory", target)
+	}
+	if unix.Access(path, unix.X_OK) != nil {
+		return "", fmt.Errorf("%s: not executable, use chmod +x to allow it (%w)", target, os.ErrPermission)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", target, err)
+	}
+	defer f.Close()
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.HasPrefix(magic, []byte("#!")) {
+		return path, nil
+	} else if err != nil || string(magic) != elf.ELFMAG {
+		return "", fmt.Errorf("%s: not an ELF executable or a script", target)
+	}
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid ELF file: %v", target, err)
+	}
+	if ef.Machine != hostMachine {
+		return "", fmt.Errorf("%s: built for %s, but this host is %s", target, machineName(ef.Machine), machineName(hostMachine))
+	}
+	if ef.Type != elf.ET_EXEC && ef.Type != elf.ET_DYN {
+		return "", fmt.Errorf("%s: not an executable (ELF type %s)", target, ef.Type)
+	}
+	return path, nil
+}
+
+// machineName returns the name of an ELF machine, such as X86_64.
+func machineName(m elf.Machine) string {
+	return strings.TrimPrefix(m.String(), "EM_")
+}